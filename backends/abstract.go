@@ -2,12 +2,16 @@ package backends
 
 import (
 	"fmt"
+	"time"
 )
 
 type User struct {
-	Uid    int64
-	Name   string
-	Active bool
+	Uid    int64  `json:"uid"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	// the user can't login after the expiry, nil if the user doesn't expire
+	// (only set by the paged listings)
+	Expires *time.Time `json:"expires,omitempty"`
 }
 
 func (u User) String() string {
@@ -21,14 +25,141 @@ func (u User) String() string {
 }
 
 type Group struct {
-	Gid  int64
-	Name string
+	Gid  int64  `json:"gid"`
+	Name string `json:"name"`
 }
 
 func (g Group) String() string {
 	return fmt.Sprintf("%s:%d", g.Name, g.Gid)
 }
 
+type Role struct {
+	Rid  int64  `json:"rid"`
+	Name string `json:"name"`
+}
+
+func (r Role) String() string {
+	return fmt.Sprintf("%s:%d", r.Name, r.Rid)
+}
+
+type Permission struct {
+	Pid  int64  `json:"pid"`
+	Name string `json:"name"`
+}
+
+func (p Permission) String() string {
+	return fmt.Sprintf("%s:%d", p.Name, p.Pid)
+}
+
+// PermissionCheck is the answer of a permission check, the role (and the
+// group it is assigned to) is the source that grants the permission
+type PermissionCheck struct {
+	Allowed bool   `json:"allowed"`
+	Role    string `json:"role,omitempty"`
+	Group   string `json:"group,omitempty"`
+}
+
+func (c PermissionCheck) String() string {
+	if !c.Allowed {
+		return "no"
+	}
+	if c.Group != "" {
+		return fmt.Sprintf("yes role:%s group:%s", c.Role, c.Group)
+	}
+	return fmt.Sprintf("yes role:%s", c.Role)
+}
+
+// Revision tells when a user, group or user data value was created and last
+// changed, the version is increased by every change. The times of rows that
+// were created before the revisions existed are zero.
+type Revision struct {
+	Version int64     `json:"version"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func (r Revision) String() string {
+	return fmt.Sprintf("version:%d created:%s updated:%s", r.Version,
+		formatRevisionTime(r.Created), formatRevisionTime(r.Updated))
+}
+
+func formatRevisionTime(at time.Time) string {
+	if at.IsZero() {
+		return "unknown"
+	}
+	return at.UTC().Format(time.RFC3339)
+}
+
+// UserInfo is the complete record of a user. LatestLogin is the most recent
+// login, PreviousLogin the one before it like in the loginstats. They are nil
+// if the user didn't login (twice) yet. DataRevisions has the revision of
+// every data key.
+type UserInfo struct {
+	Uid           int64               `json:"uid"`
+	Name          string              `json:"name"`
+	Active        bool                `json:"active"`
+	Expires       *time.Time          `json:"expires,omitempty"`
+	Version       int64               `json:"version"`
+	Created       time.Time           `json:"created"`
+	Updated       time.Time           `json:"updated"`
+	LatestLogin   *time.Time          `json:"latestlogin,omitempty"`
+	PreviousLogin *time.Time          `json:"previouslogin,omitempty"`
+	FailCount     int64               `json:"failcount"`
+	Groups        []Group             `json:"groups"`
+	Data          map[string]string   `json:"data"`
+	DataRevisions map[string]Revision `json:"datarevisions"`
+}
+
+// DataChange is a change of a user data key in the history. Unset changes
+// removed the key. The first change of a key may be the value from before the
+// history was enabled, its time is zero and the client is empty.
+type DataChange struct {
+	Value   string    `json:"value"`
+	Unset   bool      `json:"unset"`
+	Changed time.Time `json:"changed"`
+	Client  string    `json:"client"`
+}
+
+// ScheduledChange is a state change of a user that was due and applied
+type ScheduledChange struct {
+	Uid    int64     `json:"uid"`
+	Name   string    `json:"name"`
+	Active bool      `json:"active"`
+	Due    time.Time `json:"due"`
+}
+
+func (c ScheduledChange) String() string {
+	action := "disable"
+	if c.Active {
+		action = "enable"
+	}
+	return fmt.Sprintf("%s %s:%d at %s", action, c.Name, c.Uid, c.Due.UTC().Format(time.RFC3339))
+}
+
+type Tenant struct {
+	Tid  int64  `json:"tid"`
+	Name string `json:"name"`
+}
+
+func (t Tenant) String() string {
+	return fmt.Sprintf("%s:%d", t.Name, t.Tid)
+}
+
+// ListOptions filter, sort and page the users and groups listings
+type ListOptions struct {
+	Filter string // pattern, * matches any characters and ? a single one
+	State  string // active, inactive or empty for all users
+	Sort   string // name or uid (default), for groups gid is the same as uid
+	Limit  int    // maximum number of entries, 0 for no limit
+	After  string // cursor of the previous page
+	// include the users of nested groups (group users only)
+	Transitive bool
+	// show the expiry of the users in the text format
+	Expiry bool
+	// list the deleted users or groups in the trash instead
+	Deleted bool
+}
+
 type Error struct {
 	Code    string
 	Message string
@@ -44,19 +175,131 @@ type Abstract interface {
 	EnableUser(nameuid string) *Error
 	SetUserData(nameuid string, key string, value string) *Error
 	GetUserData(nameuid string, key string) (string, *Error)
+	GetUserDataAt(nameuid string, key string, at time.Time) (string, *Error)
+	UserDataHistory(nameuid string, key string) ([]DataChange, *Error)
 	GetUserDataKeys(nameuid string) ([]string, *Error)
+	GetAllUserData(nameuid string) (map[string]string, *Error)
+	UnsetUserData(nameuid string, key string) *Error
+	SetManyUserData(nameuid string, values map[string]string) *Error
+	FindUsers(key string, op string, value string) ([]User, *Error)
 	LoginUser(name string, password string) (int64, *Error)
+	ExpireUser(nameuid string, at time.Time) *Error
+	ScheduleUserState(nameuid string, at time.Time, active bool) *Error
 	ChangeUserPassword(nameuid string, password string, newpassword string) *Error
 	ChangeUserName(nameuid string, password string, newname string) *Error
+	RenameUser(nameuid string, newname string) *Error
+	SetUserPassword(nameuid string, newpassword string) *Error
 	UserGroups(nameuid string) ([]Group, *Error)
+	UserGroupsTransitive(nameuid string) ([]Group, *Error)
+	UserRevision(nameuid string) (Revision, *Error)
+	UserDataRevision(nameuid string, key string) (Revision, *Error)
+	UserInfo(nameuid string) (UserInfo, *Error)
 	DeleteUser(nameuid string) *Error
+	RestoreUser(uid string) *Error
 	Users() ([]User, *Error)
+	UsersPage(options ListOptions) ([]User, string, *Error)
 	CreateGroup(name string) (int64, *Error)
 	AddUserToGroup(nameuid string, groupgid string) *Error
 	RemoveUserFromGroup(nameuid string, groupgid string) *Error
+	AddGroupToGroup(childgid string, parentgid string) *Error
+	RemoveGroupFromGroup(childgid string, parentgid string) *Error
 	DeleteGroup(groupgid string) *Error
+	RestoreGroup(gid string) *Error
+	Purge(olderThan time.Duration) (int64, *Error)
+	RenameGroup(groupgid string, newname string) *Error
+	GroupRevision(groupgid string) (Revision, *Error)
 	Groups() ([]Group, *Error)
+	GroupsPage(options ListOptions) ([]Group, string, *Error)
 	GroupUsers(groupgid string) ([]User, *Error)
+	GroupUsersPage(groupgid string, options ListOptions) ([]User, string, *Error)
+	SetGroupData(groupgid string, key string, value string) *Error
+	GetGroupData(groupgid string, key string) (string, *Error)
+	GetGroupDataKeys(groupgid string) ([]string, *Error)
+	UnsetGroupData(groupgid string, key string) *Error
+	CreateRole(name string) (int64, *Error)
+	DeleteRole(rolerid string) *Error
+	Roles() ([]Role, *Error)
+	RolePermissions(rolerid string) ([]Permission, *Error)
+	CreatePermission(name string) (int64, *Error)
+	DeletePermission(permpid string) *Error
+	Permissions() ([]Permission, *Error)
+	GrantPermission(rolerid string, permpid string) *Error
+	RevokePermission(rolerid string, permpid string) *Error
+	AssignRoleToUser(rolerid string, nameuid string) *Error
+	UnassignRoleFromUser(rolerid string, nameuid string) *Error
+	AssignRoleToGroup(rolerid string, groupgid string) *Error
+	UnassignRoleFromGroup(rolerid string, groupgid string) *Error
+	UserPermissions(nameuid string) ([]string, *Error)
+	CheckPermission(nameuid string, permission string) (PermissionCheck, *Error)
 	Stats() (stats map[string]int64, err *Error)
 	Close()
 }
+
+// Transactional is implemented by backends that support transactions
+type Transactional interface {
+	Begin() (Transaction, *Error)
+}
+
+// Transaction is a backend that executes all operations within a single
+// transaction until it is committed or rolled back. Closing it rolls back.
+type Transaction interface {
+	Abstract
+	Commit() *Error
+	Rollback() *Error
+}
+
+// Savepoints is implemented by transactions that can undo the statements of a
+// failed command and continue, the server sets a savepoint before every
+// command within a transaction
+type Savepoints interface {
+	Savepoint() *Error
+	RollbackToSavepoint() *Error
+	ReleaseSavepoint() *Error
+}
+
+// Scheduled is implemented by backends that apply scheduled state changes,
+// ApplySchedules applies the changes of all tenants that are due
+type Scheduled interface {
+	ApplySchedules() ([]ScheduledChange, *Error)
+}
+
+// Purger is implemented by backends with a trash, PurgeAll purges the users
+// and groups of all tenants that were deleted at least olderThan ago
+type Purger interface {
+	PurgeAll(olderThan time.Duration) (int64, *Error)
+}
+
+// Versioned is implemented by backends that count the changes of users and
+// groups. IfVersion returns a copy of a transaction whose changes of users
+// and groups fail with ESTALE if the changed user or group doesn't have the
+// version anymore, the transaction has to be rolled back then.
+type Versioned interface {
+	IfVersion(version int64) (Abstract, *Error)
+}
+
+// Historized is implemented by backends that can keep the previous values of
+// the user data. EnableHistory records all following changes, Identify
+// returns a copy of the backend (that has to be closed) that records the
+// changes with the identity of the client and PruneHistory removes the changes of all tenants that were
+// replaced longer than the retention of their key ("*" for the other keys)
+// ago.
+type Historized interface {
+	EnableHistory()
+	Identify(client string) Abstract
+	PruneHistory(retention map[string]time.Duration) (int64, *Error)
+}
+
+// the users, groups, roles and permissions that exist before tenants are
+// created belong to the default tenant
+const DEFAULT_TENANT = "default"
+
+// MultiTenant is implemented by backends that keep the users, groups, roles
+// and permissions of several tenants apart. Names are unique per tenant.
+type MultiTenant interface {
+	// Tenant returns a backend that runs all operations in the tenant,
+	// closing it doesn't close the backend it was selected from
+	Tenant(name string) (Abstract, *Error)
+	CreateTenant(name string) (int64, *Error)
+	DeleteTenant(name string) *Error
+	Tenants() ([]Tenant, *Error)
+}
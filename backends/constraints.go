@@ -0,0 +1,39 @@
+package backends
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// nameConstraint is the unique constraint of the names of a table, the
+// constraints of databases created before the tenants or the trash existed
+// don't contain all columns and are rebuilt when the backend is opened. MySQL
+// names all unique constraints SingleKeys.
+type nameConstraint struct {
+	table, name, columns string
+}
+
+var nameConstraints = []nameConstraint{
+	{"Users", "UniqueUserNames", "tenant, name, trashed"},
+	{"Groups", "UniqueGroupNames", "tenant, name, trashed"},
+	{"Roles", "UniqueRoleNames", "tenant, name"},
+	{"Permissions", "UniquePermissionNames", "tenant, name"},
+}
+
+// conflictError returns EEXIST for violations of unique constraints and
+// EFAULT for all other errors, e.g. lost connections or locked databases
+func conflictError(err error) *Error {
+	var sqliteErr sqlite3.Error
+	var pqErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	switch {
+	case errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique,
+		errors.As(err, &pqErr) && pqErr.Code == "23505",
+		errors.As(err, &mysqlErr) && mysqlErr.Number == 1062:
+		return &Error{"EEXIST", err.Error()}
+	}
+	return &Error{"EFAULT", err.Error()}
+}
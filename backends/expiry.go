@@ -0,0 +1,139 @@
+package backends
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Users that expire can't login after the expiry (EEXPIRED). Scheduled state
+// changes enable or disable users when they are due, they are applied by
+// ApplySchedules. The times are stored as unix timestamps.
+
+// addExpiryColumn adds the expiry to the users of databases created before
+// the expiry existed, the error for an existing column is ignored
+func (backend *SqlBackend) addExpiryColumn() {
+	backend.db.Exec("ALTER TABLE Users ADD COLUMN expires BIGINT;")
+}
+
+// SetClock replaces the clock that decides if users are expired and which
+// state changes are due, e.g. in tests
+func (backend *SqlBackend) SetClock(clock func() time.Time) {
+	backend.clock = clock
+}
+
+func (backend *SqlBackend) now() time.Time {
+	if backend.clock != nil {
+		return backend.clock()
+	}
+	return time.Now()
+}
+
+// ExpireUser sets the time after which the user can't login anymore, the
+// zero time removes the expiry
+func (backend *SqlBackend) ExpireUser(nameuid string, at time.Time) *Error {
+	if nameuid == "" {
+		return &Error{"EINVAL", "Name or uid has to be passed"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return err
+	}
+	var expires sql.NullInt64
+	if !at.IsZero() {
+		expires = sql.NullInt64{Int64: at.Unix(), Valid: true}
+	}
+	if _, uerr := backend.exec("UPDATE Users SET expires = "+backend.placeholder(1)+
+		" WHERE uid = "+backend.placeholder(2), expires, uid); uerr != nil {
+		return &Error{"EFAULT", uerr.Error()}
+	}
+	return backend.touchUser(uid)
+}
+
+// ScheduleUserState enables (active) or disables the user when the time is
+// due
+func (backend *SqlBackend) ScheduleUserState(nameuid string, at time.Time, active bool) *Error {
+	if nameuid == "" || at.IsZero() {
+		return &Error{"EINVAL", "Name/uid and time can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return err
+	}
+	state := STATUS_INACTIVE
+	if active {
+		state = STATUS_ACTIVE
+	}
+	if _, ierr := backend.exec("INSERT INTO UserSchedules (uid, due, state) VALUES ("+
+		backend.placeholder(1)+", "+backend.placeholder(2)+", "+backend.placeholder(3)+")",
+		uid, at.Unix(), state); ierr != nil {
+		return &Error{"EFAULT", ierr.Error()}
+	}
+	return nil
+}
+
+// ApplySchedules applies the due state changes of the users of all tenants
+// in the order they were due and removes them. Changes of users in the trash
+// are kept until the users are restored or purged.
+func (backend *SqlBackend) ApplySchedules() ([]ScheduledChange, *Error) {
+	if backend.tx != nil { // already part of a transaction
+		return backend.applySchedules()
+	}
+	tx, err := backend.begin()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := tx.applySchedules()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return changes, tx.Commit()
+}
+
+func (backend *SqlBackend) applySchedules() ([]ScheduledChange, *Error) {
+	now := backend.now().Unix()
+	rows, err := backend.query(`SELECT s.uid, u.name, s.state, s.due
+		FROM UserSchedules s
+		JOIN Users u ON (u.uid = s.uid)
+		WHERE u.trashed = 0 AND s.due <= `+backend.placeholder(1)+`
+		ORDER BY s.due`, now)
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	var changes []ScheduledChange
+	var states []int
+	for rows.Next() {
+		var change ScheduledChange
+		var state int
+		var due int64
+		if err = rows.Scan(&change.Uid, &change.Name, &state, &due); err != nil {
+			rows.Close()
+			return nil, &Error{"EFAULT", err.Error()}
+		}
+		change.Active = state == STATUS_ACTIVE
+		change.Due = time.Unix(due, 0).UTC()
+		changes = append(changes, change)
+		states = append(states, state)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	// the rows have to be closed before the updates as the transaction
+	// uses a single connection
+	for i, change := range changes {
+		if _, err = backend.exec("UPDATE Users SET state = "+backend.placeholder(1)+
+			" WHERE uid = "+backend.placeholder(2), states[i], change.Uid); err != nil {
+			return nil, &Error{"EFAULT", err.Error()}
+		}
+		if terr := backend.touchUser(change.Uid); terr != nil {
+			return nil, terr
+		}
+		if _, err = backend.exec("DELETE FROM UserSchedules WHERE uid = "+backend.placeholder(1)+
+			" AND due <= "+backend.placeholder(2), change.Uid, now); err != nil {
+			return nil, &Error{"EFAULT", err.Error()}
+		}
+	}
+	return changes, nil
+}
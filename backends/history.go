@@ -0,0 +1,205 @@
+package backends
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The history keeps the previous values of the user data if it is enabled.
+// Every set and unset adds a change with the new value (NULL for unset), the
+// unix timestamp and the identity of the client. The first change of a key
+// also keeps the value it had before the history was enabled, its time and
+// client are unknown (NULL). The changes are removed with the user when it is
+// purged. The bookkeeping of logins isn't recorded.
+
+func (backend *SqlBackend) EnableHistory() {
+	backend.history = true
+}
+
+func (backend *SqlBackend) Identify(client string) Abstract {
+	return backend.identify(client)
+}
+
+// identify returns a copy of the backend that records the changes with the
+// identity of the client, like tenants it has to be closed
+func (backend *SqlBackend) identify(client string) *SqlBackend {
+	identified := *backend
+	identified.client = client
+	identified.scoped = true
+	return &identified
+}
+
+// setHistorizedUserData stores the value like setUserData and records the
+// change in the history
+func (backend *SqlBackend) setHistorizedUserData(uid int64, key string, value string) *Error {
+	if err := backend.keepUserValue(uid, key); err != nil {
+		return err
+	}
+	if err := backend.setUserData(uid, key, value); err != nil {
+		return err
+	}
+	return backend.addUserValueChange(uid, key, backend.valueArg(value))
+}
+
+// keepUserValue adds the current value of the key to the history if the key
+// wasn't changed since the history was enabled, it has to be called before
+// the value is changed
+func (backend *SqlBackend) keepUserValue(uid int64, key string) *Error {
+	if !backend.history {
+		return nil
+	}
+	if _, err := backend.keepUserValueStmt.Exec(uid, key, uid, key); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+// addUserValueChange adds the new value of the key to the history, a nil
+// value records an unset
+func (backend *SqlBackend) addUserValueChange(uid int64, key string, value interface{}) *Error {
+	if !backend.history {
+		return nil
+	}
+	client := sql.NullString{String: backend.client, Valid: backend.client != ""}
+	if _, err := backend.addUserValueChangeStmt.Exec(uid, key, value,
+		backend.now().Unix(), client); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+// UserDataHistory returns the changes of the key, the oldest first
+func (backend *SqlBackend) UserDataHistory(nameuid string, key string) ([]DataChange, *Error) {
+	if nameuid == "" || key == "" {
+		return nil, &Error{"EINVAL", "Name/uid and key can't be blank"}
+	}
+	if !backend.history {
+		return nil, &Error{"ENOTSUP", "History is not enabled"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return nil, err
+	}
+	rows, qerr := backend.query("SELECT c.value, c.changed, c.client FROM UserValueChanges c "+
+		"WHERE c.uid = "+backend.placeholder(1)+" AND c.key = "+backend.placeholder(2)+
+		" ORDER BY c.id", uid, key)
+	if qerr != nil {
+		return nil, &Error{"EFAULT", qerr.Error()}
+	}
+	defer rows.Close()
+	var changes []DataChange
+	for rows.Next() {
+		var value, client sql.NullString
+		var changed sql.NullInt64
+		if serr := rows.Scan(&value, &changed, &client); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		change := DataChange{Value: value.String, Unset: !value.Valid, Client: client.String}
+		if changed.Valid {
+			change.Changed = time.Unix(changed.Int64, 0).UTC()
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) == 0 {
+		return nil, &Error{"ENOENT", "Key has no history"}
+	}
+	return changes, nil
+}
+
+// GetUserDataAt returns the value the key had at the time. Values that were
+// set before the history was enabled are returned for all times before their
+// first change.
+func (backend *SqlBackend) GetUserDataAt(nameuid string, key string, at time.Time) (string, *Error) {
+	if nameuid == "" || key == "" {
+		return "", &Error{"EINVAL", "Name/uid and key can't be blank"}
+	}
+	if !backend.history {
+		return "", &Error{"ENOTSUP", "History is not enabled"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return "", err
+	}
+	var value sql.NullString
+	serr := backend.queryRow("SELECT c.value FROM UserValueChanges c "+
+		"WHERE c.uid = "+backend.placeholder(1)+" AND c.key = "+backend.placeholder(2)+
+		" AND (c.changed <= "+backend.placeholder(3)+" OR c.changed IS NULL)"+
+		" ORDER BY c.id DESC LIMIT 1", uid, key, at.Unix()).Scan(&value)
+	switch {
+	case serr == sql.ErrNoRows:
+		return "", &Error{"ENOENT", "Key unknown at that time"}
+	case serr != nil:
+		return "", &Error{"EFAULT", serr.Error()}
+	case !value.Valid:
+		return "", &Error{"ENOENT", "Key unknown at that time"}
+	}
+	return value.String, nil
+}
+
+// PruneHistory removes the changes of all tenants that were replaced longer
+// than the retention of their key ago, so that the values of all later times
+// are kept. The retention of "*" applies to the keys without their own
+// retention, 0 keeps the changes forever. It returns the number of removed
+// changes.
+func (backend *SqlBackend) PruneHistory(retention map[string]time.Duration) (int64, *Error) {
+	var pruned int64
+	var keys []interface{}
+	for key, keep := range retention {
+		if key == "*" {
+			continue
+		}
+		keys = append(keys, key)
+		if keep <= 0 {
+			continue
+		}
+		count, err := backend.pruneHistory("c.key = "+backend.placeholder(1),
+			[]interface{}{key}, keep)
+		if err != nil {
+			return pruned, err
+		}
+		pruned += count
+	}
+	if keep := retention["*"]; keep > 0 {
+		condition := "1 = 1"
+		if len(keys) > 0 {
+			condition = "c.key NOT IN ("
+			for i := range keys {
+				if i > 0 {
+					condition += ", "
+				}
+				condition += backend.placeholder(i + 1)
+			}
+			condition += ")"
+		}
+		count, err := backend.pruneHistory(condition, keys, keep)
+		if err != nil {
+			return pruned, err
+		}
+		pruned += count
+	}
+	return pruned, nil
+}
+
+// pruneHistory removes the changes matching the condition that were replaced
+// longer than keep ago and the unsets that are the last change of their key,
+// the condition uses the first placeholders for its args
+func (backend *SqlBackend) pruneHistory(condition string, args []interface{}, keep time.Duration) (int64, *Error) {
+	cutoff := backend.now().Add(-keep).Unix()
+	n := len(args)
+	// the changes are selected in a derived table, mysql can't delete from a
+	// table that is used in the subquery otherwise
+	result, err := backend.exec("DELETE FROM UserValueChanges WHERE id IN (SELECT id FROM ("+
+		"SELECT c.id FROM UserValueChanges c WHERE "+condition+" AND (EXISTS ("+
+		"SELECT 1 FROM UserValueChanges r WHERE r.uid = c.uid AND r.key = c.key"+
+		" AND r.id > c.id AND r.changed <= "+backend.placeholder(n+1)+") OR (c.value IS NULL"+
+		" AND c.changed <= "+backend.placeholder(n+2)+"))) pruned)",
+		append(args, cutoff, cutoff)...)
+	if err != nil {
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return count, nil
+}
@@ -0,0 +1,102 @@
+package backends
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// UserInfo returns the complete record of the user, it is read within a
+// transaction to be consistent
+func (backend *SqlBackend) UserInfo(nameuid string) (UserInfo, *Error) {
+	if nameuid == "" {
+		return UserInfo{}, &Error{"EINVAL", "Name or uid has to be passed"}
+	}
+	if backend.tx != nil { // already part of a transaction
+		return backend.userInfo(nameuid)
+	}
+	tx, err := backend.begin()
+	if err != nil {
+		return UserInfo{}, err
+	}
+	defer tx.Rollback()
+	return tx.userInfo(nameuid)
+}
+
+func (backend *SqlBackend) userInfo(nameuid string) (UserInfo, *Error) {
+	var info UserInfo
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return info, err
+	}
+	var state int
+	var expires, created, updated sql.NullInt64
+	serr := backend.queryRow("SELECT uid, name, state, expires, version, created_at, updated_at FROM Users WHERE uid = "+
+		backend.placeholder(1), uid).Scan(&info.Uid, &info.Name, &state, &expires, &info.Version, &created, &updated)
+	if serr != nil {
+		return info, &Error{"EFAULT", serr.Error()}
+	}
+	info.Active = state == STATUS_ACTIVE
+	if expires.Valid {
+		at := time.Unix(expires.Int64, 0).UTC()
+		info.Expires = &at
+	}
+	if created.Valid {
+		info.Created = time.Unix(created.Int64, 0).UTC()
+	}
+	if updated.Valid {
+		info.Updated = time.Unix(updated.Int64, 0).UTC()
+	}
+	if info.Groups, err = backend.UserGroups(nameuid); err != nil {
+		return info, err
+	}
+	if info.Data, err = backend.GetAllUserData(nameuid); err != nil {
+		return info, err
+	}
+	if info.DataRevisions, err = backend.userDataRevisions(uid); err != nil {
+		return info, err
+	}
+	// the login bookkeeping is stored in the user data, lastlogin holds the
+	// login before the current one
+	info.LatestLogin = parseLoginTime(info.Data["currentlogin"])
+	info.PreviousLogin = parseLoginTime(info.Data["lastlogin"])
+	if count, perr := strconv.ParseInt(info.Data["failcount"], 10, 64); perr == nil {
+		info.FailCount = count
+	}
+	return info, nil
+}
+
+// parseLoginTime returns the time of a login timestamp, nil if it isn't set
+func parseLoginTime(value string) *time.Time {
+	unix, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	at := time.Unix(unix, 0).UTC()
+	return &at
+}
+
+// userDataRevisions returns the revisions of all data keys of the user
+func (backend *SqlBackend) userDataRevisions(uid int64) (map[string]Revision, *Error) {
+	rows, qerr := backend.query("SELECT v.key, v.version, v.created_at, v.updated_at FROM UserValues v "+
+		"WHERE v.uid = "+backend.placeholder(1), uid)
+	if qerr != nil {
+		return nil, &Error{"EFAULT", qerr.Error()}
+	}
+	defer rows.Close()
+	revisions := make(map[string]Revision)
+	for rows.Next() {
+		var key string
+		var revision Revision
+		var created, updated sql.NullInt64
+		if serr := rows.Scan(&key, &revision.Version, &created, &updated); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		revision.Created, revision.Updated = revisionTime(created), revisionTime(updated)
+		revisions[key] = revision
+	}
+	if rerr := rows.Err(); rerr != nil {
+		return nil, &Error{"EFAULT", rerr.Error()}
+	}
+	return revisions, nil
+}
@@ -13,12 +13,32 @@ var PREPARE_MYSQL = []string{
 		name VARCHAR(255) NOT NULL,
 		password VARCHAR(255) NOT NULL,
 		state INTEGER DEFAULT %d,
-		CONSTRAINT SingleKeys UNIQUE (name)
+		expires BIGINT,
+		deleted BIGINT,
+		trashed INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT SingleKeys UNIQUE (tenant, name, trashed)
 	) ENGINE=InnoDB;`, STATUS_ACTIVE),
+	`CREATE TABLE IF NOT EXISTS UserSchedules (
+		uid INTEGER NOT NULL,
+		due BIGINT NOT NULL,
+		state INTEGER NOT NULL,
+		INDEX (due),
+		CONSTRAINT FOREIGN KEY (uid) REFERENCES Users(uid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`,
 	`CREATE TABLE IF NOT EXISTS Groups (
 		gid INTEGER PRIMARY KEY AUTO_INCREMENT,
 		name VARCHAR(255) NOT NULL,
-		CONSTRAINT SingleKeys UNIQUE (name)
+		deleted BIGINT,
+		trashed INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT SingleKeys UNIQUE (tenant, name, trashed)
 	) ENGINE=InnoDB;`,
 	`CREATE TABLE IF NOT EXISTS UserGroups (
 		uid INTEGER NOT NULL,
@@ -30,10 +50,75 @@ var PREPARE_MYSQL = []string{
 	fmt.Sprintf(`CREATE TABLE IF NOT EXISTS UserValues (
 		uid INTEGER,
 		%s VARCHAR(255) NOT NULL,
-		value LONGTEXT NOT NULL,
+		value LONGBLOB NOT NULL,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
 		CONSTRAINT SingleKeys UNIQUE (uid, %s),
 		CONSTRAINT FOREIGN KEY (uid) REFERENCES Users(uid) ON DELETE CASCADE
 	) ENGINE=InnoDB;`, "`key`", "`key`"),
+	fmt.Sprintf(`CREATE TABLE IF NOT EXISTS UserValueChanges (
+		id INTEGER PRIMARY KEY AUTO_INCREMENT,
+		uid INTEGER NOT NULL,
+		%s VARCHAR(255) NOT NULL,
+		value LONGBLOB,
+		changed BIGINT,
+		client VARCHAR(255),
+		INDEX (uid, %s),
+		CONSTRAINT FOREIGN KEY (uid) REFERENCES Users(uid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`, "`key`", "`key`"),
+	fmt.Sprintf(`CREATE TABLE IF NOT EXISTS GroupValues (
+		gid INTEGER,
+		%s VARCHAR(255) NOT NULL,
+		value LONGBLOB NOT NULL,
+		CONSTRAINT SingleKeys UNIQUE (gid, %s),
+		CONSTRAINT FOREIGN KEY (gid) REFERENCES Groups(gid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`, "`key`", "`key`"),
+	`CREATE TABLE IF NOT EXISTS GroupGroups (
+		child INTEGER NOT NULL,
+		parent INTEGER NOT NULL,
+		CONSTRAINT SingleKeys UNIQUE (child, parent),
+		CONSTRAINT FOREIGN KEY (child) REFERENCES Groups(gid) ON DELETE CASCADE,
+		CONSTRAINT FOREIGN KEY (parent) REFERENCES Groups(gid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`,
+	`CREATE TABLE IF NOT EXISTS Roles (
+		rid INTEGER PRIMARY KEY AUTO_INCREMENT,
+		name VARCHAR(255) NOT NULL,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT SingleKeys UNIQUE (tenant, name)
+	) ENGINE=InnoDB;`,
+	`CREATE TABLE IF NOT EXISTS Permissions (
+		pid INTEGER PRIMARY KEY AUTO_INCREMENT,
+		name VARCHAR(255) NOT NULL,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT SingleKeys UNIQUE (tenant, name)
+	) ENGINE=InnoDB;`,
+	`CREATE TABLE IF NOT EXISTS RolePermissions (
+		rid INTEGER NOT NULL,
+		pid INTEGER NOT NULL,
+		CONSTRAINT SingleKeys UNIQUE (rid, pid),
+		CONSTRAINT FOREIGN KEY (rid) REFERENCES Roles(rid) ON DELETE CASCADE,
+		CONSTRAINT FOREIGN KEY (pid) REFERENCES Permissions(pid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`,
+	`CREATE TABLE IF NOT EXISTS UserRoles (
+		uid INTEGER NOT NULL,
+		rid INTEGER NOT NULL,
+		CONSTRAINT SingleKeys UNIQUE (uid, rid),
+		CONSTRAINT FOREIGN KEY (uid) REFERENCES Users(uid) ON DELETE CASCADE,
+		CONSTRAINT FOREIGN KEY (rid) REFERENCES Roles(rid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`,
+	`CREATE TABLE IF NOT EXISTS GroupRoles (
+		gid INTEGER NOT NULL,
+		rid INTEGER NOT NULL,
+		CONSTRAINT SingleKeys UNIQUE (gid, rid),
+		CONSTRAINT FOREIGN KEY (gid) REFERENCES Groups(gid) ON DELETE CASCADE,
+		CONSTRAINT FOREIGN KEY (rid) REFERENCES Roles(rid) ON DELETE CASCADE
+	) ENGINE=InnoDB;`,
+	`CREATE TABLE IF NOT EXISTS Tenants (
+		tid INTEGER PRIMARY KEY AUTO_INCREMENT,
+		name VARCHAR(255) NOT NULL,
+		CONSTRAINT SingleKeys UNIQUE (name)
+	) ENGINE=InnoDB;`,
 }
 
 type MysqlBackend struct {
@@ -44,13 +129,49 @@ func NewMysqlBackend(url string) (MysqlBackend, error) {
 	var backend MysqlBackend
 	db, err := sql.Open("mysql", url)
 	if err == nil {
-		backend = MysqlBackend{SqlBackend{db: db}}
+		backend = MysqlBackend{SqlBackend{db: db, questionMarks: true, iterativeNesting: true,
+			binaryValues: true}}
 		return backend, backend.init(PREPARE_MYSQL)
 	} else {
 		return backend, err
 	}
 }
 
+// binaryValueColumns converts the text values of databases created before
+// to bytes
+func (backend *MysqlBackend) binaryValueColumns() {
+	backend.db.Exec("ALTER TABLE UserValues MODIFY value LONGBLOB NOT NULL;")
+	backend.db.Exec("ALTER TABLE UserValueChanges MODIFY value LONGBLOB;")
+	backend.db.Exec("ALTER TABLE GroupValues MODIFY value LONGBLOB NOT NULL;")
+}
+
+// migrateNameConstraints replaces the unique constraints of the names that
+// are outdated
+func (backend *MysqlBackend) migrateNameConstraints() error {
+	for _, constraint := range nameConstraints {
+		var columns sql.NullString
+		err := backend.db.QueryRow(`SELECT GROUP_CONCAT(column_name ORDER BY seq_in_index SEPARATOR ', ')
+			FROM information_schema.statistics
+			WHERE table_schema = DATABASE() AND table_name = ? AND index_name = 'SingleKeys'`,
+			constraint.table).Scan(&columns)
+		if err != nil {
+			return err
+		}
+		if columns.String == constraint.columns {
+			continue
+		}
+		alter := "ALTER TABLE " + constraint.table + " "
+		if columns.Valid {
+			alter += "DROP INDEX SingleKeys, "
+		}
+		alter += "ADD CONSTRAINT SingleKeys UNIQUE (" + constraint.columns + ");"
+		if _, err = backend.db.Exec(alter); err != nil {
+			return fmt.Errorf("Unable to migrate the unique names of %s: %s", constraint.table, err)
+		}
+	}
+	return nil
+}
+
 func (backend *MysqlBackend) init(prepare []string) error {
 	var err error
 	// set the default encoding, enable foreign keys, enable journal mode,
@@ -62,39 +183,57 @@ func (backend *MysqlBackend) init(prepare []string) error {
 			panic(err)
 		}
 	}
+	// only a prefix of the values can be indexed, ignore if the index exists
+	backend.db.Exec("CREATE INDEX UserValuesKeyValue ON UserValues (`key`, value(255));")
+	backend.addTenantColumns()
+	backend.addExpiryColumn()
+	backend.addTrashColumns()
+	backend.addVersionColumns()
+	backend.binaryValueColumns()
+	if err = backend.migrateNameConstraints(); err != nil {
+		return err
+	}
 	backend.createUserStmt, err = backend.db.Prepare(`INSERT INTO Users
-		(name, password) VALUES (?, ?);`)
+		(name, password, tenant, created_at, updated_at) VALUES (?, ?, ?, ?, ?);`)
 	if err != nil {
 		panic(err)
 	}
-	backend.usersStmt, err = backend.db.Prepare(`SELECT name, uid, state FROM Users`)
+	backend.usersStmt, err = backend.db.Prepare(`SELECT name, uid, state FROM Users
+		WHERE tenant = ? AND trashed = 0 ORDER BY uid`)
 	if err != nil {
 		panic(err)
 	}
-	backend.deleteUserStmt, err = backend.db.Prepare(`DELETE FROM Users WHERE uid = ? OR name = ?;`)
+	backend.deleteUserStmt, err = backend.db.Prepare(`UPDATE Users
+		SET trashed = uid, deleted = ?
+		WHERE (uid = ? OR name = ?) AND tenant = ? AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.loginUserStmt, err = backend.db.Prepare(fmt.Sprintf(
-		"SELECT uid FROM Users WHERE name = ? AND password = ? AND state = %d;",
+		"SELECT uid, expires FROM Users WHERE name = ? AND password = ? AND tenant = ? AND state = %d AND trashed = 0;",
 		STATUS_ACTIVE))
 	if err != nil {
 		panic(err)
 	}
 	backend.setUserStateStmt, err = backend.db.Prepare(`UPDATE IGNORE Users
 		SET state = ?
-		WHERE name = ? OR uid = ?;`)
+		WHERE (name = ? OR uid = ?) AND tenant = ? AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.uidForNameUidStmt, err = backend.db.Prepare(`SELECT uid FROM Users
-		WHERE name = ? OR uid = ?;`)
+		WHERE (name = ? OR uid = ?) AND tenant = ? AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.setUserDataStmt, err = backend.db.Prepare(
-		"INSERT INTO UserValues (uid, `key`, value) VALUES (?, ?, ?) " +
-			"ON DUPLICATE KEY UPDATE value=VALUES(value);")
+		"INSERT INTO UserValues (uid, `key`, value, created_at, updated_at) VALUES (?, ?, ?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE value=VALUES(value), updated_at=VALUES(updated_at), version=version+1;")
+	if err != nil {
+		panic(err)
+	}
+	backend.updateUserDataStmt, err = backend.db.Prepare(
+		"UPDATE UserValues SET value = ?, updated_at = ?, version = version + 1 WHERE uid = ? AND `key` = ?;")
 	if err != nil {
 		panic(err)
 	}
@@ -103,6 +242,42 @@ func (backend *MysqlBackend) init(prepare []string) error {
 	if err != nil {
 		panic(err)
 	}
+	backend.getUserDataKeysStmt, err = backend.db.Prepare(
+		"SELECT `key` FROM UserValues WHERE uid = ?;")
+	if err != nil {
+		panic(err)
+	}
+	backend.getAllUserDataStmt, err = backend.db.Prepare(
+		"SELECT `key`, value FROM UserValues WHERE uid = ?;")
+	if err != nil {
+		panic(err)
+	}
+	backend.deleteUserDataStmt, err = backend.db.Prepare(
+		"DELETE FROM UserValues WHERE uid = ? AND `key` = ?;")
+	if err != nil {
+		panic(err)
+	}
+	backend.setGroupDataStmt, err = backend.db.Prepare(
+		"INSERT INTO GroupValues (gid, `key`, value) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE value=VALUES(value);")
+	if err != nil {
+		panic(err)
+	}
+	backend.getGroupDataStmt, err = backend.db.Prepare(
+		"SELECT value FROM GroupValues WHERE gid = ? AND `key` = ?;")
+	if err != nil {
+		panic(err)
+	}
+	backend.getGroupDataKeysStmt, err = backend.db.Prepare(
+		"SELECT `key` FROM GroupValues WHERE gid = ?;")
+	if err != nil {
+		panic(err)
+	}
+	backend.deleteGroupDataStmt, err = backend.db.Prepare(
+		"DELETE FROM GroupValues WHERE gid = ? AND `key` = ?;")
+	if err != nil {
+		panic(err)
+	}
 	backend.changeUserPasswordStmt, err = backend.db.Prepare(`UPDATE Users
 		SET password = ?
 		WHERE uid = ? AND password = ?;`)
@@ -115,29 +290,46 @@ func (backend *MysqlBackend) init(prepare []string) error {
 	if err != nil {
 		panic(err)
 	}
+	backend.renameUserStmt, err = backend.db.Prepare(`UPDATE Users
+		SET name = ? WHERE uid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.setUserPasswordStmt, err = backend.db.Prepare(`UPDATE Users
+		SET password = ? WHERE uid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.renameGroupStmt, err = backend.db.Prepare(`UPDATE Groups
+		SET name = ? WHERE gid = ?;`)
+	if err != nil {
+		panic(err)
+	}
 	backend.userGroupsStmt, err = backend.db.Prepare(`SELECT g.name, g.gid
 		FROM Groups g
 		JOIN UserGroups ug ON (ug.gid = g.gid)
-		WHERE ug.uid = ?`)
+		WHERE ug.uid = ? AND g.trashed = 0`)
 	if err != nil {
 		panic(err)
 	}
-	backend.createGroupStmt, err = backend.db.Prepare(`INSERT INTO Groups (name)
-		VALUES (?);`)
+	backend.createGroupStmt, err = backend.db.Prepare(`INSERT INTO Groups (name, tenant, created_at, updated_at)
+		VALUES (?, ?, ?, ?);`)
 	if err != nil {
 		panic(err)
 	}
-	backend.groupsStmt, err = backend.db.Prepare(`SELECT name, gid FROM Groups;`)
+	backend.groupsStmt, err = backend.db.Prepare(`SELECT name, gid FROM Groups
+		WHERE tenant = ? AND trashed = 0 ORDER BY gid;`)
 	if err != nil {
 		panic(err)
 	}
-	backend.deleteGroupStmt, err = backend.db.Prepare(`DELETE FROM Groups
-		WHERE gid = ? OR name = ?;`)
+	backend.deleteGroupStmt, err = backend.db.Prepare(`UPDATE Groups
+		SET trashed = gid, deleted = ?
+		WHERE (gid = ? OR name = ?) AND tenant = ? AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.gidForNameGidStmt, err = backend.db.Prepare(`SELECT gid FROM Groups
-		WHERE gid = ? OR name = ?;`)
+		WHERE (gid = ? OR name = ?) AND tenant = ? AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
@@ -151,16 +343,127 @@ func (backend *MysqlBackend) init(prepare []string) error {
 	if err != nil {
 		return err
 	}
+	backend.addGroupToGroupStmt, err = backend.db.Prepare(
+		`INSERT INTO GroupGroups (child, parent) VALUES (?, ?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.removeGroupFromGroupStmt, err = backend.db.Prepare(`DELETE FROM GroupGroups
+		WHERE child = ? AND parent = ?;`)
+	if err != nil {
+		panic(err)
+	}
 	backend.groupUsersStmt, err = backend.db.Prepare(`SELECT u.name, u.uid, u.state
 		FROM Users u
 		JOIN UserGroups ug ON (ug.uid = u.uid)
-		WHERE ug.gid = ?`)
+		WHERE ug.gid = ? AND u.trashed = 0`)
+	if err != nil {
+		panic(err)
+	}
+	backend.createRoleStmt, err = backend.db.Prepare(`INSERT INTO Roles (name, tenant)
+		VALUES (?, ?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.rolesStmt, err = backend.db.Prepare(`SELECT name, rid FROM Roles
+		WHERE tenant = ? ORDER BY rid;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.deleteRoleStmt, err = backend.db.Prepare(`DELETE FROM Roles WHERE rid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.ridForNameRidStmt, err = backend.db.Prepare(`SELECT rid FROM Roles
+		WHERE (rid = ? OR name = ?) AND tenant = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.createPermissionStmt, err = backend.db.Prepare(`INSERT INTO Permissions (name, tenant)
+		VALUES (?, ?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.permissionsStmt, err = backend.db.Prepare(`SELECT name, pid FROM Permissions
+		WHERE tenant = ? ORDER BY pid;`)
 	if err != nil {
 		panic(err)
 	}
-	backend.statsStmt, err = backend.db.Prepare(`SELECT 'Users', COUNT(*) FROM Users
+	backend.deletePermissionStmt, err = backend.db.Prepare(`DELETE FROM Permissions WHERE pid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.pidForNamePidStmt, err = backend.db.Prepare(`SELECT pid FROM Permissions
+		WHERE (pid = ? OR name = ?) AND tenant = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.rolePermissionsStmt, err = backend.db.Prepare(`SELECT p.name, p.pid
+		FROM Permissions p
+		JOIN RolePermissions rp ON (rp.pid = p.pid)
+		WHERE rp.rid = ?`)
+	if err != nil {
+		panic(err)
+	}
+	backend.grantPermissionStmt, err = backend.db.Prepare(
+		`INSERT INTO RolePermissions (rid, pid) VALUES (?, ?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.revokePermissionStmt, err = backend.db.Prepare(`DELETE FROM RolePermissions
+		WHERE rid = ? AND pid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.assignUserRoleStmt, err = backend.db.Prepare(
+		`INSERT INTO UserRoles (uid, rid) VALUES (?, ?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.unassignUserRoleStmt, err = backend.db.Prepare(`DELETE FROM UserRoles
+		WHERE uid = ? AND rid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.assignGroupRoleStmt, err = backend.db.Prepare(
+		`INSERT INTO GroupRoles (gid, rid) VALUES (?, ?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.unassignGroupRoleStmt, err = backend.db.Prepare(`DELETE FROM GroupRoles
+		WHERE gid = ? AND rid = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.createTenantStmt, err = backend.db.Prepare(`INSERT INTO Tenants (name)
+		VALUES (?);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.tenantsStmt, err = backend.db.Prepare(`SELECT name, tid FROM Tenants;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.tidForNameStmt, err = backend.db.Prepare(`SELECT tid FROM Tenants
+		WHERE name = ?;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.statsStmt, err = backend.db.Prepare(`SELECT 'Users', COUNT(*) FROM Users WHERE trashed = 0 AND tenant = ?
 												UNION
-												SELECT 'Groups', COUNT(*) FROM Groups`)
+												SELECT 'Groups', COUNT(*) FROM Groups WHERE trashed = 0 AND tenant = ?`)
+	if err != nil {
+		panic(err)
+	}
+	backend.keepUserValueStmt, err = backend.db.Prepare("INSERT INTO UserValueChanges " +
+		"(uid, `key`, value) SELECT uid, `key`, value FROM UserValues " +
+		"WHERE uid = ? AND `key` = ? AND NOT EXISTS (SELECT 1 FROM UserValueChanges " +
+		"WHERE uid = ? AND `key` = ?);")
+	if err != nil {
+		panic(err)
+	}
+	backend.addUserValueChangeStmt, err = backend.db.Prepare("INSERT INTO UserValueChanges " +
+		"(uid, `key`, value, changed, client) VALUES (?, ?, ?, ?, ?);")
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,187 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+)
+
+// groupClosure returns the groups selected by the seed query together with
+// all groups nested in them (down) or containing them (up). The seed query
+// selects gids and takes the seed argument as first parameter. The result is
+// a WITH clause that has to prefix the query and the subquery (or list) for
+// an IN condition together with the arguments of the query.
+//
+// Dialects with recursive queries use a recursive CTE, the others resolve the
+// nested groups with one query per level. UNION and the visited groups stop
+// the recursion for cycles. Deleted (trashed) groups and the groups only
+// reachable through them are left out unless trashed is set.
+func (backend *SqlBackend) groupClosure(seed string, seedArg interface{}, up bool, trashed bool) (string, string, []interface{}, *Error) {
+	from, to := "parent", "child"
+	if up {
+		from, to = "child", "parent"
+	}
+	live := "g.trashed = 0"
+	if trashed {
+		live = "1 = 1"
+	}
+	if !backend.iterativeNesting {
+		with := fmt.Sprintf(`WITH RECURSIVE tree(gid) AS (%s
+			UNION SELECT gg.%s FROM GroupGroups gg JOIN tree t ON gg.%s = t.gid
+			JOIN Groups g ON g.gid = gg.%s WHERE %s) `,
+			seed, to, from, to, live)
+		return with, "SELECT gid FROM tree", []interface{}{seedArg}, nil
+	}
+	gids, err := backend.queryGids(seed, seedArg)
+	if err != nil {
+		return "", "", nil, err
+	}
+	visited := make(map[int64]bool)
+	for _, gid := range gids {
+		visited[gid] = true
+	}
+	level := fmt.Sprintf(`SELECT gg.%s FROM GroupGroups gg JOIN Groups g ON g.gid = gg.%s
+		WHERE gg.%s = %s AND %s`, to, to, from, backend.placeholder(1), live)
+	for i := 0; i < len(gids); i++ {
+		next, err := backend.queryGids(level, gids[i])
+		if err != nil {
+			return "", "", nil, err
+		}
+		for _, gid := range next {
+			if !visited[gid] {
+				visited[gid] = true
+				gids = append(gids, gid)
+			}
+		}
+	}
+	if len(gids) == 0 {
+		return "", "NULL", nil, nil
+	}
+	placeholders := make([]string, len(gids))
+	args := make([]interface{}, len(gids))
+	for i, gid := range gids {
+		placeholders[i] = backend.placeholder(i + 1)
+		args[i] = gid
+	}
+	return "", strings.Join(placeholders, ", "), args, nil
+}
+
+func (backend *SqlBackend) queryGids(query string, args ...interface{}) ([]int64, *Error) {
+	rows, err := backend.query(query, args...)
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	defer rows.Close()
+	var gids []int64
+	for rows.Next() {
+		var gid int64
+		if serr := rows.Scan(&gid); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		gids = append(gids, gid)
+	}
+	return gids, nil
+}
+
+// AddGroupToGroup makes the child group a member of the parent group, the
+// members of the child are then transitive members of the parent. Cycles
+// are rejected with ELOOP, also those through deleted groups as they can be
+// restored. The check and the insert run in a transaction.
+func (backend *SqlBackend) AddGroupToGroup(childgid string, parentgid string) *Error {
+	if childgid == "" || parentgid == "" {
+		return &Error{"EINVAL", "Child and parent group can't be blank"}
+	}
+	if backend.tx != nil { // already part of a transaction
+		return backend.addGroupToGroup(childgid, parentgid)
+	}
+	tx, err := backend.begin()
+	if err != nil {
+		return err
+	}
+	if err = tx.addGroupToGroup(childgid, parentgid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (backend *SqlBackend) addGroupToGroup(childgid string, parentgid string) *Error {
+	child, cerr := backend.getGidForNameGid(childgid)
+	if cerr != nil {
+		return cerr
+	}
+	parent, perr := backend.getGidForNameGid(parentgid)
+	if perr != nil {
+		return perr
+	}
+	// the parent must not be nested in the child already, the IN list comes
+	// first as sqlite numbers the parameters in order of appearance
+	with, in, args, err := backend.groupClosure(
+		"SELECT gid FROM Groups WHERE gid = "+backend.placeholder(1), child, false, true)
+	if err != nil {
+		return err
+	}
+	args = append(args, parent)
+	var count int64
+	serr := backend.queryRow(fmt.Sprintf("%sSELECT COUNT(*) FROM Groups WHERE gid IN (%s) AND gid = %s",
+		with, in, backend.placeholder(len(args))), args...).Scan(&count)
+	if serr != nil {
+		return &Error{"EFAULT", serr.Error()}
+	}
+	if count > 0 {
+		return &Error{"ELOOP", "Group would contain itself"}
+	}
+	if _, aerr := backend.addGroupToGroupStmt.Exec(child, parent); aerr != nil {
+		return &Error{"EFAULT", aerr.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) RemoveGroupFromGroup(childgid string, parentgid string) *Error {
+	if childgid == "" || parentgid == "" {
+		return &Error{"EINVAL", "Child and parent group can't be blank"}
+	}
+	child, cerr := backend.getGidForNameGid(childgid)
+	if cerr != nil {
+		return cerr
+	}
+	parent, perr := backend.getGidForNameGid(parentgid)
+	if perr != nil {
+		return perr
+	}
+	if _, rerr := backend.removeGroupFromGroupStmt.Exec(child, parent); rerr != nil {
+		return &Error{"EFAULT", rerr.Error()}
+	}
+	return nil
+}
+
+// UserGroupsTransitive returns the groups of the user including the groups
+// that contain them
+func (backend *SqlBackend) UserGroupsTransitive(nameuid string) ([]Group, *Error) {
+	if nameuid == "" {
+		return nil, &Error{"EINVAL", "Name or uid has to be passed"}
+	}
+	uid, uerr := backend.getUidForNameUid(nameuid)
+	if uerr != nil {
+		return nil, uerr
+	}
+	with, in, args, err := backend.userGroupClosure(uid)
+	if err != nil {
+		return nil, err
+	}
+	rows, qerr := backend.query(fmt.Sprintf("%sSELECT name, gid FROM Groups WHERE gid IN (%s) ORDER BY gid",
+		with, in), args...)
+	if qerr != nil {
+		return nil, &Error{"EFAULT", qerr.Error()}
+	}
+	defer rows.Close()
+	var groups []Group
+	for rows.Next() {
+		var gid int64
+		var name string
+		if serr := rows.Scan(&name, &gid); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		groups = append(groups, Group{gid, name})
+	}
+	return groups, nil
+}
@@ -1,5 +1,9 @@
 package backends
 
+import (
+	"time"
+)
+
 type NilBackend struct {
 }
 
@@ -23,14 +27,46 @@ func (backend *NilBackend) GetUserData(nameuid string, key string) (string, *Err
 	return "", nil
 }
 
+func (backend *NilBackend) GetUserDataAt(nameuid string, key string, at time.Time) (string, *Error) {
+	return "", nil
+}
+
+func (backend *NilBackend) UserDataHistory(nameuid string, key string) ([]DataChange, *Error) {
+	return nil, nil
+}
+
 func (backend *NilBackend) GetUserDataKeys(nameuid string) (keys []string, err *Error) {
 	return
 }
 
+func (backend *NilBackend) GetAllUserData(nameuid string) (map[string]string, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) UnsetUserData(nameuid string, key string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) SetManyUserData(nameuid string, values map[string]string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) FindUsers(key string, op string, value string) ([]User, *Error) {
+	return nil, nil
+}
+
 func (backend *NilBackend) LoginUser(name string, password string) (int64, *Error) {
 	return 0, nil
 }
 
+func (backend *NilBackend) ExpireUser(nameuid string, at time.Time) *Error {
+	return nil
+}
+
+func (backend *NilBackend) ScheduleUserState(nameuid string, at time.Time, active bool) *Error {
+	return nil
+}
+
 func (backend *NilBackend) ChangeUserPassword(nameuid string, password string, newpassword string) *Error {
 	return nil
 }
@@ -39,18 +75,50 @@ func (backend *NilBackend) ChangeUserName(nameuid string, password string, newna
 	return nil
 }
 
+func (backend *NilBackend) RenameUser(nameuid string, newname string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) SetUserPassword(nameuid string, newpassword string) *Error {
+	return nil
+}
+
 func (backend *NilBackend) UserGroups(nameuid string) ([]Group, *Error) {
 	return nil, nil
 }
 
+func (backend *NilBackend) UserGroupsTransitive(nameuid string) ([]Group, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) UserRevision(nameuid string) (Revision, *Error) {
+	return Revision{}, nil
+}
+
+func (backend *NilBackend) UserDataRevision(nameuid string, key string) (Revision, *Error) {
+	return Revision{}, nil
+}
+
+func (backend *NilBackend) UserInfo(nameuid string) (UserInfo, *Error) {
+	return UserInfo{}, nil
+}
+
 func (backend *NilBackend) DeleteUser(nameuid string) *Error {
 	return nil
 }
 
+func (backend *NilBackend) RestoreUser(uid string) *Error {
+	return nil
+}
+
 func (backend *NilBackend) Users() ([]User, *Error) {
 	return nil, nil
 }
 
+func (backend *NilBackend) UsersPage(options ListOptions) ([]User, string, *Error) {
+	return nil, "", nil
+}
+
 func (backend *NilBackend) CreateGroup(name string) (int64, *Error) {
 	return 0, nil
 }
@@ -63,18 +131,126 @@ func (backend *NilBackend) RemoveUserFromGroup(nameuid string, groupgid string)
 	return nil
 }
 
+func (backend *NilBackend) AddGroupToGroup(childgid string, parentgid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) RemoveGroupFromGroup(childgid string, parentgid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) GroupRevision(groupgid string) (Revision, *Error) {
+	return Revision{}, nil
+}
+
 func (backend *NilBackend) DeleteGroup(groupgid string) *Error {
 	return nil
 }
 
+func (backend *NilBackend) RestoreGroup(gid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) Purge(olderThan time.Duration) (int64, *Error) {
+	return 0, nil
+}
+
+func (backend *NilBackend) RenameGroup(groupgid string, newname string) *Error {
+	return nil
+}
+
 func (backend *NilBackend) Groups() ([]Group, *Error) {
 	return nil, nil
 }
 
+func (backend *NilBackend) GroupsPage(options ListOptions) ([]Group, string, *Error) {
+	return nil, "", nil
+}
+
 func (backend *NilBackend) GroupUsers(groupgid string) ([]User, *Error) {
 	return nil, nil
 }
 
+func (backend *NilBackend) GroupUsersPage(groupgid string, options ListOptions) ([]User, string, *Error) {
+	return nil, "", nil
+}
+
+func (backend *NilBackend) SetGroupData(groupgid string, key string, value string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) GetGroupData(groupgid string, key string) (string, *Error) {
+	return "", nil
+}
+
+func (backend *NilBackend) GetGroupDataKeys(groupgid string) ([]string, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) UnsetGroupData(groupgid string, key string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) CreateRole(name string) (int64, *Error) {
+	return 0, nil
+}
+
+func (backend *NilBackend) DeleteRole(rolerid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) Roles() ([]Role, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) RolePermissions(rolerid string) ([]Permission, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) CreatePermission(name string) (int64, *Error) {
+	return 0, nil
+}
+
+func (backend *NilBackend) DeletePermission(permpid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) Permissions() ([]Permission, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) GrantPermission(rolerid string, permpid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) RevokePermission(rolerid string, permpid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) AssignRoleToUser(rolerid string, nameuid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) UnassignRoleFromUser(rolerid string, nameuid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) AssignRoleToGroup(rolerid string, groupgid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) UnassignRoleFromGroup(rolerid string, groupgid string) *Error {
+	return nil
+}
+
+func (backend *NilBackend) UserPermissions(nameuid string) ([]string, *Error) {
+	return nil, nil
+}
+
+func (backend *NilBackend) CheckPermission(nameuid string, permission string) (PermissionCheck, *Error) {
+	return PermissionCheck{}, nil
+}
+
 func (backend *NilBackend) Stats() (map[string]int64, *Error) {
 	return nil, nil
 }
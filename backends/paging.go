@@ -0,0 +1,239 @@
+package backends
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursors are opaque to clients, they contain the sort order and the sort key
+// of the last entry of a page (e.g. "i:42" or "n:joe") in url safe base64.
+
+func newCursor(byName bool, id int64, name string) string {
+	var cursor string
+	if byName {
+		cursor = "n:" + name
+	} else {
+		cursor = "i:" + strconv.FormatInt(id, 10)
+	}
+	return base64.URLEncoding.EncodeToString([]byte(cursor))
+}
+
+// parseCursor returns the sort key of the cursor, the cursor has to belong
+// to the same sort order
+func parseCursor(cursor string, byName bool) (interface{}, *Error) {
+	data, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, &Error{"EINVAL", "Invalid cursor"}
+	}
+	value := string(data)
+	if byName && strings.HasPrefix(value, "n:") {
+		return value[2:], nil
+	}
+	if !byName && strings.HasPrefix(value, "i:") {
+		id, perr := strconv.ParseInt(value[2:], 10, 64)
+		if perr == nil {
+			return id, nil
+		}
+	}
+	return nil, &Error{"EINVAL", "Invalid cursor"}
+}
+
+// likePattern converts the filter pattern into a LIKE pattern with ! as
+// escape character
+func likePattern(pattern string) string {
+	var buf []byte
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			buf = append(buf, '%')
+		case '?':
+			buf = append(buf, '_')
+		case '%', '_', '!':
+			buf = append(buf, '!', c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// likeEscape escapes the LIKE wildcards of a literal string with ! as escape
+// character
+func likeEscape(literal string) string {
+	var buf []byte
+	for i := 0; i < len(literal); i++ {
+		switch c := literal[i]; c {
+		case '%', '_', '!':
+			buf = append(buf, '!', c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// globEscape escapes the GLOB wildcards of a literal string as character
+// classes
+func globEscape(literal string) string {
+	var buf []byte
+	for i := 0; i < len(literal); i++ {
+		switch c := literal[i]; c {
+		case '*', '?', '[':
+			buf = append(buf, '[', c, ']')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// pageQuery appends the filter, cursor, order and limit of the options to the
+// query. One row more than the limit is selected to detect further pages.
+func (backend *SqlBackend) pageQuery(query string, args []interface{}, id string, name string, options ListOptions) (string, []interface{}, *Error) {
+	if options.Filter != "" {
+		args = append(args, likePattern(options.Filter))
+		query += fmt.Sprintf(" AND %s LIKE %s ESCAPE '!'", name, backend.placeholder(len(args)))
+	}
+	sort := id
+	switch strings.ToLower(options.Sort) {
+	case "", "uid", "gid":
+	case "name":
+		sort = name
+	default:
+		return "", nil, &Error{"EINVAL", "Unknown sort order"}
+	}
+	if options.After != "" {
+		value, err := parseCursor(options.After, sort == name)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, value)
+		query += fmt.Sprintf(" AND %s > %s", sort, backend.placeholder(len(args)))
+	}
+	query += " ORDER BY " + sort
+	if options.Limit < 0 {
+		return "", nil, &Error{"EINVAL", "Invalid limit"}
+	} else if options.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", options.Limit+1)
+	}
+	return query, args, nil
+}
+
+func (backend *SqlBackend) UsersPage(options ListOptions) ([]User, string, *Error) {
+	if options.Transitive {
+		return nil, "", &Error{"EINVAL", "Only group users can be transitive"}
+	}
+	return backend.usersPage(`SELECT name, uid, state, expires FROM Users WHERE `+
+		trashCondition(options.Deleted)+` AND tenant = `+backend.placeholder(1),
+		[]interface{}{backend.tenant}, "", options)
+}
+
+func (backend *SqlBackend) GroupUsersPage(groupgid string, options ListOptions) ([]User, string, *Error) {
+	if groupgid == "" {
+		return nil, "", &Error{"EINVAL", "Name or gid has to be passed"}
+	}
+	if options.Deleted {
+		return nil, "", &Error{"EINVAL", "Deleted users are no group members"}
+	}
+	gid, gerr := backend.getGidForNameGid(groupgid)
+	if gerr != nil {
+		return nil, "", gerr
+	}
+	if options.Transitive {
+		// include the users of all nested groups
+		with, in, args, err := backend.groupClosure(
+			"SELECT gid FROM Groups WHERE gid = "+backend.placeholder(1), gid, false, false)
+		if err != nil {
+			return nil, "", err
+		}
+		query := fmt.Sprintf(`%sSELECT u.name, u.uid, u.state, u.expires FROM Users u
+			WHERE u.trashed = 0 AND u.uid IN (SELECT ug.uid FROM UserGroups ug WHERE ug.gid IN (%s))`, with, in)
+		return backend.usersPage(query, args, "u.", options)
+	}
+	query := fmt.Sprintf(`SELECT u.name, u.uid, u.state, u.expires FROM Users u
+		JOIN UserGroups ug ON u.uid = ug.uid WHERE u.trashed = 0 AND ug.gid = %s`, backend.placeholder(1))
+	return backend.usersPage(query, []interface{}{gid}, "u.", options)
+}
+
+// usersPage selects the users of the query, prefix is the alias of the
+// Users table in the query
+func (backend *SqlBackend) usersPage(query string, args []interface{}, prefix string, options ListOptions) ([]User, string, *Error) {
+	switch strings.ToLower(options.State) {
+	case "":
+	case "active":
+		query += fmt.Sprintf(" AND %sstate = %d", prefix, STATUS_ACTIVE)
+	case "inactive":
+		query += fmt.Sprintf(" AND %sstate = %d", prefix, STATUS_INACTIVE)
+	default:
+		return nil, "", &Error{"EINVAL", "Unknown state"}
+	}
+	query, args, err := backend.pageQuery(query, args, prefix+"uid", prefix+"name", options)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, qerr := backend.query(query, args...)
+	if qerr != nil {
+		return nil, "", &Error{"EFAULT", qerr.Error()}
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var uid int64
+		var name string
+		var state int
+		var expires sql.NullInt64
+		if serr := rows.Scan(&name, &uid, &state, &expires); serr != nil {
+			return nil, "", &Error{"EFAULT", serr.Error()}
+		}
+		user := User{Uid: uid, Name: name, Active: state == STATUS_ACTIVE}
+		if expires.Valid {
+			at := time.Unix(expires.Int64, 0).UTC()
+			user.Expires = &at
+		}
+		users = append(users, user)
+	}
+	var cursor string
+	if options.Limit > 0 && len(users) > options.Limit {
+		users = users[:options.Limit]
+		last := users[len(users)-1]
+		cursor = newCursor(strings.ToLower(options.Sort) == "name", last.Uid, last.Name)
+	}
+	return users, cursor, nil
+}
+
+func (backend *SqlBackend) GroupsPage(options ListOptions) ([]Group, string, *Error) {
+	if options.State != "" || options.Transitive {
+		return nil, "", &Error{"EINVAL", "Groups have no state or members"}
+	}
+	query, args, err := backend.pageQuery(`SELECT name, gid FROM Groups WHERE `+
+		trashCondition(options.Deleted)+` AND tenant = `+backend.placeholder(1),
+		[]interface{}{backend.tenant}, "gid", "name", options)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, qerr := backend.query(query, args...)
+	if qerr != nil {
+		return nil, "", &Error{"EFAULT", qerr.Error()}
+	}
+	defer rows.Close()
+	var groups []Group
+	for rows.Next() {
+		var gid int64
+		var name string
+		if serr := rows.Scan(&name, &gid); serr != nil {
+			return nil, "", &Error{"EFAULT", serr.Error()}
+		}
+		groups = append(groups, Group{gid, name})
+	}
+	var cursor string
+	if options.Limit > 0 && len(groups) > options.Limit {
+		groups = groups[:options.Limit]
+		last := groups[len(groups)-1]
+		cursor = newCursor(strings.ToLower(options.Sort) == "name", last.Gid, last.Name)
+	}
+	return groups, cursor, nil
+}
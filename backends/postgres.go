@@ -13,12 +13,30 @@ var PREPARE_POSTGRES = []string{
 		name TEXT NOT NULL,
 		password TEXT NOT NULL,
 		state INTEGER DEFAULT %d,
-		CONSTRAINT UniqueUserNames UNIQUE (name)
+		expires BIGINT,
+		deleted BIGINT,
+		trashed INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniqueUserNames UNIQUE (tenant, name, trashed)
 	);`, STATUS_ACTIVE),
+	`CREATE TABLE IF NOT EXISTS UserSchedules (
+		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+		due BIGINT NOT NULL,
+		state INTEGER NOT NULL
+	);`,
 	`CREATE TABLE IF NOT EXISTS Groups (
 		gid INTEGER PRIMARY KEY DEFAULT nextval('GroupsSeq'),
 		name TEXT NOT NULL,
-		CONSTRAINT UniqueGroupNames UNIQUE (name)
+		deleted BIGINT,
+		trashed INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniqueGroupNames UNIQUE (tenant, name, trashed)
 	);`,
 	`CREATE TABLE IF NOT EXISTS UserGroups (
 		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
@@ -28,9 +46,63 @@ var PREPARE_POSTGRES = []string{
 	`CREATE TABLE IF NOT EXISTS UserValues (
 		uid INTEGER REFERENCES Users(uid) ON DELETE CASCADE,
 		key TEXT NOT NULL,
-		value TEXT NOT NULL,
+		value BYTEA NOT NULL,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
 		CONSTRAINT UniqueUidKeyPairs UNIQUE (uid, key)
 	);`,
+	`CREATE TABLE IF NOT EXISTS UserValueChanges (
+		id SERIAL PRIMARY KEY,
+		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value BYTEA,
+		changed BIGINT,
+		client TEXT
+	);`,
+	`CREATE TABLE IF NOT EXISTS GroupValues (
+		gid INTEGER REFERENCES Groups(gid) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value BYTEA NOT NULL,
+		CONSTRAINT UniqueGidKeyPairs UNIQUE (gid, key)
+	);`,
+	`CREATE TABLE IF NOT EXISTS GroupGroups (
+		child INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+		parent INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+		CONSTRAINT UniqueChildParentPairs UNIQUE (child, parent)
+	);`,
+	`CREATE TABLE IF NOT EXISTS Roles (
+		rid INTEGER PRIMARY KEY DEFAULT nextval('RolesSeq'),
+		name TEXT NOT NULL,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniqueRoleNames UNIQUE (tenant, name)
+	);`,
+	`CREATE TABLE IF NOT EXISTS Permissions (
+		pid INTEGER PRIMARY KEY DEFAULT nextval('PermissionsSeq'),
+		name TEXT NOT NULL,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniquePermissionNames UNIQUE (tenant, name)
+	);`,
+	`CREATE TABLE IF NOT EXISTS RolePermissions (
+		rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+		pid INTEGER NOT NULL REFERENCES Permissions(pid) ON DELETE CASCADE,
+		CONSTRAINT UniqueRidPidPairs UNIQUE (rid, pid)
+	);`,
+	`CREATE TABLE IF NOT EXISTS UserRoles (
+		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+		rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+		CONSTRAINT UniqueUidRidPairs UNIQUE (uid, rid)
+	);`,
+	`CREATE TABLE IF NOT EXISTS GroupRoles (
+		gid INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+		rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+		CONSTRAINT UniqueGidRidPairs UNIQUE (gid, rid)
+	);`,
+	`CREATE TABLE IF NOT EXISTS Tenants (
+		tid INTEGER PRIMARY KEY DEFAULT nextval('TenantsSeq'),
+		name TEXT NOT NULL,
+		CONSTRAINT UniqueTenantNames UNIQUE (name)
+	);`,
 }
 
 type PostgresBackend struct {
@@ -41,7 +113,8 @@ func NewPostgresBackend(url string) (PostgresBackend, error) {
 	var backend PostgresBackend
 	db, err := sql.Open("postgres", url)
 	if err == nil {
-		backend = PostgresBackend{SqlBackend{db: db}}
+		backend = PostgresBackend{SqlBackend{db: db, binaryValues: true,
+			valueIndex: "substring(%s FROM 1 FOR 255)"}}
 		return backend, backend.init(PREPARE_POSTGRES)
 	} else {
 		return backend, err
@@ -52,6 +125,9 @@ func (backend *PostgresBackend) init(sqls []string) (err error) {
 	// create sequences and ignore if this is failing
 	backend.db.Exec(`CREATE SEQUENCE UsersSeq;`)
 	backend.db.Exec(`CREATE SEQUENCE GroupsSeq;`)
+	backend.db.Exec(`CREATE SEQUENCE RolesSeq;`)
+	backend.db.Exec(`CREATE SEQUENCE PermissionsSeq;`)
+	backend.db.Exec(`CREATE SEQUENCE TenantsSeq;`)
 	backend.db.Exec(`CREATE OR REPLACE FUNCTION convert_to_integer(v_input text)
 	RETURNS INTEGER AS $$
 	DECLARE v_int_value INTEGER DEFAULT NULL;
@@ -65,56 +141,137 @@ func (backend *PostgresBackend) init(sqls []string) (err error) {
 	RETURN v_int_value;
 	END;
 	$$ LANGUAGE plpgsql;`)
+	// the columns are converted before the statements are prepared
+	backend.binaryValueColumns()
 	err = backend.SqlBackend.init(sqls)
 	if err != nil {
 		panic(err)
 	}
+	if err = backend.migrateNameConstraints(); err != nil {
+		return err
+	}
+	// btree entries are limited in size, therefore only the first bytes of
+	// the values are indexed with the keys (see valueIndex), ignore if the
+	// index exists
+	backend.db.Exec(`CREATE INDEX UserValuesKeyValue ON UserValues (key, substring(value FROM 1 FOR 255));`)
+	backend.db.Exec(`DROP INDEX IF EXISTS UserValuesKey;`)
+	backend.db.Exec(`CREATE INDEX UserValueChangesUidKey ON UserValueChanges (uid, key);`)
 	backend.SqlBackend.createUserStmt, err = backend.db.Prepare(
-		`INSERT INTO Users (name, password) VALUES ($1, $2) RETURNING uid;`)
+		`INSERT INTO Users (name, password, tenant, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING uid;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.SqlBackend.createGroupStmt, err = backend.db.Prepare(
-		`INSERT INTO Groups (name) VALUES ($1) RETURNING gid;`)
+		`INSERT INTO Groups (name, tenant, created_at, updated_at)
+		VALUES ($1, $2, $3, $4) RETURNING gid;`)
 	if err != nil {
 		panic(err)
 	}
-	backend.SqlBackend.deleteUserStmt, err = backend.db.Prepare(
-		`DELETE FROM Users
-		WHERE uid = convert_to_integer($1) OR name = $2;`)
+	backend.SqlBackend.deleteUserStmt, err = backend.db.Prepare(`UPDATE Users
+		SET trashed = uid, deleted = $1
+		WHERE (uid = convert_to_integer($2) OR name = $3) AND tenant = $4 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.SqlBackend.setUserStateStmt, err = backend.db.Prepare(`UPDATE Users
 		SET state = $1
-		WHERE name = $2 OR uid = convert_to_integer($3);`)
+		WHERE (name = $2 OR uid = convert_to_integer($3)) AND tenant = $4 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.SqlBackend.uidForNameUidStmt, err = backend.db.Prepare(`SELECT uid FROM Users
-		WHERE name = $1 OR uid = convert_to_integer($2);`)
+		WHERE (name = $1 OR uid = convert_to_integer($2)) AND tenant = $3 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
-	backend.SqlBackend.deleteGroupStmt, err = backend.db.Prepare(`DELETE FROM Groups
-		WHERE gid = convert_to_integer($1) OR name = $2;`)
+	backend.SqlBackend.deleteGroupStmt, err = backend.db.Prepare(`UPDATE Groups
+		SET trashed = gid, deleted = $1
+		WHERE (gid = convert_to_integer($2) OR name = $3) AND tenant = $4 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.SqlBackend.gidForNameGidStmt, err = backend.db.Prepare(`SELECT gid FROM Groups
-		WHERE gid = convert_to_integer($1) OR name = $2;`)
+		WHERE (gid = convert_to_integer($1) OR name = $2) AND tenant = $3 AND trashed = 0;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.SqlBackend.createRoleStmt, err = backend.db.Prepare(
+		`INSERT INTO Roles (name, tenant) VALUES ($1, $2) RETURNING rid;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.SqlBackend.ridForNameRidStmt, err = backend.db.Prepare(`SELECT rid FROM Roles
+		WHERE (rid = convert_to_integer($1) OR name = $2) AND tenant = $3;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.SqlBackend.createPermissionStmt, err = backend.db.Prepare(
+		`INSERT INTO Permissions (name, tenant) VALUES ($1, $2) RETURNING pid;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.SqlBackend.pidForNamePidStmt, err = backend.db.Prepare(`SELECT pid FROM Permissions
+		WHERE (pid = convert_to_integer($1) OR name = $2) AND tenant = $3;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.SqlBackend.createTenantStmt, err = backend.db.Prepare(
+		`INSERT INTO Tenants (name) VALUES ($1) RETURNING tid;`)
+	if err != nil {
+		panic(err)
+	}
+	// update the value or insert it if the key doesn't exist yet
+	backend.SqlBackend.setGroupDataStmt, err = backend.db.Prepare(`WITH updated AS (
+			UPDATE GroupValues SET value = $3 WHERE gid = $1 AND key = $2 RETURNING gid
+		)
+		INSERT INTO GroupValues (gid, key, value)
+		SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM updated);`)
 	if err != nil {
 		panic(err)
 	}
 	return
 }
 
+// migrateNameConstraints replaces the unique constraints of the names that
+// are outdated
+func (backend *PostgresBackend) migrateNameConstraints() error {
+	for _, constraint := range nameConstraints {
+		var definition string
+		err := backend.db.QueryRow(`SELECT pg_get_constraintdef(oid) FROM pg_constraint
+			WHERE conname = lower($1) AND conrelid = $2::regclass`,
+			constraint.name, constraint.table).Scan(&definition)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if definition == "UNIQUE ("+constraint.columns+")" {
+			continue
+		}
+		if _, err = backend.db.Exec("ALTER TABLE " + constraint.table +
+			" DROP CONSTRAINT IF EXISTS " + constraint.name +
+			", ADD CONSTRAINT " + constraint.name + " UNIQUE (" + constraint.columns + ");"); err != nil {
+			return fmt.Errorf("Unable to migrate the unique names of %s: %s", constraint.table, err)
+		}
+	}
+	return nil
+}
+
+// binaryValueColumns converts the text values of databases created before
+// to bytes, it fails for new databases and columns that are converted already
+func (backend *PostgresBackend) binaryValueColumns() {
+	for _, table := range []string{"UserValues", "UserValueChanges", "GroupValues"} {
+		backend.db.Exec("ALTER TABLE " + table +
+			" ALTER COLUMN value TYPE BYTEA USING convert_to(value, 'UTF8');")
+	}
+}
+
 func (backend *PostgresBackend) CreateUser(name string, password string) (int64, *Error) {
 	if name == "" || password == "" {
 		return 0, &Error{"EINVAL", "User name and password can't be blank"}
 	}
 	var uid int64
-	err := backend.SqlBackend.createUserStmt.QueryRow(name, password).Scan(&uid)
+	now := backend.now().Unix()
+	err := backend.SqlBackend.createUserStmt.QueryRow(name, password, backend.tenant, now, now).Scan(&uid)
 	if err != nil {
 		return 0, &Error{"EFAULT", err.Error()}
 	}
@@ -126,9 +283,74 @@ func (backend *PostgresBackend) CreateGroup(name string) (int64, *Error) {
 		return 0, &Error{"EINVAL", "Invalid group name"}
 	}
 	var gid int64
-	err := backend.SqlBackend.createGroupStmt.QueryRow(name).Scan(&gid)
+	now := backend.now().Unix()
+	err := backend.SqlBackend.createGroupStmt.QueryRow(name, backend.tenant, now, now).Scan(&gid)
 	if err != nil {
 		return 0, &Error{"EEXIST", err.Error()}
 	}
 	return gid, nil
 }
+
+func (backend *PostgresBackend) CreateRole(name string) (int64, *Error) {
+	if name == "" {
+		return 0, &Error{"EINVAL", "Invalid role name"}
+	}
+	var rid int64
+	err := backend.SqlBackend.createRoleStmt.QueryRow(name, backend.tenant).Scan(&rid)
+	if err != nil {
+		return 0, &Error{"EEXIST", err.Error()}
+	}
+	return rid, nil
+}
+
+func (backend *PostgresBackend) CreatePermission(name string) (int64, *Error) {
+	if name == "" {
+		return 0, &Error{"EINVAL", "Invalid permission name"}
+	}
+	var pid int64
+	err := backend.SqlBackend.createPermissionStmt.QueryRow(name, backend.tenant).Scan(&pid)
+	if err != nil {
+		return 0, &Error{"EEXIST", err.Error()}
+	}
+	return pid, nil
+}
+
+func (backend *PostgresBackend) CreateTenant(name string) (int64, *Error) {
+	if err := checkTenantName(name); err != nil {
+		return 0, err
+	}
+	var tid int64
+	err := backend.SqlBackend.createTenantStmt.QueryRow(name).Scan(&tid)
+	if err != nil {
+		return 0, &Error{"EEXIST", err.Error()}
+	}
+	return tid, nil
+}
+
+func (backend *PostgresBackend) Tenant(name string) (Abstract, *Error) {
+	scoped, err := backend.SqlBackend.scope(name)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresBackend{*scoped}, nil
+}
+
+func (backend *PostgresBackend) IfVersion(version int64) (Abstract, *Error) {
+	guarded, err := backend.SqlBackend.guard(version)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresBackend{*guarded}, nil
+}
+
+func (backend *PostgresBackend) Identify(client string) Abstract {
+	return &PostgresBackend{*backend.SqlBackend.identify(client)}
+}
+
+func (backend *PostgresBackend) Begin() (Transaction, *Error) {
+	tx, err := backend.SqlBackend.begin()
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresBackend{*tx}, nil
+}
@@ -0,0 +1,312 @@
+package backends
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Roles bundle permissions and are assigned to users and groups. The
+// permissions of a user are the permissions of the roles assigned to the
+// user and to the groups of the user (including the groups containing them).
+
+func (backend *SqlBackend) CreateRole(name string) (int64, *Error) {
+	if name == "" {
+		return 0, &Error{"EINVAL", "Invalid role name"}
+	}
+	result, err := backend.createRoleStmt.Exec(name, backend.tenant)
+	if err != nil {
+		return 0, &Error{"EEXIST", err.Error()}
+	}
+	rid, err := result.LastInsertId()
+	if err != nil {
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return rid, nil
+}
+
+func (backend *SqlBackend) DeleteRole(rolerid string) *Error {
+	if rolerid == "" {
+		return &Error{"EINVAL", "Name or rid has to be passed"}
+	}
+	rid, err := backend.getRidForNameRid(rolerid)
+	if err != nil {
+		return err
+	}
+	if _, derr := backend.deleteRoleStmt.Exec(rid); derr != nil {
+		return &Error{"EFAULT", derr.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) Roles() ([]Role, *Error) {
+	rows, err := backend.rolesStmt.Query(backend.tenant)
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	defer rows.Close()
+	var roles []Role
+	for rows.Next() {
+		var rid int64
+		var name string
+		if serr := rows.Scan(&name, &rid); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		roles = append(roles, Role{rid, name})
+	}
+	return roles, nil
+}
+
+func (backend *SqlBackend) RolePermissions(rolerid string) ([]Permission, *Error) {
+	if rolerid == "" {
+		return nil, &Error{"EINVAL", "Name or rid has to be passed"}
+	}
+	rid, err := backend.getRidForNameRid(rolerid)
+	if err != nil {
+		return nil, err
+	}
+	rows, qerr := backend.rolePermissionsStmt.Query(rid)
+	if qerr != nil {
+		return nil, &Error{"EFAULT", qerr.Error()}
+	}
+	return scanPermissions(rows)
+}
+
+func (backend *SqlBackend) CreatePermission(name string) (int64, *Error) {
+	if name == "" {
+		return 0, &Error{"EINVAL", "Invalid permission name"}
+	}
+	result, err := backend.createPermissionStmt.Exec(name, backend.tenant)
+	if err != nil {
+		return 0, &Error{"EEXIST", err.Error()}
+	}
+	pid, err := result.LastInsertId()
+	if err != nil {
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return pid, nil
+}
+
+func (backend *SqlBackend) DeletePermission(permpid string) *Error {
+	if permpid == "" {
+		return &Error{"EINVAL", "Name or pid has to be passed"}
+	}
+	pid, err := backend.getPidForNamePid(permpid)
+	if err != nil {
+		return err
+	}
+	if _, derr := backend.deletePermissionStmt.Exec(pid); derr != nil {
+		return &Error{"EFAULT", derr.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) Permissions() ([]Permission, *Error) {
+	rows, err := backend.permissionsStmt.Query(backend.tenant)
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	return scanPermissions(rows)
+}
+
+func (backend *SqlBackend) GrantPermission(rolerid string, permpid string) *Error {
+	return backend.rolePermission(backend.grantPermissionStmt, rolerid, permpid)
+}
+
+func (backend *SqlBackend) RevokePermission(rolerid string, permpid string) *Error {
+	return backend.rolePermission(backend.revokePermissionStmt, rolerid, permpid)
+}
+
+func (backend *SqlBackend) rolePermission(stmt *sql.Stmt, rolerid string, permpid string) *Error {
+	if rolerid == "" || permpid == "" {
+		return &Error{"EINVAL", "Role and permission can't be blank"}
+	}
+	rid, rerr := backend.getRidForNameRid(rolerid)
+	if rerr != nil {
+		return rerr
+	}
+	pid, perr := backend.getPidForNamePid(permpid)
+	if perr != nil {
+		return perr
+	}
+	if _, err := stmt.Exec(rid, pid); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) AssignRoleToUser(rolerid string, nameuid string) *Error {
+	return backend.userRole(backend.assignUserRoleStmt, rolerid, nameuid)
+}
+
+func (backend *SqlBackend) UnassignRoleFromUser(rolerid string, nameuid string) *Error {
+	return backend.userRole(backend.unassignUserRoleStmt, rolerid, nameuid)
+}
+
+func (backend *SqlBackend) userRole(stmt *sql.Stmt, rolerid string, nameuid string) *Error {
+	if rolerid == "" || nameuid == "" {
+		return &Error{"EINVAL", "Role and name/uid can't be blank"}
+	}
+	rid, rerr := backend.getRidForNameRid(rolerid)
+	if rerr != nil {
+		return rerr
+	}
+	uid, uerr := backend.getUidForNameUid(nameuid)
+	if uerr != nil {
+		return uerr
+	}
+	if _, err := stmt.Exec(uid, rid); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) AssignRoleToGroup(rolerid string, groupgid string) *Error {
+	return backend.groupRole(backend.assignGroupRoleStmt, rolerid, groupgid)
+}
+
+func (backend *SqlBackend) UnassignRoleFromGroup(rolerid string, groupgid string) *Error {
+	return backend.groupRole(backend.unassignGroupRoleStmt, rolerid, groupgid)
+}
+
+func (backend *SqlBackend) groupRole(stmt *sql.Stmt, rolerid string, groupgid string) *Error {
+	if rolerid == "" || groupgid == "" {
+		return &Error{"EINVAL", "Role and name/gid can't be blank"}
+	}
+	rid, rerr := backend.getRidForNameRid(rolerid)
+	if rerr != nil {
+		return rerr
+	}
+	gid, gerr := backend.getGidForNameGid(groupgid)
+	if gerr != nil {
+		return gerr
+	}
+	if _, err := stmt.Exec(gid, rid); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+// UserPermissions returns the names of the effective permissions of the
+// user sorted by name
+func (backend *SqlBackend) UserPermissions(nameuid string) ([]string, *Error) {
+	if nameuid == "" {
+		return nil, &Error{"EINVAL", "Name or uid has to be passed"}
+	}
+	uid, uerr := backend.getUidForNameUid(nameuid)
+	if uerr != nil {
+		return nil, uerr
+	}
+	with, in, args, err := backend.userGroupClosure(uid)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, uid)
+	rows, qerr := backend.query(fmt.Sprintf(`%sSELECT DISTINCT p.name
+		FROM Permissions p
+		JOIN RolePermissions rp ON (rp.pid = p.pid)
+		WHERE rp.rid IN (SELECT rid FROM GroupRoles WHERE gid IN (%s))
+		OR rp.rid IN (SELECT rid FROM UserRoles WHERE uid = %s)
+		ORDER BY p.name`, with, in, backend.placeholder(len(args))), args...)
+	if qerr != nil {
+		return nil, &Error{"EFAULT", qerr.Error()}
+	}
+	defer rows.Close()
+	var permissions []string
+	for rows.Next() {
+		var name string
+		if serr := rows.Scan(&name); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		permissions = append(permissions, name)
+	}
+	return permissions, nil
+}
+
+// CheckPermission checks if the user has the permission. Roles assigned to
+// the user directly are preferred as source over roles assigned to groups.
+func (backend *SqlBackend) CheckPermission(nameuid string, permission string) (PermissionCheck, *Error) {
+	var check PermissionCheck
+	if nameuid == "" || permission == "" {
+		return check, &Error{"EINVAL", "Name/uid and permission can't be blank"}
+	}
+	uid, uerr := backend.getUidForNameUid(nameuid)
+	if uerr != nil {
+		return check, uerr
+	}
+	with, in, args, err := backend.userGroupClosure(uid)
+	if err != nil {
+		return check, err
+	}
+	n := len(args)
+	args = append(args, permission, uid, permission)
+	// the placeholders have to appear in the order of the arguments
+	serr := backend.queryRow(fmt.Sprintf(`%sSELECT r.name, g.name
+		FROM GroupRoles gr
+		JOIN Groups g ON (g.gid = gr.gid)
+		JOIN Roles r ON (r.rid = gr.rid)
+		JOIN RolePermissions rp ON (rp.rid = r.rid)
+		JOIN Permissions p ON (p.pid = rp.pid)
+		WHERE gr.gid IN (%s) AND p.name = %s
+		UNION
+		SELECT r.name, ''
+		FROM UserRoles ur
+		JOIN Roles r ON (r.rid = ur.rid)
+		JOIN RolePermissions rp ON (rp.rid = r.rid)
+		JOIN Permissions p ON (p.pid = rp.pid)
+		WHERE ur.uid = %s AND p.name = %s
+		ORDER BY 2, 1`, with, in, backend.placeholder(n+1),
+		backend.placeholder(n+2), backend.placeholder(n+3)), args...).Scan(&check.Role, &check.Group)
+	switch {
+	case serr == sql.ErrNoRows:
+		return check, nil
+	case serr != nil:
+		return check, &Error{"EFAULT", serr.Error()}
+	}
+	check.Allowed = true
+	return check, nil
+}
+
+// userGroupClosure selects the groups of the user and all groups containing
+// them
+func (backend *SqlBackend) userGroupClosure(uid int64) (string, string, []interface{}, *Error) {
+	return backend.groupClosure(`SELECT ug.gid FROM UserGroups ug
+		JOIN Groups g ON g.gid = ug.gid WHERE ug.uid = `+backend.placeholder(1)+` AND g.trashed = 0`, uid, true, false)
+}
+
+func scanPermissions(rows *sql.Rows) ([]Permission, *Error) {
+	defer rows.Close()
+	var permissions []Permission
+	for rows.Next() {
+		var pid int64
+		var name string
+		if err := rows.Scan(&name, &pid); err != nil {
+			return nil, &Error{"EFAULT", err.Error()}
+		}
+		permissions = append(permissions, Permission{pid, name})
+	}
+	return permissions, nil
+}
+
+func (backend *SqlBackend) getRidForNameRid(rolerid string) (int64, *Error) {
+	var rid int64
+	err := backend.ridForNameRidStmt.QueryRow(rolerid, rolerid, backend.tenant).Scan(&rid)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, &Error{"ENOENT", "Role unknown"}
+	case err != nil:
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return rid, nil
+}
+
+func (backend *SqlBackend) getPidForNamePid(permpid string) (int64, *Error) {
+	var pid int64
+	err := backend.pidForNamePidStmt.QueryRow(permpid, permpid, backend.tenant).Scan(&pid)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, &Error{"ENOENT", "Permission unknown"}
+	case err != nil:
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return pid, nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,27 +14,71 @@ const (
 )
 
 type SqlBackend struct {
-	db                      *sql.DB
-	createUserStmt          *sql.Stmt
-	usersStmt               *sql.Stmt
-	deleteUserStmt          *sql.Stmt
-	loginUserStmt           *sql.Stmt
-	setUserStateStmt        *sql.Stmt
-	uidForNameUidStmt       *sql.Stmt
-	setUserDataStmt         *sql.Stmt
-	getUserDataStmt         *sql.Stmt
-	getUserDataKeysStmt     *sql.Stmt
-	changeUserPasswordStmt  *sql.Stmt
-	changeUserNameStmt      *sql.Stmt
-	userGroupsStmt          *sql.Stmt
-	createGroupStmt         *sql.Stmt
-	groupsStmt              *sql.Stmt
-	deleteGroupStmt         *sql.Stmt
-	gidForNameGidStmt       *sql.Stmt
-	addUserToGroupStmt      *sql.Stmt
-	removeUserFromGroupStmt *sql.Stmt
-	groupUsersStmt          *sql.Stmt
-	statsStmt               *sql.Stmt
+	db                       *sql.DB
+	tx                       *sql.Tx
+	questionMarks            bool             // placeholders are ? instead of $n
+	iterativeNesting         bool             // nested groups are resolved without recursive queries
+	binaryValues             bool             // user and group data values are bound as bytes
+	globPatterns             bool             // LIKE ignores the case (sqlite), values are matched with GLOB
+	valueIndex               string           // indexed expression of a value (%s) if not the value itself
+	tenant                   int64            // users, groups, roles and permissions are scoped by the tenant
+	scoped                   bool             // selected tenant or client of another backend that owns the database
+	clock                    func() time.Time // time of expiry and schedules, time.Now if nil
+	ifVersion                int64            // expected version of the changed user or group, 0 if unguarded
+	history                  bool             // changes of the user data are recorded
+	client                   string           // identity of the client recorded with the changes
+	createUserStmt           *sql.Stmt
+	usersStmt                *sql.Stmt
+	deleteUserStmt           *sql.Stmt
+	loginUserStmt            *sql.Stmt
+	setUserStateStmt         *sql.Stmt
+	uidForNameUidStmt        *sql.Stmt
+	setUserDataStmt          *sql.Stmt
+	updateUserDataStmt       *sql.Stmt
+	getUserDataStmt          *sql.Stmt
+	getUserDataKeysStmt      *sql.Stmt
+	getAllUserDataStmt       *sql.Stmt
+	deleteUserDataStmt       *sql.Stmt
+	changeUserPasswordStmt   *sql.Stmt
+	changeUserNameStmt       *sql.Stmt
+	renameUserStmt           *sql.Stmt
+	setUserPasswordStmt      *sql.Stmt
+	renameGroupStmt          *sql.Stmt
+	userGroupsStmt           *sql.Stmt
+	createGroupStmt          *sql.Stmt
+	groupsStmt               *sql.Stmt
+	deleteGroupStmt          *sql.Stmt
+	gidForNameGidStmt        *sql.Stmt
+	addUserToGroupStmt       *sql.Stmt
+	removeUserFromGroupStmt  *sql.Stmt
+	addGroupToGroupStmt      *sql.Stmt
+	removeGroupFromGroupStmt *sql.Stmt
+	groupUsersStmt           *sql.Stmt
+	setGroupDataStmt         *sql.Stmt
+	getGroupDataStmt         *sql.Stmt
+	getGroupDataKeysStmt     *sql.Stmt
+	deleteGroupDataStmt      *sql.Stmt
+	createRoleStmt           *sql.Stmt
+	rolesStmt                *sql.Stmt
+	deleteRoleStmt           *sql.Stmt
+	ridForNameRidStmt        *sql.Stmt
+	createPermissionStmt     *sql.Stmt
+	permissionsStmt          *sql.Stmt
+	deletePermissionStmt     *sql.Stmt
+	pidForNamePidStmt        *sql.Stmt
+	rolePermissionsStmt      *sql.Stmt
+	grantPermissionStmt      *sql.Stmt
+	revokePermissionStmt     *sql.Stmt
+	assignUserRoleStmt       *sql.Stmt
+	unassignUserRoleStmt     *sql.Stmt
+	assignGroupRoleStmt      *sql.Stmt
+	unassignGroupRoleStmt    *sql.Stmt
+	createTenantStmt         *sql.Stmt
+	tenantsStmt              *sql.Stmt
+	tidForNameStmt           *sql.Stmt
+	statsStmt                *sql.Stmt
+	keepUserValueStmt        *sql.Stmt
+	addUserValueChangeStmt   *sql.Stmt
 }
 
 func (backend *SqlBackend) init(prepare []string) error {
@@ -47,38 +92,50 @@ func (backend *SqlBackend) init(prepare []string) error {
 			panic(err)
 		}
 	}
+	backend.addTenantColumns()
+	backend.addExpiryColumn()
+	backend.addTrashColumns()
+	backend.addVersionColumns()
 	backend.createUserStmt, err = backend.db.Prepare(`INSERT INTO Users
-		(name, password) VALUES ($1, $2);`)
+		(name, password, tenant, created_at, updated_at) VALUES ($1, $2, $3, $4, $5);`)
 	if err != nil {
 		panic(err)
 	}
-	backend.usersStmt, err = backend.db.Prepare(`SELECT name, uid, state FROM Users`)
+	backend.usersStmt, err = backend.db.Prepare(`SELECT name, uid, state FROM Users
+		WHERE tenant = $1 AND trashed = 0 ORDER BY uid`)
 	if err != nil {
 		panic(err)
 	}
-	backend.deleteUserStmt, err = backend.db.Prepare(`DELETE FROM Users WHERE uid = $1 OR name = $2;`)
+	backend.deleteUserStmt, err = backend.db.Prepare(`UPDATE Users
+		SET trashed = uid, deleted = $1
+		WHERE (uid = $2 OR name = $3) AND tenant = $4 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.loginUserStmt, err = backend.db.Prepare(fmt.Sprintf(
-		"SELECT uid FROM Users WHERE name = $1 AND password = $2 AND state = %d;",
+		"SELECT uid, expires FROM Users WHERE name = $1 AND password = $2 AND tenant = $3 AND state = %d AND trashed = 0;",
 		STATUS_ACTIVE))
 	if err != nil {
 		panic(err)
 	}
 	backend.setUserStateStmt, err = backend.db.Prepare(`UPDATE Users
 		SET state = $1
-		WHERE name = $2 OR uid = $3;`)
+		WHERE (name = $2 OR uid = $3) AND tenant = $4 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.uidForNameUidStmt, err = backend.db.Prepare(`SELECT uid FROM Users
-		WHERE name = $1 OR uid = $2;`)
+		WHERE (name = $1 OR uid = $2) AND tenant = $3 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.setUserDataStmt, err = backend.db.Prepare(`INSERT INTO UserValues
-		(uid, key, value) VALUES ($1, $2, $3);`)
+		(uid, key, value, created_at, updated_at) VALUES ($1, $2, $3, $4, $5);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.updateUserDataStmt, err = backend.db.Prepare(`UPDATE UserValues
+		SET value = $1, updated_at = $2, version = version + 1 WHERE uid = $3 AND key = $4;`)
 	if err != nil {
 		panic(err)
 	}
@@ -92,6 +149,16 @@ func (backend *SqlBackend) init(prepare []string) error {
 	if err != nil {
 		panic(err)
 	}
+	backend.getAllUserDataStmt, err = backend.db.Prepare(`SELECT key, value FROM UserValues
+		WHERE uid = $1;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.deleteUserDataStmt, err = backend.db.Prepare(`DELETE FROM UserValues
+		WHERE uid = $1 AND key = $2;`)
+	if err != nil {
+		panic(err)
+	}
 	backend.changeUserPasswordStmt, err = backend.db.Prepare(`UPDATE Users
 		SET password = $1
 		WHERE uid = $2 AND password = $3;`)
@@ -104,29 +171,46 @@ func (backend *SqlBackend) init(prepare []string) error {
 	if err != nil {
 		panic(err)
 	}
+	backend.renameUserStmt, err = backend.db.Prepare(`UPDATE Users
+		SET name = $1 WHERE uid = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.setUserPasswordStmt, err = backend.db.Prepare(`UPDATE Users
+		SET password = $1 WHERE uid = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.renameGroupStmt, err = backend.db.Prepare(`UPDATE Groups
+		SET name = $1 WHERE gid = $2;`)
+	if err != nil {
+		panic(err)
+	}
 	backend.userGroupsStmt, err = backend.db.Prepare(`SELECT g.name, g.gid
 		FROM Groups g
 		JOIN UserGroups ug ON (ug.gid = g.gid)
-		WHERE ug.uid = $1`)
+		WHERE ug.uid = $1 AND g.trashed = 0`)
 	if err != nil {
 		panic(err)
 	}
-	backend.createGroupStmt, err = backend.db.Prepare(`INSERT INTO Groups (name)
-		VALUES ($1);`)
+	backend.createGroupStmt, err = backend.db.Prepare(`INSERT INTO Groups (name, tenant, created_at, updated_at)
+		VALUES ($1, $2, $3, $4);`)
 	if err != nil {
 		panic(err)
 	}
-	backend.groupsStmt, err = backend.db.Prepare(`SELECT name, gid FROM Groups;`)
+	backend.groupsStmt, err = backend.db.Prepare(`SELECT name, gid FROM Groups
+		WHERE tenant = $1 AND trashed = 0 ORDER BY gid;`)
 	if err != nil {
 		panic(err)
 	}
-	backend.deleteGroupStmt, err = backend.db.Prepare(`DELETE FROM Groups
-		WHERE gid = $1 OR name = $2;`)
+	backend.deleteGroupStmt, err = backend.db.Prepare(`UPDATE Groups
+		SET trashed = gid, deleted = $1
+		WHERE (gid = $2 OR name = $3) AND tenant = $4 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
 	backend.gidForNameGidStmt, err = backend.db.Prepare(`SELECT gid FROM Groups
-		WHERE gid = $1 OR name = $2;`)
+		WHERE (gid = $1 OR name = $2) AND tenant = $3 AND trashed = 0;`)
 	if err != nil {
 		panic(err)
 	}
@@ -140,16 +224,147 @@ func (backend *SqlBackend) init(prepare []string) error {
 	if err != nil {
 		return err
 	}
+	backend.addGroupToGroupStmt, err = backend.db.Prepare(
+		`INSERT INTO GroupGroups (child, parent) VALUES ($1, $2);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.removeGroupFromGroupStmt, err = backend.db.Prepare(`DELETE FROM GroupGroups
+		WHERE child = $1 AND parent = $2;`)
+	if err != nil {
+		panic(err)
+	}
 	backend.groupUsersStmt, err = backend.db.Prepare(`SELECT u.name, u.uid, u.state
 		FROM Users u
 		JOIN UserGroups ug ON (ug.uid = u.uid)
-		WHERE ug.gid = $1`)
+		WHERE ug.gid = $1 AND u.trashed = 0`)
+	if err != nil {
+		panic(err)
+	}
+	backend.setGroupDataStmt, err = backend.db.Prepare(`INSERT INTO GroupValues
+		(gid, key, value) VALUES ($1, $2, $3);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.getGroupDataStmt, err = backend.db.Prepare(`SELECT value FROM GroupValues
+		WHERE gid = $1 AND key = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.getGroupDataKeysStmt, err = backend.db.Prepare(`SELECT key FROM GroupValues
+		WHERE gid = $1;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.deleteGroupDataStmt, err = backend.db.Prepare(`DELETE FROM GroupValues
+		WHERE gid = $1 AND key = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.createRoleStmt, err = backend.db.Prepare(`INSERT INTO Roles (name, tenant)
+		VALUES ($1, $2);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.rolesStmt, err = backend.db.Prepare(`SELECT name, rid FROM Roles
+		WHERE tenant = $1 ORDER BY rid;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.deleteRoleStmt, err = backend.db.Prepare(`DELETE FROM Roles WHERE rid = $1;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.ridForNameRidStmt, err = backend.db.Prepare(`SELECT rid FROM Roles
+		WHERE (rid = $1 OR name = $2) AND tenant = $3;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.createPermissionStmt, err = backend.db.Prepare(`INSERT INTO Permissions (name, tenant)
+		VALUES ($1, $2);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.permissionsStmt, err = backend.db.Prepare(`SELECT name, pid FROM Permissions
+		WHERE tenant = $1 ORDER BY pid;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.deletePermissionStmt, err = backend.db.Prepare(`DELETE FROM Permissions WHERE pid = $1;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.pidForNamePidStmt, err = backend.db.Prepare(`SELECT pid FROM Permissions
+		WHERE (pid = $1 OR name = $2) AND tenant = $3;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.rolePermissionsStmt, err = backend.db.Prepare(`SELECT p.name, p.pid
+		FROM Permissions p
+		JOIN RolePermissions rp ON (rp.pid = p.pid)
+		WHERE rp.rid = $1`)
+	if err != nil {
+		panic(err)
+	}
+	backend.grantPermissionStmt, err = backend.db.Prepare(
+		`INSERT INTO RolePermissions (rid, pid) VALUES ($1, $2);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.revokePermissionStmt, err = backend.db.Prepare(`DELETE FROM RolePermissions
+		WHERE rid = $1 AND pid = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.assignUserRoleStmt, err = backend.db.Prepare(
+		`INSERT INTO UserRoles (uid, rid) VALUES ($1, $2);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.unassignUserRoleStmt, err = backend.db.Prepare(`DELETE FROM UserRoles
+		WHERE uid = $1 AND rid = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.assignGroupRoleStmt, err = backend.db.Prepare(
+		`INSERT INTO GroupRoles (gid, rid) VALUES ($1, $2);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.unassignGroupRoleStmt, err = backend.db.Prepare(`DELETE FROM GroupRoles
+		WHERE gid = $1 AND rid = $2;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.createTenantStmt, err = backend.db.Prepare(`INSERT INTO Tenants (name)
+		VALUES ($1);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.tenantsStmt, err = backend.db.Prepare(`SELECT name, tid FROM Tenants;`)
 	if err != nil {
 		panic(err)
 	}
-	backend.statsStmt, err = backend.db.Prepare(`SELECT 'Users', COUNT(*) FROM Users
+	backend.tidForNameStmt, err = backend.db.Prepare(`SELECT tid FROM Tenants
+		WHERE name = $1;`)
+	if err != nil {
+		panic(err)
+	}
+	backend.statsStmt, err = backend.db.Prepare(`SELECT 'Users', COUNT(*) FROM Users WHERE trashed = 0 AND tenant = $1
 												UNION
-												SELECT 'Groups', COUNT(*) FROM Groups`)
+												SELECT 'Groups', COUNT(*) FROM Groups WHERE trashed = 0 AND tenant = $2`)
+	if err != nil {
+		panic(err)
+	}
+	backend.keepUserValueStmt, err = backend.db.Prepare(`INSERT INTO UserValueChanges
+		(uid, key, value) SELECT uid, key, value FROM UserValues
+		WHERE uid = $1 AND key = $2 AND NOT EXISTS (SELECT 1 FROM UserValueChanges
+		WHERE uid = $3 AND key = $4);`)
+	if err != nil {
+		panic(err)
+	}
+	backend.addUserValueChangeStmt, err = backend.db.Prepare(`INSERT INTO UserValueChanges
+		(uid, key, value, changed, client) VALUES ($1, $2, $3, $4, $5);`)
 	if err != nil {
 		panic(err)
 	}
@@ -160,7 +375,8 @@ func (backend *SqlBackend) CreateUser(name string, password string) (int64, *Err
 	if name == "" || password == "" {
 		return 0, &Error{"EINVAL", "User name and password can't be blank"}
 	}
-	result, err := backend.createUserStmt.Exec(name, password)
+	now := backend.now().Unix()
+	result, err := backend.createUserStmt.Exec(name, password, backend.tenant, now, now)
 	if err != nil {
 		return 0, &Error{"EEXIST", err.Error()}
 	}
@@ -190,9 +406,27 @@ func (backend *SqlBackend) SetUserData(nameuid string, key string, value string)
 	if err != nil {
 		return err
 	}
-	_, serr := backend.setUserDataStmt.Exec(uid, key, value)
-	if serr != nil {
-		return &Error{"EFAULT", serr.Error()}
+	if err = backend.setHistorizedUserData(uid, key, value); err != nil {
+		return err
+	}
+	return backend.touchUser(uid)
+}
+
+// setUserData stores the value without changing the version of the user,
+// an existing value gets the next version
+func (backend *SqlBackend) setUserData(uid int64, key string, value string) *Error {
+	now := backend.now().Unix()
+	result, err := backend.updateUserDataStmt.Exec(backend.valueArg(value), now, uid, key)
+	if err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	} else if count > 0 {
+		return nil
+	}
+	if _, err = backend.setUserDataStmt.Exec(uid, key, backend.valueArg(value), now, now); err != nil {
+		return &Error{"EFAULT", err.Error()}
 	}
 	return nil
 }
@@ -248,18 +482,113 @@ func (backend *SqlBackend) GetUserDataKeys(nameuid string) (keys []string, err *
 	return
 }
 
+func (backend *SqlBackend) GetAllUserData(nameuid string) (map[string]string, *Error) {
+	if nameuid == "" {
+		return nil, &Error{"EINVAL", "Name/uid can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return nil, err
+	}
+	rows, gerr := backend.getAllUserDataStmt.Query(uid)
+	if gerr != nil {
+		return nil, &Error{"EFAULT", gerr.Error()}
+	}
+	defer rows.Close()
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if serr := rows.Scan(&key, &value); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (backend *SqlBackend) UnsetUserData(nameuid string, key string) *Error {
+	if nameuid == "" || key == "" {
+		return &Error{"EINVAL", "Name/uid and key can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return err
+	}
+	if err = backend.keepUserValue(uid, key); err != nil {
+		return err
+	}
+	result, derr := backend.deleteUserDataStmt.Exec(uid, key)
+	if derr != nil {
+		return &Error{"EFAULT", derr.Error()}
+	}
+	n, aerr := result.RowsAffected()
+	if aerr != nil {
+		return &Error{"EFAULT", aerr.Error()}
+	}
+	if n == 0 {
+		return &Error{"ENOENT", "Key unknown"}
+	}
+	if err = backend.addUserValueChange(uid, key, nil); err != nil {
+		return err
+	}
+	return backend.touchUser(uid)
+}
+
+// SetManyUserData stores all values in a transaction, either all or none of
+// them are stored
+func (backend *SqlBackend) SetManyUserData(nameuid string, values map[string]string) *Error {
+	if len(values) == 0 {
+		return &Error{"EINVAL", "Values can't be empty"}
+	}
+	if backend.tx != nil { // already part of a transaction
+		return backend.setUserDataValues(nameuid, values)
+	}
+	tx, err := backend.begin()
+	if err != nil {
+		return err
+	}
+	if err = tx.setUserDataValues(nameuid, values); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (backend *SqlBackend) setUserDataValues(nameuid string, values map[string]string) *Error {
+	if nameuid == "" {
+		return &Error{"EINVAL", "Name/uid, key and value can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		if key == "" || value == "" {
+			return &Error{"EINVAL", "Name/uid, key and value can't be blank"}
+		}
+		if err = backend.setHistorizedUserData(uid, key, value); err != nil {
+			return err
+		}
+	}
+	return backend.touchUser(uid)
+}
+
 func (backend *SqlBackend) LoginUser(name string, password string) (uid int64, err *Error) {
 	if name == "" || password == "" {
 		err = &Error{"EINVAL", "Username and password can't be blank"}
 		return
 	}
 
-	serr := backend.loginUserStmt.QueryRow(name, password).Scan(&uid)
+	var expires sql.NullInt64
+	serr := backend.loginUserStmt.QueryRow(name, password, backend.tenant).Scan(&uid, &expires)
 	switch {
 	case serr == sql.ErrNoRows:
 		err = &Error{"ENOENT", "Username unknown"}
 	case serr != nil:
 		err = &Error{"EFAULT", serr.Error()}
+	case expires.Valid && expires.Int64 <= backend.now().Unix():
+		uid = 0
+		err = &Error{"EEXPIRED", "User expired"}
 	}
 	if err == nil {
 		backend.SaveLastLogin(name)
@@ -271,10 +600,14 @@ func (backend *SqlBackend) LoginUser(name string, password string) (uid int64, e
 }
 
 func (backend *SqlBackend) IncFailCount(nameuid string) (err *Error) {
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return
+	}
 	countS, err := backend.GetUserData(nameuid, "failcount")
 	if err != nil {
 		if err.Message == "Key unknown" {
-			err = backend.SetUserData(nameuid, "failcount", "1")
+			err = backend.setUserData(uid, "failcount", "1")
 		}
 		return
 	}
@@ -283,18 +616,20 @@ func (backend *SqlBackend) IncFailCount(nameuid string) (err *Error) {
 		err = &Error{"EFAULT", serr.Error()}
 		return
 	}
-	err = backend.SetUserData(nameuid, "failcount", strconv.Itoa(count+1))
+	err = backend.setUserData(uid, "failcount", strconv.Itoa(count+1))
 	return
 }
 
 func (backend *SqlBackend) SaveLastLogin(nameuid string) (err *Error) {
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return
+	}
 	lastS, err := backend.GetUserData(nameuid, "currentlogin")
 	if err == nil {
-		backend.SetUserData(nameuid, "lastlogin", lastS)
+		backend.setUserData(uid, "lastlogin", lastS)
 	}
-	var current int64
-	current = time.Now().Unix()
-	err = backend.SetUserData(nameuid, "currentlogin", strconv.FormatInt(current, 10))
+	err = backend.setUserData(uid, "currentlogin", strconv.FormatInt(backend.now().Unix(), 10))
 	return
 }
 
@@ -320,7 +655,7 @@ func (backend *SqlBackend) ChangeUserPassword(nameuid string, password string, n
 	if count < 1 {
 		return &Error{"ENOENT", "Password didn't match"}
 	}
-	return nil
+	return backend.touchUser(uid)
 }
 
 func (backend *SqlBackend) ChangeUserName(nameuid string, password string, newname string) *Error {
@@ -345,7 +680,51 @@ func (backend *SqlBackend) ChangeUserName(nameuid string, password string, newna
 	if count < 1 {
 		return &Error{"ENOENT", "Password didn't match"}
 	}
-	return nil
+	return backend.touchUser(uid)
+}
+
+// RenameUser changes the name without the password of the user
+func (backend *SqlBackend) RenameUser(nameuid string, newname string) *Error {
+	if nameuid == "" || newname == "" {
+		return &Error{"EINVAL", "nameuid and new name can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return err
+	}
+	if _, serr := backend.renameUserStmt.Exec(newname, uid); serr != nil {
+		return &Error{"EEXIST", serr.Error()}
+	}
+	return backend.touchUser(uid)
+}
+
+// SetUserPassword changes the password without the current password
+func (backend *SqlBackend) SetUserPassword(nameuid string, newpassword string) *Error {
+	if nameuid == "" || newpassword == "" {
+		return &Error{"EINVAL", "nameuid and password can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return err
+	}
+	if _, serr := backend.setUserPasswordStmt.Exec(newpassword, uid); serr != nil {
+		return &Error{"EFAULT", serr.Error()}
+	}
+	return backend.touchUser(uid)
+}
+
+func (backend *SqlBackend) RenameGroup(groupgid string, newname string) *Error {
+	if groupgid == "" || newname == "" {
+		return &Error{"EINVAL", "Name/gid and new name can't be blank"}
+	}
+	gid, err := backend.getGidForNameGid(groupgid)
+	if err != nil {
+		return err
+	}
+	if _, serr := backend.renameGroupStmt.Exec(newname, gid); serr != nil {
+		return &Error{"EEXIST", serr.Error()}
+	}
+	return backend.touchGroup(gid)
 }
 
 func (backend *SqlBackend) UserGroups(nameuid string) ([]Group, *Error) {
@@ -378,8 +757,12 @@ func (backend *SqlBackend) DeleteUser(nameuid string) *Error {
 	if nameuid == "" {
 		return &Error{"EINVAL", "Name or uid has to be passed"}
 	}
+	uid, uerr := backend.getUidForNameUid(nameuid)
+	if uerr != nil {
+		return uerr
+	}
 
-	result, err := backend.deleteUserStmt.Exec(nameuid, nameuid)
+	result, err := backend.deleteUserStmt.Exec(backend.now().Unix(), nameuid, nameuid, backend.tenant)
 	if err != nil {
 		return &Error{"EFAULT", err.Error()}
 	}
@@ -391,12 +774,12 @@ func (backend *SqlBackend) DeleteUser(nameuid string) *Error {
 	if count < 1 {
 		return &Error{"ENOENT", "Name or uid unknown"}
 	}
-	return nil
+	return backend.touchUser(uid)
 }
 
 func (backend *SqlBackend) Users() ([]User, *Error) {
 	var users []User
-	rows, err := backend.usersStmt.Query()
+	rows, err := backend.usersStmt.Query(backend.tenant)
 	defer rows.Close()
 	if err != nil {
 		return nil, &Error{"EFAULT", err.Error()}
@@ -409,7 +792,7 @@ func (backend *SqlBackend) Users() ([]User, *Error) {
 		if err != nil {
 			return nil, &Error{"EFAULT", err.Error()}
 		}
-		users = append(users, User{uid, name, state == STATUS_ACTIVE})
+		users = append(users, User{Uid: uid, Name: name, Active: state == STATUS_ACTIVE})
 	}
 	return users, nil
 }
@@ -418,7 +801,8 @@ func (backend *SqlBackend) CreateGroup(name string) (int64, *Error) {
 	if name == "" {
 		return 0, &Error{"EINVAL", "Invalid group name"}
 	}
-	result, err := backend.createGroupStmt.Exec(name)
+	now := backend.now().Unix()
+	result, err := backend.createGroupStmt.Exec(name, backend.tenant, now, now)
 	if err != nil {
 		return 0, &Error{"EEXIST", err.Error()}
 	}
@@ -448,7 +832,7 @@ func (backend *SqlBackend) AddUserToGroup(nameuid string, groupgid string) *Erro
 	if aerr != nil {
 		return &Error{"EFAULT", aerr.Error()}
 	}
-	return nil
+	return backend.touchUser(uid)
 }
 
 func (backend *SqlBackend) RemoveUserFromGroup(nameuid string, groupgid string) *Error {
@@ -467,15 +851,19 @@ func (backend *SqlBackend) RemoveUserFromGroup(nameuid string, groupgid string)
 	if aerr != nil {
 		return &Error{"EFAULT", aerr.Error()}
 	}
-	return nil
+	return backend.touchUser(uid)
 }
 
 func (backend *SqlBackend) DeleteGroup(groupgid string) *Error {
 	if groupgid == "" {
 		return &Error{"EINVAL", "Name or gid has to be passed"}
 	}
+	gid, gerr := backend.getGidForNameGid(groupgid)
+	if gerr != nil {
+		return gerr
+	}
 
-	result, err := backend.deleteGroupStmt.Exec(groupgid, groupgid)
+	result, err := backend.deleteGroupStmt.Exec(backend.now().Unix(), groupgid, groupgid, backend.tenant)
 	if err != nil {
 		return &Error{"EFAULT", err.Error()}
 	}
@@ -487,12 +875,12 @@ func (backend *SqlBackend) DeleteGroup(groupgid string) *Error {
 	if count < 1 {
 		return &Error{"ENOENT", "Name or gid unknown"}
 	}
-	return nil
+	return backend.touchGroup(gid)
 }
 
 func (backend *SqlBackend) Groups() ([]Group, *Error) {
 	var groups []Group
-	rows, err := backend.groupsStmt.Query()
+	rows, err := backend.groupsStmt.Query(backend.tenant)
 	defer rows.Close()
 	if err != nil {
 		return nil, &Error{"EFAULT", err.Error()}
@@ -531,14 +919,154 @@ func (backend *SqlBackend) GroupUsers(groupgid string) ([]User, *Error) {
 		if err != nil {
 			return nil, &Error{"EFAULT", err.Error()}
 		}
-		users = append(users, User{uid, name, state == STATUS_ACTIVE})
+		users = append(users, User{Uid: uid, Name: name, Active: state == STATUS_ACTIVE})
 	}
 	return users, nil
 }
 
+func (backend *SqlBackend) SetGroupData(groupgid string, key string, value string) *Error {
+	if groupgid == "" || key == "" || value == "" {
+		return &Error{"EINVAL", "Name/gid, key and value can't be blank"}
+	}
+	gid, err := backend.getGidForNameGid(groupgid)
+	if err != nil {
+		return err
+	}
+	_, serr := backend.setGroupDataStmt.Exec(gid, key, backend.valueArg(value))
+	if serr != nil {
+		return &Error{"EFAULT", serr.Error()}
+	}
+	return backend.touchGroup(gid)
+}
+
+func (backend *SqlBackend) GetGroupData(groupgid string, key string) (string, *Error) {
+	if groupgid == "" || key == "" {
+		return "", &Error{"EINVAL", "Name/gid and key can't be blank"}
+	}
+	gid, err := backend.getGidForNameGid(groupgid)
+	if err != nil {
+		return "", err
+	}
+	var value string
+	gerr := backend.getGroupDataStmt.QueryRow(gid, key).Scan(&value)
+	if gerr == sql.ErrNoRows {
+		return "", &Error{"ENOENT", "Key unknown"}
+	} else if gerr != nil {
+		return "", &Error{"EFAULT", gerr.Error()}
+	}
+	return value, nil
+}
+
+func (backend *SqlBackend) GetGroupDataKeys(groupgid string) ([]string, *Error) {
+	if groupgid == "" {
+		return nil, &Error{"EINVAL", "Name/gid can't be blank"}
+	}
+	gid, err := backend.getGidForNameGid(groupgid)
+	if err != nil {
+		return nil, err
+	}
+	rows, gerr := backend.getGroupDataKeysStmt.Query(gid)
+	if gerr != nil {
+		return nil, &Error{"EFAULT", gerr.Error()}
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if serr := rows.Scan(&key); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (backend *SqlBackend) UnsetGroupData(groupgid string, key string) *Error {
+	if groupgid == "" || key == "" {
+		return &Error{"EINVAL", "Name/gid and key can't be blank"}
+	}
+	gid, err := backend.getGidForNameGid(groupgid)
+	if err != nil {
+		return err
+	}
+	result, derr := backend.deleteGroupDataStmt.Exec(gid, key)
+	if derr != nil {
+		return &Error{"EFAULT", derr.Error()}
+	}
+	n, aerr := result.RowsAffected()
+	if aerr != nil {
+		return &Error{"EFAULT", aerr.Error()}
+	}
+	if n == 0 {
+		return &Error{"ENOENT", "Key unknown"}
+	}
+	return backend.touchGroup(gid)
+}
+
+// FindUsers returns the users with a value for the key that is equal to
+// (=), starts with (prefix) or contains (contains) the value. The bytes of the
+// values are compared, so that all databases match case sensitive.
+func (backend *SqlBackend) FindUsers(key string, op string, value string) ([]User, *Error) {
+	if key == "" {
+		return nil, &Error{"EINVAL", "Key can't be blank"}
+	}
+	condition := "v.value = " + backend.placeholder(2)
+	switch strings.ToLower(op) {
+	case "=":
+		if backend.valueIndex != "" {
+			condition += " AND " + fmt.Sprintf(backend.valueIndex, "v.value") +
+				" = " + fmt.Sprintf(backend.valueIndex, backend.placeholder(2))
+		}
+	case "prefix":
+		value, condition = backend.pattern(value, false)
+	case "contains":
+		value, condition = backend.pattern(value, true)
+	default:
+		return nil, &Error{"EINVAL", "Unknown operator"}
+	}
+	rows, err := backend.query(fmt.Sprintf(`SELECT u.name, u.uid, u.state FROM Users u
+		JOIN UserValues v ON u.uid = v.uid
+		WHERE v.key = %s AND %s AND u.tenant = %s AND u.trashed = 0 ORDER BY u.uid`,
+		backend.placeholder(1), condition, backend.placeholder(3)),
+		key, backend.valueArg(value), backend.tenant)
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var uid int64
+		var name string
+		var state int
+		if serr := rows.Scan(&name, &uid, &state); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		users = append(users, User{Uid: uid, Name: name, Active: state == STATUS_ACTIVE})
+	}
+	return users, nil
+}
+
+// pattern returns the pattern and the condition that matches the values that
+// start with or contain the literal value
+func (backend *SqlBackend) pattern(literal string, contains bool) (string, string) {
+	if backend.globPatterns {
+		pattern := globEscape(literal) + "*"
+		if contains {
+			pattern = "*" + pattern
+		}
+		return pattern, "v.value GLOB " + backend.placeholder(2)
+	}
+	pattern := likeEscape(literal) + "%"
+	if contains {
+		pattern = "%" + pattern
+	}
+	return pattern, fmt.Sprintf("v.value LIKE %s ESCAPE '!'", backend.placeholder(2))
+}
+
+// Stats returns the number of users and groups of the tenant
 func (backend *SqlBackend) Stats() (stats map[string]int64, err *Error) {
 	stats = make(map[string]int64)
-	rows, rerr := backend.statsStmt.Query()
+	rows, rerr := backend.statsStmt.Query(backend.tenant, backend.tenant)
 	defer rows.Close()
 	if rerr != nil {
 		err = &Error{"EFAULT", rerr.Error()}
@@ -557,11 +1085,192 @@ func (backend *SqlBackend) Stats() (stats map[string]int64, err *Error) {
 }
 
 func (backend *SqlBackend) Close() {
+	if backend.tx != nil {
+		backend.Rollback()
+		return
+	}
+	if backend.scoped {
+		return
+	}
 	backend.db.Close()
 }
 
+func (backend *SqlBackend) Begin() (Transaction, *Error) {
+	return backend.begin()
+}
+
+// begin starts a transaction and returns a copy of the backend that runs
+// all statements within the transaction
+func (backend *SqlBackend) begin() (*SqlBackend, *Error) {
+	if backend.tx != nil {
+		return nil, &Error{"EINVAL", "Transaction already in progress"}
+	}
+	tx, err := backend.db.Begin()
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	txBackend := *backend
+	txBackend.tx = tx
+	txBackend.createUserStmt = tx.Stmt(backend.createUserStmt)
+	txBackend.usersStmt = tx.Stmt(backend.usersStmt)
+	txBackend.deleteUserStmt = tx.Stmt(backend.deleteUserStmt)
+	txBackend.loginUserStmt = tx.Stmt(backend.loginUserStmt)
+	txBackend.setUserStateStmt = tx.Stmt(backend.setUserStateStmt)
+	txBackend.uidForNameUidStmt = tx.Stmt(backend.uidForNameUidStmt)
+	txBackend.setUserDataStmt = tx.Stmt(backend.setUserDataStmt)
+	txBackend.updateUserDataStmt = tx.Stmt(backend.updateUserDataStmt)
+	txBackend.getUserDataStmt = tx.Stmt(backend.getUserDataStmt)
+	txBackend.getUserDataKeysStmt = tx.Stmt(backend.getUserDataKeysStmt)
+	txBackend.getAllUserDataStmt = tx.Stmt(backend.getAllUserDataStmt)
+	txBackend.deleteUserDataStmt = tx.Stmt(backend.deleteUserDataStmt)
+	txBackend.changeUserPasswordStmt = tx.Stmt(backend.changeUserPasswordStmt)
+	txBackend.changeUserNameStmt = tx.Stmt(backend.changeUserNameStmt)
+	txBackend.renameUserStmt = tx.Stmt(backend.renameUserStmt)
+	txBackend.setUserPasswordStmt = tx.Stmt(backend.setUserPasswordStmt)
+	txBackend.renameGroupStmt = tx.Stmt(backend.renameGroupStmt)
+	txBackend.userGroupsStmt = tx.Stmt(backend.userGroupsStmt)
+	txBackend.createGroupStmt = tx.Stmt(backend.createGroupStmt)
+	txBackend.groupsStmt = tx.Stmt(backend.groupsStmt)
+	txBackend.deleteGroupStmt = tx.Stmt(backend.deleteGroupStmt)
+	txBackend.gidForNameGidStmt = tx.Stmt(backend.gidForNameGidStmt)
+	txBackend.addUserToGroupStmt = tx.Stmt(backend.addUserToGroupStmt)
+	txBackend.removeUserFromGroupStmt = tx.Stmt(backend.removeUserFromGroupStmt)
+	txBackend.addGroupToGroupStmt = tx.Stmt(backend.addGroupToGroupStmt)
+	txBackend.removeGroupFromGroupStmt = tx.Stmt(backend.removeGroupFromGroupStmt)
+	txBackend.groupUsersStmt = tx.Stmt(backend.groupUsersStmt)
+	txBackend.setGroupDataStmt = tx.Stmt(backend.setGroupDataStmt)
+	txBackend.getGroupDataStmt = tx.Stmt(backend.getGroupDataStmt)
+	txBackend.getGroupDataKeysStmt = tx.Stmt(backend.getGroupDataKeysStmt)
+	txBackend.deleteGroupDataStmt = tx.Stmt(backend.deleteGroupDataStmt)
+	txBackend.createRoleStmt = tx.Stmt(backend.createRoleStmt)
+	txBackend.rolesStmt = tx.Stmt(backend.rolesStmt)
+	txBackend.deleteRoleStmt = tx.Stmt(backend.deleteRoleStmt)
+	txBackend.ridForNameRidStmt = tx.Stmt(backend.ridForNameRidStmt)
+	txBackend.createPermissionStmt = tx.Stmt(backend.createPermissionStmt)
+	txBackend.permissionsStmt = tx.Stmt(backend.permissionsStmt)
+	txBackend.deletePermissionStmt = tx.Stmt(backend.deletePermissionStmt)
+	txBackend.pidForNamePidStmt = tx.Stmt(backend.pidForNamePidStmt)
+	txBackend.rolePermissionsStmt = tx.Stmt(backend.rolePermissionsStmt)
+	txBackend.grantPermissionStmt = tx.Stmt(backend.grantPermissionStmt)
+	txBackend.revokePermissionStmt = tx.Stmt(backend.revokePermissionStmt)
+	txBackend.assignUserRoleStmt = tx.Stmt(backend.assignUserRoleStmt)
+	txBackend.unassignUserRoleStmt = tx.Stmt(backend.unassignUserRoleStmt)
+	txBackend.assignGroupRoleStmt = tx.Stmt(backend.assignGroupRoleStmt)
+	txBackend.unassignGroupRoleStmt = tx.Stmt(backend.unassignGroupRoleStmt)
+	txBackend.createTenantStmt = tx.Stmt(backend.createTenantStmt)
+	txBackend.tenantsStmt = tx.Stmt(backend.tenantsStmt)
+	txBackend.tidForNameStmt = tx.Stmt(backend.tidForNameStmt)
+	txBackend.statsStmt = tx.Stmt(backend.statsStmt)
+	txBackend.keepUserValueStmt = tx.Stmt(backend.keepUserValueStmt)
+	txBackend.addUserValueChangeStmt = tx.Stmt(backend.addUserValueChangeStmt)
+	return &txBackend, nil
+}
+
+func (backend *SqlBackend) Commit() *Error {
+	if backend.tx == nil {
+		return &Error{"EINVAL", "No transaction in progress"}
+	}
+	err := backend.tx.Commit()
+	backend.tx = nil
+	if err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) Rollback() *Error {
+	if backend.tx == nil {
+		return &Error{"EINVAL", "No transaction in progress"}
+	}
+	err := backend.tx.Rollback()
+	backend.tx = nil
+	if err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+// Savepoint marks the state of the transaction before a command, so that a
+// failed command can be undone without losing the transaction. Postgres
+// aborts the whole transaction on the first failed statement otherwise.
+func (backend *SqlBackend) Savepoint() *Error {
+	return backend.savepoint("SAVEPOINT command")
+}
+
+// RollbackToSavepoint undoes the statements since the savepoint, the
+// transaction can be continued
+func (backend *SqlBackend) RollbackToSavepoint() *Error {
+	return backend.savepoint("ROLLBACK TO SAVEPOINT command")
+}
+
+// ReleaseSavepoint keeps the statements since the savepoint
+func (backend *SqlBackend) ReleaseSavepoint() *Error {
+	return backend.savepoint("RELEASE SAVEPOINT command")
+}
+
+func (backend *SqlBackend) savepoint(stmt string) *Error {
+	if backend.tx == nil {
+		return &Error{"EINVAL", "No transaction in progress"}
+	}
+	if _, err := backend.tx.Exec(stmt); err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	return nil
+}
+
+// query runs a dynamically built query within the transaction if there is one
+func (backend *SqlBackend) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if backend.tx != nil {
+		return backend.tx.Query(query, args...)
+	}
+	return backend.db.Query(query, args...)
+}
+
+// exec runs a dynamically built statement within the transaction if there
+// is one
+func (backend *SqlBackend) exec(query string, args ...interface{}) (sql.Result, error) {
+	if backend.tx != nil {
+		return backend.tx.Exec(query, args...)
+	}
+	return backend.db.Exec(query, args...)
+}
+
+// queryRow runs a dynamically built query within the transaction if there
+// is one
+func (backend *SqlBackend) queryRow(query string, args ...interface{}) *sql.Row {
+	if backend.tx != nil {
+		return backend.tx.QueryRow(query, args...)
+	}
+	return backend.db.QueryRow(query, args...)
+}
+
+// placeholder returns the placeholder of the nth argument of a query
+func (backend *SqlBackend) placeholder(n int) string {
+	if backend.questionMarks {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// valueArg returns the argument for a user or group data value, the binary
+// columns of postgres would parse strings as escaped bytes
+func (backend *SqlBackend) valueArg(value string) interface{} {
+	if backend.binaryValues {
+		return []byte(value)
+	}
+	return value
+}
+
+// prepare prepares the statement within the transaction if there is one
+func (backend *SqlBackend) prepare(query string) (*sql.Stmt, error) {
+	if backend.tx != nil {
+		return backend.tx.Prepare(query)
+	}
+	return backend.db.Prepare(query)
+}
+
 func (backend *SqlBackend) getUidForNameUid(nameuid string) (int64, *Error) {
-	rows, err := backend.uidForNameUidStmt.Query(nameuid, nameuid)
+	rows, err := backend.uidForNameUidStmt.Query(nameuid, nameuid, backend.tenant)
 	defer rows.Close()
 	if err != nil {
 		return 0, &Error{"EFAULT", err.Error()}
@@ -578,7 +1287,7 @@ func (backend *SqlBackend) getUidForNameUid(nameuid string) (int64, *Error) {
 }
 
 func (backend *SqlBackend) getGidForNameGid(groupgid string) (int64, *Error) {
-	rows, err := backend.gidForNameGidStmt.Query(groupgid, groupgid)
+	rows, err := backend.gidForNameGidStmt.Query(groupgid, groupgid, backend.tenant)
 	defer rows.Close()
 	if err != nil {
 		return 0, &Error{"EFAULT", err.Error()}
@@ -598,7 +1307,11 @@ func (backend *SqlBackend) setUserState(state int, nameuid string) *Error {
 	if nameuid == "" {
 		return &Error{"EINVAL", "User name or uid must be given"}
 	}
-	result, err := backend.setUserStateStmt.Exec(state, nameuid, nameuid)
+	uid, uerr := backend.getUidForNameUid(nameuid)
+	if uerr != nil {
+		return uerr
+	}
+	result, err := backend.setUserStateStmt.Exec(state, nameuid, nameuid, backend.tenant)
 	if err != nil {
 		return &Error{"EFAULT", err.Error()}
 	}
@@ -609,5 +1322,5 @@ func (backend *SqlBackend) setUserState(state int, nameuid string) *Error {
 	if n == 0 {
 		return &Error{"ENOENT", "User name"}
 	}
-	return nil
+	return backend.touchUser(uid)
 }
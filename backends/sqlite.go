@@ -1,9 +1,11 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"strings"
 )
 
 var PREPARE_SQLITE = []string{
@@ -18,12 +20,31 @@ var PREPARE_SQLITE = []string{
 		name TEXT NOT NULL,
 		password TEXT NOT NULL,
 		state INTEGER DEFAULT %d,
-		CONSTRAINT UniqueUserNames UNIQUE (name) ON CONFLICT ROLLBACK
+		expires BIGINT,
+		deleted BIGINT,
+		trashed INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniqueUserNames UNIQUE (tenant, name, trashed)
 	);`, STATUS_ACTIVE),
+	`CREATE TABLE IF NOT EXISTS UserSchedules (
+		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+		due INTEGER NOT NULL,
+		state INTEGER NOT NULL
+	);`,
+	"CREATE INDEX IF NOT EXISTS UserSchedulesDue ON UserSchedules (due);",
 	`CREATE TABLE IF NOT EXISTS Groups (
 		gid INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT NOT NULL,
-		CONSTRAINT UniqueGroupNames UNIQUE (name) ON CONFLICT ROLLBACK
+		deleted BIGINT,
+		trashed INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniqueGroupNames UNIQUE (tenant, name, trashed)
 	);`,
 	`CREATE TABLE IF NOT EXISTS UserGroups (
 		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
@@ -34,8 +55,64 @@ var PREPARE_SQLITE = []string{
 		uid INTEGER REFERENCES Users(uid) ON DELETE CASCADE,
 		key TEXT NOT NULL,
 		value BLOB NOT NULL,
+		created_at BIGINT,
+		updated_at BIGINT,
+		version INTEGER NOT NULL DEFAULT 1,
 		CONSTRAINT UniqueUidKeyPairs UNIQUE (uid, key) ON CONFLICT REPLACE
 	);`,
+	"CREATE INDEX IF NOT EXISTS UserValuesKeyValue ON UserValues (key, value);",
+	`CREATE TABLE IF NOT EXISTS UserValueChanges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value BLOB,
+		changed BIGINT,
+		client TEXT
+	);`,
+	"CREATE INDEX IF NOT EXISTS UserValueChangesUidKey ON UserValueChanges (uid, key);",
+	`CREATE TABLE IF NOT EXISTS GroupValues (
+		gid INTEGER REFERENCES Groups(gid) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value BLOB NOT NULL,
+		CONSTRAINT UniqueGidKeyPairs UNIQUE (gid, key) ON CONFLICT REPLACE
+	);`,
+	`CREATE TABLE IF NOT EXISTS GroupGroups (
+		child INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+		parent INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+		CONSTRAINT UniqueChildParentPairs UNIQUE (child, parent) ON CONFLICT IGNORE
+	);`,
+	`CREATE TABLE IF NOT EXISTS Roles (
+		rid INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniqueRoleNames UNIQUE (tenant, name)
+	);`,
+	`CREATE TABLE IF NOT EXISTS Permissions (
+		pid INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		tenant INTEGER NOT NULL DEFAULT 0,
+		CONSTRAINT UniquePermissionNames UNIQUE (tenant, name)
+	);`,
+	`CREATE TABLE IF NOT EXISTS RolePermissions (
+		rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+		pid INTEGER NOT NULL REFERENCES Permissions(pid) ON DELETE CASCADE,
+		CONSTRAINT UniqueRidPidPairs UNIQUE (rid, pid) ON CONFLICT IGNORE
+	);`,
+	`CREATE TABLE IF NOT EXISTS UserRoles (
+		uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+		rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+		CONSTRAINT UniqueUidRidPairs UNIQUE (uid, rid) ON CONFLICT IGNORE
+	);`,
+	`CREATE TABLE IF NOT EXISTS GroupRoles (
+		gid INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+		rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+		CONSTRAINT UniqueGidRidPairs UNIQUE (gid, rid) ON CONFLICT IGNORE
+	);`,
+	`CREATE TABLE IF NOT EXISTS Tenants (
+		tid INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		CONSTRAINT UniqueTenantNames UNIQUE (name)
+	);`,
 }
 
 type SqliteBackend struct {
@@ -44,32 +121,176 @@ type SqliteBackend struct {
 
 func NewSqliteBackend(url string) (SqliteBackend, error) {
 	var backend SqliteBackend
+	memory := isSqliteMemory(url)
+	if !memory {
+		// the pragmas only apply to the connection they are executed on,
+		// the pooled connections get them from the url
+		url += sqliteParamSeparator(url) + "_foreign_keys=1&_busy_timeout=60000"
+	}
 	db, err := sql.Open("sqlite3", url)
 	if err == nil {
-		backend = SqliteBackend{SqlBackend{db: db}}
-		return backend, backend.init(PREPARE_SQLITE)
+		// every connection to an in memory database opens a new database,
+		// it has to use a single connection. Files use several connections,
+		// so that a running transaction doesn't block the other clients.
+		if memory {
+			db.SetMaxOpenConns(1)
+		}
+		backend = SqliteBackend{SqlBackend{db: db, globPatterns: true}}
+		if err = backend.init(PREPARE_SQLITE); err != nil {
+			return backend, err
+		}
+		return backend, backend.migrateNameConstraints()
 	} else {
 		return backend, err
 	}
 }
 
-func (backend *SqliteBackend) CreateUser(name string, password string) (uid int64, err *Error) {
-	uid, err = backend.SqlBackend.CreateUser(name, password)
+// migrateNameConstraints rebuilds the tables whose unique constraint of the
+// names is outdated, sqlite can't change the constraints of a table
+func (backend *SqliteBackend) migrateNameConstraints() error {
+	for _, constraint := range nameConstraints {
+		var schema string
+		if err := backend.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?",
+			constraint.table).Scan(&schema); err != nil {
+			return err
+		}
+		if strings.Contains(schema, "UNIQUE ("+constraint.columns+")") {
+			continue
+		}
+		if err := backend.rebuildTable(constraint.table); err != nil {
+			return fmt.Errorf("Unable to migrate the unique names of %s: %s", constraint.table, err)
+		}
+	}
+	return nil
+}
+
+// rebuildTable copies the rows into a new table with the current schema and
+// replaces the table with it. The foreign keys are disabled on the connection
+// while the table is replaced, so that the references are kept.
+func (backend *SqliteBackend) rebuildTable(table string) error {
+	create := ""
+	for _, stmt := range PREPARE_SQLITE {
+		if strings.HasPrefix(stmt, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			create = strings.Replace(stmt, "IF NOT EXISTS "+table, "new_"+table, 1)
+		}
+	}
+	if create == "" {
+		return fmt.Errorf("Unknown table %s", table)
+	}
+	ctx := context.Background()
+	conn, err := backend.db.Conn(ctx)
 	if err != nil {
-		// after error occured, the statement is broken, we need to recreate it
-		backend.createUserStmt.Close()
-		backend.createUserStmt, _ = backend.db.Prepare(`INSERT INTO Users
-			(name, password) VALUES (?, ?);`)
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF;"); err != nil {
+		return err
 	}
-	return
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON;")
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(create); err != nil {
+		return err
+	}
+	var columns []string
+	rows, err := tx.Query("SELECT name FROM pragma_table_info('new_" + table + "')")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, column)
+	}
+	rows.Close()
+	// the sequence is removed with the table, the ids of purged rows must not
+	// be reused
+	var seq sql.NullInt64
+	if err = tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = ?", table).Scan(&seq); err != nil &&
+		err != sql.ErrNoRows {
+		return err
+	}
+	list := strings.Join(columns, ", ")
+	for _, stmt := range []string{
+		"INSERT INTO new_" + table + " (" + list + ") SELECT " + list + " FROM " + table + ";",
+		"DROP TABLE " + table + ";",
+		"ALTER TABLE new_" + table + " RENAME TO " + table + ";",
+	} {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if seq.Valid {
+		if _, err = tx.Exec("UPDATE sqlite_sequence SET seq = ? WHERE name = ? AND seq < ?",
+			seq.Int64, table, seq.Int64); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("INSERT INTO sqlite_sequence (name, seq) SELECT ?, ? WHERE NOT EXISTS "+
+			"(SELECT 1 FROM sqlite_sequence WHERE name = ?)", table, seq.Int64, table); err != nil {
+			return err
+		}
+	}
+	violations, err := tx.Query("PRAGMA foreign_key_check;")
+	if err != nil {
+		return err
+	}
+	broken := violations.Next()
+	violations.Close()
+	if broken {
+		return fmt.Errorf("Foreign keys are broken")
+	}
+	return tx.Commit()
+}
+
+// isSqliteMemory returns true for urls of in memory databases
+func isSqliteMemory(url string) bool {
+	return url == ":memory:" || strings.HasPrefix(url, "file::memory:") ||
+		strings.Contains(url, "mode=memory")
+}
+
+func sqliteParamSeparator(url string) string {
+	if strings.Contains(url, "?") {
+		return "&"
+	}
+	return "?"
+}
+
+// Statements that failed, e.g. with a constraint violation, are reset by
+// the driver and stay usable, so they are shared by the copies of the backend
+// for tenants and clients like with the other databases.
+
+// Tenant selects the backend of the tenant
+func (backend *SqliteBackend) Tenant(name string) (Abstract, *Error) {
+	scoped, err := backend.SqlBackend.scope(name)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteBackend{*scoped}, nil
+}
+
+func (backend *SqliteBackend) IfVersion(version int64) (Abstract, *Error) {
+	guarded, err := backend.SqlBackend.guard(version)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteBackend{*guarded}, nil
+}
+
+// Identify returns the backend of a client
+func (backend *SqliteBackend) Identify(client string) Abstract {
+	return &SqliteBackend{*backend.SqlBackend.identify(client)}
 }
 
-func (backend *SqliteBackend) CreateGroup(name string) (gid int64, err *Error) {
-	gid, err = backend.SqlBackend.CreateGroup(name)
+func (backend *SqliteBackend) Begin() (Transaction, *Error) {
+	tx, err := backend.SqlBackend.begin()
 	if err != nil {
-		backend.createGroupStmt.Close()
-		backend.createGroupStmt, _ = backend.db.Prepare(`INSERT INTO Groups
-			(name) VALUES (?);`)
+		return nil, err
 	}
-	return
+	return &SqliteBackend{*tx}, nil
 }
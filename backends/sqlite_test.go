@@ -1,8 +1,16 @@
 package backends
 
 import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCreateUser(t *testing.T) {
@@ -455,3 +463,1254 @@ func TestUsersAndGroupsAssociations(t *testing.T) {
 		t.Fatalf("expected to have no admin, got %v", users)
 	}
 }
+
+func TestTransaction(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	// rolled back changes are discarded
+	tx, err := backend.Begin()
+	if err != nil {
+		t.Fatal("should begin transaction", err)
+	}
+	tx.CreateUser("joe", "secret")
+	tx.CreateGroup("dev")
+	if users, _ := tx.Users(); len(users) != 1 {
+		t.Fatal("transaction should see its own changes", users)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal("should rollback", err)
+	}
+	if users, _ := backend.Users(); len(users) != 0 {
+		t.Fatal("user count should have been 0 but was", len(users))
+	}
+	if err = tx.Rollback(); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should fail without transaction", err)
+	}
+
+	// committed changes are kept
+	tx, _ = backend.Begin()
+	if _, nerr := tx.(Transactional).Begin(); nerr == nil || nerr.Code != "EINVAL" {
+		t.Fatal("should not allow nested transactions", nerr)
+	}
+	tx.CreateUser("joe", "secret")
+	tx.SetUserData("joe", "email", "joe@example.com")
+	if err = tx.Commit(); err != nil {
+		t.Fatal("should commit", err)
+	}
+	value, _ := backend.GetUserData("joe", "email")
+	if value != "joe@example.com" {
+		t.Fatal("expected committed value but got", value)
+	}
+	if err = tx.Commit(); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should fail without transaction", err)
+	}
+
+	// a name conflict only fails the statement, the transaction goes on
+	tx, _ = backend.Begin()
+	tx.CreateUser("b", "secret")
+	if _, err = tx.CreateUser("joe", "secret"); err == nil {
+		t.Fatal("should fail for duplicate name")
+	}
+	if _, err = tx.CreateUser("c", "secret"); err != nil {
+		t.Fatal("should create user after conflict", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal("should commit after conflict", err)
+	}
+	if users, _ := backend.Users(); len(users) != 3 {
+		t.Fatal("should keep the users before and after the conflict", users)
+	}
+
+	// statements since a savepoint can be undone, the transaction goes on
+	tx, _ = backend.Begin()
+	savepoints := tx.(Savepoints)
+	tx.CreateUser("d", "secret")
+	if err = savepoints.Savepoint(); err != nil {
+		t.Fatal("should set savepoint", err)
+	}
+	tx.CreateUser("e", "secret")
+	if err = savepoints.RollbackToSavepoint(); err != nil {
+		t.Fatal("should roll back to savepoint", err)
+	}
+	savepoints.Savepoint()
+	tx.CreateUser("f", "secret")
+	if err = savepoints.ReleaseSavepoint(); err != nil {
+		t.Fatal("should release savepoint", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal("should commit after savepoints", err)
+	}
+	users, _ := backend.Users()
+	if len(users) != 5 || users[3].Name != "d" || users[4].Name != "f" {
+		t.Fatal("should only undo the user after the savepoint", users)
+	}
+	if err = savepoints.Savepoint(); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should fail without transaction", err)
+	}
+}
+
+func TestUsersPage(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	uid0, _ := backend.CreateUser("dave", "secret")
+	uid1, _ := backend.CreateUser("carol", "secret")
+	uid2, _ := backend.CreateUser("bob", "secret")
+	uid3, _ := backend.CreateUser("alice_1", "secret")
+	backend.DisableUser("bob")
+
+	// pages are sorted by uid
+	users, cursor, err := backend.UsersPage(ListOptions{Limit: 3})
+	if err != nil || cursor == "" {
+		t.Fatal("expected first page with cursor", err)
+	}
+	expected := []User{
+		User{Uid: uid0, Name: "dave", Active: true},
+		User{Uid: uid1, Name: "carol", Active: true},
+		User{Uid: uid2, Name: "bob", Active: false},
+	}
+	if !reflect.DeepEqual(expected, users) {
+		t.Fatalf("expected %v\nto equal %v\n", expected, users)
+	}
+	users, cursor, _ = backend.UsersPage(ListOptions{Limit: 3, After: cursor})
+	if cursor != "" || len(users) != 1 || users[0].Uid != uid3 {
+		t.Fatal("expected last page", users, cursor)
+	}
+
+	// sorted by name
+	users, cursor, _ = backend.UsersPage(ListOptions{Sort: "name", Limit: 2})
+	if len(users) != 2 || users[0].Name != "alice_1" || users[1].Name != "bob" {
+		t.Fatal("expected users sorted by name", users)
+	}
+	users, cursor, _ = backend.UsersPage(ListOptions{Sort: "name", Limit: 2, After: cursor})
+	if cursor != "" || len(users) != 2 || users[0].Name != "carol" {
+		t.Fatal("expected second page sorted by name", users, cursor)
+	}
+
+	// filter and state
+	users, _, _ = backend.UsersPage(ListOptions{Filter: "*a*", State: "active"})
+	if len(users) != 3 {
+		t.Fatal("expected three active users matching the filter", users)
+	}
+	users, _, _ = backend.UsersPage(ListOptions{Filter: "alice?1"})
+	if len(users) != 1 {
+		t.Fatal("expected single character wildcard to match", users)
+	}
+	users, _, _ = backend.UsersPage(ListOptions{Filter: "alice%"})
+	if len(users) != 0 {
+		t.Fatal("expected % to be matched literally", users)
+	}
+	users, _, _ = backend.UsersPage(ListOptions{State: "inactive"})
+	if len(users) != 1 || users[0].Name != "bob" {
+		t.Fatal("expected inactive user", users)
+	}
+
+	// invalid options
+	if _, _, err = backend.UsersPage(ListOptions{Sort: "password"}); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for unknown sort", err)
+	}
+	if _, _, err = backend.UsersPage(ListOptions{Sort: "name", After: newCursor(false, 1, "")}); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for cursor of other sort order", err)
+	}
+}
+
+func TestGroupsPage(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	backend.CreateGroup("sales")
+	backend.CreateGroup("admins")
+	backend.CreateGroup("developers")
+	backend.CreateUser("joe", "secret")
+	backend.CreateUser("alice", "secret")
+	backend.CreateUser("bob", "secret")
+	backend.AddUserToGroup("joe", "admins")
+	backend.AddUserToGroup("alice", "admins")
+	backend.AddUserToGroup("bob", "sales")
+
+	groups, cursor, _ := backend.GroupsPage(ListOptions{Sort: "name", Limit: 2})
+	if len(groups) != 2 || groups[0].Name != "admins" || cursor == "" {
+		t.Fatal("expected first page of groups", groups, cursor)
+	}
+	groups, cursor, _ = backend.GroupsPage(ListOptions{Sort: "name", Limit: 2, After: cursor})
+	if len(groups) != 1 || groups[0].Name != "sales" || cursor != "" {
+		t.Fatal("expected last page of groups", groups, cursor)
+	}
+	if _, _, err := backend.GroupsPage(ListOptions{State: "active"}); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for state of groups", err)
+	}
+
+	users, cursor, _ := backend.GroupUsersPage("admins", ListOptions{Sort: "name", Limit: 1})
+	if len(users) != 1 || users[0].Name != "alice" || cursor == "" {
+		t.Fatal("expected first page of group users", users, cursor)
+	}
+	users, cursor, _ = backend.GroupUsersPage("admins", ListOptions{Sort: "name", Limit: 1, After: cursor})
+	if len(users) != 1 || users[0].Name != "joe" || cursor != "" {
+		t.Fatal("expected last page of group users", users, cursor)
+	}
+	if _, _, err := backend.GroupUsersPage("unknown", ListOptions{}); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT for unknown group", err)
+	}
+}
+
+func TestFindUsers(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	uid0, _ := backend.CreateUser("joe", "secret")
+	uid1, _ := backend.CreateUser("alice", "secret")
+	backend.CreateUser("bob", "secret")
+	backend.SetUserData("joe", "department", "sales")
+	backend.SetUserData("alice", "department", "sales_eu")
+	backend.SetUserData("bob", "team", "sales")
+
+	users, err := backend.FindUsers("department", "=", "sales")
+	expected := []User{User{Uid: uid0, Name: "joe", Active: true}}
+	if err != nil || !reflect.DeepEqual(expected, users) {
+		t.Fatalf("expected %v\nto equal %v %v\n", expected, users, err)
+	}
+	users, _ = backend.FindUsers("department", "prefix", "sales")
+	if len(users) != 2 || users[1].Uid != uid1 {
+		t.Fatal("expected two users with prefix", users)
+	}
+	users, _ = backend.FindUsers("department", "contains", "s_")
+	if len(users) != 1 || users[0].Uid != uid1 {
+		t.Fatal("expected wildcards to be matched literally", users)
+	}
+	users, _ = backend.FindUsers("department", "=", "marketing")
+	if len(users) != 0 {
+		t.Fatal("expected no users", users)
+	}
+	users, _ = backend.FindUsers("department", "prefix", "Sales")
+	if len(users) != 0 {
+		t.Fatal("expected case sensitive matching", users)
+	}
+	backend.SetUserData("bob", "department", "r*d [lab]?")
+	users, _ = backend.FindUsers("department", "contains", "*d [lab]?")
+	if len(users) != 1 || users[0].Name != "bob" {
+		t.Fatal("expected glob wildcards to be matched literally", users)
+	}
+	users, _ = backend.FindUsers("department", "prefix", "r?d")
+	if len(users) != 0 {
+		t.Fatal("expected glob wildcards to be matched literally", users)
+	}
+	if _, err = backend.FindUsers("department", "like", "sales"); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for unknown operator", err)
+	}
+	if _, err = backend.FindUsers("", "=", "sales"); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for blank key", err)
+	}
+}
+
+func TestGetAllUnsetUserData(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	backend.CreateUser("joe", "secret")
+	err := backend.SetManyUserData("joe", map[string]string{
+		"firstname": "Joe", "lastname": "Doe", "bio": "line\r\nbreak"})
+	if err != nil {
+		t.Fatal("should store values", err)
+	}
+	values, err := backend.GetAllUserData("joe")
+	expected := map[string]string{"firstname": "Joe", "lastname": "Doe", "bio": "line\r\nbreak"}
+	if err != nil || !reflect.DeepEqual(expected, values) {
+		t.Fatalf("expected %v\nto equal %v %v\n", expected, values, err)
+	}
+
+	// either all or none of the values are stored
+	err = backend.SetManyUserData("joe", map[string]string{"firstname": "Jo", "lastname": ""})
+	if err == nil || err.Code != "EINVAL" {
+		t.Fatal("should fail on blank value", err)
+	}
+	if value, _ := backend.GetUserData("joe", "firstname"); value != "Joe" {
+		t.Fatal("should not have stored any value", value)
+	}
+
+	if err = backend.UnsetUserData("joe", "bio"); err != nil {
+		t.Fatal("should unset key", err)
+	}
+	if err = backend.UnsetUserData("joe", "bio"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown key", err)
+	}
+	if _, err = backend.GetUserData("joe", "bio"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("key should be gone", err)
+	}
+	if _, err = backend.GetAllUserData("unknown"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown user", err)
+	}
+}
+
+func TestSetGetGroupData(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	gid, _ := backend.CreateGroup("admins")
+	if err := backend.SetGroupData("admins", "description", "Administrators"); err != nil {
+		t.Fatal("should store value", err)
+	}
+	backend.SetGroupData(strconv.FormatInt(gid, 10), "owner", "joe")
+	backend.SetGroupData("admins", "owner", "alice")
+	if err := backend.SetGroupData("admins", "owner", ""); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should fail on blank value", err)
+	}
+	if err := backend.SetGroupData("unknown", "owner", "joe"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail on unknown group", err)
+	}
+
+	value, err := backend.GetGroupData("admins", "owner")
+	if err != nil || value != "alice" {
+		t.Fatal("expected overwritten value but got", value, err)
+	}
+	if _, err = backend.GetGroupData("admins", "aliases"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail on unknown key", err)
+	}
+	keys, _ := backend.GetGroupDataKeys("admins")
+	if !reflect.DeepEqual([]string{"description", "owner"}, keys) {
+		t.Fatal("unexpected keys", keys)
+	}
+
+	if err = backend.UnsetGroupData("admins", "owner"); err != nil {
+		t.Fatal("should unset key", err)
+	}
+	if err = backend.UnsetGroupData("admins", "owner"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail on unknown key", err)
+	}
+
+	// values are deleted together with the group
+	backend.DeleteGroup("admins")
+	backend.CreateGroup("admins")
+	if keys, _ = backend.GetGroupDataKeys("admins"); len(keys) != 0 {
+		t.Fatal("expected values to be deleted with the group", keys)
+	}
+}
+
+func TestRenameUserAndGroup(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	uid, _ := backend.CreateUser("joe", "secret")
+	backend.CreateUser("alice", "secret")
+	if err := backend.RenameUser("joe", "joseph"); err != nil {
+		t.Fatal("should rename user", err)
+	}
+	if err := backend.RenameUser("joseph", "alice"); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should fail on existing name", err)
+	}
+	if err := backend.RenameUser("unknown", "bob"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail on unknown user", err)
+	}
+	if err := backend.SetUserPassword("joseph", "new"); err != nil {
+		t.Fatal("should set password", err)
+	}
+	if login, err := backend.LoginUser("joseph", "new"); err != nil || login != uid {
+		t.Fatal("should login with new name and password", login, err)
+	}
+	if err := backend.SetUserPassword("joseph", ""); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should fail on blank password", err)
+	}
+
+	backend.CreateGroup("admins")
+	backend.CreateGroup("sales")
+	if err := backend.RenameGroup("admins", "administrators"); err != nil {
+		t.Fatal("should rename group", err)
+	}
+	if err := backend.RenameGroup("administrators", "sales"); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should fail on existing name", err)
+	}
+	// statements still work after the conflict
+	if err := backend.RenameGroup("sales", "marketing"); err != nil {
+		t.Fatal("should rename group", err)
+	}
+	groups, _ := backend.Groups()
+	if len(groups) != 2 || groups[0].Name != "administrators" || groups[1].Name != "marketing" {
+		t.Fatal("unexpected groups", groups)
+	}
+}
+
+func TestNestedGroups(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	testNestedGroups(t, &backend.SqlBackend)
+}
+
+func TestNestedGroupsIterative(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	backend.iterativeNesting = true
+	testNestedGroups(t, &backend.SqlBackend)
+}
+
+func testNestedGroups(t *testing.T, backend *SqlBackend) {
+	backend.CreateGroup("engineering")
+	backend.CreateGroup("backend")
+	backend.CreateGroup("frontend")
+	backend.CreateGroup("sales")
+	backend.CreateUser("joe", "secret")
+	backend.CreateUser("alice", "secret")
+	backend.CreateUser("bob", "secret")
+	backend.AddUserToGroup("joe", "backend")
+	backend.AddUserToGroup("alice", "frontend")
+	backend.AddUserToGroup("bob", "engineering")
+	backend.AddUserToGroup("bob", "sales")
+	if err := backend.AddGroupToGroup("backend", "engineering"); err != nil {
+		t.Fatal("should nest group", err)
+	}
+	backend.AddGroupToGroup("frontend", "engineering")
+
+	// cycles are rejected
+	if err := backend.AddGroupToGroup("engineering", "backend"); err == nil || err.Code != "ELOOP" {
+		t.Fatal("should reject cycle", err)
+	}
+	if err := backend.AddGroupToGroup("sales", "sales"); err == nil || err.Code != "ELOOP" {
+		t.Fatal("should reject group containing itself", err)
+	}
+	if err := backend.AddGroupToGroup("unknown", "sales"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown group", err)
+	}
+
+	groups, _ := backend.UserGroups("joe")
+	if len(groups) != 1 {
+		t.Fatal("expected only direct group", groups)
+	}
+	groups, err := backend.UserGroupsTransitive("joe")
+	if err != nil || len(groups) != 2 || groups[0].Name != "engineering" || groups[1].Name != "backend" {
+		t.Fatal("expected direct and containing group", groups, err)
+	}
+
+	users, _, _ := backend.GroupUsersPage("engineering", ListOptions{})
+	if len(users) != 1 || users[0].Name != "bob" {
+		t.Fatal("expected only direct members", users)
+	}
+	users, _, err = backend.GroupUsersPage("engineering", ListOptions{Transitive: true, Sort: "name"})
+	if err != nil || len(users) != 3 || users[0].Name != "alice" || users[2].Name != "joe" {
+		t.Fatal("expected members of nested groups", users, err)
+	}
+	users, cursor, _ := backend.GroupUsersPage("engineering", ListOptions{Transitive: true, Limit: 2})
+	if len(users) != 2 || cursor == "" {
+		t.Fatal("expected paged members of nested groups", users, cursor)
+	}
+
+	backend.RemoveGroupFromGroup("frontend", "engineering")
+	users, _, _ = backend.GroupUsersPage("engineering", ListOptions{Transitive: true})
+	if len(users) != 2 {
+		t.Fatal("expected removed group to be gone", users)
+	}
+
+	// deleting a group removes the nesting
+	backend.DeleteGroup("backend")
+	users, _, _ = backend.GroupUsersPage("engineering", ListOptions{Transitive: true})
+	if len(users) != 1 {
+		t.Fatal("expected deleted group to be gone", users)
+	}
+
+	// cycles through deleted groups are rejected as they can be restored
+	backend.CreateGroup("a")
+	backend.CreateGroup("b")
+	backend.CreateGroup("c")
+	backend.AddGroupToGroup("a", "b")
+	backend.AddGroupToGroup("b", "c")
+	backend.DeleteGroup("b")
+	if err := backend.AddGroupToGroup("c", "a"); err == nil || err.Code != "ELOOP" {
+		t.Fatal("should reject cycle through deleted group", err)
+	}
+}
+
+func TestRolesAndPermissions(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	backend.CreateUser("joe", "secret")
+	backend.CreateUser("alice", "secret")
+	backend.CreateGroup("engineering")
+	backend.CreateGroup("backend")
+	backend.AddGroupToGroup("backend", "engineering")
+	backend.AddUserToGroup("alice", "backend")
+
+	rid, err := backend.CreateRole("billing")
+	if err != nil || rid < 1 {
+		t.Fatal("should create role", rid, err)
+	}
+	if _, err = backend.CreateRole("billing"); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should reject duplicate role", err)
+	}
+	backend.CreateRole("deploy")
+	pid, err := backend.CreatePermission("invoices.read")
+	if err != nil || pid < 1 {
+		t.Fatal("should create permission", pid, err)
+	}
+	if _, err = backend.CreatePermission("invoices.read"); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should reject duplicate permission", err)
+	}
+	backend.CreatePermission("invoices.write")
+	backend.CreatePermission("servers.deploy")
+
+	if err = backend.GrantPermission(strconv.FormatInt(rid, 10), "invoices.read"); err != nil {
+		t.Fatal("should grant permission", err)
+	}
+	backend.GrantPermission("billing", "invoices.write")
+	backend.GrantPermission("deploy", "servers.deploy")
+	if err = backend.GrantPermission("unknown", "invoices.read"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown role", err)
+	}
+	permissions, _ := backend.RolePermissions("billing")
+	if len(permissions) != 2 {
+		t.Fatal("expected permissions of role", permissions)
+	}
+
+	if err = backend.AssignRoleToUser("billing", "joe"); err != nil {
+		t.Fatal("should assign role to user", err)
+	}
+	if err = backend.AssignRoleToGroup("deploy", "engineering"); err != nil {
+		t.Fatal("should assign role to group", err)
+	}
+
+	check, err := backend.CheckPermission("joe", "invoices.read")
+	if err != nil || check != (PermissionCheck{Allowed: true, Role: "billing"}) {
+		t.Fatal("expected permission of user role", check, err)
+	}
+	check, _ = backend.CheckPermission("joe", "servers.deploy")
+	if check.Allowed {
+		t.Fatal("expected missing permission", check)
+	}
+	check, _ = backend.CheckPermission("alice", "servers.deploy")
+	if check != (PermissionCheck{Allowed: true, Role: "deploy", Group: "engineering"}) {
+		t.Fatal("expected permission of nested group role", check)
+	}
+	if _, err = backend.CheckPermission("unknown", "servers.deploy"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown user", err)
+	}
+
+	backend.AssignRoleToUser("billing", "alice")
+	names, err := backend.UserPermissions("alice")
+	if err != nil || !reflect.DeepEqual(names, []string{"invoices.read", "invoices.write", "servers.deploy"}) {
+		t.Fatal("expected effective permissions", names, err)
+	}
+
+	backend.RevokePermission("billing", "invoices.write")
+	backend.UnassignRoleFromGroup("deploy", "engineering")
+	names, _ = backend.UserPermissions("alice")
+	if !reflect.DeepEqual(names, []string{"invoices.read"}) {
+		t.Fatal("expected remaining permissions", names)
+	}
+
+	backend.DeletePermission("invoices.read")
+	backend.DeleteRole("deploy")
+	roles, _ := backend.Roles()
+	permissionList, _ := backend.Permissions()
+	if len(roles) != 1 || len(permissionList) != 2 {
+		t.Fatal("expected deleted role and permission to be gone", roles, permissionList)
+	}
+	names, _ = backend.UserPermissions("alice")
+	if len(names) != 0 {
+		t.Fatal("expected no permissions", names)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	tid, err := backend.CreateTenant("acme")
+	if err != nil || tid < 1 {
+		t.Fatal("should create tenant", tid, err)
+	}
+	if _, err = backend.CreateTenant("acme"); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should reject duplicate tenant", err)
+	}
+	if _, err = backend.CreateTenant(DEFAULT_TENANT); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should reject default tenant", err)
+	}
+	tenants, err := backend.Tenants()
+	if err != nil || fmt.Sprint(tenants) != fmt.Sprintf("[acme:%d]", tid) {
+		t.Fatal("should list tenants", tenants, err)
+	}
+	if _, err = backend.Tenant("unknown"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should reject unknown tenant", err)
+	}
+
+	acme, err := backend.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acme.Close()
+	backend.CreateUser("joe", "secret")
+	if _, err = acme.CreateUser("joe", "other"); err != nil {
+		t.Fatal("should create the same user in another tenant", err)
+	}
+	if _, err = acme.CreateUser("joe", "other"); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should reject duplicate user in tenant", err)
+	}
+	acme.CreateUser("alice", "secret")
+	acme.CreateGroup("admins")
+	acme.AddUserToGroup("alice", "admins")
+	if _, err = acme.LoginUser("joe", "secret"); err == nil {
+		t.Fatal("should not login with the password of the other tenant")
+	}
+	if _, err = acme.LoginUser("joe", "other"); err != nil {
+		t.Fatal("should login in tenant", err)
+	}
+	if _, err = backend.LoginUser("alice", "secret"); err == nil {
+		t.Fatal("should not login user of other tenant")
+	}
+	users, _ := backend.Users()
+	if len(users) != 1 || users[0].Name != "joe" {
+		t.Fatal("should only list users of default tenant", users)
+	}
+	if groups, _ := backend.Groups(); len(groups) != 0 {
+		t.Fatal("should only list groups of default tenant", groups)
+	}
+	if stats, _ := backend.Stats(); stats["Users"] != 1 || stats["Groups"] != 0 {
+		t.Fatal("should only count users and groups of default tenant", stats)
+	}
+	if stats, _ := acme.Stats(); stats["Users"] != 2 || stats["Groups"] != 1 {
+		t.Fatal("should only count users and groups of tenant", stats)
+	}
+	if _, err = backend.GroupUsers("admins"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should not find group of other tenant", err)
+	}
+
+	// the default tenant can be selected explicitly
+	def, err := backend.Tenant(DEFAULT_TENANT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = def.LoginUser("joe", "secret"); err != nil {
+		t.Fatal("should login in default tenant", err)
+	}
+	def.Close()
+
+	if err = backend.DeleteTenant("acme"); err != nil {
+		t.Fatal("should delete tenant", err)
+	}
+	if err = backend.DeleteTenant("acme"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail to delete unknown tenant", err)
+	}
+	if users, _ = acme.Users(); len(users) != 0 {
+		t.Fatal("should delete users of tenant", users)
+	}
+	if _, err = backend.LoginUser("joe", "secret"); err != nil {
+		t.Fatal("should keep users of default tenant", err)
+	}
+}
+
+func TestExpiryAndSchedules(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	backend.SetClock(func() time.Time { return now })
+
+	uid, _ := backend.CreateUser("joe", "secret")
+	aliceUid, _ := backend.CreateUser("alice", "secret")
+	if err := backend.ExpireUser("joe", now.Add(time.Hour)); err != nil {
+		t.Fatal("should set expiry", err)
+	}
+	if err := backend.ExpireUser("unknown", now); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown user", err)
+	}
+	if login, err := backend.LoginUser("joe", "secret"); err != nil || login != uid {
+		t.Fatal("should login before expiry", login, err)
+	}
+	users, _, _ := backend.UsersPage(ListOptions{Sort: "name"})
+	if users[0].Expires != nil || !users[1].Expires.Equal(now.Add(time.Hour)) {
+		t.Fatal("should list expiry", users)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := backend.LoginUser("joe", "secret"); err == nil || err.Code != "EEXPIRED" {
+		t.Fatal("should fail after expiry", err)
+	}
+	backend.ExpireUser("joe", time.Time{})
+	if _, err := backend.LoginUser("joe", "secret"); err != nil {
+		t.Fatal("should login without expiry", err)
+	}
+	backend.SaveLastLogin("joe")
+	if value, _ := backend.GetUserData("joe", "currentlogin"); value != strconv.FormatInt(now.Unix(), 10) {
+		t.Fatal("should save the login time of the clock", value)
+	}
+
+	if err := backend.ScheduleUserState("joe", time.Time{}, false); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should reject missing time", err)
+	}
+	backend.ScheduleUserState("joe", now.Add(time.Minute), false)
+	backend.ScheduleUserState("alice", now.Add(2*time.Minute), false)
+	backend.ScheduleUserState("joe", now.Add(3*time.Minute), true)
+	if changes, err := backend.ApplySchedules(); err != nil || len(changes) != 0 {
+		t.Fatal("should not apply changes that aren't due", changes, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	changes, err := backend.ApplySchedules()
+	if err != nil || len(changes) != 2 || changes[0].String() != "disable joe:1 at 2026-01-01T13:01:00Z" ||
+		changes[1].Name != "alice" || changes[1].Active {
+		t.Fatal("should apply due changes", changes, err)
+	}
+	if _, err = backend.LoginUser("joe", "secret"); err == nil {
+		t.Fatal("should disable user")
+	}
+	if changes, err = backend.ApplySchedules(); err != nil || len(changes) != 0 {
+		t.Fatal("should apply changes once", changes, err)
+	}
+
+	now = now.Add(time.Hour)
+	if changes, err = backend.ApplySchedules(); err != nil || len(changes) != 1 || !changes[0].Active {
+		t.Fatal("should enable user", changes, err)
+	}
+	if _, err = backend.LoginUser("joe", "secret"); err != nil {
+		t.Fatal("should login enabled user", err)
+	}
+
+	// changes of users in the trash are applied after the restore
+	backend.ScheduleUserState("alice", now.Add(time.Minute), true)
+	backend.DeleteUser("alice")
+	now = now.Add(time.Hour)
+	if changes, err = backend.ApplySchedules(); err != nil || len(changes) != 0 {
+		t.Fatal("should not apply changes of trashed users", changes, err)
+	}
+	if err = backend.RestoreUser(strconv.FormatInt(aliceUid, 10)); err != nil {
+		t.Fatal("should restore user", err)
+	}
+	if changes, err = backend.ApplySchedules(); err != nil || len(changes) != 1 || changes[0].Name != "alice" {
+		t.Fatal("should keep changes of trashed users", changes, err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	backend.SetClock(func() time.Time { return now })
+
+	uid, _ := backend.CreateUser("joe", "secret")
+	gid, _ := backend.CreateGroup("admins")
+	backend.AddUserToGroup("joe", "admins")
+	backend.SetUserData("joe", "email", "joe@example.com")
+	if err := backend.DeleteUser("joe"); err != nil {
+		t.Fatal("should delete user", err)
+	}
+	if err := backend.DeleteUser("joe"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should not delete trashed user twice", err)
+	}
+	if _, err := backend.LoginUser("joe", "secret"); err == nil {
+		t.Fatal("should not login trashed user")
+	}
+	if users, _ := backend.Users(); len(users) != 0 {
+		t.Fatal("should hide trashed user", users)
+	}
+	if users, _, _ := backend.UsersPage(ListOptions{Deleted: true}); len(users) != 1 || users[0].Uid != uid {
+		t.Fatal("should list trashed user", users)
+	}
+	if _, _, err := backend.GroupUsersPage("admins", ListOptions{Deleted: true}); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should reject deleted group users", err)
+	}
+
+	newUid, err := backend.CreateUser("joe", "other")
+	if err != nil {
+		t.Fatal("should reuse name of trashed user", err)
+	}
+	if err = backend.RestoreUser(fmt.Sprint(uid)); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should not restore user with taken name", err)
+	}
+	if err = backend.RestoreUser("joe"); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should only restore by uid", err)
+	}
+	backend.DeleteUser(fmt.Sprint(newUid))
+	if err = backend.RestoreUser(fmt.Sprint(uid)); err != nil {
+		t.Fatal("should restore user", err)
+	}
+	if err = backend.RestoreUser(fmt.Sprint(uid)); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should not restore live user", err)
+	}
+	if login, lerr := backend.LoginUser("joe", "secret"); lerr != nil || login != uid {
+		t.Fatal("should login restored user", login, lerr)
+	}
+	if value, gerr := backend.GetUserData("joe", "email"); gerr != nil || value != "joe@example.com" {
+		t.Fatal("should keep data of restored user", value, gerr)
+	}
+
+	backend.DeleteGroup("admins")
+	if groups, _ := backend.UserGroups("joe"); len(groups) != 0 {
+		t.Fatal("should hide trashed group", groups)
+	}
+	if groups, _, _ := backend.GroupsPage(ListOptions{Deleted: true}); len(groups) != 1 || groups[0].Gid != gid {
+		t.Fatal("should list trashed group", groups)
+	}
+	if err = backend.RestoreGroup(fmt.Sprint(gid)); err != nil {
+		t.Fatal("should restore group", err)
+	}
+	if groups, _ := backend.UserGroups("joe"); len(groups) != 1 {
+		t.Fatal("should keep members of restored group", groups)
+	}
+
+	backend.DeleteGroup("admins")
+	now = now.Add(time.Hour)
+	if count, perr := backend.Purge(2 * time.Hour); perr != nil || count != 0 {
+		t.Fatal("should not purge recently deleted entries", count, perr)
+	}
+	if count, perr := backend.Purge(time.Hour); perr != nil || count != 2 {
+		t.Fatal("should purge user and group", count, perr)
+	}
+	if err = backend.RestoreGroup(fmt.Sprint(gid)); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should not restore purged group", err)
+	}
+	backend.db.Close()
+	if err = backend.RestoreGroup(fmt.Sprint(gid)); err == nil || err.Code != "EFAULT" {
+		t.Fatal("should only report conflicts as EEXIST", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	backend.SetClock(func() time.Time { return now })
+
+	backend.CreateUser("joe", "secret")
+	revision, err := backend.UserRevision("joe")
+	if err != nil || revision.Version != 1 || !revision.Created.Equal(now) || !revision.Updated.Equal(now) {
+		t.Fatal("should create user with first version", revision, err)
+	}
+	now = now.Add(time.Hour)
+	backend.SetUserData("joe", "email", "joe@example.com")
+	backend.LoginUser("joe", "secret")
+	backend.LoginUser("joe", "wrong")
+	revision, _ = backend.UserRevision("joe")
+	if revision.Version != 2 || !revision.Updated.Equal(now) || revision.Created.Equal(now) {
+		t.Fatal("should count changes but not logins", revision)
+	}
+	backend.SetManyUserData("joe", map[string]string{"a": "1", "b": "2"})
+	if revision, _ = backend.UserRevision("joe"); revision.Version != 3 {
+		t.Fatal("should count setmany as one change", revision)
+	}
+
+	if _, err = backend.IfVersion(3); err == nil || err.Code != "EINVAL" {
+		t.Fatal("should only guard transactions", err)
+	}
+	tx, _ := backend.Begin()
+	guarded, _ := tx.(Versioned).IfVersion(3)
+	if err = guarded.SetUserData("joe", "email", "new@example.com"); err != nil {
+		t.Fatal("should change current version", err)
+	}
+	tx.Commit()
+	tx, _ = backend.Begin()
+	guarded, _ = tx.(Versioned).IfVersion(3)
+	if err = guarded.SetUserData("joe", "email", "old@example.com"); err == nil || err.Code != "ESTALE" {
+		t.Fatal("should fail for old version", err)
+	}
+	tx.Rollback()
+	if value, _ := backend.GetUserData("joe", "email"); value != "new@example.com" {
+		t.Fatal("should keep newer value", value)
+	}
+	if revision, _ = backend.UserRevision("joe"); revision.Version != 4 {
+		t.Fatal("should not count stale change", revision)
+	}
+
+	gid, _ := backend.CreateGroup("admins")
+	backend.SetGroupData("admins", "color", "red")
+	backend.AddUserToGroup("joe", "admins")
+	if revision, _ = backend.GroupRevision(fmt.Sprint(gid)); revision.Version != 2 {
+		t.Fatal("should count group changes", revision)
+	}
+	if revision, _ = backend.UserRevision("joe"); revision.Version != 5 {
+		t.Fatal("should count membership as user change", revision)
+	}
+
+	// the values have their own revisions
+	created := now
+	now = now.Add(time.Hour)
+	backend.SetUserData("joe", "a", "3")
+	revision, err = backend.UserDataRevision("joe", "a")
+	if err != nil || revision.Version != 2 || !revision.Created.Equal(created) || !revision.Updated.Equal(now) {
+		t.Fatal("should count changes of the value", revision, err)
+	}
+	if info, _ := backend.UserInfo("joe"); info.DataRevisions["a"] != revision {
+		t.Fatal("should return data revisions in user info", info.DataRevisions)
+	}
+	if revision, _ = backend.UserDataRevision("joe", "b"); revision.Version != 1 || !revision.Updated.Equal(created) {
+		t.Fatal("should keep revision of other value", revision)
+	}
+	if _, err = backend.UserDataRevision("joe", "unknown"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail for unknown key", err)
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	backend.SetClock(func() time.Time { return now })
+
+	uid, _ := backend.CreateUser("joe", "secret")
+	gid, _ := backend.CreateGroup("admins")
+	backend.AddUserToGroup("joe", "admins")
+	backend.SetUserData("joe", "email", "joe@example.com")
+	backend.LoginUser("joe", "secret")
+	now = now.Add(time.Hour)
+	backend.LoginUser("joe", "secret")
+	backend.LoginUser("joe", "wrong")
+
+	info, err := backend.UserInfo(strconv.FormatInt(uid, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Uid != uid || info.Name != "joe" || !info.Active || info.Expires != nil {
+		t.Fatal("should return user", info)
+	}
+	if info.Version != 3 || !info.Created.Equal(now.Add(-time.Hour)) {
+		t.Fatal("should return revision", info)
+	}
+	if info.LatestLogin == nil || info.PreviousLogin == nil || info.FailCount != 1 {
+		t.Fatal("should return login bookkeeping", info)
+	}
+	if len(info.Groups) != 1 || info.Groups[0].Gid != gid || info.Groups[0].Name != "admins" {
+		t.Fatal("should return groups", info.Groups)
+	}
+	if info.Data["email"] != "joe@example.com" {
+		t.Fatal("should return data", info.Data)
+	}
+	if _, err = backend.UserInfo("jane"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	backend, dberr := NewSqliteBackend(":memory:")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	backend.SetClock(func() time.Time { return now })
+	start := now
+
+	backend.CreateUser("joe", "secret")
+	backend.SetUserData("joe", "email", "joe@example.com")
+	if _, err := backend.UserDataHistory("joe", "email"); err == nil || err.Code != "ENOTSUP" {
+		t.Fatal("expected ENOTSUP got", err)
+	}
+	backend.EnableHistory()
+
+	now = now.Add(time.Hour)
+	client := backend.Identify("127.0.0.1:4242")
+	defer client.Close()
+	if err := client.SetUserData("joe", "email", "joe@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	client.UnsetUserData("joe", "email")
+	now = now.Add(time.Hour)
+	backend.SetManyUserData("joe", map[string]string{"email": "joe@example.net"})
+	backend.LoginUser("joe", "secret")
+
+	changes, err := backend.UserDataHistory("joe", "email")
+	if err != nil || len(changes) != 4 {
+		t.Fatal("should list the changes", changes, err)
+	}
+	if changes[0].Value != "joe@example.com" || !changes[0].Changed.IsZero() {
+		t.Fatal("should keep the value from before the history", changes[0])
+	}
+	if changes[1].Value != "joe@example.org" || changes[1].Client != "127.0.0.1:4242" ||
+		!changes[1].Changed.Equal(start.Add(time.Hour)) {
+		t.Fatal("should record the change with the client", changes[1])
+	}
+	if !changes[2].Unset || changes[3].Value != "joe@example.net" || changes[3].Client != "" {
+		t.Fatal("should record unset and setmany", changes[2], changes[3])
+	}
+	if _, err = backend.UserDataHistory("joe", "lastlogin"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should not record logins", err)
+	}
+
+	for at, expected := range map[time.Duration]string{
+		0:                              "joe@example.com",
+		time.Hour + 30*time.Minute:     "joe@example.org",
+		3 * time.Hour:                  "joe@example.net",
+		3*time.Hour + 24*365*time.Hour: "joe@example.net",
+	} {
+		if value, err := backend.GetUserDataAt("joe", "email", start.Add(at)); err != nil || value != expected {
+			t.Fatal("unexpected value at", at, value, err)
+		}
+	}
+	if _, err = backend.GetUserDataAt("joe", "email", start.Add(2*time.Hour)); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT for unset value got", err)
+	}
+
+	// prune the values replaced more than a day ago, the values of later
+	// times have to be kept
+	now = now.Add(48 * time.Hour)
+	backend.SetUserData("joe", "phone", "123")
+	if pruned, err := backend.PruneHistory(map[string]time.Duration{"phone": 0, "*": 24 * time.Hour}); err != nil || pruned != 3 {
+		t.Fatal("should prune replaced values", pruned, err)
+	}
+	if value, err := backend.GetUserDataAt("joe", "email", now.Add(-24*time.Hour)); err != nil || value != "joe@example.net" {
+		t.Fatal("should keep the current value", value, err)
+	}
+	if changes, _ = backend.UserDataHistory("joe", "phone"); len(changes) != 1 {
+		t.Fatal("should keep keys with own retention", changes)
+	}
+}
+
+func TestFileTransactionDoesntBlock(t *testing.T) {
+	dir, ioerr := ioutil.TempDir("", "ustackd")
+	if ioerr != nil {
+		t.Fatal(ioerr)
+	}
+	defer os.RemoveAll(dir)
+	backend, dberr := NewSqliteBackend(filepath.Join(dir, "ustackd.db"))
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	tx, _ := backend.Begin()
+	defer tx.Rollback()
+	tx.CreateUser("joe", "secret")
+	done := make(chan []User)
+	go func() {
+		users, _ := backend.Users()
+		done <- users
+	}()
+	select {
+	case users := <-done:
+		if len(users) != 0 {
+			t.Fatal("should not see the uncommitted user", users)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading should not be blocked by the transaction")
+	}
+}
+
+// createBaselineDatabase creates a database with the schema from before the
+// tenants and the trash existed, roles already existed
+func createBaselineDatabase(t *testing.T, path string) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		`CREATE TABLE Users (
+			uid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			password TEXT NOT NULL,
+			state INTEGER DEFAULT 1,
+			CONSTRAINT UniqueUserNames UNIQUE (name) ON CONFLICT ROLLBACK
+		);`,
+		`CREATE TABLE Groups (
+			gid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			CONSTRAINT UniqueGroupNames UNIQUE (name) ON CONFLICT ROLLBACK
+		);`,
+		`CREATE TABLE UserGroups (
+			uid INTEGER NOT NULL REFERENCES Users(uid) ON DELETE CASCADE,
+			gid INTEGER NOT NULL REFERENCES Groups(gid) ON DELETE CASCADE,
+			CONSTRAINT UniqueUidGidPairs UNIQUE (uid, gid) ON CONFLICT IGNORE
+		);`,
+		`CREATE TABLE UserValues (
+			uid INTEGER REFERENCES Users(uid) ON DELETE CASCADE,
+			key TEXT NOT NULL,
+			value BLOB NOT NULL,
+			CONSTRAINT UniqueUidKeyPairs UNIQUE (uid, key) ON CONFLICT REPLACE
+		);`,
+		`CREATE TABLE Roles (
+			rid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			CONSTRAINT UniqueRoleNames UNIQUE (name) ON CONFLICT ROLLBACK
+		);`,
+		`CREATE TABLE Permissions (
+			pid INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			CONSTRAINT UniquePermissionNames UNIQUE (name) ON CONFLICT ROLLBACK
+		);`,
+		`CREATE TABLE RolePermissions (
+			rid INTEGER NOT NULL REFERENCES Roles(rid) ON DELETE CASCADE,
+			pid INTEGER NOT NULL REFERENCES Permissions(pid) ON DELETE CASCADE,
+			CONSTRAINT UniqueRidPidPairs UNIQUE (rid, pid) ON CONFLICT IGNORE
+		);`,
+		"INSERT INTO Roles (name) VALUES ('admin');",
+		"INSERT INTO Permissions (name) VALUES ('write');",
+		"INSERT INTO RolePermissions (rid, pid) VALUES (1, 1);",
+		"INSERT INTO Users (name, password) VALUES ('joe', 'secret'), ('bob', 'secret'), ('gone', 'x');",
+		"DELETE FROM Users WHERE name = 'gone';",
+		"INSERT INTO Groups (name) VALUES ('admins');",
+		"INSERT INTO UserGroups (uid, gid) VALUES (1, 1);",
+		"INSERT INTO UserValues (uid, key, value) VALUES (1, 'email', 'joe@example.com');",
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateNameConstraints(t *testing.T) {
+	dir, ioerr := ioutil.TempDir("", "ustackd")
+	if ioerr != nil {
+		t.Fatal(ioerr)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ustackd.db")
+	createBaselineDatabase(t, path)
+	backend, dberr := NewSqliteBackend(path)
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+
+	if err := backend.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	uid, err := backend.CreateUser("bob", "secret")
+	if err != nil {
+		t.Fatal("should reuse the name of a deleted user", err)
+	}
+	if uid != 4 {
+		t.Fatal("should not reuse the uid of a removed user", uid)
+	}
+	if value, _ := backend.GetUserData("joe", "email"); value != "joe@example.com" {
+		t.Fatal("should keep the user data", value)
+	}
+	if users, _ := backend.GroupUsers("admins"); len(users) != 1 || users[0].Name != "joe" {
+		t.Fatal("should keep the memberships", users)
+	}
+	if err = backend.DeleteGroup("admins"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = backend.CreateGroup("admins"); err != nil {
+		t.Fatal("should reuse the name of a deleted group", err)
+	}
+	if _, err = backend.Purge(0); err != nil {
+		t.Fatal("should purge with intact foreign keys", err)
+	}
+
+	// the names are unique per tenant
+	backend.CreateTenant("acme")
+	acme, err := backend.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acme.Close()
+	if _, err = acme.CreateUser("joe", "secret"); err != nil {
+		t.Fatal("should create the user name of another tenant", err)
+	}
+	if _, err = acme.CreateGroup("admins"); err != nil {
+		t.Fatal("should create the group name of another tenant", err)
+	}
+	if _, err = acme.CreateRole("admin"); err != nil {
+		t.Fatal("should create the role name of another tenant", err)
+	}
+	if _, err = acme.CreatePermission("write"); err != nil {
+		t.Fatal("should create the permission name of another tenant", err)
+	}
+	if permissions, _ := backend.RolePermissions("admin"); len(permissions) != 1 {
+		t.Fatal("should keep the permissions of the roles", permissions)
+	}
+}
+
+func TestStatementsAfterErrors(t *testing.T) {
+	dir, ioerr := ioutil.TempDir("", "ustackd")
+	if ioerr != nil {
+		t.Fatal(ioerr)
+	}
+	defer os.RemoveAll(dir)
+	backend, dberr := NewSqliteBackend(filepath.Join(dir, "ustackd.db"))
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	defer backend.Close()
+	if _, err := backend.CreateTenant("acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backend, tenants and clients share the statements on several
+	// connections, errors of one must not break the others
+	var wg sync.WaitGroup
+	errs := make(chan *Error, 400)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tenant, err := backend.Tenant("acme")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tenant.Close()
+			client := backend.Identify(fmt.Sprint("client", i))
+			defer client.Close()
+			for j, current := range []Abstract{&backend, tenant, client} {
+				for k := 0; k < 10; k++ {
+					name := fmt.Sprintf("user%d-%d-%d", i, j, k)
+					if _, err := current.CreateUser(name, "secret"); err != nil {
+						errs <- err
+					}
+					if _, err := current.CreateUser(name, "secret"); err == nil || err.Code != "EEXIST" {
+						errs <- &Error{"EFAULT", fmt.Sprint("expected EEXIST got ", err)}
+					}
+					if _, err := current.CreateGroup(name); err != nil {
+						errs <- err
+					}
+					if k == 0 {
+						continue
+					}
+					first := fmt.Sprintf("user%d-%d-0", i, j)
+					if err := current.RenameUser(name, first); err == nil || err.Code != "EEXIST" {
+						errs <- &Error{"EFAULT", fmt.Sprint("expected EEXIST got ", err)}
+					}
+					if err := current.RenameUser(name, name+"x"); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
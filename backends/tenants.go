@@ -0,0 +1,128 @@
+package backends
+
+import (
+	"database/sql"
+)
+
+// tables with entities that belong to a tenant, the values and associations
+// are removed with them
+var tenantTables = []string{"Users", "Groups", "Roles", "Permissions"}
+
+// addTenantColumns adds the tenant to the tables of databases created before
+// tenants existed, the errors for existing columns are ignored. The unique
+// constraints of the names are rebuilt afterwards, see nameConstraints.
+func (backend *SqlBackend) addTenantColumns() {
+	for _, table := range tenantTables {
+		backend.db.Exec("ALTER TABLE " + table + " ADD COLUMN tenant INTEGER NOT NULL DEFAULT 0;")
+	}
+}
+
+func checkTenantName(name string) *Error {
+	if name == "" {
+		return &Error{"EINVAL", "Invalid tenant name"}
+	}
+	if name == DEFAULT_TENANT {
+		return &Error{"EINVAL", "The default tenant can't be changed"}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) Tenant(name string) (Abstract, *Error) {
+	return backend.scope(name)
+}
+
+// scope returns a copy of the backend that runs all operations in the tenant
+func (backend *SqlBackend) scope(name string) (*SqlBackend, *Error) {
+	var tid int64
+	if name != DEFAULT_TENANT {
+		var err *Error
+		if tid, err = backend.getTidForName(name); err != nil {
+			return nil, err
+		}
+	}
+	scoped := *backend
+	scoped.tenant = tid
+	scoped.scoped = true
+	return &scoped, nil
+}
+
+func (backend *SqlBackend) CreateTenant(name string) (int64, *Error) {
+	if err := checkTenantName(name); err != nil {
+		return 0, err
+	}
+	result, err := backend.createTenantStmt.Exec(name)
+	if err != nil {
+		return 0, &Error{"EEXIST", err.Error()}
+	}
+	tid, err := result.LastInsertId()
+	if err != nil {
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return tid, nil
+}
+
+// DeleteTenant deletes the tenant with all its users, groups, roles and
+// permissions in a transaction
+func (backend *SqlBackend) DeleteTenant(name string) *Error {
+	if err := checkTenantName(name); err != nil {
+		return err
+	}
+	if backend.tx != nil { // already part of a transaction
+		return backend.deleteTenant(name)
+	}
+	tx, err := backend.begin()
+	if err != nil {
+		return err
+	}
+	if err = tx.deleteTenant(name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (backend *SqlBackend) deleteTenant(name string) *Error {
+	tid, err := backend.getTidForName(name)
+	if err != nil {
+		return err
+	}
+	for _, table := range tenantTables {
+		if _, derr := backend.exec("DELETE FROM "+table+" WHERE tenant = "+backend.placeholder(1), tid); derr != nil {
+			return &Error{"EFAULT", derr.Error()}
+		}
+	}
+	if _, derr := backend.exec("DELETE FROM Tenants WHERE tid = "+backend.placeholder(1), tid); derr != nil {
+		return &Error{"EFAULT", derr.Error()}
+	}
+	return nil
+}
+
+func (backend *SqlBackend) Tenants() ([]Tenant, *Error) {
+	rows, err := backend.tenantsStmt.Query()
+	if err != nil {
+		return nil, &Error{"EFAULT", err.Error()}
+	}
+	defer rows.Close()
+	var tenants []Tenant
+	for rows.Next() {
+		var tid int64
+		var name string
+		if serr := rows.Scan(&name, &tid); serr != nil {
+			return nil, &Error{"EFAULT", serr.Error()}
+		}
+		tenants = append(tenants, Tenant{tid, name})
+	}
+	return tenants, nil
+}
+
+func (backend *SqlBackend) getTidForName(name string) (int64, *Error) {
+	var tid int64
+	err := backend.tidForNameStmt.QueryRow(name).Scan(&tid)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, &Error{"ENOENT", "Tenant unknown"}
+	case err != nil:
+		return 0, &Error{"EFAULT", err.Error()}
+	}
+	return tid, nil
+}
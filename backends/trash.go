@@ -0,0 +1,102 @@
+package backends
+
+import (
+	"strconv"
+	"time"
+)
+
+// Deleted users and groups are moved into the trash, they are hidden from
+// logins, listings and lookups by name until they are restored or purged.
+// trashed is 0 for live rows and the uid/gid of the row itself in the trash,
+// this way the names are unique among the live rows only and a deleted name
+// can be reused. deleted is the unix timestamp of the deletion.
+
+// addTrashColumns adds the trash to the users and groups of databases created
+// before the trash existed, the errors for existing columns are ignored. The
+// unique constraints of the names are rebuilt afterwards, see
+// nameConstraints.
+func (backend *SqlBackend) addTrashColumns() {
+	for _, table := range []string{"Users", "Groups"} {
+		backend.db.Exec("ALTER TABLE " + table + " ADD COLUMN deleted BIGINT;")
+		backend.db.Exec("ALTER TABLE " + table + " ADD COLUMN trashed INTEGER NOT NULL DEFAULT 0;")
+	}
+}
+
+// trashCondition selects either the live or the deleted rows
+func trashCondition(deleted bool) string {
+	if deleted {
+		return "trashed <> 0"
+	}
+	return "trashed = 0"
+}
+
+// RestoreUser moves the deleted user back out of the trash, a user with the
+// same name must not exist meanwhile
+func (backend *SqlBackend) RestoreUser(uid string) *Error {
+	return backend.restore("Users", "uid", uid)
+}
+
+// RestoreGroup moves the deleted group back out of the trash, a group with
+// the same name must not exist meanwhile
+func (backend *SqlBackend) RestoreGroup(gid string) *Error {
+	return backend.restore("Groups", "gid", gid)
+}
+
+func (backend *SqlBackend) restore(table string, column string, idstr string) *Error {
+	id, perr := strconv.ParseInt(idstr, 10, 64)
+	if perr != nil {
+		return &Error{"EINVAL", "Deleted entries can only be restored by " + column}
+	}
+	result, err := backend.exec("UPDATE "+table+" SET trashed = 0, deleted = NULL, "+
+		"version = version + 1, updated_at = "+backend.placeholder(1)+" WHERE "+
+		column+" = "+backend.placeholder(2)+" AND tenant = "+backend.placeholder(3)+
+		" AND trashed <> 0", backend.now().Unix(), id, backend.tenant)
+	if err != nil {
+		return conflictError(err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	if count < 1 {
+		return &Error{"ENOENT", "Deleted " + column + " unknown"}
+	}
+	return nil
+}
+
+// Purge removes the users and groups of the tenant that were deleted at
+// least olderThan ago, their values and memberships are removed with them.
+// It returns the number of purged users and groups.
+func (backend *SqlBackend) Purge(olderThan time.Duration) (int64, *Error) {
+	return backend.purge(olderThan, true)
+}
+
+// PurgeAll purges the trash of all tenants like Purge
+func (backend *SqlBackend) PurgeAll(olderThan time.Duration) (int64, *Error) {
+	return backend.purge(olderThan, false)
+}
+
+func (backend *SqlBackend) purge(olderThan time.Duration, scoped bool) (int64, *Error) {
+	if olderThan < 0 {
+		return 0, &Error{"EINVAL", "Invalid age"}
+	}
+	args := []interface{}{backend.now().Add(-olderThan).Unix()}
+	condition := " WHERE trashed <> 0 AND deleted <= " + backend.placeholder(1)
+	if scoped {
+		args = append(args, backend.tenant)
+		condition += " AND tenant = " + backend.placeholder(2)
+	}
+	var purged int64
+	for _, table := range []string{"Users", "Groups"} {
+		result, err := backend.exec("DELETE FROM "+table+condition, args...)
+		if err != nil {
+			return 0, &Error{"EFAULT", err.Error()}
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return 0, &Error{"EFAULT", err.Error()}
+		}
+		purged += count
+	}
+	return purged, nil
+}
@@ -0,0 +1,149 @@
+package backends
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Users, groups and the values of the user data record when they were created
+// and last changed. The version starts at 1 and is increased by every change
+// of the user (including its data and memberships), the group or the value.
+// The bookkeeping of logins doesn't change the version of the user. The times
+// are stored as unix timestamps.
+
+// addVersionColumns adds the timestamps and versions to the users, groups and
+// user data of databases created before they existed, the errors for existing
+// columns are ignored. The timestamps of existing rows stay empty.
+func (backend *SqlBackend) addVersionColumns() {
+	for _, table := range []string{"Users", "Groups", "UserValues"} {
+		backend.db.Exec("ALTER TABLE " + table + " ADD COLUMN created_at BIGINT;")
+		backend.db.Exec("ALTER TABLE " + table + " ADD COLUMN updated_at BIGINT;")
+		backend.db.Exec("ALTER TABLE " + table + " ADD COLUMN version INTEGER NOT NULL DEFAULT 1;")
+	}
+}
+
+func (backend *SqlBackend) IfVersion(version int64) (Abstract, *Error) {
+	guarded, err := backend.guard(version)
+	if err != nil {
+		return nil, err
+	}
+	return guarded, nil
+}
+
+// guard returns a copy of the transaction whose changes of users and groups
+// fail with ESTALE if the user or group doesn't have the version anymore.
+// The version is checked after the change, the transaction has to be rolled
+// back on errors.
+func (backend *SqlBackend) guard(version int64) (*SqlBackend, *Error) {
+	if backend.tx == nil {
+		return nil, &Error{"EINVAL", "Versions can only be checked within transactions"}
+	}
+	if version < 1 {
+		return nil, &Error{"EINVAL", "Invalid version"}
+	}
+	guarded := *backend
+	guarded.ifVersion = version
+	return &guarded, nil
+}
+
+func (backend *SqlBackend) UserRevision(nameuid string) (Revision, *Error) {
+	if nameuid == "" {
+		return Revision{}, &Error{"EINVAL", "Name or uid has to be passed"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return Revision{}, err
+	}
+	return backend.revision("Users", "uid", uid)
+}
+
+func (backend *SqlBackend) GroupRevision(groupgid string) (Revision, *Error) {
+	if groupgid == "" {
+		return Revision{}, &Error{"EINVAL", "Name or gid has to be passed"}
+	}
+	gid, err := backend.getGidForNameGid(groupgid)
+	if err != nil {
+		return Revision{}, err
+	}
+	return backend.revision("Groups", "gid", gid)
+}
+
+// UserDataRevision returns when the value of the key was created and last
+// changed, the version is increased by every set of the key
+func (backend *SqlBackend) UserDataRevision(nameuid string, key string) (Revision, *Error) {
+	if nameuid == "" || key == "" {
+		return Revision{}, &Error{"EINVAL", "Name/uid and key can't be blank"}
+	}
+	uid, err := backend.getUidForNameUid(nameuid)
+	if err != nil {
+		return Revision{}, err
+	}
+	var revision Revision
+	var created, updated sql.NullInt64
+	serr := backend.queryRow("SELECT v.version, v.created_at, v.updated_at FROM UserValues v WHERE v.uid = "+
+		backend.placeholder(1)+" AND v.key = "+backend.placeholder(2), uid, key).Scan(
+		&revision.Version, &created, &updated)
+	switch {
+	case serr == sql.ErrNoRows:
+		return revision, &Error{"ENOENT", "Key unknown"}
+	case serr != nil:
+		return revision, &Error{"EFAULT", serr.Error()}
+	}
+	revision.Created, revision.Updated = revisionTime(created), revisionTime(updated)
+	return revision, nil
+}
+
+func (backend *SqlBackend) revision(table string, column string, id int64) (Revision, *Error) {
+	var revision Revision
+	var created, updated sql.NullInt64
+	err := backend.queryRow("SELECT version, created_at, updated_at FROM "+table+
+		" WHERE "+column+" = "+backend.placeholder(1), id).Scan(&revision.Version, &created, &updated)
+	if err != nil {
+		return revision, &Error{"EFAULT", err.Error()}
+	}
+	revision.Created, revision.Updated = revisionTime(created), revisionTime(updated)
+	return revision, nil
+}
+
+// revisionTime returns the time of a timestamp column, the zero time if it
+// is empty
+func revisionTime(at sql.NullInt64) time.Time {
+	if !at.Valid {
+		return time.Time{}
+	}
+	return time.Unix(at.Int64, 0).UTC()
+}
+
+// touchUser increases the version of the changed user and sets the time of
+// the change. It fails with ESTALE if the backend is guarded by a version and
+// the user was changed meanwhile.
+func (backend *SqlBackend) touchUser(uid int64) *Error {
+	return backend.touch("Users", "uid", uid)
+}
+
+// touchGroup increases the version of the changed group like touchUser
+func (backend *SqlBackend) touchGroup(gid int64) *Error {
+	return backend.touch("Groups", "gid", gid)
+}
+
+func (backend *SqlBackend) touch(table string, column string, id int64) *Error {
+	query := "UPDATE " + table + " SET version = version + 1, updated_at = " +
+		backend.placeholder(1) + " WHERE " + column + " = " + backend.placeholder(2)
+	args := []interface{}{backend.now().Unix(), id}
+	if backend.ifVersion > 0 {
+		query += " AND version = " + backend.placeholder(3)
+		args = append(args, backend.ifVersion)
+	}
+	result, err := backend.exec(query, args...)
+	if err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return &Error{"EFAULT", err.Error()}
+	}
+	if count < 1 {
+		return &Error{"ESTALE", "Version changed meanwhile"}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// Capabilities describes the protocol version and features of a server
+type Capabilities struct {
+	Protocol int
+	Commands []string
+	Formats  []string
+	Features []string
+	Auth     []string
+	Tls      string
+	Backend  string
+	Limits   map[string]int
+}
+
+// commands of servers that don't support the capabilities command
+var LEGACY_COMMANDS = []string{
+	"client auth", "quit", "starttls",
+	"login", "set", "get", "getkeys",
+	"change password", "change name", "user groups", "user", "delete user",
+	"users", "add", "remove", "delete group", "groups", "group users", "group",
+	"stats", "loginstats",
+}
+
+var protocolRegexp = regexp.MustCompile(`\[PROTOCOL (\d+)\]`)
+
+// parseProtocol returns the protocol version announced in the realm, servers
+// that don't announce a version speak protocol 0
+func parseProtocol(realm string) int {
+	match := protocolRegexp.FindStringSubmatch(realm)
+	if match == nil {
+		return 0
+	}
+	version, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// parseCapabilities parses the lines of the capabilities command, unknown
+// capabilities are ignored
+func parseCapabilities(lines []string) (*Capabilities, *backends.Error) {
+	caps := &Capabilities{Limits: make(map[string]int)}
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, &backends.Error{Code: "EFAULT", Message: "Expected capability and value: " + line}
+		}
+		switch parts[0] {
+		case "protocol":
+			version, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, &backends.Error{Code: "EFAULT", Message: "Expected number: " + parts[1]}
+			}
+			caps.Protocol = version
+		case "command":
+			caps.Commands = append(caps.Commands, parts[1])
+		case "format":
+			caps.Formats = append(caps.Formats, parts[1])
+		case "feature":
+			caps.Features = append(caps.Features, parts[1])
+		case "auth":
+			caps.Auth = append(caps.Auth, parts[1])
+		case "tls":
+			caps.Tls = parts[1]
+		case "backend":
+			caps.Backend = parts[1]
+		case "limit":
+			limit := strings.SplitN(parts[1], " ", 2)
+			if len(limit) != 2 {
+				return nil, &backends.Error{Code: "EFAULT", Message: "Expected limit and value: " + line}
+			}
+			value, err := strconv.Atoi(limit[1])
+			if err != nil {
+				return nil, &backends.Error{Code: "EFAULT", Message: "Expected number: " + limit[1]}
+			}
+			caps.Limits[limit[0]] = value
+		}
+	}
+	return caps, nil
+}
+
+// legacyCapabilities returns the capabilities of servers that are older
+// than the capabilities command
+func legacyCapabilities() *Capabilities {
+	return &Capabilities{
+		Commands: LEGACY_COMMANDS,
+		Formats:  []string{"text"},
+		Limits:   make(map[string]int),
+	}
+}
+
+// HasCommand returns true if the server supports the command
+func (caps *Capabilities) HasCommand(command string) bool {
+	for _, cmd := range caps.Commands {
+		if cmd == command {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFormat returns true if the server supports the response format
+func (caps *Capabilities) HasFormat(format string) bool {
+	for _, f := range caps.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature returns true if the server supports the feature (e.g. tags)
+func (caps *Capabilities) HasFeature(feature string) bool {
+	for _, f := range caps.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Protocol returns the protocol version announced by the server in the realm
+func (client *Client) Protocol() int {
+	return client.protocol
+}
+
+// Capabilities returns the capabilities of the server. They are requested
+// once and cached until the connection changes (e.g. by starttls). Servers
+// that announce no protocol version get the legacy capabilities.
+func (client *Client) Capabilities() (*Capabilities, *backends.Error) {
+	if client.capabilities != nil {
+		return client.capabilities, nil
+	}
+	if client.protocol == 0 {
+		client.capabilities = legacyCapabilities()
+		return client.capabilities, nil
+	}
+	lines, err := client.listCmd("capabilities")
+	if err != nil {
+		return nil, err
+	}
+	caps, err := parseCapabilities(lines)
+	if err != nil {
+		return nil, err
+	}
+	client.capabilities = caps
+	return caps, nil
+}
+
+// Supports returns true if the server supports the command, if the
+// capabilities can't be determined false is returned
+func (client *Client) Supports(command string) bool {
+	caps, err := client.Capabilities()
+	return err == nil && caps.HasCommand(command)
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProtocol(t *testing.T) {
+	if version := parseProtocol("ustackd 0.0.1 [PROTOCOL 1]"); version != 1 {
+		t.Fatal("expected protocol 1 got", version)
+	}
+	if version := parseProtocol("ustackd 0.0.1"); version != 0 {
+		t.Fatal("expected protocol 0 got", version)
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := parseCapabilities([]string{
+		"protocol 1",
+		"command login",
+		"command client auth",
+		"auth secret",
+		"auth peer",
+		"tls starttls",
+		"backend sqlite",
+		"limit max-line-length 4096",
+		"future feature",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Capabilities{
+		Protocol: 1,
+		Commands: []string{"login", "client auth"},
+		Auth:     []string{"secret", "peer"},
+		Tls:      "starttls",
+		Backend:  "sqlite",
+		Limits:   map[string]int{"max-line-length": 4096},
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Fatalf("expected %v got %v", expected, caps)
+	}
+	if !caps.HasCommand("client auth") || caps.HasCommand("setb") {
+		t.Fatal("unexpected commands", caps.Commands)
+	}
+
+	if _, err = parseCapabilities([]string{"limit max-line-length"}); err == nil {
+		t.Fatal("expected error for limit without value")
+	}
+}
+
+func TestLegacyCapabilities(t *testing.T) {
+	caps := legacyCapabilities()
+	if !caps.HasCommand("login") || caps.HasCommand("capabilities") {
+		t.Fatal("unexpected legacy commands", caps.Commands)
+	}
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/UserStack/ustackd/backends"
 )
@@ -17,16 +19,28 @@ import (
 /* parts of the code are taken from smtp.go from the core library */
 
 type Client struct {
-	mutex   sync.Mutex
-	Text    *textproto.Conn
-	conn    net.Conn
-	tlsConn *tls.Conn
-	host    string
+	mutex        sync.Mutex
+	Text         *textproto.Conn
+	conn         net.Conn
+	tlsConn      *tls.Conn
+	host         string
+	protocol     int
+	capabilities *Capabilities
+	json         bool
+	pipeline     *pipeline
 }
 
 // Dial returns a new Client connected to an ustack server at addr.
-// The addr must include a port number.
+// The addr must include a port number or be a unix socket like
+// "unix:/path/to/sock".
 func Dial(addr string) (*Client, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		conn, err := net.Dial("unix", strings.TrimPrefix(addr, "unix:"))
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(conn, "localhost")
+	}
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -44,14 +58,34 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 		text.Close()
 		return nil, err
 	}
+	if strings.HasPrefix(line, "- ") {
+		text.Close()
+		return nil, parseError(line)
+	}
 	if !strings.Contains(line, "ustack") {
 		text.Close()
 		return nil, fmt.Errorf("Not a ustackd server")
 	}
-	return &Client{Text: text, conn: conn, host: host}, nil
+	client := &Client{Text: text, conn: conn, host: host,
+		protocol: parseProtocol(line)}
+	if client.protocol > 0 {
+		// use the json format if the server supports it
+		caps, err := client.Capabilities()
+		if err == nil && caps.HasFormat("json") {
+			err = client.SetFormat("json")
+		}
+		if err != nil {
+			text.Close()
+			return nil, err
+		}
+	}
+	return client, nil
 }
 
 func (client *Client) StartTls(config *tls.Config) error {
+	if client.pipeline != nil {
+		return fmt.Errorf("Can't start tls after pipelining was enabled")
+	}
 	_, err := client.Text.Cmd("starttls")
 	if err != nil {
 		return err
@@ -62,6 +96,7 @@ func (client *Client) StartTls(config *tls.Config) error {
 	}
 	client.conn = client.tlsConn
 	client.Text = textproto.NewConn(client.conn)
+	client.capabilities = nil
 	return nil
 }
 
@@ -102,16 +137,60 @@ func (client *Client) EnableUser(nameuid string) *backends.Error {
 	return client.simpleCmd("enable %s", nameuid)
 }
 
+// ExpireUser sets the time after which the user can't login, the zero time
+// removes the expiry
+func (client *Client) ExpireUser(nameuid string, at time.Time) *backends.Error {
+	return client.simpleCmd("expire at %s %s", nameuid, formatTime(at))
+}
+
+// ScheduleUserState enables (active) or disables the user at the time
+func (client *Client) ScheduleUserState(nameuid string, at time.Time, active bool) *backends.Error {
+	if active {
+		return client.simpleCmd("enable at %s %s", nameuid, formatTime(at))
+	}
+	return client.simpleCmd("disable at %s %s", nameuid, formatTime(at))
+}
+
+// formatTime formats times as RFC3339 in UTC and the zero time as never
+func formatTime(at time.Time) string {
+	if at.IsZero() {
+		return "never"
+	}
+	return at.UTC().Format(time.RFC3339)
+}
+
 func (client *Client) SetUserData(nameuid string, key string, value string) *backends.Error {
 	return client.simpleCmd("set %s %s %s", nameuid, key, value)
 }
 
+// GetUserData returns the value of the key. Values with line breaks are
+// transparently fetched base64 encoded.
 func (client *Client) GetUserData(nameuid string, key string) (string, *backends.Error) {
-	list, err := client.listCmd("get %s %s", nameuid, key)
+	value, err := client.valueCmd("get %s %s", nameuid, key)
+	if err != nil && err.Code == "EILSEQ" {
+		data, berr := client.GetUserDataBytes(nameuid, key)
+		return string(data), berr
+	}
+	return value, err
+}
+
+// SetUserDataBytes stores binary data (sent base64 encoded)
+func (client *Client) SetUserDataBytes(nameuid string, key string, value []byte) *backends.Error {
+	return client.simpleCmd("setb %s %s %s", nameuid, key, base64.StdEncoding.EncodeToString(value))
+}
+
+// GetUserDataBytes returns binary data stored with SetUserDataBytes or
+// SetUserData
+func (client *Client) GetUserDataBytes(nameuid string, key string) ([]byte, *backends.Error) {
+	encoded, err := client.valueCmd("getb %s %s", nameuid, key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return list[0], nil
+	value, derr := base64.StdEncoding.DecodeString(encoded)
+	if derr != nil {
+		return nil, &backends.Error{Code: "EFAULT", Message: derr.Error()}
+	}
+	return value, nil
 }
 
 func (client *Client) GetUserDataKeys(nameuid string) (keys []string, err *backends.Error) {
@@ -119,6 +198,53 @@ func (client *Client) GetUserDataKeys(nameuid string) (keys []string, err *backe
 	return
 }
 
+// GetAllUserData returns all keys and values of the user in one round trip
+func (client *Client) GetAllUserData(nameuid string) (map[string]string, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd("getall %s", nameuid)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]string)
+		err = decodeJson(response.Value, &values)
+		return values, err
+	}
+	lines, err := client.listCmd("getall %s", nameuid)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range lines {
+		args, serr := SplitArgs(line, 2)
+		if serr != nil || len(args) != 2 {
+			return nil, &backends.Error{Code: "EFAULT", Message: "Expected key and value: " + line}
+		}
+		values[args[0]] = args[1]
+	}
+	return values, nil
+}
+
+func (client *Client) UnsetUserData(nameuid string, key string) *backends.Error {
+	return client.simpleCmd("unset %s %s", nameuid, key)
+}
+
+// SetManyUserData stores all values atomically
+func (client *Client) SetManyUserData(nameuid string, values map[string]string) *backends.Error {
+	format := "setmany %s"
+	args := []interface{}{nameuid}
+	for key, value := range values {
+		format += " %s %s"
+		args = append(args, key, value)
+	}
+	return client.simpleCmd(format, args...)
+}
+
+// FindUsers returns the users with a value for the key that is equal to (=),
+// starts with (prefix) or contains (contains) the value
+func (client *Client) FindUsers(key string, op string, value string) ([]backends.User, *backends.Error) {
+	return client.listUserCmd("find %s %s %s", key, op, value)
+}
+
 func (client *Client) LoginUser(name string, password string) (uid int64, err *backends.Error) {
 	uid, err = client.simpleIntCmd("login %s %s", name, password)
 	return
@@ -132,20 +258,52 @@ func (client *Client) ChangeUserName(nameuid string, password string, newname st
 	return client.simpleCmd("change name %s %s %s", nameuid, password, newname)
 }
 
+// RenameUser changes the name of the user without the password, the
+// client has to be allowed to use admin commands
+func (client *Client) RenameUser(nameuid string, newname string) *backends.Error {
+	return client.simpleCmd("admin rename user %s %s", nameuid, newname)
+}
+
+// SetUserPassword resets the password of the user without the current one
+func (client *Client) SetUserPassword(nameuid string, newpassword string) *backends.Error {
+	return client.simpleCmd("admin password %s %s", nameuid, newpassword)
+}
+
 func (client *Client) UserGroups(nameuid string) (list []backends.Group, err *backends.Error) {
 	list, err = client.listGroupCmd("user groups %s", nameuid)
 	return
 }
 
+// UserGroupsTransitive lists the groups of the user including the groups
+// containing them.
+func (client *Client) UserGroupsTransitive(nameuid string) ([]backends.Group, *backends.Error) {
+	return client.listGroupCmd("user groups %s --transitive", nameuid)
+}
+
 func (client *Client) DeleteUser(nameuid string) *backends.Error {
 	return client.simpleCmd("delete user %s", nameuid)
 }
 
+// RestoreUser moves the deleted user with the uid out of the trash
+func (client *Client) RestoreUser(uid string) *backends.Error {
+	return client.simpleCmd("restore user %s", uid)
+}
+
 func (client *Client) Users() (list []backends.User, err *backends.Error) {
 	list, err = client.listUserCmd("users")
 	return
 }
 
+// UsersPage lists the users matching the options. The returned cursor is
+// passed as After to get the next page, it is empty on the last page.
+func (client *Client) UsersPage(options backends.ListOptions) ([]backends.User, string, *backends.Error) {
+	format, args, err := client.listOptions("users", nil, options)
+	if err != nil {
+		return nil, "", err
+	}
+	return client.listUserPageCmd(format, args...)
+}
+
 func (client *Client) CreateGroup(name string) (gid int64, err *backends.Error) {
 	gid, err = client.simpleIntCmd("group %s", name)
 	return
@@ -159,22 +317,100 @@ func (client *Client) RemoveUserFromGroup(nameuid string, groupgid string) *back
 	return client.simpleCmd("remove %s %s", nameuid, groupgid)
 }
 
+func (client *Client) AddGroupToGroup(childgid string, parentgid string) *backends.Error {
+	return client.simpleCmd("add group %s %s", childgid, parentgid)
+}
+
+func (client *Client) RemoveGroupFromGroup(childgid string, parentgid string) *backends.Error {
+	return client.simpleCmd("remove group %s %s", childgid, parentgid)
+}
+
 func (client *Client) DeleteGroup(groupgid string) *backends.Error {
 	return client.simpleCmd("delete group %s", groupgid)
 }
 
+// RestoreGroup moves the deleted group with the gid out of the trash
+func (client *Client) RestoreGroup(gid string) *backends.Error {
+	return client.simpleCmd("restore group %s", gid)
+}
+
+// Purge removes the users and groups that were deleted at least olderThan
+// ago and returns their number
+func (client *Client) Purge(olderThan time.Duration) (int64, *backends.Error) {
+	return client.simpleIntCmd("purge %s", olderThan.String())
+}
+
+func (client *Client) RenameGroup(groupgid string, newname string) *backends.Error {
+	return client.simpleCmd("rename group %s %s", groupgid, newname)
+}
+
 func (client *Client) Groups() (list []backends.Group, err *backends.Error) {
 	list, err = client.listGroupCmd("groups")
 	return
 }
 
+func (client *Client) GroupsPage(options backends.ListOptions) ([]backends.Group, string, *backends.Error) {
+	format, args, err := client.listOptions("groups", nil, options)
+	if err != nil {
+		return nil, "", err
+	}
+	return client.listGroupPageCmd(format, args...)
+}
+
 func (client *Client) GroupUsers(groupgid string) (list []backends.User, err *backends.Error) {
 	list, err = client.listUserCmd("group users %s", groupgid)
 	return
 }
 
+func (client *Client) GroupUsersPage(groupgid string, options backends.ListOptions) ([]backends.User, string, *backends.Error) {
+	format, args, err := client.listOptions("group users %s", []interface{}{groupgid}, options)
+	if err != nil {
+		return nil, "", err
+	}
+	return client.listUserPageCmd(format, args...)
+}
+
+func (client *Client) SetGroupData(groupgid string, key string, value string) *backends.Error {
+	return client.simpleCmd("group set %s %s %s", groupgid, key, value)
+}
+
+func (client *Client) GetGroupData(groupgid string, key string) (string, *backends.Error) {
+	return client.valueCmd("group get %s %s", groupgid, key)
+}
+
+func (client *Client) GetGroupDataKeys(groupgid string) ([]string, *backends.Error) {
+	return client.listCmd("group getkeys %s", groupgid)
+}
+
+func (client *Client) UnsetGroupData(groupgid string, key string) *backends.Error {
+	return client.simpleCmd("group unset %s %s", groupgid, key)
+}
+
+// Begin starts a transaction on the connection, all following commands are
+// executed within it until Commit or Rollback. Servers whose backend doesn't
+// support transactions answer with ENOTSUP.
+func (client *Client) Begin() *backends.Error {
+	return client.simpleCmd("begin")
+}
+
+func (client *Client) Commit() *backends.Error {
+	return client.simpleCmd("commit")
+}
+
+func (client *Client) Rollback() *backends.Error {
+	return client.simpleCmd("rollback")
+}
+
 func (client *Client) Stats() (stats map[string]int64, err *backends.Error) {
 	stats = make(map[string]int64)
+	if client.json {
+		response, jerr := client.jsonCmd("stats")
+		if jerr != nil {
+			return nil, jerr
+		}
+		err = decodeJson(response.Value, &stats)
+		return
+	}
 	list, err := client.listCmd("stats")
 	if err != nil {
 		return
@@ -197,20 +433,31 @@ func (client *Client) Stats() (stats map[string]int64, err *backends.Error) {
 }
 
 func (client *Client) Close() {
+	client.mutex.Lock()
 	client.Text.Cmd("quit")
+	client.mutex.Unlock()
 	client.Text.Close()
 }
 
 // Helpers
 
-func (client *Client) handleIntResponse() (int64, *backends.Error) {
-	line, rerr := client.Text.ReadLine()
+func (client *Client) handleIntResponse(reader lineReader) (int64, *backends.Error) {
+	if client.json {
+		response, err := readJson(reader)
+		if err != nil {
+			return 0, err
+		}
+		var value int64
+		err = decodeJson(response.Value, &value)
+		return value, err
+	}
+	line, rerr := reader.ReadLine()
 	if rerr != nil {
 		return 0, &backends.Error{Code: "EFAULT", Message: rerr.Error()}
 	}
 	ret := strings.Split(line, " ")
 	if ret[0] == "-" {
-		return 0, &backends.Error{Code: ret[1], Message: "Remote failure"}
+		return 0, parseError(line)
 	}
 	val, perr := strconv.ParseInt(ret[2], 10, 64)
 	if perr != nil {
@@ -219,105 +466,277 @@ func (client *Client) handleIntResponse() (int64, *backends.Error) {
 	return val, nil
 }
 
-func (client *Client) handleResponse() *backends.Error {
-	line, rerr := client.Text.ReadLine()
+func (client *Client) handleResponse(reader lineReader) *backends.Error {
+	if client.json {
+		_, err := readJson(reader)
+		return err
+	}
+	line, rerr := reader.ReadLine()
 	if rerr != nil {
 		return &backends.Error{Code: "EFAULT", Message: rerr.Error()}
 	}
-	ret := strings.Split(line, " ")
-	if ret[0] == "-" {
-		return &backends.Error{Code: ret[1], Message: "Remote failure"}
+	if strings.HasPrefix(line, "- ") {
+		return parseError(line)
 	}
 	return nil
 }
 
-func (client *Client) simpleCmd(format string, args ...interface{}) *backends.Error {
+// parseError parses an error response like "- ENOENT Name or uid unknown",
+// older servers don't send a message
+func parseError(line string) *backends.Error {
+	parts := strings.SplitN(strings.TrimPrefix(line, "- "), " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return &backends.Error{Code: parts[0], Message: "Remote failure"}
+	}
+	return &backends.Error{Code: parts[0], Message: parts[1]}
+}
+
+// cmd sends the command. Servers that speak protocol 1 or later get all
+// arguments quoted, so that they can't contain further arguments or line
+// breaks. Legacy servers don't unquote, their arguments are sent bare and
+// rejected if they would need quotes.
+func (client *Client) cmd(format string, args ...interface{}) (uint, *backends.Error) {
+	formatted := make([]interface{}, len(args))
+	for i, arg := range args {
+		value := fmt.Sprint(arg)
+		if client.protocol > 0 {
+			formatted[i] = Quote(value)
+		} else if NeedsQuote(value) {
+			return 0, &backends.Error{Code: "EINVAL", Message: "Argument not supported by the server"}
+		} else {
+			formatted[i] = value
+		}
+	}
+	id, err := client.Text.Cmd("%s", fmt.Sprintf(format, formatted...))
+	if err != nil {
+		return 0, &backends.Error{Code: "EFAULT", Message: err.Error()}
+	}
+	return id, nil
+}
+
+// send sends the command and returns the reader for the response. Without
+// pipelining the connection is locked until done is called.
+func (client *Client) send(format string, args ...interface{}) (reader lineReader, done func(), err *backends.Error) {
+	if client.pipeline != nil {
+		reader, err = client.pipeline.send(client, format, args...)
+		return reader, func() {}, err
+	}
 	client.mutex.Lock()
-	defer client.mutex.Unlock()
-	_, err := client.Text.Cmd(format, args...)
+	if _, err = client.cmd(format, args...); err != nil {
+		client.mutex.Unlock()
+		return nil, nil, err
+	}
+	return client.Text, client.mutex.Unlock, nil
+}
+
+func (client *Client) simpleCmd(format string, args ...interface{}) *backends.Error {
+	reader, done, err := client.send(format, args...)
 	if err != nil {
-		return &backends.Error{Code: "EFAULT", Message: err.Error()}
+		return err
 	}
-	return client.handleResponse()
+	defer done()
+	return client.handleResponse(reader)
 }
 
 func (client *Client) simpleIntCmd(format string, args ...interface{}) (int64, *backends.Error) {
-	client.mutex.Lock()
-	defer client.mutex.Unlock()
-	_, err := client.Text.Cmd(format, args...)
+	reader, done, err := client.send(format, args...)
 	if err != nil {
-		return 0, &backends.Error{Code: "EFAULT", Message: err.Error()}
+		return 0, err
 	}
-	return client.handleIntResponse()
+	defer done()
+	return client.handleIntResponse(reader)
+}
+
+// listOptions appends the list options to the command, servers without the
+// paging feature only support listings without options
+func (client *Client) listOptions(format string, args []interface{}, options backends.ListOptions) (string, []interface{}, *backends.Error) {
+	if options == (backends.ListOptions{}) {
+		return format, args, nil
+	}
+	caps, err := client.Capabilities()
+	if err != nil {
+		return "", nil, err
+	}
+	if !caps.HasFeature("paging") {
+		return "", nil, &backends.Error{Code: "ENOTSUP", Message: "Server doesn't support paging"}
+	}
+	if options.Filter != "" {
+		format += " filter %s"
+		args = append(args, options.Filter)
+	}
+	if options.State != "" {
+		format += " %s"
+		args = append(args, options.State)
+	}
+	if options.Sort != "" {
+		format += " sort %s"
+		args = append(args, options.Sort)
+	}
+	if options.Limit != 0 {
+		format += " limit %s"
+		args = append(args, options.Limit)
+	}
+	if options.After != "" {
+		format += " after %s"
+		args = append(args, options.After)
+	}
+	if options.Transitive {
+		format += " --transitive"
+	}
+	if options.Expiry {
+		format += " --expiry"
+	}
+	if options.Deleted {
+		format += " --deleted"
+	}
+	return format, args, nil
 }
 
 func (client *Client) listUserCmd(format string, args ...interface{}) ([]backends.User, *backends.Error) {
-	list, err := client.listCmd(format, args...)
+	users, _, err := client.listUserPageCmd(format, args...)
+	return users, err
+}
+
+func (client *Client) listUserPageCmd(format string, args ...interface{}) ([]backends.User, string, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd(format, args...)
+		if err != nil {
+			return nil, "", err
+		}
+		var users []backends.User
+		var cursor string
+		if err = decodeJson(response.Items, &users); err == nil {
+			err = decodeJson(response.Value, &cursor)
+		}
+		return users, cursor, err
+	}
+	list, cursor, err := client.listPageCmd(format, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	var users []backends.User
 	for _, line := range list {
-		args := strings.Split(line, ":")
-		if len(args) != 3 {
-			return nil, &backends.Error{Code: "EFAULT", Message: "Expected three values: " + line}
+		// the expiry (--expiry) is a time with colons or never
+		args := strings.SplitN(line, ":", 4)
+		if len(args) < 3 {
+			return nil, "", &backends.Error{Code: "EFAULT", Message: "Expected three values: " + line}
 		}
 		uid, perr := strconv.ParseInt(args[1], 10, 64)
 		if perr != nil {
-			return nil, &backends.Error{Code: "EFAULT", Message: perr.Error()}
+			return nil, "", &backends.Error{Code: "EFAULT", Message: perr.Error()}
 		}
-		users = append(users, backends.User{
+		user := backends.User{
 			Uid:    uid,
 			Name:   args[0],
 			Active: (args[2] == "Y"),
-		})
+		}
+		if len(args) == 4 && args[3] != "never" {
+			expires, terr := time.Parse(time.RFC3339, args[3])
+			if terr != nil {
+				return nil, "", &backends.Error{Code: "EFAULT", Message: terr.Error()}
+			}
+			user.Expires = &expires
+		}
+		users = append(users, user)
 	}
-	return users, nil
+	return users, cursor, nil
 }
 
 func (client *Client) listGroupCmd(format string, args ...interface{}) ([]backends.Group, *backends.Error) {
-	list, err := client.listCmd(format, args...)
+	groups, _, err := client.listGroupPageCmd(format, args...)
+	return groups, err
+}
+
+func (client *Client) listGroupPageCmd(format string, args ...interface{}) ([]backends.Group, string, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd(format, args...)
+		if err != nil {
+			return nil, "", err
+		}
+		var groups []backends.Group
+		var cursor string
+		if err = decodeJson(response.Items, &groups); err == nil {
+			err = decodeJson(response.Value, &cursor)
+		}
+		return groups, cursor, err
+	}
+	list, cursor, err := client.listPageCmd(format, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	var groups []backends.Group
 	for _, line := range list {
 		args := strings.Split(line, ":")
 		if len(args) != 2 {
-			return nil, &backends.Error{Code: "EFAULT", Message: "Expected two values: " + line}
+			return nil, "", &backends.Error{Code: "EFAULT", Message: "Expected two values: " + line}
 		}
 		gid, perr := strconv.ParseInt(args[1], 10, 64)
 		if perr != nil {
-			return nil, &backends.Error{Code: "EFAULT", Message: perr.Error()}
+			return nil, "", &backends.Error{Code: "EFAULT", Message: perr.Error()}
 		}
 		groups = append(groups, backends.Group{
 			Gid:  gid,
 			Name: args[0],
 		})
 	}
-	return groups, nil
+	return groups, cursor, nil
+}
+
+// valueCmd returns the single value of the response
+func (client *Client) valueCmd(format string, args ...interface{}) (string, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd(format, args...)
+		if err != nil {
+			return "", err
+		}
+		var value string
+		err = decodeJson(response.Value, &value)
+		return value, err
+	}
+	list, err := client.listCmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	if len(list) != 1 {
+		return "", &backends.Error{Code: "EFAULT", Message: "Expected one value"}
+	}
+	return list[0], nil
 }
 
 func (client *Client) listCmd(format string, args ...interface{}) ([]string, *backends.Error) {
-	client.mutex.Lock()
-	defer client.mutex.Unlock()
-	_, err := client.Text.Cmd(fmt.Sprintf(format, args...))
+	if client.json {
+		response, err := client.jsonCmd(format, args...)
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		err = decodeJson(response.Items, &list)
+		return list, err
+	}
+	list, _, err := client.listPageCmd(format, args...)
+	return list, err
+}
+
+// listPageCmd returns the lines of a text response and the cursor of the
+// next page from the + OK line
+func (client *Client) listPageCmd(format string, args ...interface{}) ([]string, string, *backends.Error) {
+	reader, done, err := client.send(format, args...)
 	if err != nil {
-		return nil, &backends.Error{Code: "EFAULT", Message: err.Error()}
+		return nil, "", err
 	}
+	defer done()
 	var list []string
 	for {
-		line, rerr := client.Text.ReadLine()
+		line, rerr := reader.ReadLine()
 		if rerr != nil {
-			return nil, &backends.Error{Code: "EFAULT", Message: rerr.Error()}
+			return nil, "", &backends.Error{Code: "EFAULT", Message: rerr.Error()}
 		}
-		if strings.HasPrefix(line, "- E") {
-			ret := strings.Split(line, " ")
-			return nil, &backends.Error{Code: ret[1], Message: "Remote failure"}
+		if strings.HasPrefix(line, "- ") {
+			return nil, "", parseError(line)
 		} else if strings.HasPrefix(line, "+ ") {
-			return list, nil
+			return list, strings.TrimSpace(strings.TrimPrefix(line, "+ OK")), nil
 		}
 		list = append(list, line)
 	}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	err := parseError("- ENOENT Name or uid unknown")
+	if err.Code != "ENOENT" || err.Message != "Name or uid unknown" {
+		t.Fatal("unexpected error", err)
+	}
+	err = parseError("- EFAULT")
+	if err.Code != "EFAULT" || err.Message != "Remote failure" {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestCmdQuoting(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	lines := bufio.NewReader(remote)
+	client := &Client{Text: textproto.NewConn(local)}
+	expect := func(expected string) {
+		if line, err := lines.ReadString('\n'); line != expected+"\r\n" || err != nil {
+			t.Fatalf("expected %q got %q %v", expected, line, err)
+		}
+	}
+	go client.cmd("login %s %s", "joe", "secret")
+	expect("login joe secret")
+	for _, arg := range []string{"", "with space", `"quoted"`, "a\nb", "tab\t"} {
+		if _, err := client.cmd("login %s %s", arg, "secret"); err == nil || err.Code != "EINVAL" {
+			t.Fatalf("expected EINVAL for %q got %v", arg, err)
+		}
+	}
+	client.protocol = 1
+	go client.cmd("login %s %s", "joe", "with space")
+	expect(`login "joe" "with space"`)
+}
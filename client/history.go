@@ -0,0 +1,57 @@
+package client
+
+import (
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func (client *Client) GetUserDataAt(nameuid string, key string, at time.Time) (string, *backends.Error) {
+	return client.valueCmd("get %s %s at %s", nameuid, key, at.UTC().Format(time.RFC3339))
+}
+
+func (client *Client) UserDataHistory(nameuid string, key string) ([]backends.DataChange, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd("history %s %s", nameuid, key)
+		if err != nil {
+			return nil, err
+		}
+		var changes []backends.DataChange
+		err = decodeJson(response.Items, &changes)
+		return changes, err
+	}
+	lines, err := client.listCmd("history %s %s", nameuid, key)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]backends.DataChange, len(lines))
+	for i, line := range lines {
+		if !parseDataChangeLine(&changes[i], line) {
+			return nil, &backends.Error{Code: "EFAULT", Message: "Unexpected answer: " + line}
+		}
+	}
+	return changes, nil
+}
+
+// parseDataChangeLine parses lines like `<time|unknown> "<client>" set
+// "<value>"` or `<time|unknown> "<client>" unset`, it returns false for
+// malformed lines
+func parseDataChangeLine(change *backends.DataChange, line string) bool {
+	args, err := SplitArgs(line, 4)
+	if err != nil || len(args) < 3 {
+		return false
+	}
+	if change.Changed, err = parseRevisionTime(args[0]); err != nil {
+		return false
+	}
+	change.Client = args[1]
+	switch {
+	case args[2] == "set" && len(args) == 4:
+		change.Value = args[3]
+	case args[2] == "unset" && len(args) == 3:
+		change.Unset = true
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func (client *Client) UserInfo(nameuid string) (backends.UserInfo, *backends.Error) {
+	var info backends.UserInfo
+	if client.json {
+		response, err := client.jsonCmd("user info %s", nameuid)
+		if err != nil {
+			return info, err
+		}
+		err = decodeJson(response.Value, &info)
+		return info, err
+	}
+	lines, _, err := client.listPageCmd("user info %s", nameuid)
+	if err != nil {
+		return info, err
+	}
+	info.Data = make(map[string]string)
+	info.DataRevisions = make(map[string]backends.Revision)
+	for _, line := range lines {
+		if !parseUserInfoLine(&info, line) {
+			return info, &backends.Error{Code: "EFAULT", Message: "Unexpected answer: " + line}
+		}
+	}
+	return info, nil
+}
+
+// parseUserInfoLine sets the field of one "<field> <value>" line, it returns
+// false for malformed lines
+func parseUserInfoLine(info *backends.UserInfo, line string) bool {
+	args, err := SplitArgs(line, 3)
+	if err != nil || len(args) < 2 {
+		return false
+	}
+	switch args[0] {
+	case "uid":
+		info.Uid, err = strconv.ParseInt(args[1], 10, 64)
+	case "name":
+		info.Name = args[1]
+	case "active":
+		info.Active = args[1] == "Y"
+	case "expires":
+		if args[1] != "never" {
+			var at time.Time
+			at, err = time.Parse(time.RFC3339, args[1])
+			info.Expires = &at
+		}
+	case "version":
+		info.Version, err = strconv.ParseInt(args[1], 10, 64)
+	case "created":
+		info.Created, err = parseRevisionTime(args[1])
+	case "updated":
+		info.Updated, err = parseRevisionTime(args[1])
+	case "latestlogin":
+		info.LatestLogin, err = parseLogin(args[1])
+	case "previouslogin":
+		info.PreviousLogin, err = parseLogin(args[1])
+	case "failcount":
+		info.FailCount, err = strconv.ParseInt(args[1], 10, 64)
+	case "group":
+		if len(args) != 3 {
+			return false
+		}
+		group := backends.Group{Name: args[1]}
+		group.Gid, err = strconv.ParseInt(args[2], 10, 64)
+		info.Groups = append(info.Groups, group)
+	case "data":
+		if len(args) != 3 {
+			return false
+		}
+		info.Data[args[1]] = args[2]
+	case "datarevision":
+		if len(args) != 3 {
+			return false
+		}
+		info.DataRevisions[args[1]], err = parseRevision(args[2])
+	}
+	return err == nil
+}
+
+// parseLogin parses the time of a login, nil for never
+func parseLogin(value string) (*time.Time, error) {
+	if value == "never" {
+		return nil, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	return &at, err
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// jsonResponse is a response of the server in the json format
+type jsonResponse struct {
+	Ok      bool            `json:"ok"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Value   json.RawMessage `json:"value"`
+	Items   json.RawMessage `json:"items"`
+}
+
+// SetFormat selects the response format of the server (text or json), the
+// client handles both formats transparently. It must not be called while
+// other commands are in flight.
+func (client *Client) SetFormat(format string) *backends.Error {
+	if err := client.simpleCmd("format %s", format); err != nil {
+		return err
+	}
+	client.json = format == "json"
+	return nil
+}
+
+// jsonCmd sends the command and reads the json response, unsuccessful
+// responses are returned as error
+func (client *Client) jsonCmd(format string, args ...interface{}) (*jsonResponse, *backends.Error) {
+	reader, done, err := client.send(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return readJson(reader)
+}
+
+func readJson(reader lineReader) (*jsonResponse, *backends.Error) {
+	line, rerr := reader.ReadLine()
+	if rerr != nil {
+		return nil, &backends.Error{Code: "EFAULT", Message: rerr.Error()}
+	}
+	var response jsonResponse
+	if err := json.Unmarshal([]byte(line), &response); err != nil {
+		return nil, &backends.Error{Code: "EFAULT", Message: err.Error()}
+	}
+	if !response.Ok {
+		message := response.Message
+		if message == "" {
+			message = "Remote failure"
+		}
+		return nil, &backends.Error{Code: response.Code, Message: message}
+	}
+	return &response, nil
+}
+
+// decodeJson decodes the value or items of a response, missing values are
+// left untouched
+func decodeJson(raw json.RawMessage, value interface{}) *backends.Error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return &backends.Error{Code: "EFAULT", Message: err.Error()}
+	}
+	return nil
+}
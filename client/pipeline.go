@@ -0,0 +1,182 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// lineReader reads the lines of a response
+type lineReader interface {
+	ReadLine() (string, error)
+}
+
+// maximum length of a tag
+const MAX_TAG_LENGTH = 32
+
+// SplitTag removes an IMAP like tag (e.g. "A1 login joe secret") from the
+// line. A tag starts with a letter, consists of letters and digits and
+// contains at least one digit, so that it can't be confused with a command.
+func SplitTag(line string) (tag string, rest string) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 || !isTag(parts[0]) {
+		return "", line
+	}
+	return parts[0], parts[1]
+}
+
+func isTag(word string) bool {
+	if len(word) == 0 || len(word) > MAX_TAG_LENGTH {
+		return false
+	}
+	digit := false
+	for i, c := range word {
+		switch {
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				return false
+			}
+			digit = true
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		default:
+			return false
+		}
+	}
+	return digit
+}
+
+// pendingCmd is a command that was sent with a tag and waits for its response
+type pendingCmd struct {
+	tag   string
+	json  bool
+	lines chan string
+}
+
+func (cmd *pendingCmd) ReadLine() (string, error) {
+	line, ok := <-cmd.lines
+	if !ok {
+		return "", io.ErrUnexpectedEOF
+	}
+	return line, nil
+}
+
+// final returns true if the line completes the response
+func (cmd *pendingCmd) final(line string) bool {
+	return cmd.json || strings.HasPrefix(line, "+ ") || strings.HasPrefix(line, "- ")
+}
+
+// pipeline sends tagged commands and dispatches the responses by tag, so that
+// multiple commands can be in flight at the same time
+type pipeline struct {
+	sync.Mutex
+	counter int
+	pending map[string]*pendingCmd
+	order   []*pendingCmd
+	closed  bool
+}
+
+// EnablePipelining allows concurrent calls on the client. Commands are sent
+// with tags and the responses are matched by their tags. Starting tls isn't
+// possible afterwards.
+func (client *Client) EnablePipelining() *backends.Error {
+	if client.pipeline != nil {
+		return nil
+	}
+	caps, err := client.Capabilities()
+	if err != nil {
+		return err
+	}
+	if !caps.HasFeature("tags") {
+		return &backends.Error{Code: "ENOTSUP", Message: "Server doesn't support tags"}
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.pipeline = &pipeline{pending: make(map[string]*pendingCmd)}
+	go client.pipeline.dispatch(client.Text)
+	return nil
+}
+
+// send registers the command and sends it with a new tag. The client mutex
+// is held during both, so that the order of the commands is preserved.
+func (p *pipeline) send(client *Client, format string, args ...interface{}) (*pendingCmd, *backends.Error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return nil, &backends.Error{Code: "EFAULT", Message: "Connection closed"}
+	}
+	p.counter++
+	cmd := &pendingCmd{
+		tag:   fmt.Sprintf("A%d", p.counter),
+		json:  client.json,
+		lines: make(chan string, 16),
+	}
+	p.pending[cmd.tag] = cmd
+	p.order = append(p.order, cmd)
+	p.Unlock()
+	if _, err := client.cmd(cmd.tag+" "+format, args...); err != nil {
+		p.Lock()
+		p.remove(cmd)
+		p.Unlock()
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// dispatch reads the responses and passes the lines to the waiting commands.
+// Untagged lines (e.g. errors for too long lines) belong to the oldest
+// command, since the server executes the commands in order.
+func (p *pipeline) dispatch(reader lineReader) {
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			p.close()
+			return
+		}
+		tag, rest := SplitTag(line)
+		p.Lock()
+		cmd := p.pending[tag]
+		if cmd == nil && len(p.order) > 0 {
+			cmd, rest = p.order[0], line
+		}
+		final := cmd != nil && cmd.final(rest)
+		if final {
+			p.remove(cmd)
+		}
+		p.Unlock()
+		// the lock is released while the line is passed on, so that a slow
+		// reader of a long response doesn't block sending other commands
+		if cmd != nil {
+			cmd.lines <- rest
+			if final {
+				close(cmd.lines)
+			}
+		}
+	}
+}
+
+func (p *pipeline) remove(cmd *pendingCmd) {
+	delete(p.pending, cmd.tag)
+	for i, c := range p.order {
+		if c == cmd {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// close fails all waiting commands
+func (p *pipeline) close() {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	for _, cmd := range p.order {
+		close(cmd.lines)
+	}
+	p.pending = make(map[string]*pendingCmd)
+	p.order = nil
+}
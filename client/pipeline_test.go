@@ -0,0 +1,99 @@
+package client
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSplitTag(t *testing.T) {
+	tests := map[string][2]string{
+		"A1 login joe secret": {"A1", "login joe secret"},
+		"a42 + OK 5":          {"a42", "+ OK 5"},
+		"login joe secret":    {"", "login joe secret"},
+		"1A users":            {"", "1A users"},
+		"AB users":            {"", "AB users"},
+		"A-1 users":           {"", "A-1 users"},
+		"A1":                  {"", "A1"},
+	}
+	for line, expected := range tests {
+		tag, rest := SplitTag(line)
+		if tag != expected[0] || rest != expected[1] {
+			t.Fatalf("expected %q got %q %q", expected, tag, rest)
+		}
+	}
+}
+
+type linesReader []string
+
+func (lines *linesReader) ReadLine() (string, error) {
+	if len(*lines) == 0 {
+		return "", io.EOF
+	}
+	line := (*lines)[0]
+	*lines = (*lines)[1:]
+	return line, nil
+}
+
+func TestPipelineDispatch(t *testing.T) {
+	p := &pipeline{pending: make(map[string]*pendingCmd)}
+	a1 := &pendingCmd{tag: "A1", lines: make(chan string, 16)}
+	a2 := &pendingCmd{tag: "A2", json: true, lines: make(chan string, 16)}
+	a3 := &pendingCmd{tag: "A3", lines: make(chan string, 16)}
+	for _, cmd := range []*pendingCmd{a1, a2, a3} {
+		p.pending[cmd.tag] = cmd
+		p.order = append(p.order, cmd)
+	}
+	p.dispatch(&linesReader{
+		"A2 {\"ok\":true}",
+		"A1 joe:1:Y",
+		"A1 + OK",
+		"- E2BIG Line too long",
+	})
+	expect := func(cmd *pendingCmd, lines ...string) {
+		for _, expected := range lines {
+			if line, err := cmd.ReadLine(); line != expected || err != nil {
+				t.Fatalf("expected %q got %q %v", expected, line, err)
+			}
+		}
+		if _, err := cmd.ReadLine(); err == nil {
+			t.Fatal("expected closed response of", cmd.tag)
+		}
+	}
+	expect(a1, "joe:1:Y", "+ OK")
+	expect(a2, "{\"ok\":true}")
+	expect(a3, "- E2BIG Line too long")
+	if !p.closed || len(p.pending) != 0 {
+		t.Fatal("expected closed pipeline")
+	}
+}
+
+func TestPipelineDispatchSlowReader(t *testing.T) {
+	p := &pipeline{pending: make(map[string]*pendingCmd)}
+	a1 := &pendingCmd{tag: "A1", lines: make(chan string, 1)}
+	p.pending[a1.tag] = a1
+	p.order = append(p.order, a1)
+	go p.dispatch(&linesReader{"A1 joe:1:Y", "A1 jane:2:Y", "A1 + OK"})
+
+	// the dispatcher waits for the reader of the full response, sending
+	// other commands has to be possible meanwhile
+	for len(a1.lines) < cap(a1.lines) {
+		time.Sleep(time.Millisecond)
+	}
+	locked := make(chan bool)
+	go func() {
+		p.Lock()
+		p.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline stays locked while the reader is slow")
+	}
+	for _, expected := range []string{"joe:1:Y", "jane:2:Y", "+ OK"} {
+		if line, err := a1.ReadLine(); line != expected || err != nil {
+			t.Fatalf("expected %q got %q %v", expected, line, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Arguments of the line protocol are separated by spaces. An argument that
+// contains spaces, quotes or control characters has to be double quoted,
+// within the quotes a backslash escapes the next character:
+//
+//     \"  quote
+//     \\  backslash
+//     \r  carriage return
+//     \n  line feed
+//     \t  tab
+
+// Quote returns the argument as a double quoted string that is safe to be
+// sent as a single argument
+func Quote(arg string) string {
+	var buf []byte
+	buf = append(buf, '"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(append(buf, '"'))
+}
+
+// NeedsQuote reports whether the argument is empty or contains spaces, quotes
+// or control characters, so that it can only be sent quoted
+func NeedsQuote(arg string) bool {
+	if arg == "" {
+		return true
+	}
+	for i := 0; i < len(arg); i++ {
+		if c := arg[i]; c <= ' ' || c == '"' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitArgs splits the line into at most n arguments like strings.SplitN.
+// Quoted arguments are unquoted. The last argument is the rest of the line,
+// for compatibility with unquoted values containing spaces it is only
+// unquoted if it consists of a single quoted string.
+func SplitArgs(line string, n int) (args []string, err error) {
+	pos := 0
+	for {
+		for pos < len(line) && line[pos] == ' ' {
+			pos++
+		}
+		if pos == len(line) {
+			return
+		}
+		var arg string
+		if len(args) == n-1 {
+			arg = line[pos:]
+			if unquoted, end, qerr := unquote(arg, 0); qerr == nil &&
+				strings.TrimRight(arg[end:], " ") == "" {
+				arg = unquoted
+			}
+			pos = len(line)
+		} else if line[pos] == '"' {
+			arg, pos, err = unquote(line, pos)
+			if err != nil {
+				return nil, err
+			}
+			if pos < len(line) && line[pos] != ' ' {
+				return nil, fmt.Errorf("Missing space after quoted argument")
+			}
+		} else {
+			end := strings.IndexByte(line[pos:], ' ')
+			if end < 0 {
+				end = len(line) - pos
+			}
+			arg, pos = line[pos:pos+end], pos+end
+		}
+		args = append(args, arg)
+	}
+}
+
+// unquote reads the quoted string starting at pos and returns it together
+// with the position after the closing quote
+func unquote(line string, pos int) (string, int, error) {
+	if pos >= len(line) || line[pos] != '"' {
+		return "", pos, fmt.Errorf("Missing quote")
+	}
+	var buf []byte
+	for pos++; pos < len(line); pos++ {
+		switch c := line[pos]; c {
+		case '"':
+			return string(buf), pos + 1, nil
+		case '\\':
+			pos++
+			if pos == len(line) {
+				return "", pos, fmt.Errorf("Unterminated escape sequence")
+			}
+			switch e := line[pos]; e {
+			case '"', '\\':
+				buf = append(buf, e)
+			case 'r':
+				buf = append(buf, '\r')
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			default:
+				return "", pos, fmt.Errorf("Unknown escape sequence: \\%c", e)
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", pos, fmt.Errorf("Unterminated quoted argument")
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"":                 `""`,
+		"name":             `"name"`,
+		"with space":       `"with space"`,
+		`"quoted" \ slash`: `"\"quoted\" \\ slash"`,
+		"a\r\nb\tc":        `"a\r\nb\tc"`,
+	}
+	for arg, expected := range tests {
+		if quoted := Quote(arg); quoted != expected {
+			t.Fatalf("expected %s got %s", expected, quoted)
+		}
+	}
+}
+
+func TestQuoteRoundtrip(t *testing.T) {
+	values := []string{"", "name", "with space", `"\`, "a\r\nb\tc", "100%"}
+	for _, value := range values {
+		line := "set " + Quote(value) + " " + Quote(value) + " " + Quote(value)
+		args, err := SplitArgs(line, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, []string{"set", value, value, value}) {
+			t.Fatalf("expected %q got %q", value, args)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := SplitArgs("set  name key value  with spaces", 4)
+	if err != nil || !reflect.DeepEqual(args, []string{"set", "name", "key", "value  with spaces"}) {
+		t.Fatalf("unexpected args %q %v", args, err)
+	}
+	args, err = SplitArgs("", 2)
+	if err != nil || len(args) != 0 {
+		t.Fatalf("unexpected args %q %v", args, err)
+	}
+	args, err = SplitArgs(`get "name" "key" more`, 3)
+	if err != nil || !reflect.DeepEqual(args, []string{"get", "name", `"key" more`}) {
+		t.Fatalf("unexpected args %q %v", args, err)
+	}
+	for _, line := range []string{`"open x`, `"a"b x`, `"a\qb" x`, `"a\`} {
+		if _, err = SplitArgs(line, 3); err == nil {
+			t.Fatal("expected error for", line)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func (client *Client) CreateRole(name string) (int64, *backends.Error) {
+	return client.simpleIntCmd("role %s", name)
+}
+
+func (client *Client) DeleteRole(rolerid string) *backends.Error {
+	return client.simpleCmd("delete role %s", rolerid)
+}
+
+func (client *Client) Roles() ([]backends.Role, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd("roles")
+		if err != nil {
+			return nil, err
+		}
+		var roles []backends.Role
+		err = decodeJson(response.Items, &roles)
+		return roles, err
+	}
+	names, ids, err := client.listNameIdCmd("roles")
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]backends.Role, len(names))
+	for i, name := range names {
+		roles[i] = backends.Role{Rid: ids[i], Name: name}
+	}
+	return roles, nil
+}
+
+func (client *Client) RolePermissions(rolerid string) ([]backends.Permission, *backends.Error) {
+	return client.listPermissionCmd("role permissions %s", rolerid)
+}
+
+func (client *Client) CreatePermission(name string) (int64, *backends.Error) {
+	return client.simpleIntCmd("permission %s", name)
+}
+
+func (client *Client) DeletePermission(permpid string) *backends.Error {
+	return client.simpleCmd("delete permission %s", permpid)
+}
+
+func (client *Client) Permissions() ([]backends.Permission, *backends.Error) {
+	return client.listPermissionCmd("permissions")
+}
+
+func (client *Client) GrantPermission(rolerid string, permpid string) *backends.Error {
+	return client.simpleCmd("grant %s %s", rolerid, permpid)
+}
+
+func (client *Client) RevokePermission(rolerid string, permpid string) *backends.Error {
+	return client.simpleCmd("revoke %s %s", rolerid, permpid)
+}
+
+func (client *Client) AssignRoleToUser(rolerid string, nameuid string) *backends.Error {
+	return client.simpleCmd("assign %s user %s", rolerid, nameuid)
+}
+
+func (client *Client) UnassignRoleFromUser(rolerid string, nameuid string) *backends.Error {
+	return client.simpleCmd("unassign %s user %s", rolerid, nameuid)
+}
+
+func (client *Client) AssignRoleToGroup(rolerid string, groupgid string) *backends.Error {
+	return client.simpleCmd("assign %s group %s", rolerid, groupgid)
+}
+
+func (client *Client) UnassignRoleFromGroup(rolerid string, groupgid string) *backends.Error {
+	return client.simpleCmd("unassign %s group %s", rolerid, groupgid)
+}
+
+// UserPermissions lists the names of the effective permissions of the user
+func (client *Client) UserPermissions(nameuid string) ([]string, *backends.Error) {
+	return client.listCmd("permissions %s", nameuid)
+}
+
+// CheckPermission checks if the user has the permission and returns the
+// role (and group) granting it
+func (client *Client) CheckPermission(nameuid string, permission string) (backends.PermissionCheck, *backends.Error) {
+	var check backends.PermissionCheck
+	if client.json {
+		response, err := client.jsonCmd("check %s %s", nameuid, permission)
+		if err != nil {
+			return check, err
+		}
+		err = decodeJson(response.Value, &check)
+		return check, err
+	}
+	_, value, err := client.listPageCmd("check %s %s", nameuid, permission)
+	if err != nil {
+		return check, err
+	}
+	// yes role:<role> [group:<group>] or no
+	if value == "no" {
+		return check, nil
+	}
+	if !strings.HasPrefix(value, "yes role:") {
+		return check, &backends.Error{Code: "EFAULT", Message: "Unexpected answer: " + value}
+	}
+	check.Allowed = true
+	check.Role = strings.TrimPrefix(value, "yes role:")
+	if i := strings.LastIndex(check.Role, " group:"); i >= 0 {
+		check.Role, check.Group = check.Role[:i], check.Role[i+len(" group:"):]
+	}
+	return check, nil
+}
+
+func (client *Client) listPermissionCmd(format string, args ...interface{}) ([]backends.Permission, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd(format, args...)
+		if err != nil {
+			return nil, err
+		}
+		var permissions []backends.Permission
+		err = decodeJson(response.Items, &permissions)
+		return permissions, err
+	}
+	names, ids, err := client.listNameIdCmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	permissions := make([]backends.Permission, len(names))
+	for i, name := range names {
+		permissions[i] = backends.Permission{Pid: ids[i], Name: name}
+	}
+	return permissions, nil
+}
+
+// listNameIdCmd parses text responses with <name>:<id> lines
+func (client *Client) listNameIdCmd(format string, args ...interface{}) ([]string, []int64, *backends.Error) {
+	list, _, err := client.listPageCmd(format, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, len(list))
+	ids := make([]int64, len(list))
+	for i, line := range list {
+		sep := strings.LastIndex(line, ":")
+		if sep < 0 {
+			return nil, nil, &backends.Error{Code: "EFAULT", Message: "Expected two values: " + line}
+		}
+		id, perr := strconv.ParseInt(line[sep+1:], 10, 64)
+		if perr != nil {
+			return nil, nil, &backends.Error{Code: "EFAULT", Message: perr.Error()}
+		}
+		names[i], ids[i] = line[:sep], id
+	}
+	return names, ids, nil
+}
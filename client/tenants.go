@@ -0,0 +1,38 @@
+package client
+
+import (
+	"github.com/UserStack/ustackd/backends"
+)
+
+// The tenant admin commands are only allowed for global clients, the client
+// doesn't implement backends.MultiTenant as the tenant of a connection is
+// selected by the client auth.
+
+func (client *Client) CreateTenant(name string) (int64, *backends.Error) {
+	return client.simpleIntCmd("tenant %s", name)
+}
+
+func (client *Client) DeleteTenant(name string) *backends.Error {
+	return client.simpleCmd("delete tenant %s", name)
+}
+
+func (client *Client) Tenants() ([]backends.Tenant, *backends.Error) {
+	if client.json {
+		response, err := client.jsonCmd("tenants")
+		if err != nil {
+			return nil, err
+		}
+		var tenants []backends.Tenant
+		err = decodeJson(response.Items, &tenants)
+		return tenants, err
+	}
+	names, ids, err := client.listNameIdCmd("tenants")
+	if err != nil {
+		return nil, err
+	}
+	tenants := make([]backends.Tenant, len(names))
+	for i, name := range names {
+		tenants[i] = backends.Tenant{Tid: ids[i], Name: name}
+	}
+	return tenants, nil
+}
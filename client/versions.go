@@ -0,0 +1,90 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// Changes are guarded by sending them with if-version, the client doesn't
+// implement backends.Versioned as the guard is checked by the server.
+
+func (client *Client) UserRevision(nameuid string) (backends.Revision, *backends.Error) {
+	info, err := client.UserInfo(nameuid)
+	if err != nil {
+		return backends.Revision{}, err
+	}
+	return backends.Revision{Version: info.Version, Created: info.Created, Updated: info.Updated}, nil
+}
+
+// UserDataRevision returns the revision of the key from the user info
+func (client *Client) UserDataRevision(nameuid string, key string) (backends.Revision, *backends.Error) {
+	info, err := client.UserInfo(nameuid)
+	if err != nil {
+		return backends.Revision{}, err
+	}
+	revision, ok := info.DataRevisions[key]
+	if !ok {
+		return revision, &backends.Error{Code: "ENOENT", Message: "Key unknown"}
+	}
+	return revision, nil
+}
+
+func (client *Client) GroupRevision(groupgid string) (backends.Revision, *backends.Error) {
+	return client.revisionCmd("group info %s", groupgid)
+}
+
+func (client *Client) revisionCmd(format string, args ...interface{}) (backends.Revision, *backends.Error) {
+	var revision backends.Revision
+	if client.json {
+		response, err := client.jsonCmd(format, args...)
+		if err != nil {
+			return revision, err
+		}
+		err = decodeJson(response.Value, &revision)
+		return revision, err
+	}
+	_, value, err := client.listPageCmd(format, args...)
+	if err != nil {
+		return revision, err
+	}
+	revision, perr := parseRevision(value)
+	if perr != nil {
+		return revision, &backends.Error{Code: "EFAULT", Message: perr.Error()}
+	}
+	return revision, nil
+}
+
+// parseRevision parses "version:<n> created:<time|unknown> updated:<time|unknown>"
+func parseRevision(value string) (backends.Revision, error) {
+	var revision backends.Revision
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return revision, fmt.Errorf("Unexpected answer: %s", value)
+		}
+		var err error
+		switch parts[0] {
+		case "version":
+			revision.Version, err = strconv.ParseInt(parts[1], 10, 64)
+		case "created":
+			revision.Created, err = parseRevisionTime(parts[1])
+		case "updated":
+			revision.Updated, err = parseRevisionTime(parts[1])
+		}
+		if err != nil {
+			return revision, err
+		}
+	}
+	return revision, nil
+}
+
+func parseRevisionTime(value string) (time.Time, error) {
+	if value == "unknown" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Acl restricts access based on the source ip address of a connection.
+// Deny rules always win, if no allow rule is given every address that isn't
+// denied is permitted.
+type Acl struct {
+	Allow, Deny []*net.IPNet
+}
+
+func parseAcl(allow, deny []string) (acl Acl, err error) {
+	if acl.Allow, err = parseNetworks(allow); err != nil {
+		return
+	}
+	acl.Deny, err = parseNetworks(deny)
+	return
+}
+
+// parseNetworks parses a list of networks in CIDR notation (IPv4 or IPv6),
+// single ip addresses are treated as host networks (/32 and /128).
+func parseNetworks(list []string) (networks []*net.IPNet, err error) {
+	for _, entry := range list {
+		for _, word := range strings.Fields(entry) {
+			network, perr := parseNetwork(word)
+			if perr != nil {
+				err = perr
+				return
+			}
+			networks = append(networks, network)
+		}
+	}
+	return
+}
+
+func parseNetwork(word string) (*net.IPNet, error) {
+	if strings.Contains(word, "/") {
+		_, network, err := net.ParseCIDR(word)
+		return network, err
+	}
+	ip := net.ParseIP(word)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid ip address or network: %s", word)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Empty returns true if the acl has no rules at all
+func (acl *Acl) Empty() bool {
+	return len(acl.Allow) == 0 && len(acl.Deny) == 0
+}
+
+// Permits checks if the passed address is allowed by the acl. Addresses
+// without ip (e.g. unix sockets) are only permitted if no allow rules exist.
+func (acl *Acl) Permits(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return len(acl.Allow) == 0
+	}
+	if contains(acl.Deny, ip) {
+		return false
+	}
+	return len(acl.Allow) == 0 || contains(acl.Allow, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP extracts the ip address of a network address or returns nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
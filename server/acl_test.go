@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestAclEmpty(t *testing.T) {
+	var acl Acl
+	if !acl.Empty() {
+		t.Fatal("expected acl to be empty")
+	}
+	if !acl.Permits(tcpAddr("192.168.1.1")) || !acl.Permits(tcpAddr("::1")) {
+		t.Fatal("empty acl should permit everything")
+	}
+}
+
+func TestAclAllow(t *testing.T) {
+	acl, err := parseAcl([]string{"10.0.0.0/8 fd00::/8", "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.1.2.3", "fd00::1", "127.0.0.1", "::ffff:10.0.0.1"} {
+		if !acl.Permits(tcpAddr(ip)) {
+			t.Fatal("expected to permit", ip)
+		}
+	}
+	for _, ip := range []string{"11.1.2.3", "fe80::1", "127.0.0.2", "::1"} {
+		if acl.Permits(tcpAddr(ip)) {
+			t.Fatal("expected not to permit", ip)
+		}
+	}
+	if acl.Permits(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}) {
+		t.Fatal("expected not to permit address without ip")
+	}
+}
+
+func TestAclDeny(t *testing.T) {
+	acl, err := parseAcl([]string{"10.0.0.0/8"}, []string{"10.0.0.13", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Permits(tcpAddr("10.0.0.13")) {
+		t.Fatal("deny should win over allow")
+	}
+	if !acl.Permits(tcpAddr("10.0.0.14")) {
+		t.Fatal("expected to permit 10.0.0.14")
+	}
+
+	acl, _ = parseAcl(nil, []string{"::1"})
+	if acl.Permits(tcpAddr("::1")) || !acl.Permits(tcpAddr("::2")) {
+		t.Fatal("expected deny only acl to block ::1 but not ::2")
+	}
+}
+
+func TestAclInvalid(t *testing.T) {
+	if _, err := parseAcl([]string{"10.0.0.0/40"}, nil); err == nil {
+		t.Fatal("expected invalid cidr to fail")
+	}
+	if _, err := parseAcl(nil, []string{"localhost"}); err == nil {
+		t.Fatal("expected hostname to fail")
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	if ip := addrIP(tcpAddr("10.0.0.1")); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal("expected 10.0.0.1 got", ip)
+	}
+	if ip := addrIP(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}); ip != nil {
+		t.Fatal("expected no ip for unix address got", ip)
+	}
+}
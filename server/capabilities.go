@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// version of the line protocol, it is announced in the realm and by the
+// capabilities command and has to be increased on incompatible changes
+const PROTOCOL_VERSION = 1
+
+// commands understood by the parser (starttls is handled by the context)
+var COMMANDS = []string{
+	"client auth", "quit", "capabilities", "format",
+	"login", "disable at", "enable at", "expire at", "set", "get", "setb", "getb", "getkeys",
+	"getall", "unset", "setmany", "find",
+	"change password", "change name", "admin rename user", "admin password",
+	"user groups", "user info", "user", "delete user", "restore user", "users", "add", "remove", "add group", "remove group", "delete group", "restore group", "rename group", "groups", "group users", "purge",
+	"group set", "group get", "group getkeys", "group unset", "group info", "group",
+	"role permissions", "role", "roles", "delete role", "permission", "permissions", "delete permission",
+	"grant", "revoke", "assign", "unassign", "check",
+	"stats", "loginstats", "begin", "commit", "rollback",
+	"tenant", "tenants", "delete tenant", "if-version", "get at", "history",
+}
+
+// response formats that can be selected with the format command
+var FORMATS = []string{"text", "json"}
+
+// optional protocol features, tags allow pipelining of commands and paging
+// the options of the users and groups listings, the transactions, tenants and
+// versions features are only announced if the backend supports them and the
+// history feature if it is enabled
+var FEATURES = []string{"tags", "paging"}
+
+// capabilities lists one capability per line in the format
+// "<name> <value>...", e.g.:
+//
+//	protocol 1
+//	command login
+//	format json
+//	feature tags
+//	auth secret
+//	tls starttls
+//	backend sqlite
+//	limit max-line-length 4096
+func (ip *Interpreter) capabilities() {
+	ip.Item(fmt.Sprintf("protocol %d", PROTOCOL_VERSION))
+	for _, command := range COMMANDS {
+		ip.Item("command " + command)
+	}
+	for _, format := range FORMATS {
+		ip.Item("format " + format)
+	}
+	for _, feature := range FEATURES {
+		ip.Item("feature " + feature)
+	}
+	if _, ok := ip.Backend.(backends.Transactional); ok {
+		ip.Item("feature transactions")
+	}
+	if _, ok := ip.Backend.(backends.MultiTenant); ok {
+		ip.Item("feature tenants")
+	}
+	if _, ok := ip.Backend.(backends.Versioned); ok {
+		ip.Item("feature versions")
+	}
+	if ip.Cfg.History.Enabled {
+		ip.Item("feature history")
+	}
+	for _, mechanism := range ip.authMechanisms() {
+		ip.Item("auth " + mechanism)
+	}
+	if _, ok := ip.conn.(*tls.Conn); ok {
+		ip.Item("tls active")
+	} else if ip.tlsConfig != nil {
+		ip.Item("command starttls")
+		ip.Item("tls starttls")
+	} else {
+		ip.Item("tls none")
+	}
+	ip.Item("backend " + ip.Cfg.Daemon.Backend)
+	for _, limit := range ip.limits() {
+		ip.Item("limit " + limit)
+	}
+	ip.Ok()
+}
+
+// authMechanisms returns how clients can authenticate: none (no auth
+// required), secret (client auth) or peer (unix socket credentials)
+func (ip *Interpreter) authMechanisms() (mechanisms []string) {
+	if len(ip.Cfg.Client.Auth) == 0 {
+		return []string{"none"}
+	}
+	var secret, peer bool
+	for _, auth := range ip.Cfg.Client.Auth {
+		if auth.Passwd != "" {
+			secret = true
+		}
+		if len(auth.Uids) > 0 || len(auth.Gids) > 0 {
+			peer = true
+		}
+	}
+	if secret {
+		mechanisms = append(mechanisms, "secret")
+	}
+	if peer {
+		mechanisms = append(mechanisms, "peer")
+	}
+	return
+}
+
+// limits returns the configured limits, 0 means unlimited
+func (ip *Interpreter) limits() []string {
+	daemon := ip.Cfg.Daemon
+	return []string{
+		fmt.Sprintf("idle-timeout %d", daemon.IdleTimeout),
+		fmt.Sprintf("command-timeout %d", daemon.CommandTimeout),
+		fmt.Sprintf("max-line-length %d", daemon.MaxLineLength),
+		fmt.Sprintf("max-value-size %d", daemon.MaxValueSize),
+		fmt.Sprintf("max-connections %d", daemon.MaxConnections),
+		fmt.Sprintf("max-connections-per-ip %d", daemon.MaxConnectionsPerIp),
+	}
+}
@@ -2,39 +2,57 @@ package server
 
 import (
 	"code.google.com/p/gcfg"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log/syslog"
+	"os"
+	"os/user"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ConfigIntern struct {
 	Daemon
-	Syslog SyslogIntern
-	Client ClientIntern
+	Syslog   SyslogIntern
+	Client   ClientIntern
+	Listener map[string]*ListenerIntern
 	Security
 	Ssl
 	Sqlite
 	Mysql
 	Postgres
 	Proxy
+	History HistoryIntern
 }
 
 type Config struct {
 	Daemon
 	Syslog
 	Client
+	Listener map[string]*Listener
 	Security
 	Ssl
 	Sqlite
 	Mysql
 	Postgres
 	Proxy
+	History
 }
 
 type Daemon struct {
 	Listen              []string
 	Realm, Backend, Pid string
 	Foreground          bool
+	IdleTimeout         int  `gcfg:"idle-timeout"`
+	CommandTimeout      int  `gcfg:"command-timeout"`
+	MaxLineLength       int  `gcfg:"max-line-length"`
+	MaxConnections      int  `gcfg:"max-connections"`
+	MaxConnectionsPerIp int  `gcfg:"max-connections-per-ip"`
+	MaxValueSize        int  `gcfg:"max-value-size"`
+	HideInternalErrors  bool `gcfg:"hide-internal-errors"`
+	TrashRetention      int  `gcfg:"trash-retention"`
 }
 
 type SyslogIntern struct {
@@ -46,7 +64,7 @@ type Syslog struct {
 }
 
 type ClientIntern struct {
-	Auth []string
+	Auth, Allow, Deny, Peer, Tenant, Name []string
 }
 
 type Client struct {
@@ -56,6 +74,58 @@ type Client struct {
 type Auth struct {
 	Passwd, Regex string
 	Allow         bool
+	Source        Acl
+	Uids, Gids    []int
+	Tenant        string // empty for global clients (operators)
+	Name          string // identity of the client in the history
+}
+
+// Identity returns the name of the client or, for clients without a name, the
+// tenant and a short hash of the secret. Unlike the position of the rule it
+// doesn't change if the rules are reordered.
+func (auth *Auth) Identity() string {
+	if auth.Name != "" {
+		return auth.Name
+	}
+	sum := sha256.Sum256([]byte(auth.Passwd))
+	hash := hex.EncodeToString(sum[:4])
+	if auth.Tenant != "" {
+		return auth.Tenant + "/" + hash
+	}
+	return hash
+}
+
+// MatchesPeer returns true if the auth should be selected for the peer
+// credentials of a unix socket connection
+func (auth *Auth) MatchesPeer(peer *Peer) bool {
+	if peer == nil {
+		return false
+	}
+	for _, uid := range auth.Uids {
+		if uid == peer.Uid {
+			return true
+		}
+	}
+	for _, gid := range auth.Gids {
+		if gid == peer.Gid {
+			return true
+		}
+	}
+	return false
+}
+
+type ListenerIntern struct {
+	Allow, Deny, Trusted []string
+	Proxy                bool
+	Mode, Owner          string
+}
+
+type Listener struct {
+	Source   Acl
+	Proxy    bool
+	Trusted  Acl
+	Mode     os.FileMode
+	Uid, Gid int
 }
 
 type Security struct {
@@ -85,6 +155,16 @@ type Proxy struct {
 	Cert, Passwd string
 }
 
+type HistoryIntern struct {
+	Enabled   bool
+	Retention []string
+}
+
+type History struct {
+	Enabled   bool
+	Retention map[string]time.Duration // by key, "*" for the other keys
+}
+
 func Read(filename string) (config Config, err error) {
 	var cfgIntern ConfigIntern
 	err = gcfg.ReadFileInto(&cfgIntern, filename)
@@ -109,6 +189,39 @@ func Read(filename string) (config Config, err error) {
 	config.Postgres = cfgIntern.Postgres
 
 	config.Client, err = splitAuth(cfgIntern.Client)
+	if err != nil {
+		return
+	}
+
+	config.Listener, err = translateListeners(cfgIntern.Listener)
+	if err != nil {
+		return
+	}
+
+	config.History, err = translateHistory(cfgIntern.History)
+	return
+}
+
+// translateHistory parses the retention lines like "<key|*> <days>", 0 days
+// keep the changes forever
+func translateHistory(historyIntern HistoryIntern) (history History, err error) {
+	history.Enabled = historyIntern.Enabled
+	for _, line := range historyIntern.Retention {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			err = fmt.Errorf("Could not split [history] retention line into key and days: %s", line)
+			return
+		}
+		days, perr := strconv.Atoi(fields[1])
+		if perr != nil || days < 0 {
+			err = fmt.Errorf("Invalid days in [history] retention line: %s", line)
+			return
+		}
+		if history.Retention == nil {
+			history.Retention = make(map[string]time.Duration)
+		}
+		history.Retention[fields[0]] = time.Duration(days) * 24 * time.Hour
+	}
 	return
 }
 
@@ -137,6 +250,219 @@ func splitAuth(clientIntern ClientIntern) (client Client, err error) {
 		}
 		client.Auth[i] = auth
 	}
+
+	if err = addAuthSources(client.Auth, clientIntern.Allow, true); err != nil {
+		return
+	}
+	if err = addAuthSources(client.Auth, clientIntern.Deny, false); err != nil {
+		return
+	}
+	if err = addAuthPeers(client.Auth, clientIntern.Peer); err != nil {
+		return
+	}
+	if err = addAuthTenants(client.Auth, clientIntern.Tenant); err != nil {
+		return
+	}
+	err = addAuthNames(client.Auth, clientIntern.Name)
+	return
+}
+
+// addAuthSources parses lines like "<passwd> <network> [<network> ...]" and
+// adds the networks to the allow or deny list of the matching auth
+func addAuthSources(auths []Auth, lines []string, allow bool) error {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("Could not split [client] source line into passwd and networks: %s", line)
+		}
+		networks, err := parseNetworks(fields[1:])
+		if err != nil {
+			return err
+		}
+		found := false
+		for i := range auths {
+			if auths[i].Passwd != fields[0] {
+				continue
+			}
+			found = true
+			if allow {
+				auths[i].Source.Allow = append(auths[i].Source.Allow, networks...)
+			} else {
+				auths[i].Source.Deny = append(auths[i].Source.Deny, networks...)
+			}
+		}
+		if !found {
+			return fmt.Errorf("No [client] auth found for source line: %s", line)
+		}
+	}
+	return nil
+}
+
+// addAuthPeers parses lines like "<passwd> uid=<user|uid> gid=<group|gid>"
+// and adds the uids and gids to the matching auth
+func addAuthPeers(auths []Auth, lines []string) error {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("Could not split [client] peer line into passwd and credentials: %s", line)
+		}
+		var uids, gids []int
+		for _, field := range fields[1:] {
+			pair := strings.SplitN(field, "=", 2)
+			if len(pair) != 2 {
+				return fmt.Errorf("Expected uid=<user|uid> or gid=<group|gid> in [client] peer line: %s", line)
+			}
+			switch pair[0] {
+			case "uid":
+				uid, err := lookupUid(pair[1])
+				if err != nil {
+					return err
+				}
+				uids = append(uids, uid)
+			case "gid":
+				gid, err := lookupGid(pair[1])
+				if err != nil {
+					return err
+				}
+				gids = append(gids, gid)
+			default:
+				return fmt.Errorf("Expected uid=<user|uid> or gid=<group|gid> in [client] peer line: %s", line)
+			}
+		}
+		found := false
+		for i := range auths {
+			if auths[i].Passwd == fields[0] {
+				found = true
+				auths[i].Uids = append(auths[i].Uids, uids...)
+				auths[i].Gids = append(auths[i].Gids, gids...)
+			}
+		}
+		if !found {
+			return fmt.Errorf("No [client] auth found for peer line: %s", line)
+		}
+	}
+	return nil
+}
+
+// addAuthTenants parses lines like "<passwd> <tenant>" and binds the matching
+// auth to the tenant
+func addAuthTenants(auths []Auth, lines []string) error {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Could not split [client] tenant line into passwd and tenant: %s", line)
+		}
+		found := false
+		for i := range auths {
+			if auths[i].Passwd == fields[0] {
+				found = true
+				auths[i].Tenant = fields[1]
+			}
+		}
+		if !found {
+			return fmt.Errorf("No [client] auth found for tenant line: %s", line)
+		}
+	}
+	return nil
+}
+
+// addAuthNames parses lines like "<passwd> <name>" and names the matching
+// auth
+func addAuthNames(auths []Auth, lines []string) error {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Could not split [client] name line into passwd and name: %s", line)
+		}
+		found := false
+		for i := range auths {
+			if auths[i].Passwd == fields[0] {
+				found = true
+				auths[i].Name = fields[1]
+			}
+		}
+		if !found {
+			return fmt.Errorf("No [client] auth found for name line: %s", line)
+		}
+	}
+	return nil
+}
+
+func lookupUid(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(usr.Uid)
+}
+
+func lookupGid(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// parseOwner parses "<user|uid>[:<group|gid>]", -1 is returned for the
+// parts that should stay unchanged
+func parseOwner(owner string) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		if uid, err = lookupUid(parts[0]); err != nil {
+			return
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		gid, err = lookupGid(parts[1])
+	}
+	return
+}
+
+// translateListeners parses the [listener "<address|name>"] sections, the
+// name is either a [Daemon] listen address or the name of a socket passed by
+// systemd
+func translateListeners(listenersIntern map[string]*ListenerIntern) (listeners map[string]*Listener, err error) {
+	listeners = make(map[string]*Listener)
+	for address, listenerIntern := range listenersIntern {
+		var listener Listener
+		listener.Source, err = parseAcl(listenerIntern.Allow, listenerIntern.Deny)
+		if err != nil {
+			return
+		}
+		listener.Proxy = listenerIntern.Proxy
+		listener.Trusted, err = parseAcl(listenerIntern.Trusted, nil)
+		if err != nil {
+			return
+		}
+		if listener.Proxy && listener.Trusted.Empty() {
+			err = fmt.Errorf("[listener \"%s\"] proxy requires at least one trusted network", address)
+			return
+		}
+		if listenerIntern.Mode != "" {
+			mode, perr := strconv.ParseUint(listenerIntern.Mode, 8, 32)
+			if perr != nil {
+				err = fmt.Errorf("[listener \"%s\"] invalid mode: %s", address, listenerIntern.Mode)
+				return
+			}
+			listener.Mode = os.FileMode(mode)
+		}
+		listener.Uid, listener.Gid, err = parseOwner(listenerIntern.Owner)
+		if err != nil {
+			return
+		}
+		listeners[address] = &listener
+	}
 	return
 }
 
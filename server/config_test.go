@@ -2,10 +2,20 @@ package server
 
 import (
 	"log/syslog"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
+func network(cidr string) *net.IPNet {
+	n, err := parseNetwork(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
 func TestRead(t *testing.T) {
 	cfg, err := Read("../config/ustackd.conf")
 
@@ -16,9 +26,10 @@ func TestRead(t *testing.T) {
 	var nilString string
 
 	expected := Config{
-		Daemon{[]string{"0.0.0.0:7654"}, "ustackd $VERSION$", "sqlite", "./ustackd.pid", false},
+		Daemon{[]string{"0.0.0.0:7654"}, "ustackd $VERSION$", "sqlite", "./ustackd.pid", false, 0, 0, 0, 0, 0, 0, false, 0},
 		Syslog{syslog.LOG_FTP, syslog.LOG_DEBUG},
 		Client{[]Auth{}},
+		map[string]*Listener{},
 		Security{nilString, nilString},
 
 		Ssl{true, "config/key.pem", "config/cert.pem"},
@@ -26,6 +37,7 @@ func TestRead(t *testing.T) {
 		Mysql{""},
 		Postgres{""},
 		Proxy{"", false, "", ""},
+		History{false, nil},
 	}
 
 	if !reflect.DeepEqual(cfg, expected) {
@@ -44,9 +56,10 @@ func TestDefault(t *testing.T) {
 	var nilString string
 
 	expected := Config{
-		Daemon{[]string{"0.0.0.0:7654"}, "ustackd $VERSION$", "nil", "./ustackd.pid", true},
+		Daemon{[]string{"0.0.0.0:7654"}, "ustackd $VERSION$", "nil", "./ustackd.pid", true, 0, 0, 0, 0, 0, 0, false, 0},
 		Syslog{syslog.LOG_DAEMON, syslog.LOG_EMERG},
 		Client{[]Auth{}},
+		map[string]*Listener{},
 		Security{nilString, nilString},
 
 		Ssl{false, nilString, nilString},
@@ -54,6 +67,7 @@ func TestDefault(t *testing.T) {
 		Mysql{""},
 		Postgres{""},
 		Proxy{nilString, false, nilString, nilString},
+		History{false, nil},
 	}
 
 	if !reflect.DeepEqual(cfg, expected) {
@@ -69,14 +83,24 @@ func TestReadAll(t *testing.T) {
 	}
 
 	expected := Config{
-		Daemon{[]string{"0.0.0.0:1234", "127.0.0.1:7654"}, "ustackd $VERSION$", "sqlite", "/var/run/ustackd.pid", true},
+		Daemon{[]string{"0.0.0.0:1234", "127.0.0.1:7654", "unix:/var/run/ustackd.sock"}, "ustackd $VERSION$", "sqlite", "/var/run/ustackd.pid", true, 300, 30, 4096, 1000, 100, 65536, true, 30},
 		Syslog{syslog.LOG_FTP, syslog.LOG_DEBUG},
 		Client{[]Auth{
-			Auth{"42421da75756d69832d", ".*", true},
-			Auth{"6d95e4ac638daf4b786", "^(login|set|get|change (password|email))", true},
-			Auth{"04d6eb93ab5d30f7bb0", "^(users|groups|group users)", false},
+			Auth{"42421da75756d69832d", ".*", true, Acl{
+				[]*net.IPNet{network("10.0.0.0/8"), network("fd00::/8")},
+				[]*net.IPNet{network("10.0.0.13")},
+			}, nil, nil, "", "webgui"},
+			Auth{"6d95e4ac638daf4b786", "^(login|set|get|change (password|email))( |$)", true, Acl{}, []int{33}, []int{0}, "acme", ""},
+			Auth{"04d6eb93ab5d30f7bb0", "^(users|groups|group users)", false, Acl{}, nil, nil, "", ""},
 		},
 		},
+		map[string]*Listener{
+			"127.0.0.1:7654": &Listener{Acl{
+				[]*net.IPNet{network("127.0.0.0/8"), network("::1")},
+				[]*net.IPNet{network("127.0.0.2")},
+			}, true, Acl{[]*net.IPNet{network("127.0.0.1")}, nil}, 0, -1, -1},
+			"unix:/var/run/ustackd.sock": &Listener{Acl{}, false, Acl{}, 0660, 0, 0},
+		},
 		Security{
 			"/var/run/ustackd",
 			"ustack",
@@ -90,6 +114,11 @@ func TestReadAll(t *testing.T) {
 		Mysql{"travis/ustackd?encoding=utf8"},
 		Postgres{"user=postgres dbname=ustackd"},
 		Proxy{"127.0.0.1:7654", true, "config/cert.pem", "SOMEVERYGOODSECRET"},
+		History{true, map[string]time.Duration{
+			"*":     90 * 24 * time.Hour,
+			"email": 365 * 24 * time.Hour,
+			"phone": 0,
+		}},
 	}
 
 	if !reflect.DeepEqual(cfg, expected) {
@@ -116,7 +145,7 @@ func TestSplitAuth(t *testing.T) {
 		t.Error(err.Error())
 	}
 
-	expected := Client{[]Auth{Auth{"a", "c", false}}}
+	expected := Client{[]Auth{Auth{"a", "c", false, Acl{}, nil, nil, "", ""}}}
 	if !reflect.DeepEqual(client, expected) {
 		t.Errorf("Config.Client is expected to be %+v, but is %+v", expected, client)
 	}
@@ -130,7 +159,7 @@ func TestSplitAuthAllow(t *testing.T) {
 		t.Error(err.Error())
 	}
 
-	expected := Client{[]Auth{Auth{"a", "c", true}}}
+	expected := Client{[]Auth{Auth{"a", "c", true, Acl{}, nil, nil, "", ""}}}
 	if !reflect.DeepEqual(client, expected) {
 		t.Errorf("Config.Client is expected to be %+v, but is %+v", expected, client)
 	}
@@ -145,3 +174,140 @@ func TestSplitAuthFail(t *testing.T) {
 	}
 
 }
+
+func TestSplitAuthSources(t *testing.T) {
+	clientIntern := ClientIntern{
+		Auth:  []string{"a:allow:c", "b:allow:c"},
+		Allow: []string{"a 10.0.0.0/8 ::1"},
+		Deny:  []string{"a 10.0.0.1"},
+	}
+	client, err := splitAuth(clientIntern)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	expected := Client{[]Auth{
+		Auth{"a", "c", true, Acl{
+			[]*net.IPNet{network("10.0.0.0/8"), network("::1/128")},
+			[]*net.IPNet{network("10.0.0.1/32")},
+		}, nil, nil, "", ""},
+		Auth{"b", "c", true, Acl{}, nil, nil, "", ""},
+	}}
+	if !reflect.DeepEqual(client, expected) {
+		t.Errorf("Config.Client is expected to be %+v, but is %+v", expected, client)
+	}
+}
+
+func TestSplitAuthSourcesFail(t *testing.T) {
+	_, err := splitAuth(ClientIntern{Auth: []string{"a:allow:c"}, Allow: []string{"b 10.0.0.0/8"}})
+	if err == nil || err.Error() != "No [client] auth found for source line: b 10.0.0.0/8" {
+		t.Error("Failed to fail on unknown passwd", err)
+	}
+
+	_, err = splitAuth(ClientIntern{Auth: []string{"a:allow:c"}, Deny: []string{"a 10.0.0.0/33"}})
+	if err == nil {
+		t.Error("Failed to fail on invalid network")
+	}
+
+	_, err = splitAuth(ClientIntern{Auth: []string{"a:allow:c"}, Deny: []string{"a"}})
+	if err == nil {
+		t.Error("Failed to fail on missing network")
+	}
+}
+
+func TestTranslateListenersProxyWithoutTrusted(t *testing.T) {
+	_, err := translateListeners(map[string]*ListenerIntern{
+		"127.0.0.1:1": &ListenerIntern{Proxy: true},
+	})
+	if err == nil {
+		t.Error("Failed to fail on proxy without trusted networks")
+	}
+}
+
+func TestSplitAuthPeers(t *testing.T) {
+	client, err := splitAuth(ClientIntern{
+		Auth: []string{"a:allow:c", "b:allow:c"},
+		Peer: []string{"a uid=1000 gid=100", "a uid=1001"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.Auth[0].Uids, []int{1000, 1001}) ||
+		!reflect.DeepEqual(client.Auth[0].Gids, []int{100}) {
+		t.Errorf("Unexpected peer credentials %+v", client.Auth[0])
+	}
+	if !client.Auth[0].MatchesPeer(&Peer{Uid: 1001, Gid: 1001}) ||
+		!client.Auth[0].MatchesPeer(&Peer{Uid: 5, Gid: 100}) {
+		t.Error("Expected auth to match peer")
+	}
+	if client.Auth[0].MatchesPeer(&Peer{Uid: 5, Gid: 5}) || client.Auth[0].MatchesPeer(nil) ||
+		client.Auth[1].MatchesPeer(&Peer{Uid: 1000, Gid: 100}) {
+		t.Error("Expected auth not to match peer")
+	}
+
+	for _, line := range []string{"a", "a uid", "a pid=1", "b uid=1", "a uid=doesnotexist-ustackd"} {
+		_, err = splitAuth(ClientIntern{Auth: []string{"a:allow:c"}, Peer: []string{line}})
+		if err == nil {
+			t.Error("Failed to fail on invalid peer line", line)
+		}
+	}
+}
+
+func TestSplitAuthTenants(t *testing.T) {
+	client, err := splitAuth(ClientIntern{
+		Auth:   []string{"a:allow:c", "b:allow:c"},
+		Tenant: []string{"a acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Auth[0].Tenant != "acme" || client.Auth[1].Tenant != "" {
+		t.Errorf("Unexpected tenants %+v", client.Auth)
+	}
+
+	for _, line := range []string{"a", "a acme other", "c acme"} {
+		_, err = splitAuth(ClientIntern{Auth: []string{"a:allow:c"}, Tenant: []string{line}})
+		if err == nil {
+			t.Error("Failed to fail on invalid tenant line", line)
+		}
+	}
+}
+
+func TestSplitAuthNames(t *testing.T) {
+	client, err := splitAuth(ClientIntern{
+		Auth: []string{"a:allow:c", "b:allow:c"},
+		Name: []string{"b webgui"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Auth[0].Name != "" || client.Auth[1].Name != "webgui" {
+		t.Errorf("Unexpected names %+v", client.Auth)
+	}
+
+	for _, line := range []string{"a", "a webgui other", "c webgui"} {
+		_, err = splitAuth(ClientIntern{Auth: []string{"a:allow:c"}, Name: []string{line}})
+		if err == nil {
+			t.Error("Failed to fail on invalid name line", line)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	uid, gid, err := parseOwner("")
+	if err != nil || uid != -1 || gid != -1 {
+		t.Error("Expected unchanged owner, got", uid, gid, err)
+	}
+	uid, gid, err = parseOwner("10:20")
+	if err != nil || uid != 10 || gid != 20 {
+		t.Error("Expected owner 10:20, got", uid, gid, err)
+	}
+	uid, gid, err = parseOwner(":20")
+	if err != nil || uid != -1 || gid != 20 {
+		t.Error("Expected owner -1:20, got", uid, gid, err)
+	}
+	_, _, err = parseOwner("doesnotexist-ustackd")
+	if err == nil {
+		t.Error("Failed to fail on unknown user")
+	}
+}
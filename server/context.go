@@ -6,15 +6,48 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+	"github.com/UserStack/ustackd/client"
 )
 
+// time a trusted proxy has to send the PROXY protocol header
+const PROXY_HEADER_TIMEOUT = 10 * time.Second
+
 type Context struct {
 	conn   net.Conn
 	reader *bufio.Reader
 	writer *bufio.Writer
 	*Server
 	addr     net.Addr
+	listener *Listener
+	peer     *Peer
 	quitting bool
+	json     bool
+	items    []interface{}
+	tag      string
+	failed   bool     // an error was sent, reset before commands with if-version
+	holding  bool     // lines are held back until they are released
+	held     []string // lines that are held back
+}
+
+// Peer contains the credentials of the process on the other end of a unix
+// socket connection
+type Peer struct {
+	Uid, Gid, Pid int
+}
+
+// bufferedConn is a connection that reads through a buffered reader, so that
+// data that was already buffered doesn't get lost if the connection is
+// wrapped (e.g. on starttls)
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
 }
 
 func NewContext(conn net.Conn, server *Server) *Context {
@@ -27,29 +60,88 @@ func NewContext(conn net.Conn, server *Server) *Context {
 	}
 }
 
+// Write sends a line, it is prefixed with the tag of the current command
 func (context *Context) Write(line string) {
+	if context.tag != "" {
+		line = context.tag + " " + line
+	}
+	if context.holding {
+		context.held = append(context.held, line)
+		return
+	}
+	context.writeLine(line)
+}
+
+func (context *Context) writeLine(line string) {
 	context.Log("<- " + line)
+	if timeout := context.Cfg.Daemon.CommandTimeout; timeout > 0 {
+		context.conn.SetWriteDeadline(time.Now().Add(
+			time.Duration(timeout) * time.Second))
+	}
 	context.writer.WriteString(line + "\r\n")
 	context.writer.Flush()
 }
 
+// hold holds back the following lines, e.g. until a transaction is
+// committed
+func (context *Context) hold() {
+	context.holding = true
+}
+
+// release sends the held back lines or discards them
+func (context *Context) release(send bool) {
+	context.holding = false
+	if send {
+		for _, line := range context.held {
+			context.writeLine(line)
+		}
+	}
+	context.held = nil
+}
+
 func (context *Context) Writef(format string, args ...interface{}) {
-	line := fmt.Sprintf(format, args...)
-	context.Log("<- " + line)
-	context.writer.WriteString(line + "\r\n")
-	context.writer.Flush()
+	context.Write(fmt.Sprintf(format, args...))
 }
 
 func (context *Context) Ok() {
+	if context.json {
+		context.writeJson(&Response{Ok: true})
+		return
+	}
 	context.Write("+ OK")
 }
 
 func (context *Context) OkValue(value interface{}) {
+	if context.json {
+		context.writeJson(&Response{Ok: true, Value: value})
+		return
+	}
 	context.Writef("+ OK %v", value)
 }
 
-func (context *Context) Err(code string) {
-	context.Write("- " + code)
+// Err sends an error response with the code and a human readable message
+func (context *Context) Err(code string, message string) {
+	context.failed = true
+	message = strings.Join(strings.Fields(message), " ") // no line breaks
+	if context.json {
+		context.writeJson(&Response{Code: code, Message: message})
+		return
+	}
+	if message == "" {
+		context.Write("- " + code)
+		return
+	}
+	context.Write("- " + code + " " + message)
+}
+
+// Error sends the backend error, internal details are hidden if configured
+func (context *Context) Error(err *backends.Error) {
+	if context.Cfg.Daemon.HideInternalErrors && err.Code == "EFAULT" {
+		context.Logf("Internal error: %s", err.Message)
+		context.Err(err.Code, "Internal error")
+		return
+	}
+	context.Err(err.Code, err.Message)
 }
 
 func (context *Context) Log(line string) {
@@ -60,10 +152,12 @@ func (context *Context) Logf(format string, args ...interface{}) {
 	context.Log(fmt.Sprintf(format, args...))
 }
 
+// Realm sends the configured realm followed by the protocol version, e.g.
+// "ustackd 0.0.1 [PROTOCOL 1]"
 func (context *Context) Realm() {
 	realm := strings.Replace(context.Cfg.Daemon.Realm, "$VERSION$",
 		context.App.Version, 1)
-	context.Write(realm)
+	context.Writef("%s [PROTOCOL %d]", realm, PROTOCOL_VERSION)
 	context.Log("Client connected")
 	context.Server.Stats.Connects++
 }
@@ -71,21 +165,136 @@ func (context *Context) Realm() {
 func (context *Context) Close() {
 	context.Log("Client disconnected")
 	context.Server.Stats.Disconnects++
+	context.Server.connections.release(addrIP(context.addr))
 	context.conn.Close()
 }
 
+// accept checks the listener configuration of the connection, reads the
+// PROXY protocol header of trusted proxies, checks the listener acl and the
+// connection limits
+func (context *Context) accept() bool {
+	if conn, ok := context.conn.(*net.UnixConn); ok {
+		peer, err := peerCredentials(conn)
+		if err != nil {
+			context.Logf("Unable to get peer credentials: %s", err)
+		} else {
+			context.Logf("Peer uid=%d gid=%d pid=%d", peer.Uid, peer.Gid, peer.Pid)
+			context.peer = peer
+		}
+	}
+	if context.listener != nil && !context.acceptListener(context.listener) {
+		return false
+	}
+	return context.acquireConnection()
+}
+
+func (context *Context) acceptListener(listener *Listener) bool {
+	if listener.Proxy && listener.Trusted.Permits(context.addr) {
+		context.conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		addr, err := readProxyHeader(context.reader)
+		context.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			context.Logf("Invalid proxy protocol header: %s", err)
+			context.Server.Stats.rejectedProxyHeaders++
+			return false
+		}
+		if addr != nil {
+			context.Logf("Proxied connection from %s", addr)
+			context.addr = addr
+		}
+	}
+	if !listener.Source.Permits(context.addr) {
+		context.Log("Connection refused by listener acl")
+		context.Server.Stats.rejectedConnections++
+		return false
+	}
+	return true
+}
+
+func (context *Context) acquireConnection() bool {
+	daemon := context.Cfg.Daemon
+	ok, perIp := context.Server.connections.acquire(addrIP(context.addr),
+		daemon.MaxConnections, daemon.MaxConnectionsPerIp)
+	if ok {
+		return true
+	}
+	if perIp {
+		context.Log("Connection refused, too many connections from address")
+		context.Server.Stats.ipConnectionLimitRejects++
+	} else {
+		context.Log("Connection refused, too many connections")
+		context.Server.Stats.connectionLimitRejects++
+	}
+	context.Err("EMFILE", "Too many connections")
+	return false
+}
+
+// readLine waits at most the idle timeout for the next command, which then
+// has to be received completely within the command timeout
+func (context *Context) readLine() (string, error) {
+	daemon := context.Cfg.Daemon
+	if daemon.IdleTimeout > 0 {
+		context.conn.SetReadDeadline(time.Now().Add(
+			time.Duration(daemon.IdleTimeout) * time.Second))
+	}
+	if _, err := context.reader.Peek(1); err != nil {
+		if isTimeout(err) {
+			return "", errIdleTimeout
+		}
+		return "", err
+	}
+	if daemon.CommandTimeout > 0 {
+		context.conn.SetReadDeadline(time.Now().Add(
+			time.Duration(daemon.CommandTimeout) * time.Second))
+	} else if daemon.IdleTimeout > 0 {
+		context.conn.SetReadDeadline(time.Time{})
+	}
+	line, err := readLimitedLine(context.reader, daemon.MaxLineLength)
+	if err != nil && isTimeout(err) {
+		return "", errCommandTimeout
+	}
+	return line, err
+}
+
 func (context *Context) Handle() {
+	if !context.accept() {
+		context.conn.Close()
+		return
+	}
 	context.Realm()
 	defer context.Close()
 	interpreter := Interpreter{Context: context}
+	defer interpreter.closeTenant()
+	defer interpreter.abortTransaction()
+	interpreter.identify()
+	interpreter.peerAuth()
 
 	for !context.quitting {
-		line, err := context.reader.ReadString('\n')
-		if err != nil {
-			break // quit connection
+		line, err := context.readLine()
+		context.tag = ""
+		switch err {
+		case nil:
+		case errLineTooLong:
+			context.Log("Line too long")
+			context.Server.Stats.tooLongLines++
+			context.Err("E2BIG", "Line too long")
+			continue
+		case errIdleTimeout:
+			context.Log("Idle timeout")
+			context.Server.Stats.idleTimeouts++
+			context.Err("ETIMEDOUT", "Idle timeout")
+			return
+		case errCommandTimeout:
+			context.Log("Command timeout")
+			context.Server.Stats.commandTimeouts++
+			context.Err("ETIMEDOUT", "Command timeout")
+			return
+		default:
+			return // quit connection
 		}
 		line = strings.Trim(line, " \r\n")
 		context.Log("-> " + line)
+		context.tag, line = client.SplitTag(line)
 		if context.starttls(line) {
 			continue
 		}
@@ -95,11 +304,12 @@ func (context *Context) Handle() {
 
 func (context *Context) starttls(line string) bool {
 	if line == "starttls" && context.tlsConfig != nil {
-		conn := tls.Server(context.conn, context.tlsConfig)
+		conn := tls.Server(&bufferedConn{context.conn, context.reader},
+			context.tlsConfig)
 		err := conn.Handshake()
 		if err != nil {
 			context.Logf("Faild to change to channel: %v", err)
-			context.Err("EFAULT")
+			context.Err("EFAULT", "Failed to change to tls channel")
 		} else {
 			context.conn = conn
 			context.reader = bufio.NewReader(conn)
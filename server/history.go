@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+	"github.com/UserStack/ustackd/client"
+)
+
+// identity of the client that is recorded with the changes in the history,
+// the identity of the authenticated [client] rule (see Auth.Identity), the
+// peer credentials of unix socket connections or the remote address without
+// the port
+func (ip *Interpreter) identity() string {
+	if ip.auth != nil {
+		return "client=" + ip.auth.Identity()
+	}
+	if ip.peer != nil {
+		return fmt.Sprintf("uid=%d gid=%d", ip.peer.Uid, ip.peer.Gid)
+	}
+	if host, _, err := net.SplitHostPort(ip.addr.String()); err == nil {
+		return host
+	}
+	return ip.addr.String()
+}
+
+// identify selects a copy of the backend (of the tenant) that records the
+// changes in the history with the identity of the client
+func (ip *Interpreter) identify() {
+	if !ip.Cfg.History.Enabled {
+		return
+	}
+	backend := ip.tenant
+	if backend == nil {
+		backend = ip.Backend
+	}
+	historized, ok := backend.(backends.Historized)
+	if !ok {
+		return
+	}
+	identified := historized.Identify(ip.identity())
+	ip.closeTenant()
+	ip.tenant = identified
+}
+
+// get <name|uid> <key> at <time>
+func (ip *Interpreter) getAt(args []string) {
+	at, perr := time.Parse(time.RFC3339, args[2])
+	if perr != nil {
+		ip.Err("EINVAL", "Invalid time, expected RFC3339")
+		return
+	}
+	val, err := ip.backend().GetUserDataAt(args[0], args[1], at)
+	if err != nil {
+		ip.Error(err)
+	} else if !ip.json && strings.ContainsAny(val, "\r\n") {
+		ip.Err("EILSEQ", "Value contains line breaks, use the json format")
+	} else {
+		ip.Value(val)
+	}
+}
+
+// history <name|uid> <key>
+//
+// The text format has one change per line, the oldest first. Clients and
+// values are quoted, the time of values from before the history was enabled
+// is unknown:
+//
+//	unknown "" set "joe@example.com"
+//	2026-01-01T12:00:00Z "client=webgui" set "joe@example.org"
+//	2026-01-02T08:30:00Z "uid=1000 gid=1000" unset
+func (ip *Interpreter) history(args []string) {
+	changes, err := ip.backend().UserDataHistory(args[0], args[1])
+	if err != nil {
+		ip.Error(err)
+		return
+	}
+	for _, change := range changes {
+		if ip.json {
+			ip.Item(change)
+		} else {
+			ip.Item(formatDataChange(change))
+		}
+	}
+	ip.Ok()
+}
+
+func formatDataChange(change backends.DataChange) string {
+	line := formatInfoTime(change.Changed) + " " + client.Quote(change.Client)
+	if change.Unset {
+		return line + " unset"
+	}
+	return line + " set " + client.Quote(change.Value)
+}
+
+// pruneHistory removes the changes that were replaced longer than the
+// retention of their key ago
+func (s *Server) pruneHistory(backend backends.Historized, retention map[string]time.Duration) {
+	count, err := backend.PruneHistory(retention)
+	if err != nil {
+		s.Logger.Printf("Unable to prune the history: %s\n", err)
+		return
+	}
+	if count > 0 {
+		s.Logger.Printf("Pruned %d changes from the history\n", count)
+	}
+}
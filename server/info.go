@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/UserStack/ustackd/client"
+)
+
+// user info <name|uid>
+//
+// The text format has one field per line, names, keys and values are quoted:
+//
+//	uid 1
+//	name "joe"
+//	active Y
+//	expires never
+//	version 3
+//	created 2026-01-01T12:00:00Z
+//	updated 2026-01-02T08:30:00Z
+//	latestlogin 2026-01-02T08:00:00Z
+//	previouslogin 2026-01-01T18:00:00Z
+//	failcount 0
+//	group "admins" 2
+//	data "email" "joe@example.com"
+//	datarevision "email" version:2 created:2026-01-01T12:00:00Z updated:2026-01-02T08:30:00Z
+func (ip *Interpreter) userInfo(args []string) {
+	info, err := ip.backend().UserInfo(args[0])
+	if err != nil {
+		ip.Error(err)
+		return
+	}
+	if ip.json {
+		ip.OkValue(info)
+		return
+	}
+	active := "N"
+	if info.Active {
+		active = "Y"
+	}
+	ip.Item(fmt.Sprintf("uid %d", info.Uid))
+	ip.Item("name " + client.Quote(info.Name))
+	ip.Item("active " + active)
+	ip.Item("expires " + formatExpiry(info.Expires))
+	ip.Item(fmt.Sprintf("version %d", info.Version))
+	ip.Item("created " + formatInfoTime(info.Created))
+	ip.Item("updated " + formatInfoTime(info.Updated))
+	ip.Item("latestlogin " + formatLogin(info.LatestLogin))
+	ip.Item("previouslogin " + formatLogin(info.PreviousLogin))
+	ip.Item("failcount " + strconv.FormatInt(info.FailCount, 10))
+	for _, group := range info.Groups {
+		ip.Item(fmt.Sprintf("group %s %d", client.Quote(group.Name), group.Gid))
+	}
+	keys := make([]string, 0, len(info.Data))
+	for key := range info.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ip.Item("data " + client.Quote(key) + " " + client.Quote(info.Data[key]))
+		if revision, ok := info.DataRevisions[key]; ok {
+			ip.Item("datarevision " + client.Quote(key) + " " + revision.String())
+		}
+	}
+	ip.Ok()
+}
+
+// formatLogin formats the time of a login, never if there was none
+func formatLogin(at *time.Time) string {
+	if at == nil {
+		return "never"
+	}
+	return formatInfoTime(*at)
+}
+
+// formatInfoTime formats times as RFC3339 in UTC, the zero time is unknown
+func formatInfoTime(at time.Time) string {
+	if at.IsZero() {
+		return "unknown"
+	}
+	return at.UTC().Format(time.RFC3339)
+}
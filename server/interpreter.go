@@ -1,36 +1,58 @@
 package server
 
 import (
+	"encoding/base64"
+	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/UserStack/ustackd/backends"
+	"github.com/UserStack/ustackd/client"
 )
 
 type Interpreter struct {
 	*Context
 	auth   *Auth
 	regexp *regexp.Regexp
+	tx     backends.Transaction
+	tenant backends.Abstract // tenant of the client, identified if the history is enabled
+	guard  backends.Abstract
 }
 
 func (ip *Interpreter) parse(line string) {
 	cmd, args := parseCmd(line)
 	switch cmd {
-	case ERR_UNKNOWN_FUNC:
-		ip.Err("EFAULT")
-	case ERR_MISSING_ARGS, ERR_INVALID_ARGS:
-		ip.Err("EINVAL")
-	case CLIENT_AUTH, QUIT:
+	case ERR_UNKNOWN_FUNC, ERR_MISSING_ARGS, ERR_INVALID_ARGS:
+		ip.parseError(cmd)
+	case CLIENT_AUTH, QUIT, CAPABILITIES, FORMAT:
 		ip.unrestrictedCommands(cmd, args)
+	case IF_VERSION:
+		ip.savepoint(func() { ip.ifVersion(args) })
 	default:
-		if !ip.authorized(strings.ToLower(line)) {
-			ip.Err("EACCES")
+		if !ip.authorized(strings.ToLower(canonicalLine(cmd, args))) {
+			ip.Err("EACCES", "Command not allowed for client")
 			ip.Server.Stats.restrictedCommandsAccessDenied++
 			return
 		}
-		ip.restrictedCommands(cmd, args)
+		if cmd == COMMIT || cmd == ROLLBACK {
+			ip.restrictedCommands(cmd, args)
+			return
+		}
+		ip.savepoint(func() { ip.restrictedCommands(cmd, args) })
+	}
+}
+
+func (ip *Interpreter) parseError(cmd Command) {
+	switch cmd {
+	case ERR_UNKNOWN_FUNC:
+		ip.Err("EFAULT", "Unknown command")
+	case ERR_MISSING_ARGS:
+		ip.Err("EINVAL", "Missing arguments")
+	case ERR_INVALID_ARGS:
+		ip.Err("EINVAL", "Invalid arguments")
 	}
 }
 
@@ -41,6 +63,10 @@ func (ip *Interpreter) unrestrictedCommands(cmd Command, args []string) {
 		ip.clientAuth(args)
 	case QUIT:
 		ip.quit()
+	case CAPABILITIES:
+		ip.capabilities()
+	case FORMAT:
+		ip.format(args)
 	}
 }
 
@@ -53,40 +79,132 @@ func (ip *Interpreter) restrictedCommands(cmd Command, args []string) {
 		ip.disable(args)
 	case ENABLE:
 		ip.enable(args)
+	case DISABLE_AT:
+		ip.disableAt(args)
+	case ENABLE_AT:
+		ip.enableAt(args)
+	case EXPIRE_AT:
+		ip.expireAt(args)
 	case SET:
 		ip.set(args)
 	case GET:
 		ip.get(args)
+	case GET_AT:
+		ip.getAt(args)
+	case HISTORY:
+		ip.history(args)
+	case SET_BINARY:
+		ip.setBinary(args)
+	case GET_BINARY:
+		ip.getBinary(args)
 	case GETKEYS:
 		ip.getKeys(args)
+	case GETALL:
+		ip.getAll(args)
+	case UNSET:
+		ip.unset(args)
+	case SETMANY:
+		ip.setMany(args)
+	case FIND:
+		ip.find(args)
 	case CHANGE_PASSWORD:
 		ip.changePassword(args)
 	case CHANGE_NAME:
 		ip.changeName(args)
+	case ADMIN_RENAME_USER:
+		ip.adminRenameUser(args)
+	case ADMIN_PASSWORD:
+		ip.adminPassword(args)
+	case RENAME_GROUP:
+		ip.renameGroup(args)
 	case USER_GROUPS:
 		ip.userGroups(args)
+	case USER_INFO:
+		ip.userInfo(args)
 	case USER:
 		ip.user(args)
 	case DELETE_USER:
 		ip.deleteUser(args)
+	case RESTORE_USER:
+		ip.restoreUser(args)
 	case USERS:
-		ip.users()
+		ip.users(args)
 	case ADD:
 		ip.add(args)
 	case REMOVE:
 		ip.remove(args)
+	case ADD_GROUP:
+		ip.addGroup(args)
+	case REMOVE_GROUP:
+		ip.removeGroup(args)
 	case DELETE_GROUP:
 		ip.deleteGroup(args)
+	case RESTORE_GROUP:
+		ip.restoreGroup(args)
+	case PURGE:
+		ip.purge(args)
 	case GROUPS:
-		ip.groups()
+		ip.groups(args)
 	case GROUP_USERS:
 		ip.groupUsers(args)
+	case GROUP_SET:
+		ip.groupSet(args)
+	case GROUP_GET:
+		ip.groupGet(args)
+	case GROUP_GETKEYS:
+		ip.groupGetKeys(args)
+	case GROUP_UNSET:
+		ip.groupUnset(args)
+	case GROUP_INFO:
+		ip.groupInfo(args)
 	case GROUP:
 		ip.group(args)
+	case ROLE:
+		ip.role(args)
+	case ROLES:
+		ip.roles()
+	case ROLE_PERMISSIONS:
+		ip.rolePermissions(args)
+	case DELETE_ROLE:
+		ip.deleteRole(args)
+	case PERMISSION:
+		ip.permission(args)
+	case PERMISSIONS:
+		ip.permissions()
+	case USER_PERMISSIONS:
+		ip.userPermissions(args)
+	case DELETE_PERMISSION:
+		ip.deletePermission(args)
+	case GRANT:
+		ip.grant(args)
+	case REVOKE:
+		ip.revoke(args)
+	case ASSIGN_USER:
+		ip.assignUser(args)
+	case ASSIGN_GROUP:
+		ip.assignGroup(args)
+	case UNASSIGN_USER:
+		ip.unassignUser(args)
+	case UNASSIGN_GROUP:
+		ip.unassignGroup(args)
+	case CHECK:
+		ip.check(args)
 	case STATS:
 		ip.stats()
 	case LOGINSTATS:
 		ip.loginStats(args)
+	case BEGIN:
+		ip.begin()
+	case COMMIT:
+		ip.commit()
+	case ROLLBACK:
+		ip.rollback()
+	case TENANT:
+		ip.createTenant(args)
+	case TENANTS:
+		ip.tenants()
+	case DELETE_TENANT:
+		ip.deleteTenant(args)
 	}
 
 }
@@ -112,68 +230,122 @@ func (ip *Interpreter) authorized(line string) bool {
 func (ip *Interpreter) clientAuth(passwd []string) {
 	for _, auth := range ip.Cfg.Client.Auth {
 		if auth.Passwd == passwd[0] {
-			ip.auth = &auth
-			var err error
-			ip.regexp, err = regexp.Compile(auth.Regex)
-			if err != nil {
+			if !auth.Source.Permits(ip.addr) {
+				ip.Log("Client auth rejected for source address")
+				ip.Server.Stats.rejectedClientAuths++
+				ip.Err("EPERM", "Source address not allowed for client")
+				return
+			}
+			if err := ip.setAuth(auth); err != nil {
 				ip.Log(err.Error())
-				ip.Err("EFAULT")
+				ip.Err("EFAULT", "Invalid client configuration")
 				return
 			}
 			ip.Ok()
 			return
 		}
 	}
-	ip.Err("EPERM")
+	ip.Err("EPERM", "Invalid client secret")
+}
+
+// peerAuth selects the client auth for unix socket connections based on the
+// peer credentials, no secret is required in that case
+func (ip *Interpreter) peerAuth() {
+	for _, auth := range ip.Cfg.Client.Auth {
+		if auth.MatchesPeer(ip.peer) {
+			if err := ip.setAuth(auth); err != nil {
+				ip.Log(err.Error())
+				return
+			}
+			ip.Logf("Client authenticated by peer uid=%d gid=%d", ip.peer.Uid, ip.peer.Gid)
+			return
+		}
+	}
+}
+
+func (ip *Interpreter) setAuth(auth Auth) (err error) {
+	ip.regexp, err = regexp.Compile(auth.Regex)
+	if err != nil {
+		return
+	}
+	// the tenant backend is identified with the new auth
+	previous := ip.auth
+	ip.auth = &auth
+	if err = ip.selectTenant(auth.Tenant); err != nil {
+		ip.auth = previous
+	}
+	return
 }
 
 func (ip *Interpreter) stats() {
-	ip.Writef("Connects: %d", ip.Server.Stats.Connects)
-	ip.Writef("Disconnects: %d", ip.Server.Stats.Disconnects)
-	ip.Writef("Active Connections: %d", ip.Server.Stats.ActiveConnections())
-	ip.Writef("Successfull logins: %d", ip.Server.Stats.Login)
-	ip.Writef("Failed logins: %d", ip.Server.Stats.FailedLogin)
-	ip.Writef("Unrestricted Commands: %d", ip.Server.Stats.unrestrictedCommands)
-	ip.Writef("Restricted Commands: %d", ip.Server.Stats.restrictedCommands)
-	ip.Writef("Access denied on Restricted Commands: %d", ip.Server.Stats.restrictedCommandsAccessDenied)
-
-	stats, err := ip.Backend.Stats()
+	values := make(map[string]int64)
+	stat := func(name string, value int64) {
+		if ip.json {
+			values[name] = value
+		} else {
+			ip.Writef("%s: %d", name, value)
+		}
+	}
+	stat("Connects", int64(ip.Server.Stats.Connects))
+	stat("Disconnects", int64(ip.Server.Stats.Disconnects))
+	stat("Active Connections", int64(ip.Server.Stats.ActiveConnections()))
+	stat("Successfull logins", int64(ip.Server.Stats.Login))
+	stat("Failed logins", int64(ip.Server.Stats.FailedLogin))
+	stat("Unrestricted Commands", int64(ip.Server.Stats.unrestrictedCommands))
+	stat("Restricted Commands", int64(ip.Server.Stats.restrictedCommands))
+	stat("Access denied on Restricted Commands", int64(ip.Server.Stats.restrictedCommandsAccessDenied))
+	stat("Rejected Connections", int64(ip.Server.Stats.rejectedConnections))
+	stat("Rejected Client Auths", int64(ip.Server.Stats.rejectedClientAuths))
+	stat("Rejected Proxy Headers", int64(ip.Server.Stats.rejectedProxyHeaders))
+	stat("Idle Timeouts", int64(ip.Server.Stats.idleTimeouts))
+	stat("Command Timeouts", int64(ip.Server.Stats.commandTimeouts))
+	stat("Too long Lines", int64(ip.Server.Stats.tooLongLines))
+	stat("Rejected by Connection Limit", int64(ip.Server.Stats.connectionLimitRejects))
+	stat("Rejected by Connection Limit per IP", int64(ip.Server.Stats.ipConnectionLimitRejects))
+	stat("Scheduled State Changes", int64(ip.Server.Stats.scheduledChanges))
+	stat("Purged Users and Groups", int64(ip.Server.Stats.purged))
+
+	stats, err := ip.backend().Stats()
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 		return
 	}
 	for key, value := range stats {
-		ip.Writef("%s: %d", key, value)
+		stat(key, value)
+	}
+	if ip.json {
+		ip.OkValue(values)
+	} else {
+		ip.Ok()
 	}
-	ip.Ok()
 }
 
 func (ip *Interpreter) loginStats(args []string) {
-	lastS, err := ip.Backend.GetUserData(args[0], "lastlogin")
+	lastS, err := ip.backend().GetUserData(args[0], "lastlogin")
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 		return
 	}
 	last, serr := strconv.ParseInt(lastS, 10, 0)
 	if serr != nil {
-		ip.Err("NOINT")
+		ip.Err("NOINT", "Last login is not a number")
 		return
 	}
 
-	ip.Writef("Last successfull login: %s", time.Unix(last, 0))
+	ip.Item(fmt.Sprintf("Last successfull login: %s", time.Unix(last, 0)))
 
-	countS, err := ip.Backend.GetUserData(args[0], "failcount")
+	countS, err := ip.backend().GetUserData(args[0], "failcount")
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 		return
 	}
-	ip.Writef("Failed login attempts: %s", countS)
+	ip.Item("Failed login attempts: " + countS)
 	ip.Ok()
 }
 
 // login <name> <password>
 func (ip *Interpreter) login(args []string) {
-	uid, err := ip.Backend.LoginUser(args[0], args[1])
+	uid, err := ip.backend().LoginUser(args[0], args[1])
 	if err == nil {
 		ip.Server.Stats.Login++
 	} else {
@@ -184,115 +356,334 @@ func (ip *Interpreter) login(args []string) {
 
 // disable <name|uid>
 func (ip *Interpreter) disable(args []string) {
-	ip.simpleResponder(ip.Backend.DisableUser(args[0]))
+	ip.simpleResponder(ip.backend().DisableUser(args[0]))
 }
 
 // enable <name|uid>
 func (ip *Interpreter) enable(args []string) {
-	ip.simpleResponder(ip.Backend.EnableUser(args[0]))
+	ip.simpleResponder(ip.backend().EnableUser(args[0]))
 }
 
 // set <name|uid> <key> <value>
 func (ip *Interpreter) set(args []string) {
-	ip.simpleResponder(ip.Backend.SetUserData(args[0], args[1], args[2]))
+	ip.setValue(args[0], args[1], args[2])
 }
 
 // get <name|uid> <key>
 func (ip *Interpreter) get(args []string) {
-	val, err := ip.Backend.GetUserData(args[0], args[1])
-	if err == nil {
-		ip.Write(val)
+	val, err := ip.backend().GetUserData(args[0], args[1])
+	if err != nil {
+		ip.Error(err)
+	} else if !ip.json && strings.ContainsAny(val, "\r\n") {
+		// value can't be sent on a single line, use getb instead
+		ip.Err("EILSEQ", "Value contains line breaks, use getb")
+	} else {
+		ip.Value(val)
 	}
-	ip.simpleResponder(err)
+}
+
+// setb <name|uid> <key> <base64 value>
+func (ip *Interpreter) setBinary(args []string) {
+	value, derr := base64.StdEncoding.DecodeString(args[2])
+	if derr != nil {
+		ip.Err("EINVAL", "Invalid base64 value")
+		return
+	}
+	ip.setValue(args[0], args[1], string(value))
+}
+
+// getb <name|uid> <key>
+func (ip *Interpreter) getBinary(args []string) {
+	val, err := ip.backend().GetUserData(args[0], args[1])
+	if err != nil {
+		ip.Error(err)
+	} else {
+		ip.Value(base64.StdEncoding.EncodeToString([]byte(val)))
+	}
+}
+
+func (ip *Interpreter) setValue(nameuid, key, value string) {
+	if max := ip.Cfg.Daemon.MaxValueSize; max > 0 && len(value) > max {
+		ip.Err("E2BIG", "Value is too large")
+		return
+	}
+	ip.simpleResponder(ip.backend().SetUserData(nameuid, key, value))
 }
 
 // getkeys <name|uid>
 func (ip *Interpreter) getKeys(args []string) {
-	list, err := ip.Backend.GetUserDataKeys(args[0])
+	list, err := ip.backend().GetUserDataKeys(args[0])
 	if err == nil {
 		for _, key := range list {
-			ip.Write(key)
+			ip.Item(key)
 		}
 	}
 	ip.simpleResponder(err)
 }
 
+// getall <name|uid>, in the text format every line contains the quoted key
+// and value
+func (ip *Interpreter) getAll(args []string) {
+	values, err := ip.backend().GetAllUserData(args[0])
+	if err != nil {
+		ip.Error(err)
+		return
+	}
+	if ip.json {
+		ip.OkValue(values)
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ip.Item(client.Quote(key) + " " + client.Quote(values[key]))
+	}
+	ip.Ok()
+}
+
+// unset <name|uid> <key>
+func (ip *Interpreter) unset(args []string) {
+	ip.simpleResponder(ip.backend().UnsetUserData(args[0], args[1]))
+}
+
+// setmany <name|uid> <key> <value> [<key> <value>...]
+func (ip *Interpreter) setMany(args []string) {
+	values := make(map[string]string)
+	for i := 1; i < len(args); i += 2 {
+		if max := ip.Cfg.Daemon.MaxValueSize; max > 0 && len(args[i+1]) > max {
+			ip.Err("E2BIG", "Value is too large")
+			return
+		}
+		values[args[i]] = args[i+1]
+	}
+	ip.simpleResponder(ip.backend().SetManyUserData(args[0], values))
+}
+
+// find <key> <=|prefix|contains> <value>
+func (ip *Interpreter) find(args []string) {
+	items, err := ip.backend().FindUsers(args[0], args[1], args[2])
+	ip.userResponder(items, err)
+}
+
 // change password <name|uid> <password> <newpassword>
 func (ip *Interpreter) changePassword(args []string) {
-	ip.simpleResponder(ip.Backend.ChangeUserPassword(args[0], args[1], args[2]))
+	ip.simpleResponder(ip.backend().ChangeUserPassword(args[0], args[1], args[2]))
 }
 
 // change name <name|uid> <password> <newname>
 func (ip *Interpreter) changeName(args []string) {
-	ip.simpleResponder(ip.Backend.ChangeUserName(args[0], args[1], args[2]))
+	ip.simpleResponder(ip.backend().ChangeUserName(args[0], args[1], args[2]))
+}
+
+// admin rename user <name|uid> <newname>
+func (ip *Interpreter) adminRenameUser(args []string) {
+	ip.simpleResponder(ip.backend().RenameUser(args[0], args[1]))
 }
 
-// user groups <name|uid>
+// admin password <name|uid> <newpassword>
+func (ip *Interpreter) adminPassword(args []string) {
+	ip.simpleResponder(ip.backend().SetUserPassword(args[0], args[1]))
+}
+
+// rename group <group|gid> <newname>
+func (ip *Interpreter) renameGroup(args []string) {
+	ip.simpleResponder(ip.backend().RenameGroup(args[0], args[1]))
+}
+
+// user groups <name|uid> [--transitive]
 func (ip *Interpreter) userGroups(args []string) {
-	items, err := ip.Backend.UserGroups(args[0])
+	if len(args) == 1 {
+		items, err := ip.backend().UserGroups(args[0])
+		ip.groupResponder(items, err)
+		return
+	}
+	if len(args) != 2 || strings.ToLower(args[1]) != "--transitive" {
+		ip.Err("EINVAL", "Unknown option "+args[len(args)-1])
+		return
+	}
+	items, err := ip.backend().UserGroupsTransitive(args[0])
 	ip.groupResponder(items, err)
 }
 
 // user <name> <password>
 func (ip *Interpreter) user(args []string) {
-	uid, err := ip.Backend.CreateUser(args[0], args[1])
+	uid, err := ip.backend().CreateUser(args[0], args[1])
 	ip.intResponder(uid, err)
 }
 
 // delete user <name|uid>
 func (ip *Interpreter) deleteUser(args []string) {
-	ip.simpleResponder(ip.Backend.DeleteUser(args[0]))
+	ip.simpleResponder(ip.backend().DeleteUser(args[0]))
+}
+
+// restore user <uid>
+func (ip *Interpreter) restoreUser(args []string) {
+	ip.simpleResponder(ip.backend().RestoreUser(args[0]))
 }
 
 // users
-func (ip *Interpreter) users() {
-	items, err := ip.Backend.Users()
-	ip.userResponder(items, err)
+// users [filter <pattern>] [active|inactive] [sort name|uid] [limit n] [after <cursor>]
+func (ip *Interpreter) users(args []string) {
+	if len(args) == 0 {
+		items, err := ip.backend().Users()
+		ip.userResponder(items, err)
+		return
+	}
+	options, perr := parseListOptions(args)
+	if perr != nil {
+		ip.Err("EINVAL", perr.Error())
+		return
+	}
+	items, cursor, err := ip.backend().UsersPage(options)
+	ip.userPageResponder(items, cursor, options.Expiry, err)
 }
 
 // add <name|uid> to <group|gid>
 func (ip *Interpreter) add(args []string) {
-	ip.simpleResponder(ip.Backend.AddUserToGroup(args[0], args[1]))
+	ip.simpleResponder(ip.backend().AddUserToGroup(args[0], args[1]))
 }
 
 // remove <name|uid> from <group|gid>
 func (ip *Interpreter) remove(args []string) {
-	ip.simpleResponder(ip.Backend.RemoveUserFromGroup(args[0], args[1]))
+	ip.simpleResponder(ip.backend().RemoveUserFromGroup(args[0], args[1]))
+}
+
+// add group <group|gid> <group|gid>
+func (ip *Interpreter) addGroup(args []string) {
+	ip.simpleResponder(ip.backend().AddGroupToGroup(args[0], args[1]))
+}
+
+// remove group <group|gid> <group|gid>
+func (ip *Interpreter) removeGroup(args []string) {
+	ip.simpleResponder(ip.backend().RemoveGroupFromGroup(args[0], args[1]))
 }
 
 // delete group <group|gid>
 func (ip *Interpreter) deleteGroup(args []string) {
-	ip.simpleResponder(ip.Backend.DeleteGroup(args[0]))
+	ip.simpleResponder(ip.backend().DeleteGroup(args[0]))
+}
+
+// restore group <gid>
+func (ip *Interpreter) restoreGroup(args []string) {
+	ip.simpleResponder(ip.backend().RestoreGroup(args[0]))
+}
+
+// purge [older-than]
+func (ip *Interpreter) purge(args []string) {
+	var olderThan time.Duration
+	if len(args) > 0 {
+		var err error
+		if olderThan, err = time.ParseDuration(args[0]); err != nil {
+			ip.Err("EINVAL", "Invalid age, expected a duration like 720h")
+			return
+		}
+	}
+	ip.intResponder(ip.backend().Purge(olderThan))
 }
 
 // groups
-func (ip *Interpreter) groups() {
-	items, err := ip.Backend.Groups()
-	ip.groupResponder(items, err)
+// groups [filter <pattern>] [sort name|gid] [limit n] [after <cursor>]
+func (ip *Interpreter) groups(args []string) {
+	if len(args) == 0 {
+		items, err := ip.backend().Groups()
+		ip.groupResponder(items, err)
+		return
+	}
+	options, perr := parseListOptions(args)
+	if perr != nil {
+		ip.Err("EINVAL", perr.Error())
+		return
+	}
+	items, cursor, err := ip.backend().GroupsPage(options)
+	ip.groupPageResponder(items, cursor, err)
 }
 
-// group users <group|gid>
+// group users <group|gid> [filter <pattern>] [active|inactive] [sort name|uid] [limit n] [after <cursor>] [--transitive]
 func (ip *Interpreter) groupUsers(args []string) {
-	items, err := ip.Backend.GroupUsers(args[0])
-	ip.userResponder(items, err)
+	if len(args) == 1 {
+		items, err := ip.backend().GroupUsers(args[0])
+		ip.userResponder(items, err)
+		return
+	}
+	options, perr := parseListOptions(args[1:])
+	if perr != nil {
+		ip.Err("EINVAL", perr.Error())
+		return
+	}
+	items, cursor, err := ip.backend().GroupUsersPage(args[0], options)
+	ip.userPageResponder(items, cursor, options.Expiry, err)
+}
+
+// group set <group|gid> <key> <value>
+func (ip *Interpreter) groupSet(args []string) {
+	if max := ip.Cfg.Daemon.MaxValueSize; max > 0 && len(args[2]) > max {
+		ip.Err("E2BIG", "Value is too large")
+		return
+	}
+	ip.simpleResponder(ip.backend().SetGroupData(args[0], args[1], args[2]))
+}
+
+// group get <group|gid> <key>
+func (ip *Interpreter) groupGet(args []string) {
+	val, err := ip.backend().GetGroupData(args[0], args[1])
+	if err != nil {
+		ip.Error(err)
+	} else if !ip.json && strings.ContainsAny(val, "\r\n") {
+		ip.Err("EILSEQ", "Value contains line breaks, use the json format")
+	} else {
+		ip.Value(val)
+	}
+}
+
+// group getkeys <group|gid>
+func (ip *Interpreter) groupGetKeys(args []string) {
+	list, err := ip.backend().GetGroupDataKeys(args[0])
+	if err == nil {
+		for _, key := range list {
+			ip.Item(key)
+		}
+	}
+	ip.simpleResponder(err)
+}
+
+// group unset <group|gid> <key>
+func (ip *Interpreter) groupUnset(args []string) {
+	ip.simpleResponder(ip.backend().UnsetGroupData(args[0], args[1]))
 }
 
 // group <name>
 func (ip *Interpreter) group(args []string) {
-	gid, err := ip.Backend.CreateGroup(args[0])
+	gid, err := ip.backend().CreateGroup(args[0])
 	ip.intResponder(gid, err)
 }
 
+// format <text|json>, the response is sent in the previous format
+func (ip *Interpreter) format(args []string) {
+	switch strings.ToLower(args[0]) {
+	case "text":
+		ip.Ok()
+		ip.json = false
+	case "json":
+		ip.Ok()
+		ip.json = true
+	default:
+		ip.Err("EINVAL", "Unknown format")
+	}
+}
+
 func (ip *Interpreter) quit() {
 	ip.quitting = true
-	ip.Write("+ BYE")
+	ip.Bye()
 }
 
 // Helpers
 
 func (ip *Interpreter) simpleResponder(err *backends.Error) {
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 	} else {
 		ip.Ok()
 	}
@@ -300,30 +691,53 @@ func (ip *Interpreter) simpleResponder(err *backends.Error) {
 
 func (ip *Interpreter) intResponder(value int64, err *backends.Error) {
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 	} else {
 		ip.OkValue(value)
 	}
 }
 
 func (ip *Interpreter) groupResponder(items []backends.Group, err *backends.Error) {
+	ip.groupPageResponder(items, "", err)
+}
+
+func (ip *Interpreter) groupPageResponder(items []backends.Group, cursor string, err *backends.Error) {
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 	} else {
 		for _, item := range items {
-			ip.Write(item.String())
+			ip.Item(item)
 		}
-		ip.Ok()
+		ip.cursorResponder(cursor)
 	}
 }
 
 func (ip *Interpreter) userResponder(items []backends.User, err *backends.Error) {
+	ip.userPageResponder(items, "", false, err)
+}
+
+// userPageResponder sends the cursor of the next page in the + OK line, with
+// expiry the text lines are extended by the expiry of the users, e.g.
+// "joe:1:Y:2026-12-31T00:00:00Z" or "joe:1:Y:never"
+func (ip *Interpreter) userPageResponder(items []backends.User, cursor string, expiry bool, err *backends.Error) {
 	if err != nil {
-		ip.Err(err.Code)
+		ip.Error(err)
 	} else {
 		for _, item := range items {
-			ip.Write(item.String())
+			if expiry && !ip.json {
+				ip.Item(fmt.Sprintf("%s:%s", item, formatExpiry(item.Expires)))
+			} else {
+				ip.Item(item)
+			}
 		}
+		ip.cursorResponder(cursor)
+	}
+}
+
+func (ip *Interpreter) cursorResponder(cursor string) {
+	if cursor != "" {
+		ip.OkValue(cursor)
+	} else {
 		ip.Ok()
 	}
 }
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func TestAuthorizationOfCanonicalLine(t *testing.T) {
+	auth := Auth{Passwd: "s", Regex: "^(admin|rename|group users)"}
+	cfg := &Config{}
+	cfg.Client.Auth = []Auth{auth}
+	context, buf := newTestContext(cfg)
+	context.Server.Backend = &backends.NilBackend{}
+	ip := &Interpreter{Context: context}
+	if err := ip.setAuth(auth); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"admin password root x",
+		"\"admin\" password root pwned",
+		"admin  password root pwned",
+		"ADMIN \"password\" root pwned",
+		"group  users x",
+		"\"group\" \"users\" x",
+		"if-version 1 \"admin\" password root pwned",
+		"if-version 1 rename  group a b",
+	} {
+		buf.Reset()
+		ip.parse(line)
+		if response := strings.TrimSpace(buf.String()); !strings.HasPrefix(response, "- EACCES") {
+			t.Errorf("%q should be denied, got %q", line, response)
+		}
+	}
+	buf.Reset()
+	ip.parse("get joe email")
+	if response := strings.TrimSpace(buf.String()); strings.HasPrefix(response, "- EACCES") {
+		t.Errorf("get should be allowed, got %q", response)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	context, _ := newTestContext(&Config{})
+	context.Server.Backend = &backends.NilBackend{}
+	context.addr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50312}
+	ip := &Interpreter{Context: context}
+	if identity := ip.identity(); identity != "127.0.0.1" {
+		t.Fatal("should record the address without the port", identity)
+	}
+	ip.peer = &Peer{Uid: 1000, Gid: 100}
+	if identity := ip.identity(); identity != "uid=1000 gid=100" {
+		t.Fatal("should record the peer credentials", identity)
+	}
+	if err := ip.setAuth(Auth{Passwd: "s", Regex: ".*", Allow: true}); err != nil {
+		t.Fatal(err)
+	}
+	if identity := ip.identity(); identity != "client=043a7187" {
+		t.Fatal("should record the hash of the secret", identity)
+	}
+	if identity := (&Auth{Passwd: "s", Tenant: "acme"}).Identity(); identity != "acme/043a7187" {
+		t.Fatal("should record the tenant with the hash", identity)
+	}
+	if err := ip.setAuth(Auth{Passwd: "s", Regex: ".*", Allow: true, Name: "webgui"}); err != nil {
+		t.Fatal(err)
+	}
+	if identity := ip.identity(); identity != "client=webgui" {
+		t.Fatal("should record the client name", identity)
+	}
+}
+
+// savepointTx records the savepoints of a transaction
+type savepointTx struct {
+	*backends.SqliteBackend
+	calls *[]string
+}
+
+func (tx savepointTx) Savepoint() *backends.Error {
+	*tx.calls = append(*tx.calls, "savepoint")
+	return tx.SqliteBackend.Savepoint()
+}
+
+func (tx savepointTx) RollbackToSavepoint() *backends.Error {
+	*tx.calls = append(*tx.calls, "rollback")
+	return tx.SqliteBackend.RollbackToSavepoint()
+}
+
+func (tx savepointTx) ReleaseSavepoint() *backends.Error {
+	*tx.calls = append(*tx.calls, "release")
+	return tx.SqliteBackend.ReleaseSavepoint()
+}
+
+func TestTransactionSavepoints(t *testing.T) {
+	backend, err := backends.NewSqliteBackend(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	context, buf := newTestContext(&Config{})
+	context.Server.Backend = &backend
+	ip := &Interpreter{Context: context}
+
+	ip.parse("begin")
+	var calls []string
+	ip.tx = savepointTx{ip.tx.(*backends.SqliteBackend), &calls}
+	ip.parse("user joe secret")
+	ip.parse("user joe secret")
+	ip.parse("user jane secret")
+	ip.parse("commit")
+	expected := "+ OK\r\n+ OK 1\r\n- EEXIST UNIQUE constraint failed: Users.tenant, Users.name, Users.trashed\r\n+ OK 2\r\n+ OK\r\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q got %q", expected, buf.String())
+	}
+	if strings.Join(calls, " ") != "savepoint release savepoint rollback savepoint release" {
+		t.Fatal("unexpected savepoints", calls)
+	}
+	if users, _ := backend.Users(); len(users) != 2 {
+		t.Fatal("should commit the users around the failed command", users)
+	}
+}
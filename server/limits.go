@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	errLineTooLong    = errors.New("Line too long")
+	errIdleTimeout    = errors.New("Idle timeout")
+	errCommandTimeout = errors.New("Command timeout")
+)
+
+// readLimitedLine reads a line that is at most max bytes long (without the
+// line ending). Longer lines are discarded up to the next line ending and
+// errLineTooLong is returned. A max of 0 disables the limit.
+func readLimitedLine(reader *bufio.Reader, max int) (string, error) {
+	if max <= 0 {
+		return reader.ReadString('\n')
+	}
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 { // +2 for the CRLF
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == nil && len(strings.TrimRight(string(line), "\r\n")) > max {
+			return "", errLineTooLong
+		}
+		return string(line), err
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// connLimiter counts the active connections in total and per ip address
+type connLimiter struct {
+	sync.Mutex
+	total int
+	perIp map[string]int
+}
+
+// acquire registers a connection if the limits allow it, a limit of 0
+// disables it. The second return value tells if the per ip limit was hit.
+func (limiter *connLimiter) acquire(ip net.IP, max, maxPerIp int) (ok bool, perIp bool) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.perIp == nil {
+		limiter.perIp = make(map[string]int)
+	}
+	if max > 0 && limiter.total >= max {
+		return false, false
+	}
+	if ip != nil {
+		key := ip.String()
+		if maxPerIp > 0 && limiter.perIp[key] >= maxPerIp {
+			return false, true
+		}
+		limiter.perIp[key]++
+	}
+	limiter.total++
+	return true, false
+}
+
+func (limiter *connLimiter) release(ip net.IP) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	limiter.total--
+	if ip != nil {
+		key := ip.String()
+		if limiter.perIp[key] <= 1 {
+			delete(limiter.perIp, key)
+		} else {
+			limiter.perIp[key]--
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadLimitedLine(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	reader := bufio.NewReaderSize(strings.NewReader(
+		"users\r\n"+long+"\r\n"+long+long+long+"\r\nstats\r\n"), 16)
+	line, err := readLimitedLine(reader, 10)
+	if err != nil || line != "users\r\n" {
+		t.Fatalf("expected users got %q %v", line, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = readLimitedLine(reader, 10); err != errLineTooLong {
+			t.Fatal("expected line too long got", err)
+		}
+	}
+	line, err = readLimitedLine(reader, 10)
+	if err != nil || line != "stats\r\n" {
+		t.Fatalf("expected stats got %q %v", line, err)
+	}
+	if _, err = readLimitedLine(reader, 10); err != io.EOF {
+		t.Fatal("expected EOF got", err)
+	}
+}
+
+func TestReadLimitedLineExact(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("1234567890\n12345678901\r\n"))
+	if line, err := readLimitedLine(reader, 10); err != nil || line != "1234567890\n" {
+		t.Fatalf("expected line got %q %v", line, err)
+	}
+	if _, err := readLimitedLine(reader, 10); err != errLineTooLong {
+		t.Fatal("expected line too long got", err)
+	}
+}
+
+func TestReadLimitedLineUnlimited(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	reader := bufio.NewReader(strings.NewReader(long + "\r\n"))
+	if line, err := readLimitedLine(reader, 0); err != nil || line != long+"\r\n" {
+		t.Fatal("expected long line", err)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	var limiter connLimiter
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	if ok, _ := limiter.acquire(a, 3, 2); !ok {
+		t.Fatal("expected first connection to be accepted")
+	}
+	if ok, _ := limiter.acquire(a, 3, 2); !ok {
+		t.Fatal("expected second connection to be accepted")
+	}
+	if ok, perIp := limiter.acquire(a, 3, 2); ok || !perIp {
+		t.Fatal("expected per ip limit to be reached")
+	}
+	if ok, _ := limiter.acquire(nil, 3, 2); !ok {
+		t.Fatal("expected connection without ip to be accepted")
+	}
+	if ok, perIp := limiter.acquire(b, 3, 2); ok || perIp {
+		t.Fatal("expected total limit to be reached")
+	}
+	limiter.release(a)
+	if ok, _ := limiter.acquire(b, 3, 2); !ok {
+		t.Fatal("expected connection to be accepted after release")
+	}
+	limiter.release(a)
+	limiter.release(b)
+	limiter.release(nil)
+	if limiter.total != 0 || len(limiter.perIp) != 0 {
+		t.Fatal("expected limiter to be empty", limiter.total, limiter.perIp)
+	}
+	if ok, _ := limiter.acquire(a, 0, 0); !ok {
+		t.Fatal("expected unlimited limiter to accept")
+	}
+}
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+
+	"github.com/UserStack/ustackd/backends"
+	"github.com/UserStack/ustackd/client"
 )
 
 type Command int
@@ -9,26 +14,75 @@ type Command int
 const (
 	CLIENT_AUTH Command = iota
 	QUIT
+	CAPABILITIES
+	FORMAT
 	LOGIN
 	DISABLE
+	DISABLE_AT
+	ENABLE_AT
+	EXPIRE_AT
 	ENABLE
 	SET
 	GET
+	SET_BINARY
+	GET_BINARY
 	GETKEYS
+	GETALL
+	UNSET
+	SETMANY
+	FIND
 	CHANGE_PASSWORD
 	CHANGE_NAME
+	ADMIN_RENAME_USER
+	ADMIN_PASSWORD
+	RENAME_GROUP
 	USER_GROUPS
+	USER_INFO
 	USER
 	DELETE_USER
+	RESTORE_USER
 	USERS
 	ADD
 	REMOVE
+	ADD_GROUP
+	REMOVE_GROUP
 	DELETE_GROUP
+	RESTORE_GROUP
+	PURGE
 	GROUPS
 	GROUP_USERS
+	GROUP_SET
+	GROUP_GET
+	GROUP_GETKEYS
+	GROUP_UNSET
+	GROUP_INFO
 	GROUP
+	ROLE
+	ROLES
+	ROLE_PERMISSIONS
+	DELETE_ROLE
+	PERMISSION
+	PERMISSIONS
+	USER_PERMISSIONS
+	DELETE_PERMISSION
+	GRANT
+	REVOKE
+	ASSIGN_USER
+	ASSIGN_GROUP
+	UNASSIGN_USER
+	UNASSIGN_GROUP
+	CHECK
 	STATS
 	LOGINSTATS
+	BEGIN
+	COMMIT
+	ROLLBACK
+	TENANT
+	TENANTS
+	DELETE_TENANT
+	IF_VERSION
+	GET_AT
+	HISTORY
 
 	ERR_UNKNOWN_FUNC
 	ERR_MISSING_ARGS
@@ -40,50 +94,148 @@ var NOARGS []string
 type SubParser func(line string) (Command, []string)
 
 func parseCmd(line string) (Command, []string) {
-	parts := strings.SplitN(line, " ", 2)
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	switch strings.ToLower(parts[0]) {
 	case "login":
 		return parseTwoArgumentCmd(LOGIN, parts)
 	case "set":
 		return parseThreeArgumentCmd(SET, parts)
 	case "get":
-		return parseTwoArgumentCmd(GET, parts)
+		return parseGetCmd(parts)
+	case "history":
+		return parseTwoArgumentCmd(HISTORY, parts)
+	case "setb":
+		return parseThreeArgumentCmd(SET_BINARY, parts)
+	case "getb":
+		return parseTwoArgumentCmd(GET_BINARY, parts)
 	case "getkeys":
 		return parseOneArgumentCmd(GETKEYS, parts)
+	case "getall":
+		return parseOneArgumentCmd(GETALL, parts)
+	case "unset":
+		return parseTwoArgumentCmd(UNSET, parts)
+	case "setmany":
+		return parseSetManyCmd(parts)
+	case "find":
+		return parseThreeArgumentCmd(FIND, parts)
 	case "stats":
 		return STATS, NOARGS
 	case "loginstats":
 		return parseOneArgumentCmd(LOGINSTATS, parts)
 	case "add":
-		return parseTwoArgumentCmd(ADD, parts)
+		return parseMembershipCmd(ADD, ADD_GROUP, parts)
 	case "remove":
-		return parseTwoArgumentCmd(REMOVE, parts)
+		return parseMembershipCmd(REMOVE, REMOVE_GROUP, parts)
 	case "enable":
-		return parseOneArgumentCmd(ENABLE, parts)
+		return parseStateCmd(ENABLE, ENABLE_AT, parts)
 	case "disable":
-		return parseOneArgumentCmd(DISABLE, parts)
+		return parseStateCmd(DISABLE, DISABLE_AT, parts)
+	case "expire":
+		return parseAtCmd(EXPIRE_AT, parts)
 	case "user":
 		return expectTwoParts(parts, parseUserCmd)
 	case "group":
 		return expectTwoParts(parts, parseGroupCmd)
 	case "delete":
 		return expectTwoParts(parts, parseDeleteCmd)
+	case "restore":
+		return expectTwoParts(parts, parseRestoreCmd)
+	case "purge":
+		if len(parts) == 1 {
+			return PURGE, NOARGS
+		}
+		return parseOneArgumentCmd(PURGE, parts)
+	case "role":
+		return expectTwoParts(parts, parseRoleCmd)
+	case "roles":
+		return ROLES, NOARGS
+	case "permission":
+		return parseOneArgumentCmd(PERMISSION, parts)
+	case "permissions":
+		if len(parts) == 1 {
+			return PERMISSIONS, NOARGS
+		}
+		return parseOneArgumentCmd(USER_PERMISSIONS, parts)
+	case "grant":
+		return parseTwoArgumentCmd(GRANT, parts)
+	case "revoke":
+		return parseTwoArgumentCmd(REVOKE, parts)
+	case "assign":
+		return parseAssignCmd(ASSIGN_USER, ASSIGN_GROUP, parts)
+	case "unassign":
+		return parseAssignCmd(UNASSIGN_USER, UNASSIGN_GROUP, parts)
+	case "check":
+		return parseTwoArgumentCmd(CHECK, parts)
 	case "change":
 		return expectTwoParts(parts, parseChangeCmd)
+	case "admin":
+		return expectTwoParts(parts, parseAdminCmd)
+	case "rename":
+		return expectTwoParts(parts, parseRenameCmd)
 	case "client":
 		return expectTwoParts(parts, parseClientCmd)
 	case "quit":
 		return QUIT, NOARGS
+	case "capabilities":
+		return CAPABILITIES, NOARGS
+	case "format":
+		return parseOneArgumentCmd(FORMAT, parts)
 	case "groups":
-		return GROUPS, NOARGS
+		return parseListCmd(GROUPS, parts)
 	case "users":
-		return USERS, NOARGS
+		return parseListCmd(USERS, parts)
+	case "begin":
+		return BEGIN, NOARGS
+	case "commit":
+		return COMMIT, NOARGS
+	case "rollback":
+		return ROLLBACK, NOARGS
+	case "tenant":
+		return parseOneArgumentCmd(TENANT, parts)
+	case "tenants":
+		return TENANTS, NOARGS
+	case "if-version":
+		return parseIfVersionCmd(parts)
 	}
 	return ERR_UNKNOWN_FUNC, NOARGS
 }
 
+// parseIfVersionCmd expects the version followed by the guarded command, the
+// command is parsed by the interpreter
+func parseIfVersionCmd(parts []string) (Command, []string) {
+	if len(parts) != 2 {
+		return ERR_MISSING_ARGS, NOARGS
+	}
+	if parts = splitArgs(parts[1], 2); parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	if len(parts) != 2 {
+		return ERR_MISSING_ARGS, NOARGS
+	}
+	return IF_VERSION, parts
+}
+
+// parseGetCmd parses get <name|uid> <key> [at <time>], keys containing
+// spaces have to be quoted to be followed by a time
+func parseGetCmd(parts []string) (Command, []string) {
+	cmd, args := parseTwoArgumentCmd(GET, parts)
+	if cmd != GET {
+		return cmd, args
+	}
+	if at := splitArgs(parts[1], 4); len(at) == 4 && strings.ToLower(at[2]) == "at" {
+		return GET_AT, []string{at[0], at[1], at[3]}
+	}
+	return cmd, args
+}
+
 func parseClientCmd(line string) (Command, []string) {
-	parts := strings.SplitN(line, " ", 2)
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	switch strings.ToLower(parts[0]) {
 	case "auth":
 		return parseOneArgumentCmd(CLIENT_AUTH, parts)
@@ -92,7 +244,10 @@ func parseClientCmd(line string) (Command, []string) {
 }
 
 func parseChangeCmd(line string) (Command, []string) {
-	parts := strings.SplitN(line, " ", 2)
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	switch strings.ToLower(parts[0]) {
 	case "password":
 		return parseThreeArgumentCmd(CHANGE_PASSWORD, parts)
@@ -102,43 +257,147 @@ func parseChangeCmd(line string) (Command, []string) {
 	return ERR_UNKNOWN_FUNC, NOARGS
 }
 
+func parseAdminCmd(line string) (Command, []string) {
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	switch strings.ToLower(parts[0]) {
+	case "rename":
+		return expectTwoParts(parts, parseAdminRenameCmd)
+	case "password":
+		return parseTwoArgumentCmd(ADMIN_PASSWORD, parts)
+	}
+	return ERR_UNKNOWN_FUNC, NOARGS
+}
+
+func parseAdminRenameCmd(line string) (Command, []string) {
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	switch strings.ToLower(parts[0]) {
+	case "user":
+		return parseTwoArgumentCmd(ADMIN_RENAME_USER, parts)
+	}
+	return ERR_UNKNOWN_FUNC, NOARGS
+}
+
+func parseRenameCmd(line string) (Command, []string) {
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	switch strings.ToLower(parts[0]) {
+	case "group":
+		return parseTwoArgumentCmd(RENAME_GROUP, parts)
+	}
+	return ERR_UNKNOWN_FUNC, NOARGS
+}
+
 func parseUserCmd(line string) (Command, []string) {
-	parts := strings.SplitN(line, " ", 2)
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	if len(parts) != 2 {
 		return ERR_MISSING_ARGS, NOARGS
 	}
 	switch strings.ToLower(parts[0]) {
 	case "groups":
-		return USER_GROUPS, []string{parts[1]}
+		// the user is optionally followed by --transitive
+		if parts = splitArgs(line, -1); parts == nil {
+			return ERR_INVALID_ARGS, NOARGS
+		}
+		return USER_GROUPS, parts[1:]
+	case "info":
+		return parseOneArgumentCmd(USER_INFO, parts)
 	default:
 		return USER, parts
 	}
 }
 
 func parseDeleteCmd(line string) (Command, []string) {
-	parts := strings.SplitN(line, " ", 2)
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	switch strings.ToLower(parts[0]) {
 	case "user":
 		return parseOneArgumentCmd(DELETE_USER, parts)
 	case "group":
 		return parseOneArgumentCmd(DELETE_GROUP, parts)
+	case "role":
+		return parseOneArgumentCmd(DELETE_ROLE, parts)
+	case "permission":
+		return parseOneArgumentCmd(DELETE_PERMISSION, parts)
+	case "tenant":
+		return parseOneArgumentCmd(DELETE_TENANT, parts)
+	}
+	return ERR_UNKNOWN_FUNC, NOARGS
+}
+
+func parseRestoreCmd(line string) (Command, []string) {
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	switch strings.ToLower(parts[0]) {
+	case "user":
+		return parseOneArgumentCmd(RESTORE_USER, parts)
+	case "group":
+		return parseOneArgumentCmd(RESTORE_GROUP, parts)
 	}
 	return ERR_UNKNOWN_FUNC, NOARGS
 }
 
 func parseGroupCmd(line string) (Command, []string) {
-	parts := strings.SplitN(line, " ", 2)
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	switch strings.ToLower(parts[0]) {
 	case "users":
 		if len(parts) != 2 {
 			return ERR_MISSING_ARGS, NOARGS
 		}
-		return GROUP_USERS, []string{parts[1]}
+		// the group is followed by the list options
+		if parts = splitArgs(line, -1); parts == nil {
+			return ERR_INVALID_ARGS, NOARGS
+		}
+		return GROUP_USERS, parts[1:]
+	case "set":
+		return parseThreeArgumentCmd(GROUP_SET, parts)
+	case "get":
+		return parseTwoArgumentCmd(GROUP_GET, parts)
+	case "getkeys":
+		return parseOneArgumentCmd(GROUP_GETKEYS, parts)
+	case "unset":
+		return parseTwoArgumentCmd(GROUP_UNSET, parts)
+	case "info":
+		if len(parts) == 2 { // otherwise a group named info is created
+			return parseOneArgumentCmd(GROUP_INFO, parts)
+		}
+		return GROUP, parts
 	default:
 		return GROUP, parts
 	}
 }
 
+func parseRoleCmd(line string) (Command, []string) {
+	parts := splitArgs(line, 2)
+	if parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	switch strings.ToLower(parts[0]) {
+	case "permissions":
+		if len(parts) == 2 {
+			return ROLE_PERMISSIONS, []string{parts[1]}
+		}
+	}
+	return ROLE, parts
+}
+
 func expectTwoParts(parts []string, fn SubParser) (Command, []string) {
 	if len(parts) != 2 {
 		return ERR_UNKNOWN_FUNC, NOARGS
@@ -153,11 +412,73 @@ func parseOneArgumentCmd(cmd Command, parts []string) (Command, []string) {
 	return cmd, []string{parts[1]}
 }
 
+// parseMembershipCmd parses "<cmd> <name|uid> <group|gid>" and
+// "<cmd> group <group|gid> <group|gid>" for nested groups
+func parseMembershipCmd(cmd Command, groupCmd Command, parts []string) (Command, []string) {
+	if len(parts) != 2 {
+		return ERR_MISSING_ARGS, NOARGS
+	}
+	args := splitArgs(parts[1], 3)
+	if args == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	if len(args) == 3 && strings.ToLower(args[0]) == "group" {
+		return groupCmd, args[1:]
+	}
+	return parseTwoArgumentCmd(cmd, parts)
+}
+
+// parseStateCmd parses "<cmd> <name|uid>" and "<cmd> at <name|uid> <time>"
+// for scheduled state changes
+func parseStateCmd(cmd Command, atCmd Command, parts []string) (Command, []string) {
+	if len(parts) != 2 {
+		return ERR_MISSING_ARGS, NOARGS
+	}
+	args := splitArgs(parts[1], 3)
+	if args == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	if len(args) == 3 && strings.ToLower(args[0]) == "at" {
+		return atCmd, args[1:]
+	}
+	return parseOneArgumentCmd(cmd, parts)
+}
+
+// parseAtCmd parses "<cmd> at <name|uid> <time>"
+func parseAtCmd(cmd Command, parts []string) (Command, []string) {
+	cmd, args := parseThreeArgumentCmd(cmd, parts)
+	if len(args) != 3 {
+		return cmd, args
+	}
+	if strings.ToLower(args[0]) != "at" {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	return cmd, args[1:]
+}
+
+// parseAssignCmd parses "<cmd> <role|rid> user <name|uid>" and
+// "<cmd> <role|rid> group <group|gid>"
+func parseAssignCmd(userCmd Command, groupCmd Command, parts []string) (Command, []string) {
+	cmd, args := parseThreeArgumentCmd(userCmd, parts)
+	if cmd != userCmd {
+		return cmd, args
+	}
+	switch strings.ToLower(args[1]) {
+	case "user":
+		return userCmd, []string{args[0], args[2]}
+	case "group":
+		return groupCmd, []string{args[0], args[2]}
+	}
+	return ERR_INVALID_ARGS, NOARGS
+}
+
 func parseTwoArgumentCmd(cmd Command, parts []string) (Command, []string) {
 	if len(parts) != 2 {
 		return ERR_MISSING_ARGS, NOARGS
 	}
-	parts = strings.SplitN(parts[1], " ", 2)
+	if parts = splitArgs(parts[1], 2); parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	if len(parts) != 2 {
 		return ERR_MISSING_ARGS, NOARGS
 	}
@@ -168,9 +489,159 @@ func parseThreeArgumentCmd(cmd Command, parts []string) (Command, []string) {
 	if len(parts) != 2 {
 		return ERR_MISSING_ARGS, NOARGS
 	}
-	parts = strings.SplitN(parts[1], " ", 3)
+	if parts = splitArgs(parts[1], 3); parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
 	if len(parts) != 3 {
 		return ERR_MISSING_ARGS, NOARGS
 	}
 	return cmd, parts
 }
+
+// parseSetManyCmd expects the user followed by pairs of keys and values
+func parseSetManyCmd(parts []string) (Command, []string) {
+	if len(parts) != 2 {
+		return ERR_MISSING_ARGS, NOARGS
+	}
+	if parts = splitArgs(parts[1], -1); parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	if len(parts) < 3 || len(parts)%2 == 0 {
+		return ERR_MISSING_ARGS, NOARGS
+	}
+	return SETMANY, parts
+}
+
+// parseListCmd returns the options of a listing (e.g. users limit 10)
+func parseListCmd(cmd Command, parts []string) (Command, []string) {
+	if len(parts) != 2 {
+		return cmd, NOARGS
+	}
+	if parts = splitArgs(parts[1], -1); parts == nil {
+		return ERR_INVALID_ARGS, NOARGS
+	}
+	return cmd, parts
+}
+
+// parseListOptions parses the options of the users, groups and group users
+// listings: [filter <pattern>] [active|inactive] [sort name|uid] [limit n]
+// [after <cursor>]
+func parseListOptions(args []string) (options backends.ListOptions, err error) {
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch option {
+		case "active", "inactive":
+			options.State = option
+			continue
+		case "--transitive":
+			options.Transitive = true
+			continue
+		case "--expiry":
+			options.Expiry = true
+			continue
+		case "--deleted":
+			options.Deleted = true
+			continue
+		case "filter", "sort", "limit", "after":
+		default:
+			return options, fmt.Errorf("Unknown option %s", args[i])
+		}
+		if i+1 == len(args) {
+			return options, fmt.Errorf("Missing value for %s", option)
+		}
+		i++
+		switch option {
+		case "filter":
+			options.Filter = args[i]
+		case "sort":
+			options.Sort = strings.ToLower(args[i])
+			if options.Sort != "name" && options.Sort != "uid" && options.Sort != "gid" {
+				return options, fmt.Errorf("Unknown sort order %s", args[i])
+			}
+		case "limit":
+			options.Limit, err = strconv.Atoi(args[i])
+			if err != nil || options.Limit < 0 {
+				return options, fmt.Errorf("Invalid limit %s", args[i])
+			}
+		case "after":
+			options.After = args[i]
+		}
+	}
+	return options, nil
+}
+
+// splitArgs splits the line into at most n (optionally quoted) arguments,
+// nil is returned if the quoting is invalid
+func splitArgs(line string, n int) []string {
+	parts, err := client.SplitArgs(line, n)
+	if err != nil {
+		return nil
+	}
+	if len(parts) == 0 {
+		return []string{""}
+	}
+	return parts
+}
+
+// the words of the commands in the canonical lines
+var commandWords = map[Command]string{
+	CLIENT_AUTH: "client auth", QUIT: "quit", CAPABILITIES: "capabilities",
+	FORMAT: "format", LOGIN: "login", DISABLE: "disable", DISABLE_AT: "disable at",
+	ENABLE_AT: "enable at", EXPIRE_AT: "expire at", ENABLE: "enable", SET: "set",
+	GET: "get", SET_BINARY: "setb", GET_BINARY: "getb", GETKEYS: "getkeys",
+	GETALL: "getall", UNSET: "unset", SETMANY: "setmany", FIND: "find",
+	CHANGE_PASSWORD: "change password", CHANGE_NAME: "change name",
+	ADMIN_RENAME_USER: "admin rename user", ADMIN_PASSWORD: "admin password",
+	RENAME_GROUP: "rename group", USER_GROUPS: "user groups", USER_INFO: "user info",
+	USER: "user", DELETE_USER: "delete user", RESTORE_USER: "restore user",
+	USERS: "users", ADD: "add", REMOVE: "remove", ADD_GROUP: "add group",
+	REMOVE_GROUP: "remove group", DELETE_GROUP: "delete group",
+	RESTORE_GROUP: "restore group", PURGE: "purge", GROUPS: "groups",
+	GROUP_USERS: "group users", GROUP_SET: "group set", GROUP_GET: "group get",
+	GROUP_GETKEYS: "group getkeys", GROUP_UNSET: "group unset",
+	GROUP_INFO: "group info", GROUP: "group", ROLE: "role", ROLES: "roles",
+	ROLE_PERMISSIONS: "role permissions", DELETE_ROLE: "delete role",
+	PERMISSION: "permission", PERMISSIONS: "permissions",
+	USER_PERMISSIONS: "permissions", DELETE_PERMISSION: "delete permission",
+	GRANT: "grant", REVOKE: "revoke", ASSIGN_USER: "assign",
+	ASSIGN_GROUP: "assign", UNASSIGN_USER: "unassign", UNASSIGN_GROUP: "unassign",
+	CHECK: "check", STATS: "stats", LOGINSTATS: "loginstats", BEGIN: "begin",
+	COMMIT: "commit", ROLLBACK: "rollback", TENANT: "tenant", TENANTS: "tenants",
+	DELETE_TENANT: "delete tenant", IF_VERSION: "if-version", GET_AT: "get",
+	HISTORY: "history",
+}
+
+// canonicalLine rebuilds the parsed command with single spaces between the
+// words and arguments, arguments are only quoted if required. The client auth
+// rules are matched against it, so that they can't be bypassed by quoting the
+// command words or adding spaces.
+func canonicalLine(cmd Command, args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteIfRequired(arg)
+	}
+	words := commandWords[cmd]
+	switch cmd {
+	case ASSIGN_USER, UNASSIGN_USER:
+		return words + " " + quoted[0] + " user " + quoted[1]
+	case ASSIGN_GROUP, UNASSIGN_GROUP:
+		return words + " " + quoted[0] + " group " + quoted[1]
+	case GET_AT:
+		return words + " " + quoted[0] + " " + quoted[1] + " at " + quoted[2]
+	case IF_VERSION:
+		inner, innerArgs := parseCmd(args[1])
+		return words + " " + quoted[0] + " " + canonicalLine(inner, innerArgs)
+	}
+	return strings.Join(append([]string{words}, quoted...), " ")
+}
+
+// quoteIfRequired quotes empty arguments and arguments containing spaces,
+// quotes or control characters
+func quoteIfRequired(arg string) string {
+	if arg == "" || strings.IndexFunc(arg, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '\\' || r == 0x7f
+	}) >= 0 {
+		return client.Quote(arg)
+	}
+	return arg
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"reflect"
 	"testing"
+
+	"github.com/UserStack/ustackd/backends"
 )
 
 func TestOneParameterCommands(t *testing.T) {
@@ -123,6 +125,21 @@ func TestTwoParameterCommands(t *testing.T) {
 	if cmd != REMOVE || !reflect.DeepEqual(args, []string{"username", "group"}) {
 		t.Fatal("failed to parse", cmd, args)
 	}
+
+	cmd, args = parseCmd("add group backend engineering")
+	if cmd != ADD_GROUP || !reflect.DeepEqual(args, []string{"backend", "engineering"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("remove group backend engineering")
+	if cmd != REMOVE_GROUP || !reflect.DeepEqual(args, []string{"backend", "engineering"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("add group engineering")
+	if cmd != ADD || !reflect.DeepEqual(args, []string{"group", "engineering"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
 }
 
 func TestUserCommands(t *testing.T) {
@@ -135,6 +152,11 @@ func TestUserCommands(t *testing.T) {
 	if cmd != USER_GROUPS || !reflect.DeepEqual(args, []string{"username"}) {
 		t.Fatal("failed to parse", cmd, args)
 	}
+
+	cmd, args = parseCmd("user groups username --transitive")
+	if cmd != USER_GROUPS || !reflect.DeepEqual(args, []string{"username", "--transitive"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
 }
 
 func TestGroupCommands(t *testing.T) {
@@ -147,6 +169,31 @@ func TestGroupCommands(t *testing.T) {
 	if cmd != GROUP_USERS || !reflect.DeepEqual(args, []string{"name"}) {
 		t.Fatal("failed to parse", cmd, args)
 	}
+
+	cmd, args = parseCmd(`group set admins description "The admins"`)
+	if cmd != GROUP_SET || !reflect.DeepEqual(args, []string{"admins", "description", "The admins"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("group get admins description")
+	if cmd != GROUP_GET || !reflect.DeepEqual(args, []string{"admins", "description"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("group getkeys admins")
+	if cmd != GROUP_GETKEYS || !reflect.DeepEqual(args, []string{"admins"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("group unset admins description")
+	if cmd != GROUP_UNSET || !reflect.DeepEqual(args, []string{"admins", "description"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("group set admins description")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
 }
 
 func TestDeleteCommands(t *testing.T) {
@@ -176,4 +223,412 @@ func TestThreeParameterCommands(t *testing.T) {
 	if cmd != SET || !reflect.DeepEqual(args, []string{"username", "key", "value"}) {
 		t.Fatal("failed to parse", cmd, args)
 	}
+
+	cmd, args = parseCmd("find email = joe@example.com")
+	if cmd != FIND || !reflect.DeepEqual(args, []string{"email", "=", "joe@example.com"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("find email prefix")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestQuotedArguments(t *testing.T) {
+	cmd, args := parseCmd(`login "user name" "pass \"word\""`)
+	if cmd != LOGIN || !reflect.DeepEqual(args, []string{"user name", `pass "word"`}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`set "user name" "first name" "line\r\nbreak\\"`)
+	if cmd != SET || !reflect.DeepEqual(args, []string{"user name", "first name", "line\r\nbreak\\"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`set username key value with "spaces"`)
+	if cmd != SET || !reflect.DeepEqual(args, []string{"username", "key", `value with "spaces"`}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`group users "group name"`)
+	if cmd != GROUP_USERS || !reflect.DeepEqual(args, []string{"group name"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`delete user ""`)
+	if cmd != DELETE_USER || !reflect.DeepEqual(args, []string{""}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestInvalidQuotedArguments(t *testing.T) {
+	for _, line := range []string{
+		`login "user name secret`,
+		`login "user"name secret`,
+		`set user "key\x" value`,
+		`get "user`,
+	} {
+		cmd, args := parseCmd(line)
+		if cmd != ERR_INVALID_ARGS {
+			t.Fatal("expected invalid args for", line, cmd, args)
+		}
+	}
+}
+
+func TestBinaryCommands(t *testing.T) {
+	cmd, args := parseCmd("setb username key dmFsdWU=")
+	if cmd != SET_BINARY || !reflect.DeepEqual(args, []string{"username", "key", "dmFsdWU="}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("getb username key")
+	if cmd != GET_BINARY || !reflect.DeepEqual(args, []string{"username", "key"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("getb username")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestFormatCommand(t *testing.T) {
+	cmd, args := parseCmd("format json")
+	if cmd != FORMAT || !reflect.DeepEqual(args, []string{"json"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("format")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestTransactionCommands(t *testing.T) {
+	cmd, _ := parseCmd("begin")
+	if cmd != BEGIN {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	cmd, _ = parseCmd("COMMIT")
+	if cmd != COMMIT {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	cmd, _ = parseCmd("rollback")
+	if cmd != ROLLBACK {
+		t.Fatal("failed to parse", cmd)
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	cmd, args := parseCmd(`users filter "j*" active limit 10`)
+	if cmd != USERS || !reflect.DeepEqual(args, []string{"filter", "j*", "active", "limit", "10"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("groups sort name")
+	if cmd != GROUPS || !reflect.DeepEqual(args, []string{"sort", "name"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("group users admins after aTo1")
+	if cmd != GROUP_USERS || !reflect.DeepEqual(args, []string{"admins", "after", "aTo1"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`group users admins filter "j*`)
+	if cmd != ERR_INVALID_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	options, err := parseListOptions([]string{
+		"filter", "j*", "INACTIVE", "sort", "Name", "limit", "10", "after", "aTo1", "--transitive"})
+	expected := backends.ListOptions{
+		Filter: "j*", State: "inactive", Sort: "name", Limit: 10, After: "aTo1", Transitive: true}
+	if err != nil || options != expected {
+		t.Fatal("failed to parse", options, err)
+	}
+
+	for _, args := range [][]string{
+		{"limit"}, {"limit", "-1"}, {"limit", "ten"}, {"sort", "password"}, {"unknown"},
+	} {
+		if _, err = parseListOptions(args); err == nil {
+			t.Fatal("expected error for", args)
+		}
+	}
+}
+
+func TestUserDataCommands(t *testing.T) {
+	cmd, args := parseCmd("getall username")
+	if cmd != GETALL || !reflect.DeepEqual(args, []string{"username"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("unset username key")
+	if cmd != UNSET || !reflect.DeepEqual(args, []string{"username", "key"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`setmany username firstname Joe lastname "van Doe"`)
+	if cmd != SETMANY || !reflect.DeepEqual(args, []string{
+		"username", "firstname", "Joe", "lastname", "van Doe"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("setmany username firstname Joe lastname")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("setmany username")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	cmd, args := parseCmd("admin rename user joe joseph")
+	if cmd != ADMIN_RENAME_USER || !reflect.DeepEqual(args, []string{"joe", "joseph"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd(`admin password joe "new secret"`)
+	if cmd != ADMIN_PASSWORD || !reflect.DeepEqual(args, []string{"joe", "new secret"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("rename group admins administrators")
+	if cmd != RENAME_GROUP || !reflect.DeepEqual(args, []string{"admins", "administrators"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("admin rename user joe")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("admin rename group admins administrators")
+	if cmd != ERR_UNKNOWN_FUNC {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestRoleCommands(t *testing.T) {
+	cmd, args := parseCmd("role billing")
+	if cmd != ROLE || !reflect.DeepEqual(args, []string{"billing"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("role permissions billing")
+	if cmd != ROLE_PERMISSIONS || !reflect.DeepEqual(args, []string{"billing"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("permissions")
+	if cmd != PERMISSIONS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("permissions joe")
+	if cmd != USER_PERMISSIONS || !reflect.DeepEqual(args, []string{"joe"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("delete permission invoices.read")
+	if cmd != DELETE_PERMISSION || !reflect.DeepEqual(args, []string{"invoices.read"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("grant billing invoices.read")
+	if cmd != GRANT || !reflect.DeepEqual(args, []string{"billing", "invoices.read"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("assign billing user joe")
+	if cmd != ASSIGN_USER || !reflect.DeepEqual(args, []string{"billing", "joe"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("unassign billing group accounting")
+	if cmd != UNASSIGN_GROUP || !reflect.DeepEqual(args, []string{"billing", "accounting"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("assign billing team accounting")
+	if cmd != ERR_INVALID_ARGS {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("check joe invoices.read")
+	if cmd != CHECK || !reflect.DeepEqual(args, []string{"joe", "invoices.read"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestTenantCommands(t *testing.T) {
+	cmd, args := parseCmd("tenant acme")
+	if cmd != TENANT || !reflect.DeepEqual(args, []string{"acme"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, _ = parseCmd("tenants")
+	if cmd != TENANTS {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	cmd, args = parseCmd("delete tenant acme")
+	if cmd != DELETE_TENANT || !reflect.DeepEqual(args, []string{"acme"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, _ = parseCmd("tenant")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd)
+	}
+}
+
+func TestScheduleCommands(t *testing.T) {
+	cmd, args := parseCmd("disable at joe 2026-01-01T12:00:00Z")
+	if cmd != DISABLE_AT || !reflect.DeepEqual(args, []string{"joe", "2026-01-01T12:00:00Z"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("ENABLE AT joe 2026-01-01T12:00:00Z")
+	if cmd != ENABLE_AT || !reflect.DeepEqual(args, []string{"joe", "2026-01-01T12:00:00Z"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	// a user named at can still be disabled
+	cmd, args = parseCmd("disable at")
+	if cmd != DISABLE || !reflect.DeepEqual(args, []string{"at"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("expire at joe never")
+	if cmd != EXPIRE_AT || !reflect.DeepEqual(args, []string{"joe", "never"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, _ = parseCmd("expire on joe never")
+	if cmd != ERR_INVALID_ARGS {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	cmd, _ = parseCmd("expire at joe")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	options, err := parseListOptions([]string{"--expiry", "limit", "10"})
+	if err != nil || !options.Expiry || options.Limit != 10 {
+		t.Fatal("failed to parse", options, err)
+	}
+}
+
+func TestTrashCommands(t *testing.T) {
+	cmd, args := parseCmd("restore user 42")
+	if cmd != RESTORE_USER || !reflect.DeepEqual(args, []string{"42"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("restore group 7")
+	if cmd != RESTORE_GROUP || !reflect.DeepEqual(args, []string{"7"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, _ = parseCmd("restore role 7")
+	if cmd != ERR_UNKNOWN_FUNC {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	cmd, args = parseCmd("purge")
+	if cmd != PURGE || len(args) != 0 {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("purge 720h")
+	if cmd != PURGE || !reflect.DeepEqual(args, []string{"720h"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	options, err := parseListOptions([]string{"--deleted", "sort", "name"})
+	if err != nil || !options.Deleted || options.Sort != "name" {
+		t.Fatal("failed to parse", options, err)
+	}
+}
+
+func TestVersionCommands(t *testing.T) {
+	cmd, args := parseCmd("if-version 3 set joe email \"joe@example.com\"")
+	if cmd != IF_VERSION || !reflect.DeepEqual(args, []string{"3", "set joe email \"joe@example.com\""}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, _ = parseCmd("if-version 3")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd)
+	}
+
+	cmd, args = parseCmd("user info joe")
+	if cmd != USER_INFO || !reflect.DeepEqual(args, []string{"joe"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("group info admins")
+	if cmd != GROUP_INFO || !reflect.DeepEqual(args, []string{"admins"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	// a group named info can still be created
+	cmd, args = parseCmd("group info")
+	if cmd != GROUP || !reflect.DeepEqual(args, []string{"info"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+}
+
+func TestHistoryCommands(t *testing.T) {
+	cmd, args := parseCmd("get joe email at 2026-01-01T12:00:00Z")
+	if cmd != GET_AT || !reflect.DeepEqual(args, []string{"joe", "email", "2026-01-01T12:00:00Z"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("get joe \"home address\" at 2026-01-01T12:00:00Z")
+	if cmd != GET_AT || !reflect.DeepEqual(args, []string{"joe", "home address", "2026-01-01T12:00:00Z"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	// unquoted keys with spaces are still read completely
+	cmd, args = parseCmd("get joe home address")
+	if cmd != GET || !reflect.DeepEqual(args, []string{"joe", "home address"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, args = parseCmd("history joe email")
+	if cmd != HISTORY || !reflect.DeepEqual(args, []string{"joe", "email"}) {
+		t.Fatal("failed to parse", cmd, args)
+	}
+
+	cmd, _ = parseCmd("history joe")
+	if cmd != ERR_MISSING_ARGS {
+		t.Fatal("failed to parse", cmd)
+	}
+}
+
+func TestCanonicalLine(t *testing.T) {
+	for line, expected := range map[string]string{
+		"\"admin\"  password root \"new secret\"":          "admin password root \"new secret\"",
+		"group   users admins limit 10":                    "group users admins limit 10",
+		"get joe \"home address\" at 2026-01-01T12:00:00Z": "get joe \"home address\" at 2026-01-01T12:00:00Z",
+		"assign admin  user joe":                           "assign admin user joe",
+		"if-version 2 \"set\" joe email x":                 "if-version 2 set joe email x",
+		"set joe email \"\"":                               "set joe email \"\"",
+	} {
+		cmd, args := parseCmd(line)
+		if canonical := canonicalLine(cmd, args); canonical != expected {
+			t.Errorf("expected %q for %q got %q", expected, line, canonical)
+		}
+	}
 }
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the credentials of the process connected to the
+// other end of a unix socket (SO_PEERCRED)
+func peerCredentials(conn *net.UnixConn) (peer *Peer, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return
+	}
+	return &Peer{Uid: int(cred.Uid), Gid: int(cred.Gid), Pid: int(cred.Pid)}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+func peerCredentials(conn *net.UnixConn) (*Peer, error) {
+	return nil, fmt.Errorf("Peer credentials are not supported on this platform")
+}
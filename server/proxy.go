@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// implementation of the PROXY protocol (version 1 and 2) as specified in
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+const (
+	PROXY_V1_MAX_LENGTH = 107
+	PROXY_V2_HEADER_LEN = 16
+)
+
+var PROXY_V1_PREFIX = []byte("PROXY ")
+var PROXY_V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol header from the reader and returns
+// the source address of the proxied connection. If the header doesn't carry
+// an address (v1 UNKNOWN, v2 LOCAL or unsupported families) nil is returned.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	// the shortest valid header "PROXY UNKNOWN\r\n" has 15 bytes, so peeking
+	// the 12 bytes of the v2 signature is always safe
+	start, err := reader.Peek(len(PROXY_V2_SIGNATURE))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, PROXY_V2_SIGNATURE) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(start, PROXY_V1_PREFIX) {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, fmt.Errorf("No proxy protocol header")
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < PROXY_V1_MAX_LENGTH {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("Proxy header v1 is too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("Proxy header v1 has invalid number of fields: %d", len(fields))
+	}
+	ip := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if ip == nil || dstIP == nil {
+		return nil, fmt.Errorf("Proxy header v1 has invalid addresses")
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil || dstIP.To4() == nil {
+			return nil, fmt.Errorf("Proxy header v1 has no IPv4 addresses for TCP4")
+		}
+	case "TCP6":
+		if strings.Contains(fields[2], ".") || strings.Contains(fields[3], ".") {
+			return nil, fmt.Errorf("Proxy header v1 has no IPv6 addresses for TCP6")
+		}
+	default:
+		return nil, fmt.Errorf("Proxy header v1 has unknown protocol: %s", fields[1])
+	}
+	port, err := parsePort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = parsePort(fields[5]); err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func parsePort(str string) (int, error) {
+	port, err := strconv.ParseUint(str, 10, 16)
+	if err != nil || (len(str) > 1 && str[0] == '0') {
+		return 0, fmt.Errorf("Proxy header has invalid port: %s", str)
+	}
+	return int(port), nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, PROXY_V2_HEADER_LEN)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("Proxy header v2 has invalid version: %d", version)
+	}
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	transport := header[13] & 0x0f
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health checks of the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("Proxy header v2 has unknown command: %d", command)
+	}
+	if transport != 0x1 { // only STREAM is relevant for ustackd
+		return nil, nil
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("Proxy header v2 is too short for IPv4")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("Proxy header v2 is too short for IPv6")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	// AF_UNSPEC and AF_UNIX don't carry a usable source address
+	return nil, nil
+}
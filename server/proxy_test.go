@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func readProxyString(header string) (net.Addr, string, error) {
+	reader := bufio.NewReader(strings.NewReader(header))
+	addr, err := readProxyHeader(reader)
+	rest, _ := reader.ReadString('\n')
+	return addr, rest, err
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	addr, rest, err := readProxyString("PROXY TCP4 192.168.0.1 192.168.0.11 56324 7654\r\nlogin foo bar\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.168.0.1:56324" {
+		t.Fatal("expected address 192.168.0.1:56324 but got", addr)
+	}
+	if rest != "login foo bar\r\n" {
+		t.Fatal("expected remaining data to be untouched, got", rest)
+	}
+
+	addr, _, err = readProxyString("PROXY TCP6 2001:db8::1 2001:db8::2 1234 7654\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "[2001:db8::1]:1234" {
+		t.Fatal("expected address [2001:db8::1]:1234 but got", addr)
+	}
+
+	addr, _, err = readProxyString("PROXY UNKNOWN\r\n")
+	if err != nil || addr != nil {
+		t.Fatal("expected no address and no error for UNKNOWN", addr, err)
+	}
+}
+
+func TestProxyHeaderV1Invalid(t *testing.T) {
+	invalid := []string{
+		"login foo bar\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 7654\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 7654\r\n",
+		"PROXY TCP6 192.168.0.1 2001:db8::2 56324 7654\r\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 7654\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 7654\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 0123 7654\r\n",
+		"PROXY TCP4 foo 192.168.0.11 56324 7654\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 7654" + strings.Repeat(" ", 100) + "\r\n",
+	}
+	for _, header := range invalid {
+		if _, _, err := readProxyString(header); err == nil {
+			t.Fatalf("expected %q to fail", header)
+		}
+	}
+}
+
+func proxyV2(command, family byte, payload []byte) string {
+	header := append([]byte{}, PROXY_V2_SIGNATURE...)
+	header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	ipv4 := []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x1d, 0xe6}
+	addr, rest, err := readProxyString(proxyV2(0x1, 0x11, ipv4) + "quit\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.168.0.1:56324" {
+		t.Fatal("expected address 192.168.0.1:56324 but got", addr)
+	}
+	if rest != "quit\r\n" {
+		t.Fatal("expected remaining data to be untouched, got", rest)
+	}
+
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	ipv6[32], ipv6[33] = 0x04, 0xd2
+	// with additional TLVs that should be skipped
+	ipv6 = append(ipv6, 0x04, 0x00, 0x01, 0x00)
+	addr, rest, err = readProxyString(proxyV2(0x1, 0x21, ipv6) + "quit\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "[2001:db8::1]:1234" {
+		t.Fatal("expected address [2001:db8::1]:1234 but got", addr)
+	}
+	if rest != "quit\r\n" {
+		t.Fatal("expected remaining data to be untouched, got", rest)
+	}
+
+	addr, _, err = readProxyString(proxyV2(0x0, 0x00, nil) + "quit\r\n")
+	if err != nil || addr != nil {
+		t.Fatal("expected no address and no error for LOCAL", addr, err)
+	}
+}
+
+func TestProxyHeaderV2Invalid(t *testing.T) {
+	invalid := []string{
+		proxyV2(0x2, 0x11, make([]byte, 12)),
+		proxyV2(0x1, 0x11, make([]byte, 4)),
+		proxyV2(0x1, 0x21, make([]byte, 12)),
+		proxyV2(0x1, 0x11, nil)[:15],
+		string(PROXY_V2_SIGNATURE) + "\x11\x11\x00\x00",
+	}
+	for _, header := range invalid {
+		if _, _, err := readProxyString(header); err == nil {
+			t.Fatalf("expected %q to fail", header)
+		}
+	}
+}
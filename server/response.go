@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Response is a complete response in the json format, which is sent as a
+// single line
+type Response struct {
+	Ok      bool          `json:"ok"`
+	Code    string        `json:"code,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Value   interface{}   `json:"value,omitempty"`
+	Items   []interface{} `json:"items,omitempty"`
+}
+
+// Item sends an item of a list response. In the json format the items are
+// collected until the response is completed by Ok, OkValue or Err.
+func (context *Context) Item(item interface{}) {
+	if context.json {
+		context.items = append(context.items, item)
+		return
+	}
+	context.Write(fmt.Sprint(item))
+}
+
+// Value sends a single value followed by + OK, in the json format the value
+// is part of the response object
+func (context *Context) Value(value interface{}) {
+	if context.json {
+		context.writeJson(&Response{Ok: true, Value: value})
+		return
+	}
+	context.Write(fmt.Sprint(value))
+	context.Ok()
+}
+
+// Bye confirms the quit command
+func (context *Context) Bye() {
+	if context.json {
+		context.writeJson(&Response{Ok: true, Message: "BYE"})
+		return
+	}
+	context.Write("+ BYE")
+}
+
+func (context *Context) writeJson(response *Response) {
+	if response.Ok {
+		response.Items = context.items
+	}
+	context.items = nil
+	data, err := json.Marshal(response)
+	if err != nil {
+		context.Logf("Unable to encode json response: %s", err)
+		data = []byte(`{"ok":false,"code":"EFAULT"}`)
+	}
+	context.Write(string(data))
+}
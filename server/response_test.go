@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func newTestContext(cfg *Config) (*Context, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return &Context{
+		writer: bufio.NewWriter(&buf),
+		Server: &Server{Cfg: cfg, Logger: log.New(ioutil.Discard, "", 0)},
+	}, &buf
+}
+
+func TestErrorResponses(t *testing.T) {
+	context, buf := newTestContext(&Config{})
+	context.Err("EINVAL", "Missing\r\narguments")
+	context.Error(&backends.Error{Code: "EFAULT", Message: "no such table: Users"})
+	context.Err("EACCES", "")
+	expected := "- EINVAL Missing arguments\r\n- EFAULT no such table: Users\r\n- EACCES\r\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q got %q", expected, buf.String())
+	}
+}
+
+func TestHideInternalErrors(t *testing.T) {
+	cfg := &Config{}
+	cfg.Daemon.HideInternalErrors = true
+	context, buf := newTestContext(cfg)
+	context.Error(&backends.Error{Code: "EFAULT", Message: "no such table: Users"})
+	context.Error(&backends.Error{Code: "ENOENT", Message: "Name or uid unknown"})
+	expected := "- EFAULT Internal error\r\n- ENOENT Name or uid unknown\r\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q got %q", expected, buf.String())
+	}
+}
+
+func TestJsonResponses(t *testing.T) {
+	context, buf := newTestContext(&Config{})
+	context.json = true
+	context.Item(backends.User{Uid: 1, Name: "a:b", Active: true})
+	context.Ok()
+	context.Item("discarded")
+	context.Err("ENOENT", "Name or uid unknown")
+	context.Value("line\nbreak")
+	expected := `{"ok":true,"items":[{"uid":1,"name":"a:b","active":true}]}` + "\r\n" +
+		`{"ok":false,"code":"ENOENT","message":"Name or uid unknown"}` + "\r\n" +
+		`{"ok":true,"value":"line\nbreak"}` + "\r\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+// role <name>
+func (ip *Interpreter) role(args []string) {
+	rid, err := ip.backend().CreateRole(args[0])
+	ip.intResponder(rid, err)
+}
+
+// roles
+func (ip *Interpreter) roles() {
+	items, err := ip.backend().Roles()
+	if err == nil {
+		for _, item := range items {
+			ip.Item(item)
+		}
+	}
+	ip.simpleResponder(err)
+}
+
+// role permissions <role|rid>
+func (ip *Interpreter) rolePermissions(args []string) {
+	items, err := ip.backend().RolePermissions(args[0])
+	if err == nil {
+		for _, item := range items {
+			ip.Item(item)
+		}
+	}
+	ip.simpleResponder(err)
+}
+
+// delete role <role|rid>
+func (ip *Interpreter) deleteRole(args []string) {
+	ip.simpleResponder(ip.backend().DeleteRole(args[0]))
+}
+
+// permission <name>
+func (ip *Interpreter) permission(args []string) {
+	pid, err := ip.backend().CreatePermission(args[0])
+	ip.intResponder(pid, err)
+}
+
+// permissions
+func (ip *Interpreter) permissions() {
+	items, err := ip.backend().Permissions()
+	if err == nil {
+		for _, item := range items {
+			ip.Item(item)
+		}
+	}
+	ip.simpleResponder(err)
+}
+
+// permissions <name|uid>
+func (ip *Interpreter) userPermissions(args []string) {
+	items, err := ip.backend().UserPermissions(args[0])
+	if err == nil {
+		for _, item := range items {
+			ip.Item(item)
+		}
+	}
+	ip.simpleResponder(err)
+}
+
+// delete permission <permission|pid>
+func (ip *Interpreter) deletePermission(args []string) {
+	ip.simpleResponder(ip.backend().DeletePermission(args[0]))
+}
+
+// grant <role|rid> <permission|pid>
+func (ip *Interpreter) grant(args []string) {
+	ip.simpleResponder(ip.backend().GrantPermission(args[0], args[1]))
+}
+
+// revoke <role|rid> <permission|pid>
+func (ip *Interpreter) revoke(args []string) {
+	ip.simpleResponder(ip.backend().RevokePermission(args[0], args[1]))
+}
+
+// assign <role|rid> user <name|uid>
+func (ip *Interpreter) assignUser(args []string) {
+	ip.simpleResponder(ip.backend().AssignRoleToUser(args[0], args[1]))
+}
+
+// assign <role|rid> group <group|gid>
+func (ip *Interpreter) assignGroup(args []string) {
+	ip.simpleResponder(ip.backend().AssignRoleToGroup(args[0], args[1]))
+}
+
+// unassign <role|rid> user <name|uid>
+func (ip *Interpreter) unassignUser(args []string) {
+	ip.simpleResponder(ip.backend().UnassignRoleFromUser(args[0], args[1]))
+}
+
+// unassign <role|rid> group <group|gid>
+func (ip *Interpreter) unassignGroup(args []string) {
+	ip.simpleResponder(ip.backend().UnassignRoleFromGroup(args[0], args[1]))
+}
+
+// check <name|uid> <permission>, answers with "yes role:<role>" (followed
+// by "group:<group>" if the role is assigned to a group of the user) or "no"
+func (ip *Interpreter) check(args []string) {
+	check, err := ip.backend().CheckPermission(args[0], args[1])
+	if err != nil {
+		ip.Error(err)
+	} else {
+		ip.OkValue(check)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// interval in which the scheduler applies the due state changes, purges the
+// trash and prunes the history
+const SCHEDULE_INTERVAL = time.Minute
+
+// scheduler applies the scheduled state changes of backends that support
+// them, purges the deleted users and groups after the trash-retention (in
+// days) and prunes the history after the retention of the keys until the
+// server is stopped
+func (s *Server) scheduler() {
+	scheduled, _ := s.Backend.(backends.Scheduled)
+	purger, _ := s.Backend.(backends.Purger)
+	retention := time.Duration(s.Cfg.Daemon.TrashRetention) * 24 * time.Hour
+	if retention <= 0 {
+		purger = nil
+	}
+	historized, _ := s.Backend.(backends.Historized)
+	if !s.Cfg.History.Enabled || len(s.Cfg.History.Retention) == 0 {
+		historized = nil
+	}
+	if scheduled == nil && purger == nil && historized == nil {
+		return
+	}
+	ticker := time.NewTicker(SCHEDULE_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.running {
+			return
+		}
+		if scheduled != nil {
+			s.applySchedules(scheduled)
+		}
+		if purger != nil {
+			s.purgeTrash(purger, retention)
+		}
+		if historized != nil {
+			s.pruneHistory(historized, s.Cfg.History.Retention)
+		}
+	}
+}
+
+func (s *Server) applySchedules(backend backends.Scheduled) {
+	changes, err := backend.ApplySchedules()
+	if err != nil {
+		s.Logger.Printf("Unable to apply scheduled state changes: %s\n", err)
+		return
+	}
+	for _, change := range changes {
+		s.Logger.Printf("Applied scheduled state change: %s\n", change)
+		s.Stats.scheduledChanges++
+	}
+}
+
+func (s *Server) purgeTrash(backend backends.Purger, retention time.Duration) {
+	count, err := backend.PurgeAll(retention)
+	if err != nil {
+		s.Logger.Printf("Unable to purge the trash: %s\n", err)
+		return
+	}
+	if count > 0 {
+		s.Logger.Printf("Purged %d deleted users and groups\n", count)
+		s.Stats.purged += int(count)
+	}
+}
+
+// parseTime parses RFC3339 times, never is the zero time
+func parseTime(value string) (time.Time, error) {
+	if value == "never" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// formatExpiry formats the expiry of users as RFC3339 in UTC or never
+func formatExpiry(expires *time.Time) string {
+	if expires == nil {
+		return "never"
+	}
+	return expires.UTC().Format(time.RFC3339)
+}
+
+// expire at <name|uid> <time|never>
+func (ip *Interpreter) expireAt(args []string) {
+	at, err := parseTime(args[1])
+	if err != nil {
+		ip.Err("EINVAL", "Invalid time, expected RFC3339 or never")
+		return
+	}
+	ip.simpleResponder(ip.backend().ExpireUser(args[0], at))
+}
+
+// disable at <name|uid> <time>
+func (ip *Interpreter) disableAt(args []string) {
+	ip.scheduleState(args, false)
+}
+
+// enable at <name|uid> <time>
+func (ip *Interpreter) enableAt(args []string) {
+	ip.scheduleState(args, true)
+}
+
+func (ip *Interpreter) scheduleState(args []string, active bool) {
+	at, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		ip.Err("EINVAL", "Invalid time, expected RFC3339")
+		return
+	}
+	ip.simpleResponder(ip.backend().ScheduleUserState(args[0], at, active))
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func TestApplySchedules(t *testing.T) {
+	backend, err := backends.NewSqliteBackend(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	backend.SetClock(func() time.Time { return now })
+	s := &Server{Backend: &backend, Logger: log.New(ioutil.Discard, "", 0)}
+
+	backend.CreateUser("joe", "secret")
+	backend.ScheduleUserState("joe", now.Add(time.Minute), false)
+	s.applySchedules(&backend)
+	if s.Stats.scheduledChanges != 0 {
+		t.Fatal("should not apply changes that aren't due")
+	}
+
+	now = now.Add(time.Minute)
+	s.applySchedules(&backend)
+	if s.Stats.scheduledChanges != 1 {
+		t.Fatal("should apply due change", s.Stats.scheduledChanges)
+	}
+	if _, lerr := backend.LoginUser("joe", "secret"); lerr == nil {
+		t.Fatal("should disable user")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	at, err := parseTime("2026-01-01T12:00:00+01:00")
+	if err != nil || formatExpiry(&at) != "2026-01-01T11:00:00Z" {
+		t.Fatal("should parse time", at, err)
+	}
+	if at, err = parseTime("never"); err != nil || !at.IsZero() {
+		t.Fatal("should parse never", at, err)
+	}
+	if _, err = parseTime("tomorrow"); err == nil {
+		t.Fatal("should fail on invalid time")
+	}
+	if formatExpiry(nil) != "never" {
+		t.Fatal("should format missing expiry as never")
+	}
+}
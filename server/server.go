@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 
 	"github.com/UserStack/ustackd/backends"
 	"github.com/UserStack/ustackd/client"
@@ -16,14 +17,16 @@ import (
 )
 
 type Server struct {
-	Logger    *log.Logger
-	Cfg       *Config
-	Backend   backends.Abstract
-	App       *cli.App
-	Logging   bool
-	running   bool
-	listeners []net.Listener
-	tlsConfig *tls.Config
+	Logger      *log.Logger
+	Cfg         *Config
+	Backend     backends.Abstract
+	App         *cli.App
+	Logging     bool
+	running     bool
+	listeners   []net.Listener
+	tlsConfig   *tls.Config
+	notifier    *SdNotifier
+	connections connLimiter
 	Stats
 }
 
@@ -71,6 +74,12 @@ func (s *Server) RunContext(c *cli.Context) {
 		return
 	}
 
+	// connect to the service manager before a possible chroot
+	if s.notifier, err = NewSdNotifier(); err != nil {
+		logger.Printf("Unable to connect to service manager: %s\n", err)
+		return
+	}
+
 	if err = s.demonize(); err != nil {
 		logger.Printf("Unable to demonize: %s\n", err)
 		return
@@ -85,13 +94,16 @@ func (s *Server) RunContext(c *cli.Context) {
 		logger.Printf("Setup Backend: %s\n", err)
 		return
 	}
+	go s.scheduler()
 
-	connChan := make(chan net.Conn)
+	connChan := make(chan *Context)
 	if err = s.setupListeners(connChan); err != nil {
 		logger.Printf("Setup Listeners: %s\n", err)
 		return
 	}
 
+	s.notifier.Ready(fmt.Sprintf("Listening on %d sockets", len(s.listeners)))
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, os.Kill)
 
@@ -99,14 +111,15 @@ func (s *Server) RunContext(c *cli.Context) {
 		select {
 		case <-sigChan:
 			s.Stop()
-		case conn := <-connChan:
-			go NewContext(conn, s).Handle()
+		case context := <-connChan:
+			go context.Handle()
 		}
 	}
 	logger.Println("Shutdown server")
 }
 
 func (s *Server) Stop() (err error) {
+	s.notifier.Stopping("Shutdown server")
 	os.Remove(s.Cfg.Daemon.Pid)
 	s.running = false
 	for _, listener := range s.listeners {
@@ -159,6 +172,13 @@ func (s *Server) setupBackend() (err error) {
 	default:
 		err = fmt.Errorf("Unknown backend: %s\n", s.Cfg.Daemon.Backend)
 	}
+	if err == nil && s.Cfg.History.Enabled {
+		historized, ok := s.Backend.(backends.Historized)
+		if !ok {
+			return fmt.Errorf("Backend %s doesn't keep a history\n", s.Cfg.Daemon.Backend)
+		}
+		historized.EnableHistory()
+	}
 	return
 }
 
@@ -217,28 +237,109 @@ func (s *Server) setupProxy() (err error) {
 	return
 }
 
-func (s *Server) setupListeners(connChan chan net.Conn) (err error) {
-	s.listeners = make([]net.Listener, len(s.Cfg.Daemon.Listen))
-	for i, bindAddress := range s.Cfg.Daemon.Listen {
-		listener, lerr := net.Listen("tcp", bindAddress)
+func (s *Server) setupListeners(connChan chan *Context) (err error) {
+	files, err := activationFiles()
+	if err != nil {
+		return
+	}
+	used := make(map[string]bool)
+	if len(files) > 0 {
+		err = s.setupActivatedListeners(files, connChan, used)
+	} else {
+		err = s.setupConfiguredListeners(connChan, used)
+	}
+	for name := range s.Cfg.Listener {
+		if !used[name] {
+			s.Logger.Printf("[listener \"%s\"] doesn't match any socket\n", name)
+		}
+	}
+	return
+}
+
+func (s *Server) setupConfiguredListeners(connChan chan *Context, used map[string]bool) (err error) {
+	for _, bindAddress := range s.Cfg.Daemon.Listen {
+		cfg := s.Cfg.Listener[bindAddress]
+		listener, lerr := listen(bindAddress, cfg)
 		if lerr != nil {
 			err = fmt.Errorf("Unable to listen: %s\n", lerr)
 			return
 		}
 		s.Logger.Printf("ustackd listenting on " + bindAddress + "\n")
+		used[bindAddress] = true
+		s.serve(listener, cfg, connChan)
+	}
+	return
+}
 
-		go (func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil && s.running {
-					s.Logger.Printf("Can't accept connection: %s\n", err)
-					continue
+// setupActivatedListeners uses the sockets passed by systemd instead of the
+// configured listen addresses. The listener configuration is looked up by the
+// FileDescriptorName of the socket or by its address.
+func (s *Server) setupActivatedListeners(files []*os.File, connChan chan *Context, used map[string]bool) (err error) {
+	activated, err := activatedListeners(files)
+	if err != nil {
+		return
+	}
+	for _, a := range activated {
+		address := listenerAddress(a.listener)
+		name := a.name
+		cfg, ok := s.Cfg.Listener[name]
+		if !ok {
+			name = address
+			cfg = s.Cfg.Listener[name]
+		}
+		s.Logger.Printf("ustackd listenting on %s (%s) passed by systemd\n", address, a.name)
+		used[name] = true
+		s.serve(a.listener, cfg, connChan)
+	}
+	return
+}
+
+func (s *Server) serve(listener net.Listener, cfg *Listener, connChan chan *Context) {
+	go (func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !s.running {
+					return
 				}
-				connChan <- conn
+				s.Logger.Printf("Can't accept connection: %s\n", err)
+				continue
 			}
-		})()
+			context := NewContext(conn, s)
+			context.listener = cfg
+			connChan <- context
+		}
+	})()
 
-		s.listeners[i] = listener
+	s.listeners = append(s.listeners, listener)
+}
+
+// listen creates a tcp listener or for addresses like "unix:/path/to/sock" a
+// unix socket listener with the configured mode and owner
+func listen(bindAddress string, cfg *Listener) (net.Listener, error) {
+	if !strings.HasPrefix(bindAddress, "unix:") {
+		return net.Listen("tcp", bindAddress)
 	}
-	return
+	path := strings.TrimPrefix(bindAddress, "unix:")
+	// remove a stale socket of a previous run
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil || cfg == nil {
+		return listener, err
+	}
+	if cfg.Mode != 0 {
+		if err = os.Chmod(path, cfg.Mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if cfg.Uid != -1 || cfg.Gid != -1 {
+		if err = os.Chown(path, cfg.Uid, cfg.Gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
 }
@@ -2,7 +2,9 @@ package server
 
 type Stats struct {
 	Connects, Disconnects, Login, FailedLogin, unrestrictedCommands, restrictedCommands,
-	restrictedCommandsAccessDenied int
+	restrictedCommandsAccessDenied, rejectedConnections, rejectedClientAuths, rejectedProxyHeaders,
+	idleTimeouts, commandTimeouts, tooLongLines, connectionLimitRejects, ipConnectionLimitRejects,
+	scheduledChanges, purged int
 }
 
 func (s *Stats) Reset() {
@@ -13,6 +15,16 @@ func (s *Stats) Reset() {
 	s.restrictedCommands = 0
 	s.restrictedCommandsAccessDenied = 0
 	s.unrestrictedCommands = 0
+	s.rejectedConnections = 0
+	s.rejectedClientAuths = 0
+	s.rejectedProxyHeaders = 0
+	s.idleTimeouts = 0
+	s.commandTimeouts = 0
+	s.tooLongLines = 0
+	s.connectionLimitRejects = 0
+	s.ipConnectionLimitRejects = 0
+	s.scheduledChanges = 0
+	s.purged = 0
 }
 
 func (s *Stats) ActiveConnections() int {
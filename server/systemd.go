@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// first file descriptor passed by systemd socket activation
+const SD_LISTEN_FDS_START = 3
+
+// activatedListener is a listening socket passed by systemd, name is the
+// FileDescriptorName of the socket unit
+type activatedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// activationFiles returns the files passed by systemd socket activation
+// (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES) named by LISTEN_FDNAMES. The
+// variables are removed from the environment, so that they aren't inherited.
+func activationFiles() (files []*os.File, err error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	fdNames := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" {
+		return
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return // sockets are meant for a different process
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		err = fmt.Errorf("Invalid LISTEN_FDS: %s", fds)
+		return
+	}
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	for i := 0; i < count; i++ {
+		fd := SD_LISTEN_FDS_START + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return
+}
+
+// activatedListeners converts the passed files into listeners
+func activatedListeners(files []*os.File) (listeners []activatedListener, err error) {
+	for _, file := range files {
+		listener, lerr := net.FileListener(file)
+		if lerr != nil {
+			err = fmt.Errorf("Socket %s is not a listening socket: %s", file.Name(), lerr)
+			return
+		}
+		// FileListener dups the descriptor
+		file.Close()
+		listeners = append(listeners, activatedListener{file.Name(), listener})
+	}
+	return
+}
+
+// listenerAddress returns the address of a listener in the format of the
+// [Daemon] listen option
+func listenerAddress(listener net.Listener) string {
+	if listener.Addr().Network() == "unix" {
+		return "unix:" + listener.Addr().String()
+	}
+	return listener.Addr().String()
+}
+
+// SdNotifier sends state changes to the service manager (sd_notify)
+type SdNotifier struct {
+	conn     *net.UnixConn
+	watchdog time.Duration
+	stop     chan bool
+}
+
+// NewSdNotifier connects to the NOTIFY_SOCKET, nil is returned if ustackd
+// doesn't run as notify service. It has to be called before a chroot.
+func NewSdNotifier() (*SdNotifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+	// abstract socket names start with @ which is handled by the net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	notifier := &SdNotifier{conn: conn}
+	notifier.watchdog, err = watchdogInterval()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return notifier, nil
+}
+
+// watchdogInterval returns the interval of WATCHDOG_USEC or 0 if the
+// watchdog isn't enabled for this process
+func watchdogInterval() (time.Duration, error) {
+	usec, pid := os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	interval, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("Invalid WATCHDOG_USEC: %s", usec)
+	}
+	return time.Duration(interval) * time.Microsecond, nil
+}
+
+// Notify sends the state lines (e.g. READY=1, STATUS=...) to the service
+// manager
+func (notifier *SdNotifier) Notify(states ...string) error {
+	if notifier == nil {
+		return nil
+	}
+	_, err := notifier.conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+// Ready notifies the service manager about the finished startup and starts
+// the watchdog keepalive if requested
+func (notifier *SdNotifier) Ready(status string) error {
+	if notifier == nil {
+		return nil
+	}
+	if notifier.watchdog > 0 && notifier.stop == nil {
+		notifier.stop = make(chan bool)
+		go notifier.keepalive(notifier.watchdog/2, notifier.stop)
+	}
+	return notifier.Notify("READY=1", "STATUS="+status)
+}
+
+func (notifier *SdNotifier) keepalive(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			notifier.Notify("WATCHDOG=1")
+		}
+	}
+}
+
+// Stopping notifies the service manager about the shutdown, stops the
+// watchdog keepalive and closes the connection
+func (notifier *SdNotifier) Stopping(status string) error {
+	if notifier == nil {
+		return nil
+	}
+	if notifier.stop != nil {
+		close(notifier.stop)
+		notifier.stop = nil
+	}
+	err := notifier.Notify("STOPPING=1", "STATUS="+status)
+	notifier.conn.Close()
+	return err
+}
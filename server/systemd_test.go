@@ -0,0 +1,156 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "ustackd-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("expected notification", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotifier(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+
+	notifier, err := NewSdNotifier()
+	if err != nil || notifier == nil {
+		t.Fatal("expected notifier", err)
+	}
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Fatal("expected NOTIFY_SOCKET to be removed from the environment")
+	}
+
+	notifier.Ready("Listening on 1 sockets")
+	if msg := readNotification(t, conn); msg != "READY=1\nSTATUS=Listening on 1 sockets" {
+		t.Fatalf("unexpected notification %q", msg)
+	}
+	notifier.Notify("STATUS=busy")
+	if msg := readNotification(t, conn); msg != "STATUS=busy" {
+		t.Fatalf("unexpected notification %q", msg)
+	}
+	notifier.Stopping("Shutdown server")
+	if msg := readNotification(t, conn); msg != "STOPPING=1\nSTATUS=Shutdown server" {
+		t.Fatalf("unexpected notification %q", msg)
+	}
+}
+
+func TestSdNotifierWatchdog(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+	os.Setenv("WATCHDOG_USEC", "20000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	notifier, err := NewSdNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notifier.watchdog != 20*time.Millisecond {
+		t.Fatal("expected watchdog interval of 20ms but was", notifier.watchdog)
+	}
+	notifier.Ready("ready")
+	readNotification(t, conn)
+	if msg := readNotification(t, conn); msg != "WATCHDOG=1" {
+		t.Fatalf("expected watchdog keepalive but got %q", msg)
+	}
+	notifier.Stopping("stop")
+	for {
+		msg := readNotification(t, conn)
+		if strings.HasPrefix(msg, "STOPPING=1") {
+			break
+		}
+	}
+}
+
+func TestSdNotifierDisabled(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	notifier, err := NewSdNotifier()
+	if notifier != nil || err != nil {
+		t.Fatal("expected no notifier without NOTIFY_SOCKET", err)
+	}
+	// all calls on a nil notifier are no-ops
+	if notifier.Ready("ready") != nil || notifier.Stopping("stop") != nil {
+		t.Fatal("expected nil notifier to ignore calls")
+	}
+
+	os.Setenv("WATCHDOG_USEC", "abc")
+	if _, err := watchdogInterval(); err == nil {
+		t.Fatal("expected invalid WATCHDOG_USEC to fail")
+	}
+	os.Setenv("WATCHDOG_USEC", "1000")
+	os.Setenv("WATCHDOG_PID", "1")
+	if interval, _ := watchdogInterval(); interval != 0 {
+		t.Fatal("expected watchdog of other process to be ignored")
+	}
+}
+
+func TestActivationFiles(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "2")
+	files, err := activationFiles()
+	if len(files) != 0 || err != nil {
+		t.Fatal("expected sockets of other process to be ignored", err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("expected LISTEN_FDS to be removed from the environment")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "foo")
+	if _, err = activationFiles(); err == nil {
+		t.Fatal("expected invalid LISTEN_FDS to fail")
+	}
+}
+
+func TestActivatedListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	file, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := activatedListeners([]*os.File{os.NewFile(file.Fd(), "ustackd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].listener.Close()
+	if listeners[0].name != "ustackd" {
+		t.Fatal("expected name ustackd but got", listeners[0].name)
+	}
+	if address := listenerAddress(listeners[0].listener); address != tcp.Addr().String() {
+		t.Fatalf("expected address %s but got %s", tcp.Addr(), address)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// selectTenant runs the following commands in the tenant of the client, the
+// global clients (operators) use the server backend
+func (ip *Interpreter) selectTenant(name string) error {
+	ip.abortTransaction()
+	ip.closeTenant()
+	if name == "" {
+		ip.identify()
+		return nil
+	}
+	multi, ok := ip.Backend.(backends.MultiTenant)
+	if !ok {
+		return fmt.Errorf("Backend doesn't support tenants")
+	}
+	tenant, err := multi.Tenant(name)
+	if err != nil {
+		return err
+	}
+	ip.tenant = tenant
+	ip.identify()
+	return nil
+}
+
+// closeTenant releases the tenant backend of the connection
+func (ip *Interpreter) closeTenant() {
+	if ip.tenant != nil {
+		ip.tenant.Close()
+		ip.tenant = nil
+	}
+}
+
+// multiTenant returns the backend for the tenant admin commands, they are only
+// allowed for global clients
+func (ip *Interpreter) multiTenant() backends.MultiTenant {
+	if ip.auth != nil && ip.auth.Tenant != "" {
+		ip.Err("EPERM", "Tenant admin commands are not allowed for tenant clients")
+		return nil
+	}
+	multi, ok := ip.Backend.(backends.MultiTenant)
+	if !ok {
+		ip.Err("ENOTSUP", "Backend doesn't support tenants")
+		return nil
+	}
+	return multi
+}
+
+// tenant <name>
+func (ip *Interpreter) createTenant(args []string) {
+	if multi := ip.multiTenant(); multi != nil {
+		tid, err := multi.CreateTenant(args[0])
+		ip.intResponder(tid, err)
+	}
+}
+
+// tenants
+func (ip *Interpreter) tenants() {
+	if multi := ip.multiTenant(); multi != nil {
+		items, err := multi.Tenants()
+		if err == nil {
+			for _, item := range items {
+				ip.Item(item)
+			}
+		}
+		ip.simpleResponder(err)
+	}
+}
+
+// delete tenant <name>
+func (ip *Interpreter) deleteTenant(args []string) {
+	if multi := ip.multiTenant(); multi != nil {
+		ip.simpleResponder(multi.DeleteTenant(args[0]))
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/UserStack/ustackd/backends"
+)
+
+// backend returns the guarded backend of a command sent with if-version, the
+// backend of the running transaction, the backend of the tenant of the client
+// or the server backend
+func (ip *Interpreter) backend() backends.Abstract {
+	if ip.guard != nil {
+		return ip.guard
+	}
+	if ip.tx != nil {
+		return ip.tx
+	}
+	if ip.tenant != nil {
+		return ip.tenant
+	}
+	return ip.Backend
+}
+
+// begin starts a transaction, all following commands of the connection are
+// executed within it until commit or rollback
+func (ip *Interpreter) begin() {
+	if ip.tx != nil {
+		ip.Err("EINVAL", "Transaction already in progress")
+		return
+	}
+	backend, ok := ip.backend().(backends.Transactional)
+	if !ok {
+		ip.Err("ENOTSUP", "Backend doesn't support transactions")
+		return
+	}
+	tx, err := backend.Begin()
+	if err != nil {
+		ip.Error(err)
+		return
+	}
+	ip.tx = tx
+	ip.Ok()
+}
+
+func (ip *Interpreter) commit() {
+	if ip.tx == nil {
+		ip.Err("EINVAL", "No transaction in progress")
+		return
+	}
+	err := ip.tx.Commit()
+	ip.tx = nil
+	ip.simpleResponder(err)
+}
+
+func (ip *Interpreter) rollback() {
+	if ip.tx == nil {
+		ip.Err("EINVAL", "No transaction in progress")
+		return
+	}
+	err := ip.tx.Rollback()
+	ip.tx = nil
+	ip.simpleResponder(err)
+}
+
+// savepoint runs the command within a savepoint of the running transaction,
+// the statements of a failed command are undone and the transaction stays
+// usable (postgres aborts it on the first failed statement otherwise)
+func (ip *Interpreter) savepoint(command func()) {
+	tx, ok := ip.tx.(backends.Savepoints)
+	if !ok {
+		command()
+		return
+	}
+	if err := tx.Savepoint(); err != nil {
+		ip.Error(err)
+		return
+	}
+	ip.failed = false
+	command()
+	if ip.failed {
+		if err := tx.RollbackToSavepoint(); err != nil {
+			ip.Log("Rollback to savepoint failed: " + err.Message)
+		}
+		return
+	}
+	if err := tx.ReleaseSavepoint(); err != nil {
+		ip.Log("Release of savepoint failed: " + err.Message)
+	}
+}
+
+// abortTransaction rolls back a transaction that wasn't finished before the
+// connection was closed
+func (ip *Interpreter) abortTransaction() {
+	if ip.tx != nil {
+		ip.Log("Rolling back unfinished transaction")
+		ip.tx.Rollback()
+		ip.tx = nil
+	}
+}
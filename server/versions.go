@@ -0,0 +1,108 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+// commands that change a single user or group (the first argument) and can be
+// guarded by if-version
+var guardedCommands = map[Command]bool{
+	DISABLE: true, ENABLE: true, EXPIRE_AT: true, SET: true, SET_BINARY: true,
+	UNSET: true, SETMANY: true, CHANGE_PASSWORD: true, CHANGE_NAME: true,
+	ADMIN_RENAME_USER: true, ADMIN_PASSWORD: true, ADD: true, REMOVE: true,
+	DELETE_USER: true, GROUP_SET: true, GROUP_UNSET: true, RENAME_GROUP: true,
+	DELETE_GROUP: true,
+}
+
+// if-version <version> <command>
+//
+// The command is executed within a transaction and fails with ESTALE if the
+// user or group was changed meanwhile. The response is held back until the
+// transaction is committed. Within a running transaction the client has to
+// roll back after errors.
+func (ip *Interpreter) ifVersion(args []string) {
+	version, perr := strconv.ParseInt(args[0], 10, 64)
+	if perr != nil || version < 1 {
+		ip.Err("EINVAL", "Invalid version")
+		return
+	}
+	cmd, cmdArgs := parseCmd(args[1])
+	switch cmd {
+	case ERR_UNKNOWN_FUNC, ERR_MISSING_ARGS, ERR_INVALID_ARGS:
+		ip.parseError(cmd)
+		return
+	}
+	if !guardedCommands[cmd] {
+		ip.Err("EINVAL", "Command can't be guarded by a version")
+		return
+	}
+	if !ip.authorized(strings.ToLower(canonicalLine(cmd, cmdArgs))) {
+		ip.Err("EACCES", "Command not allowed for client")
+		ip.Server.Stats.restrictedCommandsAccessDenied++
+		return
+	}
+	tx := ip.tx
+	if tx == nil {
+		backend, ok := ip.backend().(backends.Transactional)
+		if !ok {
+			ip.Err("ENOTSUP", "Backend doesn't support transactions")
+			return
+		}
+		var err *backends.Error
+		if tx, err = backend.Begin(); err != nil {
+			ip.Error(err)
+			return
+		}
+	}
+	versioned, ok := tx.(backends.Versioned)
+	if !ok {
+		if tx != ip.tx {
+			tx.Rollback()
+		}
+		ip.Err("ENOTSUP", "Backend doesn't support versions")
+		return
+	}
+	guard, err := versioned.IfVersion(version)
+	if err != nil {
+		if tx != ip.tx {
+			tx.Rollback()
+		}
+		ip.Error(err)
+		return
+	}
+	ip.guard = guard
+	ip.failed = false
+	if tx == ip.tx {
+		ip.restrictedCommands(cmd, cmdArgs)
+		ip.guard = nil
+		return
+	}
+	ip.hold()
+	ip.restrictedCommands(cmd, cmdArgs)
+	ip.guard = nil
+	if ip.failed {
+		tx.Rollback()
+		ip.release(true)
+	} else if err = tx.Commit(); err != nil {
+		ip.release(false)
+		ip.Error(err)
+	} else {
+		ip.release(true)
+	}
+}
+
+// group info <group|gid>
+func (ip *Interpreter) groupInfo(args []string) {
+	ip.revisionResponder(ip.backend().GroupRevision(args[0]))
+}
+
+func (ip *Interpreter) revisionResponder(revision backends.Revision, err *backends.Error) {
+	if err != nil {
+		ip.Error(err)
+	} else {
+		ip.OkValue(revision)
+	}
+}
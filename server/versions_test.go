@@ -0,0 +1,97 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/UserStack/ustackd/backends"
+)
+
+func TestIfVersion(t *testing.T) {
+	backend, err := backends.NewSqliteBackend(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.CreateUser("joe", "secret")
+	context, buf := newTestContext(&Config{})
+	context.Server.Backend = &backend
+	ip := &Interpreter{Context: context}
+
+	ip.parse("if-version 1 set joe email joe@example.com")
+	ip.parse("if-version 1 set joe email old@example.com")
+	ip.parse("user info joe")
+	ip.parse("if-version 2 user jane secret")
+	expected := []string{
+		"+ OK",
+		"- ESTALE Version changed meanwhile",
+		"uid 1",
+		"name \"joe\"",
+		"active Y",
+		"expires never",
+		"version 2",
+		"created ",
+		"updated ",
+		"latestlogin never",
+		"previouslogin never",
+		"failcount 0",
+		"data \"email\" \"joe@example.com\"",
+		"datarevision \"email\" version:1 created:",
+		"+ OK",
+		"- EINVAL Command can't be guarded by a version",
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\r\n")
+	if len(lines) != len(expected) {
+		t.Fatal("unexpected responses", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("expected %q got %q", expected[i], line)
+		}
+	}
+	if value, _ := backend.GetUserData("joe", "email"); value != "joe@example.com" {
+		t.Fatal("should roll back stale change", value)
+	}
+}
+
+// failingCommitBackend begins transactions that can't be committed
+type failingCommitBackend struct {
+	*backends.SqliteBackend
+}
+
+func (backend failingCommitBackend) Begin() (backends.Transaction, *backends.Error) {
+	tx, err := backend.SqliteBackend.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return failingCommitTx{tx.(*backends.SqliteBackend)}, nil
+}
+
+type failingCommitTx struct {
+	*backends.SqliteBackend
+}
+
+func (tx failingCommitTx) Commit() *backends.Error {
+	tx.SqliteBackend.Rollback()
+	return &backends.Error{Code: "EFAULT", Message: "disk I/O error"}
+}
+
+func TestIfVersionFailingCommit(t *testing.T) {
+	backend, err := backends.NewSqliteBackend(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.CreateUser("joe", "secret")
+	context, buf := newTestContext(&Config{})
+	context.Server.Backend = failingCommitBackend{&backend}
+	ip := &Interpreter{Context: context}
+
+	ip.parse("if-version 1 set joe email joe@example.com")
+	if response := strings.TrimSpace(buf.String()); response != "- EFAULT disk I/O error" {
+		t.Fatalf("expected commit error got %q", response)
+	}
+	if _, err := backend.GetUserData("joe", "email"); err == nil {
+		t.Fatal("should not keep the change")
+	}
+}
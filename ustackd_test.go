@@ -52,6 +52,170 @@ func TestConnect(t *testing.T) {
 	defer client.Close()
 }
 
+func TestCapabilities(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	if client.Protocol() != server.PROTOCOL_VERSION {
+		t.Fatal("expected protocol", server.PROTOCOL_VERSION, "got", client.Protocol())
+	}
+	caps, err := client.Capabilities()
+	if err != nil {
+		t.Fatal("unable to get capabilities", err)
+	}
+	if caps.Protocol != server.PROTOCOL_VERSION || caps.Backend == "" ||
+		caps.Tls != "starttls" || caps.Limits["max-value-size"] != 65536 {
+		t.Fatalf("unexpected capabilities %v", caps)
+	}
+	if !client.Supports("setb") || !client.Supports("starttls") || client.Supports("unknown") {
+		t.Fatal("unexpected commands", caps.Commands)
+	}
+}
+
+func TestJsonFormat(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	username := uniqName() + ":with:colons"
+	defer client.DeleteUser(username)
+	uid, err := client.CreateUser(username, "secret")
+	if uid <= 0 {
+		t.Fatal("user not created, expected id bigger than 0 got", uid, err)
+	}
+	users, err := client.Users()
+	if err != nil {
+		t.Fatal("unable to list users", err)
+	}
+	found := false
+	for _, user := range users {
+		if user.Name == username && user.Uid == uid && user.Active {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", username, users)
+	}
+	if _, err = client.GetUserData(username, "unknown"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT for unknown key", err)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	_, err := client.LoginUser("unknown user", "secret")
+	if err == nil || err.Code != "ENOENT" || err.Message != "Username unknown" {
+		t.Fatal("expected ENOENT with message", err)
+	}
+	client.SetFormat("text")
+	_, err = client.LoginUser("unknown user", "secret")
+	if err == nil || err.Code != "ENOENT" || err.Message != "Username unknown" {
+		t.Fatal("expected ENOENT with message in text format", err)
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	if err := client.SetFormat("text"); err != nil {
+		t.Fatal("unable to switch to text format", err)
+	}
+	username := uniqName()
+	defer client.DeleteUser(username)
+	client.CreateUser(username, "secret")
+	client.SetUserData(username, "firstname", "Tester")
+	firstname, err := client.GetUserData(username, "firstname")
+	if firstname != "Tester" {
+		t.Fatal("firstname should have been 'Tester' but was", firstname, err)
+	}
+	stats, err := client.Stats()
+	if err != nil || stats["Connects"] <= 0 {
+		t.Fatal("unable to get stats", stats, err)
+	}
+	if err = client.SetFormat("xml"); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for unknown format", err)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	if err := client.EnablePipelining(); err != nil {
+		t.Fatal("unable to enable pipelining", err)
+	}
+	if err := client.StartTlsWithoutCertCheck(); err == nil {
+		t.Fatal("starttls should fail after pipelining was enabled")
+	}
+	prefix := uniqName()
+	errs := make(chan error)
+	roundtrip := func(username string) error {
+		defer client.DeleteUser(username)
+		uid, err := client.CreateUser(username, "secret")
+		if err != nil {
+			return err
+		}
+		client.SetUserData(username, "name", username)
+		value, err := client.GetUserData(username, "name")
+		if err != nil || value != username {
+			return fmt.Errorf("expected %s got %s %v", username, value, err)
+		}
+		login, err := client.LoginUser(username, "secret")
+		if err != nil || login != uid {
+			return fmt.Errorf("expected uid %d got %d %v", uid, login, err)
+		}
+		return nil
+	}
+	for i := 0; i < 10; i++ {
+		go func(username string) {
+			errs <- roundtrip(username)
+		}(fmt.Sprintf("%s-%d", prefix, i))
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	caps, _ := client.Capabilities()
+	if !caps.HasFeature("transactions") {
+		if err := client.Begin(); err == nil || err.Code != "ENOTSUP" {
+			t.Fatal("expected ENOTSUP got", err)
+		}
+		return
+	}
+	if err := client.Commit(); err == nil || err.Code != "EINVAL" {
+		t.Fatal("commit without transaction should fail", err)
+	}
+
+	// rolled back user doesn't exist
+	name := uniqName()
+	client.Begin()
+	if err := client.Begin(); err == nil || err.Code != "EINVAL" {
+		t.Fatal("nested begin should fail", err)
+	}
+	client.CreateUser(name, "secret")
+	if err := client.Rollback(); err != nil {
+		t.Fatal("unable to rollback", err)
+	}
+	if _, err := client.LoginUser(name, "secret"); err == nil {
+		t.Fatal("user should have been rolled back")
+	}
+
+	// committed user exists
+	client.Begin()
+	uid, _ := client.CreateUser(name, "secret")
+	client.SetUserData(name, "email", "joe@example.com")
+	if err := client.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	defer client.DeleteUser(name)
+	if login, err := client.LoginUser(name, "secret"); err != nil || login != uid {
+		t.Fatal("expected committed user", uid, login, err)
+	}
+}
+
 func TestConnectTls(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -67,6 +231,21 @@ func TestConnectTls(t *testing.T) {
 	}
 }
 
+func TestConnectUnix(t *testing.T) {
+	newClient().Close() // make sure the server is started
+	client, err := client.Dial("unix:/tmp/ustackd-test.sock")
+	if err != nil {
+		t.Fatal("unable to connect to unix socket", err)
+	}
+	defer client.Close()
+	username := uniqName()
+	id, serr := client.CreateUser(username, "secret")
+	defer client.DeleteUser(username)
+	if id <= 0 {
+		t.Fatal("user not created, expected id bigger than 0 got", id, serr)
+	}
+}
+
 func TestCreateUser(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -131,6 +310,105 @@ func TestSetGetUserData(t *testing.T) {
 	}
 }
 
+func TestGetAllUnsetUserData(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	client.CreateUser(name, "secret")
+	defer client.DeleteUser(name)
+
+	values := map[string]string{"firstname": "Joe", "last name": "van Doe", "bio": "line\r\nbreak"}
+	if err := client.SetManyUserData(name, values); err != nil {
+		t.Fatal("unable to set values", err)
+	}
+	all, err := client.GetAllUserData(name)
+	if err != nil || !reflect.DeepEqual(values, all) {
+		t.Fatalf("expected %v got %v %v", values, all, err)
+	}
+	if err = client.UnsetUserData(name, "bio"); err != nil {
+		t.Fatal("unable to unset value", err)
+	}
+	if err = client.UnsetUserData(name, "bio"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+
+	// the text format quotes keys and values
+	client.SetFormat("text")
+	delete(values, "bio")
+	all, err = client.GetAllUserData(name)
+	if err != nil || !reflect.DeepEqual(values, all) {
+		t.Fatalf("expected %v got %v %v", values, all, err)
+	}
+}
+
+func TestFindUsers(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	uid, _ := client.CreateUser(name, "secret")
+	defer client.DeleteUser(name)
+	client.SetUserData(name, "email", name+"@example.com")
+
+	users, err := client.FindUsers("email", "=", name+"@example.com")
+	if err != nil || len(users) != 1 || users[0].Uid != uid {
+		t.Fatal("expected to find user by email", users, err)
+	}
+	users, err = client.FindUsers("email", "prefix", name)
+	if err != nil || len(users) != 1 || users[0].Uid != uid {
+		t.Fatal("expected to find user by prefix", users, err)
+	}
+	if _, err = client.FindUsers("email", "like", name); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for unknown operator", err)
+	}
+}
+
+func TestQuotedArguments(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	username := uniqName() + " with spaces"
+	defer client.DeleteUser(username)
+	id, err := client.CreateUser(username, "pass word\r\nquit")
+	if id <= 0 {
+		t.Fatal("user not created, expected id bigger than 0 got", id, err)
+	}
+	if _, err = client.LoginUser(username, "pass word\r\nquit"); err != nil {
+		t.Fatal("should be able to login", err)
+	}
+	client.SetUserData(username, "full name", "Tester \"100%\"")
+	value, err := client.GetUserData(username, "full name")
+	if value != "Tester \"100%\"" {
+		t.Fatal("value should have been 'Tester \"100%\"' but was", value, err)
+	}
+}
+
+func TestSetGetBinaryUserData(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	username := uniqName()
+	defer client.DeleteUser(username)
+	client.CreateUser(username, "secret")
+	data := []byte{0, 1, 2, '\r', '\n', 0xfe, 0xff}
+	if err := client.SetUserDataBytes(username, "picture", data); err != nil {
+		t.Fatal("unable to set binary data", err)
+	}
+	value, err := client.GetUserDataBytes(username, "picture")
+	if !reflect.DeepEqual(value, data) {
+		t.Fatal("expected", data, "got", value, err)
+	}
+
+	notes := "first line\nsecond line\r\n"
+	client.SetUserData(username, "notes", notes)
+	text, err := client.GetUserData(username, "notes")
+	if text != notes {
+		t.Fatalf("expected %q got %q %v", notes, text, err)
+	}
+
+	err = client.SetUserDataBytes(username, "large", make([]byte, 65537))
+	if err == nil || err.Code != "E2BIG" {
+		t.Fatal("expected E2BIG for too large value", err)
+	}
+}
+
 func TestLoginUser(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -153,6 +431,167 @@ func TestLoginUser(t *testing.T) {
 	}
 }
 
+func TestExpireUser(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	client.CreateUser(name, "secret")
+	defer client.DeleteUser(name)
+
+	expires := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	if err := client.ExpireUser(name, expires); err != nil {
+		t.Fatal("should set expiry", err)
+	}
+	if _, err := client.LoginUser(name, "secret"); err == nil || err.Code != "EEXPIRED" {
+		t.Fatal("expected EEXPIRED got", err)
+	}
+	users, _, err := client.UsersPage(backends.ListOptions{Filter: name, Expiry: true})
+	if err != nil || len(users) != 1 || users[0].Expires == nil || !users[0].Expires.Equal(expires) {
+		t.Fatal("should list expiry", users, err)
+	}
+	client.ExpireUser(name, time.Time{})
+	if _, err = client.LoginUser(name, "secret"); err != nil {
+		t.Fatal("should login without expiry", err)
+	}
+	users, _, _ = client.UsersPage(backends.ListOptions{Filter: name, Expiry: true})
+	if len(users) != 1 || users[0].Expires != nil {
+		t.Fatal("should list missing expiry", users)
+	}
+
+	if err = client.ScheduleUserState(name, time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal("should schedule state change", err)
+	}
+	if err = client.ScheduleUserState(uniqName(), time.Now(), true); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	uid, _ := client.CreateUser(name, "secret")
+
+	if err := client.DeleteUser(name); err != nil {
+		t.Fatal("should delete user", err)
+	}
+	if _, err := client.LoginUser(name, "secret"); err == nil {
+		t.Fatal("should not login deleted user")
+	}
+	users, _, err := client.UsersPage(backends.ListOptions{Filter: name, Deleted: true})
+	if err != nil || len(users) != 1 || users[0].Uid != uid {
+		t.Fatal("should list deleted user", users, err)
+	}
+	if err = client.RestoreUser(fmt.Sprint(uid)); err != nil {
+		t.Fatal("should restore user", err)
+	}
+	if _, err = client.LoginUser(name, "secret"); err != nil {
+		t.Fatal("should login restored user", err)
+	}
+
+	client.DeleteUser(name)
+	if count, perr := client.Purge(0); perr != nil || count < 1 {
+		t.Fatal("should purge deleted user", count, perr)
+	}
+	if err = client.RestoreUser(fmt.Sprint(uid)); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	client.CreateUser(name, "secret")
+	defer client.DeleteUser(name)
+
+	revision, err := client.UserRevision(name)
+	if err != nil || revision.Version != 1 || revision.Created.IsZero() {
+		t.Fatal("should return first revision", revision, err)
+	}
+	client.SetUserData(name, "email", "joe@example.com")
+	if revision, err = client.UserRevision(name); err != nil || revision.Version != 2 {
+		t.Fatal("should count change", revision, err)
+	}
+	if _, err = client.UserRevision(uniqName()); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+
+	group := uniqName()
+	client.CreateGroup(group)
+	defer client.DeleteGroup(group)
+	if revision, err = client.GroupRevision(group); err != nil || revision.Version != 1 {
+		t.Fatal("should return first group revision", revision, err)
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	uid, _ := client.CreateUser(name, "secret")
+	defer client.DeleteUser(name)
+	group := uniqName()
+	client.CreateGroup(group)
+	defer client.DeleteGroup(group)
+	client.AddUserToGroup(name, group)
+	client.SetUserData(name, "email", "joe \"quoted\" @example.com")
+
+	for _, format := range []string{"json", "text"} {
+		client.SetFormat(format)
+		info, err := client.UserInfo(name)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if info.Uid != uid || info.Name != name || !info.Active || info.Version != 3 || info.Created.IsZero() {
+			t.Fatal(format, "should return user", info)
+		}
+		if len(info.Groups) != 1 || info.Groups[0].Name != group {
+			t.Fatal(format, "should return groups", info.Groups)
+		}
+		if info.Data["email"] != "joe \"quoted\" @example.com" {
+			t.Fatal(format, "should return data", info.Data)
+		}
+	}
+	client.SetFormat("json")
+	if _, err := client.UserInfo(uniqName()); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	client.CreateUser(name, "secret")
+	defer client.DeleteUser(name)
+
+	client.SetUserData(name, "email", "joe@example.com")
+	between := time.Now()
+	time.Sleep(time.Second)
+	client.SetUserData(name, "email", "joe \"quoted\" @example.org")
+
+	for _, format := range []string{"json", "text"} {
+		client.SetFormat(format)
+		changes, err := client.UserDataHistory(name, "email")
+		if err != nil || len(changes) != 2 {
+			t.Fatal(format, "should list the changes", changes, err)
+		}
+		if changes[0].Value != "joe@example.com" || changes[1].Value != "joe \"quoted\" @example.org" ||
+			changes[1].Client == "" || changes[1].Changed.IsZero() {
+			t.Fatal(format, "unexpected changes", changes)
+		}
+		value, err := client.GetUserDataAt(name, "email", between)
+		if err != nil || value != "joe@example.com" {
+			t.Fatal(format, "unexpected value", value, err)
+		}
+	}
+	client.SetFormat("json")
+	if _, err := client.GetUserDataAt(name, "email", between.Add(-time.Hour)); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
 func TestChangeUserPassword(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -221,6 +660,39 @@ func TestChangeUserName(t *testing.T) {
 	}
 }
 
+func TestAdminRenameAndPassword(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name, newname := uniqName(), uniqName()
+	uid, _ := client.CreateUser(name, "secret")
+	if err := client.RenameUser(name, newname); err != nil {
+		t.Fatal("unable to rename user", err)
+	}
+	defer client.DeleteUser(newname)
+	if err := client.SetUserPassword(newname, "new secret"); err != nil {
+		t.Fatal("unable to set password", err)
+	}
+	if login, err := client.LoginUser(newname, "new secret"); err != nil || login != uid {
+		t.Fatal("expected login with new name and password", login, err)
+	}
+	other := uniqName()
+	client.CreateUser(other, "secret")
+	defer client.DeleteUser(other)
+	if err := client.RenameUser(newname, other); err == nil || err.Code != "EEXIST" {
+		t.Fatal("expected EEXIST got", err)
+	}
+
+	group, newgroup := uniqName(), uniqName()
+	client.CreateGroup(group)
+	if err := client.RenameGroup(group, newgroup); err != nil {
+		t.Fatal("unable to rename group", err)
+	}
+	defer client.DeleteGroup(newgroup)
+	if err := client.RenameGroup(group, newgroup); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
 func TestDeleteUser(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -265,13 +737,72 @@ func TestUsers(t *testing.T) {
 	}
 }
 
+func TestUsersPage(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	prefix := uniqName()
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("%s-%d", prefix, i)
+		client.CreateUser(name, "secret")
+		defer client.DeleteUser(name)
+	}
+	client.DisableUser(prefix + "-4")
+	options := backends.ListOptions{Filter: prefix + "-*", State: "active", Sort: "name", Limit: 3}
+	users, cursor, err := client.UsersPage(options)
+	if err != nil || len(users) != 3 || users[0].Name != prefix+"-0" || cursor == "" {
+		t.Fatal("expected first page", users, cursor, err)
+	}
+	options.After = cursor
+	users, cursor, err = client.UsersPage(options)
+	if err != nil || len(users) != 1 || users[0].Name != prefix+"-3" || cursor != "" {
+		t.Fatal("expected last page", users, cursor, err)
+	}
+	if _, _, err = client.UsersPage(backends.ListOptions{Sort: "password"}); err == nil || err.Code != "EINVAL" {
+		t.Fatal("expected EINVAL for unknown sort order", err)
+	}
+
+	// the cursor is sent in the + OK line of the text format
+	client.SetFormat("text")
+	options.After = ""
+	users, cursor, err = client.UsersPage(options)
+	if err != nil || len(users) != 3 || cursor == "" {
+		t.Fatal("expected first page in text format", users, cursor, err)
+	}
+}
+
+func TestGroupsPage(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	prefix := uniqName()
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("%s-%d", prefix, i)
+		client.CreateGroup(name)
+		defer client.DeleteGroup(name)
+		client.CreateUser(name, "secret")
+		defer client.DeleteUser(name)
+		client.AddUserToGroup(name, prefix+"-0")
+	}
+	groups, cursor, err := client.GroupsPage(backends.ListOptions{Filter: prefix + "*", Limit: 2})
+	if err != nil || len(groups) != 2 || cursor == "" {
+		t.Fatal("expected first page of groups", groups, cursor, err)
+	}
+	groups, cursor, err = client.GroupsPage(backends.ListOptions{Filter: prefix + "*", Limit: 2, After: cursor})
+	if err != nil || len(groups) != 1 || groups[0].Name != prefix+"-2" || cursor != "" {
+		t.Fatal("expected last page of groups", groups, cursor, err)
+	}
+	users, cursor, err := client.GroupUsersPage(prefix+"-0", backends.ListOptions{Sort: "name", Limit: 2})
+	if err != nil || len(users) != 2 || users[1].Name != prefix+"-1" || cursor == "" {
+		t.Fatal("expected first page of group users", users, cursor, err)
+	}
+}
+
 func TestGroup(t *testing.T) {
 	client := newClient()
 	defer client.Close()
 	group := uniqName()
 
 	_, err := client.CreateGroup("")
-	if err.Code != "EFAULT" {
+	if err.Code != "EINVAL" {
 		t.Fatal("should return EINVAL instead of", err.Code)
 	}
 
@@ -287,6 +818,33 @@ func TestGroup(t *testing.T) {
 	}
 }
 
+func TestSetGetGroupData(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	name := uniqName()
+	client.CreateGroup(name)
+	defer client.DeleteGroup(name)
+
+	if err := client.SetGroupData(name, "description", "The admins"); err != nil {
+		t.Fatal("unable to set group data", err)
+	}
+	client.SetGroupData(name, "owner", "joe")
+	value, err := client.GetGroupData(name, "description")
+	if err != nil || value != "The admins" {
+		t.Fatal("expected value got", value, err)
+	}
+	keys, err := client.GetGroupDataKeys(name)
+	if err != nil || len(keys) != 2 {
+		t.Fatal("expected two keys got", keys, err)
+	}
+	if err = client.UnsetGroupData(name, "owner"); err != nil {
+		t.Fatal("unable to unset group data", err)
+	}
+	if _, err = client.GetGroupData(name, "owner"); err == nil || err.Code != "ENOENT" {
+		t.Fatal("expected ENOENT got", err)
+	}
+}
+
 func TestDeleteGroup(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -413,6 +971,137 @@ func TestUsersAndGroupsAssociations(t *testing.T) {
 	}
 }
 
+func TestNestedGroups(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+
+	joe := uniqName()
+	engineering := uniqName()
+	backend := uniqName()
+	client.CreateGroup(engineering)
+	defer client.DeleteGroup(engineering)
+	client.CreateGroup(backend)
+	defer client.DeleteGroup(backend)
+	client.CreateUser(joe, "secret")
+	defer client.DeleteUser(joe)
+	client.AddUserToGroup(joe, backend)
+
+	if err := client.AddGroupToGroup(backend, engineering); err != nil {
+		t.Fatal("should nest group", err)
+	}
+	if err := client.AddGroupToGroup(engineering, backend); err == nil || err.Code != "ELOOP" {
+		t.Fatal("should reject cycle", err)
+	}
+	groups, err := client.UserGroupsTransitive(joe)
+	if err != nil || len(groups) != 2 {
+		t.Fatal("expected direct and containing group", groups, err)
+	}
+	users, _ := client.GroupUsers(engineering)
+	if len(users) != 0 {
+		t.Fatal("expected no direct members", users)
+	}
+	users, _, err = client.GroupUsersPage(engineering, backends.ListOptions{Transitive: true})
+	if err != nil || len(users) != 1 || users[0].Name != joe {
+		t.Fatal("expected member of nested group", users, err)
+	}
+	if err := client.RemoveGroupFromGroup(backend, engineering); err != nil {
+		t.Fatal("should remove nested group", err)
+	}
+	groups, _ = client.UserGroupsTransitive(joe)
+	if len(groups) != 1 {
+		t.Fatal("expected only direct group", groups)
+	}
+}
+
+func TestRolesAndPermissions(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+
+	joe := uniqName()
+	accounting := uniqName()
+	billing := uniqName()
+	read := uniqName()
+	client.CreateUser(joe, "secret")
+	defer client.DeleteUser(joe)
+	client.CreateGroup(accounting)
+	defer client.DeleteGroup(accounting)
+	client.AddUserToGroup(joe, accounting)
+	rid, err := client.CreateRole(billing)
+	if err != nil {
+		t.Fatal("should create role", err)
+	}
+	defer client.DeleteRole(billing)
+	pid, err := client.CreatePermission(read)
+	if err != nil {
+		t.Fatal("should create permission", err)
+	}
+	defer client.DeletePermission(read)
+
+	if err = client.GrantPermission(billing, read); err != nil {
+		t.Fatal("should grant permission", err)
+	}
+	permissions, _ := client.RolePermissions(fmt.Sprintf("%d", rid))
+	if len(permissions) != 1 || permissions[0].Pid != pid || permissions[0].Name != read {
+		t.Fatal("expected permission of role", permissions)
+	}
+	check, err := client.CheckPermission(joe, read)
+	if err != nil || check.Allowed {
+		t.Fatal("expected no permission", check, err)
+	}
+	client.AssignRoleToGroup(billing, accounting)
+	check, err = client.CheckPermission(joe, read)
+	expected := backends.PermissionCheck{Allowed: true, Role: billing, Group: accounting}
+	if err != nil || check != expected {
+		t.Fatal("expected permission through group", check, err)
+	}
+	client.AssignRoleToUser(billing, joe)
+	check, _ = client.CheckPermission(joe, read)
+	if check != (backends.PermissionCheck{Allowed: true, Role: billing}) {
+		t.Fatal("expected permission through user role", check)
+	}
+	names, err := client.UserPermissions(joe)
+	if err != nil || !reflect.DeepEqual(names, []string{read}) {
+		t.Fatal("expected effective permissions", names, err)
+	}
+	client.UnassignRoleFromUser(billing, joe)
+	client.UnassignRoleFromGroup(billing, accounting)
+	names, _ = client.UserPermissions(joe)
+	if len(names) != 0 {
+		t.Fatal("expected no permissions", names)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	client := newClient()
+	defer client.Close()
+	caps, _ := client.Capabilities()
+	if !caps.HasFeature("tenants") {
+		if _, err := client.CreateTenant(uniqName()); err == nil || err.Code != "ENOTSUP" {
+			t.Fatal("expected ENOTSUP got", err)
+		}
+		return
+	}
+
+	name := uniqName()
+	tid, err := client.CreateTenant(name)
+	if err != nil {
+		t.Fatal("should create tenant", err)
+	}
+	if _, err = client.CreateTenant(name); err == nil || err.Code != "EEXIST" {
+		t.Fatal("should reject duplicate tenant", err)
+	}
+	tenants, err := client.Tenants()
+	if err != nil || !reflect.DeepEqual(tenants[len(tenants)-1], backends.Tenant{Tid: tid, Name: name}) {
+		t.Fatal("should list tenant", tenants, err)
+	}
+	if err = client.DeleteTenant(name); err != nil {
+		t.Fatal("should delete tenant", err)
+	}
+	if err = client.DeleteTenant(name); err == nil || err.Code != "ENOENT" {
+		t.Fatal("should fail to delete unknown tenant", err)
+	}
+}
+
 func TestDeleteGroupWithAssociations(t *testing.T) {
 	client := newClient()
 	defer client.Close()
@@ -476,7 +1165,7 @@ func TestStats(t *testing.T) {
 	client.LoginUser(username, "secret") // Successfull login
 	client.LoginUser("foobar", "123456") // Failed login
 	client.LoginUser("foobar", "123456") // twice
-	tempClient := newClient()            // Connects++
+	tempClient := newClient()            // Connects++, capabilities and format json
 	// since the server and client are not in sync sleep
 	time.Sleep(50 * time.Millisecond)
 
@@ -487,9 +1176,19 @@ func TestStats(t *testing.T) {
 		"Active Connections":                   1,
 		"Successfull logins":                   1,
 		"Failed logins":                        2,
-		"Unrestricted Commands":                0,
+		"Unrestricted Commands":                2,
 		"Restricted Commands":                  5,
 		"Access denied on Restricted Commands": 0,
+		"Rejected Connections":                 0,
+		"Rejected Client Auths":                0,
+		"Rejected Proxy Headers":               0,
+		"Idle Timeouts":                        0,
+		"Command Timeouts":                     0,
+		"Too long Lines":                       0,
+		"Rejected by Connection Limit":         0,
+		"Rejected by Connection Limit per IP":  0,
+		"Scheduled State Changes":              0,
+		"Purged Users and Groups":              0,
 		"Users":  userCount,
 		"Groups": groupCount,
 	}
@@ -508,9 +1207,19 @@ func TestStats(t *testing.T) {
 		"Active Connections":                   0,
 		"Successfull logins":                   1,
 		"Failed logins":                        2,
-		"Unrestricted Commands":                1,
+		"Unrestricted Commands":                3,
 		"Restricted Commands":                  6,
 		"Access denied on Restricted Commands": 0,
+		"Rejected Connections":                 0,
+		"Rejected Client Auths":                0,
+		"Rejected Proxy Headers":               0,
+		"Idle Timeouts":                        0,
+		"Command Timeouts":                     0,
+		"Too long Lines":                       0,
+		"Rejected by Connection Limit":         0,
+		"Rejected by Connection Limit per IP":  0,
+		"Scheduled State Changes":              0,
+		"Purged Users and Groups":              0,
 		"Users":  userCount,
 		"Groups": groupCount,
 	}